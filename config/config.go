@@ -0,0 +1,654 @@
+// Package config loads the server's configuration.
+//
+// Values are read, from lowest to highest precedence, from built-in
+// defaults, an optional YAML or TOML file, environment variables and
+// command-line flags. A .env file is loaded into the environment first,
+// without overriding variables that are already set.
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/joho/godotenv"
+	"gopkg.in/yaml.v2"
+)
+
+type Config struct {
+	Server   ServerConfig   `yaml:"server"`
+	Database DatabaseConfig `yaml:"database"`
+	Auth     AuthConfig     `yaml:"auth"`
+	OAuth    OAuthConfig    `yaml:"oauth"`
+	Mail     MailConfig     `yaml:"mail"`
+}
+
+// ServerConfig configures the HTTP server. FrontendURL is where the
+// website is served, and is used to build links in emails.
+// TrustedProxies are the IPs and CIDR ranges of reverse proxies whose
+// X-Forwarded-For headers are believed. With none, clients are known by
+// the address they connect from.
+type ServerConfig struct {
+	Port           int      `yaml:"port"`
+	FrontendURL    string   `yaml:"frontend_url"`
+	TrustedProxies []string `yaml:"trusted_proxies"`
+}
+
+// DatabaseConfig describes the Postgres connection. If URL is set it is
+// used as is, otherwise the connection is built from the other fields.
+type DatabaseConfig struct {
+	URL      Secret `yaml:"url"`
+	Host     string `yaml:"host"`
+	Port     int    `yaml:"port"`
+	User     string `yaml:"user"`
+	Password Secret `yaml:"password"`
+	Name     string `yaml:"name"`
+	SSLMode  string `yaml:"sslmode"`
+}
+
+// AuthConfig configures the tokens issued at login, and the tokens that
+// are emailed to users. Timeout is how long access tokens (JWTs) last, and
+// MaxRefresh how long the refresh tokens that replace them do.
+// TokenSecret signs emailed tokens.
+type AuthConfig struct {
+	JWTSecret  Secret        `yaml:"jwt_secret"`
+	Realm      string        `yaml:"realm"`
+	Timeout    time.Duration `yaml:"timeout"`
+	MaxRefresh time.Duration `yaml:"max_refresh"`
+
+	// With a signing key, access tokens are signed with it instead of
+	// JWTSecret, using RS256 or EdDSA depending on the key, and can be
+	// checked against the public keys at /.well-known/jwks.json.
+	// Tokens signed by the keys in VerificationKeyFiles, and by JWTSecret
+	// if it is set, are still accepted, so that keys can be rotated.
+	SigningKeyFile       string   `yaml:"signing_key_file"`
+	VerificationKeyFiles []string `yaml:"verification_key_files"`
+
+	// Cookies are used by clients that ask for them when logging in.
+	// CookieSecure should only be turned off for local development.
+	CookieDomain string `yaml:"cookie_domain"`
+	CookieSecure bool   `yaml:"cookie_secure"`
+
+	TokenSecret                Secret        `yaml:"token_secret"`
+	VerificationTimeout        time.Duration `yaml:"verification_timeout"`
+	VerificationResendInterval time.Duration `yaml:"verification_resend_interval"`
+	PasswordResetTimeout       time.Duration `yaml:"password_reset_timeout"`
+	UsernameChangeCooldown     time.Duration `yaml:"username_change_cooldown"`
+
+	// Users with two-factor authentication turned on have TwoFactorTimeout
+	// to enter a code after their password. TwoFactorRoles are the site
+	// and game roles that can only be used by sessions logged in to with
+	// a code.
+	TwoFactorTimeout time.Duration `yaml:"two_factor_timeout"`
+	TwoFactorRoles   []string      `yaml:"two_factor_roles"`
+
+	Password      PasswordConfig      `yaml:"password"`
+	LoginThrottle LoginThrottleConfig `yaml:"login_throttle"`
+}
+
+// PasswordConfig chooses how passwords are hashed. Hashes record the
+// algorithm and parameters they were made with, so these can be changed
+// at any time; each user's hash is upgraded the next time they log in.
+// Argon2Memory is in KiB.
+type PasswordConfig struct {
+	Algorithm     string `yaml:"algorithm"`
+	BcryptCost    int    `yaml:"bcrypt_cost"`
+	Argon2Time    int    `yaml:"argon2_time"`
+	Argon2Memory  int    `yaml:"argon2_memory"`
+	Argon2Threads int    `yaml:"argon2_threads"`
+}
+
+// LoginThrottleConfig slows down password guessing. Once an account or
+// an IP has failed to log in AccountAttempts or IPAttempts times, it is
+// locked out for BaseDelay, doubling with each further failure up to
+// MaxDelay. Failures are forgotten after Window without any. The memory
+// driver counts failures on each server separately, and the postgres
+// driver shares them between servers.
+type LoginThrottleConfig struct {
+	Driver          string        `yaml:"driver"`
+	AccountAttempts int           `yaml:"account_attempts"`
+	IPAttempts      int           `yaml:"ip_attempts"`
+	BaseDelay       time.Duration `yaml:"base_delay"`
+	MaxDelay        time.Duration `yaml:"max_delay"`
+	Window          time.Duration `yaml:"window"`
+}
+
+// OAuthConfig sets up logging in with accounts on other sites. Each
+// provider is turned on by giving it a client ID and secret. StateTimeout
+// is how long a user has to finish logging in with a provider.
+type OAuthConfig struct {
+	Discord      OAuthProvider `yaml:"discord"`
+	Twitch       OAuthProvider `yaml:"twitch"`
+	Google       OAuthProvider `yaml:"google"`
+	StateTimeout time.Duration `yaml:"state_timeout"`
+}
+
+// OAuthProvider is a site users can log in with. The endpoints default to
+// the provider's own, and only need changing to use another server, such
+// as a stub provider in tests.
+type OAuthProvider struct {
+	ClientID     string `yaml:"client_id"`
+	ClientSecret Secret `yaml:"client_secret"`
+	AuthURL      string `yaml:"auth_url"`
+	TokenURL     string `yaml:"token_url"`
+	UserInfoURL  string `yaml:"userinfo_url"`
+}
+
+// Enabled reports whether users can log in with the provider.
+func (p OAuthProvider) Enabled() bool {
+	return p.ClientID != ""
+}
+
+// MailConfig chooses how emails are sent. The log driver writes emails to
+// the server log and the file driver writes each one to a file in Dir;
+// both are meant for local development.
+type MailConfig struct {
+	Driver string     `yaml:"driver"`
+	From   string     `yaml:"from"`
+	Dir    string     `yaml:"dir"`
+	SMTP   SMTPConfig `yaml:"smtp"`
+}
+
+type SMTPConfig struct {
+	Host     string `yaml:"host"`
+	Port     int    `yaml:"port"`
+	Username string `yaml:"username"`
+	Password Secret `yaml:"password"`
+}
+
+// Mail drivers
+const (
+	MailLog  = "log"
+	MailFile = "file"
+	MailSMTP = "smtp"
+)
+
+// Password hashing algorithms
+const (
+	PasswordBcrypt   = "bcrypt"
+	PasswordArgon2id = "argon2id"
+)
+
+// Login throttle drivers
+const (
+	ThrottleMemory   = "memory"
+	ThrottlePostgres = "postgres"
+)
+
+// MinBcryptCost is the lowest bcrypt cost that is accepted.
+const MinBcryptCost = 10
+
+// MinSecretLength is the shortest JWT or token secret, in bytes, that is accepted.
+const MinSecretLength = 32
+
+// Default returns the configuration used where nothing else is given.
+// It is not valid on its own, since it has no database or JWT secret.
+func Default() *Config {
+	return &Config{
+		Server: ServerConfig{
+			Port:        3000,
+			FrontendURL: "https://leaderboards.gg",
+		},
+		Database: DatabaseConfig{
+			Port:    5432,
+			SSLMode: "disable",
+		},
+		Auth: AuthConfig{
+			Realm:      "leaderboards.gg",
+			Timeout:    15 * time.Minute,
+			MaxRefresh: 30 * 24 * time.Hour,
+
+			CookieSecure: true,
+
+			VerificationTimeout:        24 * time.Hour,
+			VerificationResendInterval: 10 * time.Minute,
+			PasswordResetTimeout:       time.Hour,
+			UsernameChangeCooldown:     30 * 24 * time.Hour,
+
+			TwoFactorTimeout: 5 * time.Minute,
+
+			// The OWASP recommendations for each algorithm.
+			Password: PasswordConfig{
+				Algorithm:     PasswordArgon2id,
+				BcryptCost:    12,
+				Argon2Time:    2,
+				Argon2Memory:  19 * 1024,
+				Argon2Threads: 1,
+			},
+			LoginThrottle: LoginThrottleConfig{
+				Driver:          ThrottleMemory,
+				AccountAttempts: 5,
+				IPAttempts:      20,
+				BaseDelay:       time.Minute,
+				MaxDelay:        time.Hour,
+				Window:          24 * time.Hour,
+			},
+		},
+		OAuth: OAuthConfig{
+			Discord: OAuthProvider{
+				AuthURL:     "https://discord.com/oauth2/authorize",
+				TokenURL:    "https://discord.com/api/oauth2/token",
+				UserInfoURL: "https://discord.com/api/users/@me",
+			},
+			Twitch: OAuthProvider{
+				AuthURL:     "https://id.twitch.tv/oauth2/authorize",
+				TokenURL:    "https://id.twitch.tv/oauth2/token",
+				UserInfoURL: "https://api.twitch.tv/helix/users",
+			},
+			Google: OAuthProvider{
+				AuthURL:     "https://accounts.google.com/o/oauth2/v2/auth",
+				TokenURL:    "https://oauth2.googleapis.com/token",
+				UserInfoURL: "https://openidconnect.googleapis.com/v1/userinfo",
+			},
+			StateTimeout: 10 * time.Minute,
+		},
+		Mail: MailConfig{
+			Driver: MailLog,
+			From:   "leaderboards.gg <noreply@leaderboards.gg>",
+			SMTP: SMTPConfig{
+				Port: 587,
+			},
+		},
+	}
+}
+
+// DSN returns the connection string for the database.
+func (c DatabaseConfig) DSN() string {
+	if c.URL != "" {
+		return c.URL.Reveal()
+	}
+	return fmt.Sprintf(
+		"host=%s port=%d user=%s dbname=%s password=%s sslmode=%s",
+		c.Host, c.Port, c.User, c.Name, c.Password.Reveal(), c.SSLMode)
+}
+
+// Load reads the configuration for the command line args, which start with
+// any global flags. The arguments left after the flags are returned.
+func Load(args []string) (*Config, []string, error) {
+	if err := loadDotEnv(); err != nil {
+		return nil, nil, err
+	}
+	return load(args, os.LookupEnv)
+}
+
+// loadDotEnv loads the .env file named by $ENV, or ./.env if it exists.
+func loadDotEnv() error {
+	path := os.Getenv("ENV")
+	if path == "" {
+		if _, err := os.Stat(".env"); errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		path = ".env"
+	}
+	if err := godotenv.Load(path); err != nil {
+		return fmt.Errorf("loading %s failed: %w", path, err)
+	}
+	return nil
+}
+
+func load(args []string, lookupEnv func(string) (string, bool)) (*Config, []string, error) {
+	flags := flag.NewFlagSet("leaderboard-backend", flag.ContinueOnError)
+	file := flags.String("config", "", "read configuration from this YAML or TOML file (env: CONFIG_FILE)")
+	port := flags.Int("port", 0, "listen on this port (env: BACKEND_PORT)")
+	databaseURL := flags.String("database-url", "", "connect to the database with this URL or DSN (env: DATABASE_URL)")
+	if err := flags.Parse(args); err != nil {
+		return nil, nil, err
+	}
+
+	config := Default()
+
+	if *file == "" {
+		*file, _ = lookupEnv("CONFIG_FILE")
+	}
+	if *file != "" {
+		if err := config.readFile(*file); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if err := config.readEnv(lookupEnv); err != nil {
+		return nil, nil, err
+	}
+
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "port":
+			config.Server.Port = *port
+		case "database-url":
+			config.Database.URL = Secret(*databaseURL)
+		}
+	})
+
+	if err := config.Validate(); err != nil {
+		return nil, nil, err
+	}
+	return config, flags.Args(), nil
+}
+
+// ErrUnsupportedFormat is returned for configuration files that are
+// neither YAML nor TOML.
+var ErrUnsupportedFormat = errors.New("configuration files must be YAML (.yml or .yaml) or TOML (.toml)")
+
+// readFile reads a configuration file, choosing its format by extension.
+func (c *Config) readFile(path string) error {
+	var toYAML func([]byte) ([]byte, error)
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yml", ".yaml", "":
+	case ".toml":
+		toYAML = tomlToYAML
+	default:
+		return fmt.Errorf("reading %s failed: %w", path, ErrUnsupportedFormat)
+	}
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if toYAML != nil {
+		if contents, err = toYAML(contents); err != nil {
+			return fmt.Errorf("reading %s failed: %w", path, err)
+		}
+	}
+	if err := yaml.UnmarshalStrict(contents, c); err != nil {
+		return fmt.Errorf("reading %s failed: %w", path, err)
+	}
+	return nil
+}
+
+// tomlToYAML rewrites a TOML file as YAML, so that both formats are read
+// with the same field names, checks for unknown settings and durations.
+func tomlToYAML(contents []byte) ([]byte, error) {
+	var values map[string]interface{}
+	if err := toml.Unmarshal(contents, &values); err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(values)
+}
+
+// readEnv overrides the configuration with any environment variables
+// that are set.
+func (c *Config) readEnv(lookupEnv func(string) (string, bool)) error {
+	str := func(dest *string) func(string) error {
+		return func(value string) error {
+			*dest = value
+			return nil
+		}
+	}
+	secret := func(dest *Secret) func(string) error {
+		return func(value string) error {
+			*dest = Secret(value)
+			return nil
+		}
+	}
+	integer := func(dest *int) func(string) error {
+		return func(value string) (err error) {
+			*dest, err = strconv.Atoi(value)
+			return err
+		}
+	}
+	boolean := func(dest *bool) func(string) error {
+		return func(value string) (err error) {
+			*dest, err = strconv.ParseBool(value)
+			return err
+		}
+	}
+	list := func(dest *[]string) func(string) error {
+		return func(value string) error {
+			*dest = nil
+			for _, item := range strings.Split(value, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					*dest = append(*dest, item)
+				}
+			}
+			return nil
+		}
+	}
+	duration := func(dest *time.Duration) func(string) error {
+		return func(value string) (err error) {
+			*dest, err = time.ParseDuration(value)
+			return err
+		}
+	}
+
+	vars := []struct {
+		name string
+		set  func(string) error
+	}{
+		{"BACKEND_PORT", integer(&c.Server.Port)},
+		{"FRONTEND_URL", str(&c.Server.FrontendURL)},
+		{"TRUSTED_PROXIES", list(&c.Server.TrustedProxies)},
+
+		{"DATABASE_URL", secret(&c.Database.URL)},
+		{"POSTGRES_HOST", str(&c.Database.Host)},
+		{"POSTGRES_PORT", integer(&c.Database.Port)},
+		{"POSTGRES_USER", str(&c.Database.User)},
+		{"POSTGRES_PASSWORD", secret(&c.Database.Password)},
+		{"POSTGRES_DB", str(&c.Database.Name)},
+		{"POSTGRES_SSLMODE", str(&c.Database.SSLMode)},
+
+		{"JWT_SECRET", secret(&c.Auth.JWTSecret)},
+		{"JWT_REALM", str(&c.Auth.Realm)},
+		{"JWT_TIMEOUT", duration(&c.Auth.Timeout)},
+		{"JWT_MAX_REFRESH", duration(&c.Auth.MaxRefresh)},
+		{"JWT_SIGNING_KEY_FILE", str(&c.Auth.SigningKeyFile)},
+		{"JWT_VERIFICATION_KEY_FILES", list(&c.Auth.VerificationKeyFiles)},
+		{"COOKIE_DOMAIN", str(&c.Auth.CookieDomain)},
+		{"COOKIE_SECURE", boolean(&c.Auth.CookieSecure)},
+		{"TOKEN_SECRET", secret(&c.Auth.TokenSecret)},
+		{"VERIFICATION_TIMEOUT", duration(&c.Auth.VerificationTimeout)},
+		{"VERIFICATION_RESEND_INTERVAL", duration(&c.Auth.VerificationResendInterval)},
+		{"PASSWORD_RESET_TIMEOUT", duration(&c.Auth.PasswordResetTimeout)},
+		{"USERNAME_CHANGE_COOLDOWN", duration(&c.Auth.UsernameChangeCooldown)},
+		{"TWO_FACTOR_TIMEOUT", duration(&c.Auth.TwoFactorTimeout)},
+		{"TWO_FACTOR_ROLES", list(&c.Auth.TwoFactorRoles)},
+		{"PASSWORD_ALGORITHM", str(&c.Auth.Password.Algorithm)},
+		{"BCRYPT_COST", integer(&c.Auth.Password.BcryptCost)},
+		{"ARGON2_TIME", integer(&c.Auth.Password.Argon2Time)},
+		{"ARGON2_MEMORY", integer(&c.Auth.Password.Argon2Memory)},
+		{"ARGON2_THREADS", integer(&c.Auth.Password.Argon2Threads)},
+		{"LOGIN_THROTTLE_DRIVER", str(&c.Auth.LoginThrottle.Driver)},
+		{"LOGIN_ACCOUNT_ATTEMPTS", integer(&c.Auth.LoginThrottle.AccountAttempts)},
+		{"LOGIN_IP_ATTEMPTS", integer(&c.Auth.LoginThrottle.IPAttempts)},
+		{"LOGIN_BASE_DELAY", duration(&c.Auth.LoginThrottle.BaseDelay)},
+		{"LOGIN_MAX_DELAY", duration(&c.Auth.LoginThrottle.MaxDelay)},
+		{"LOGIN_FAILURE_WINDOW", duration(&c.Auth.LoginThrottle.Window)},
+
+		{"DISCORD_CLIENT_ID", str(&c.OAuth.Discord.ClientID)},
+		{"DISCORD_CLIENT_SECRET", secret(&c.OAuth.Discord.ClientSecret)},
+		{"TWITCH_CLIENT_ID", str(&c.OAuth.Twitch.ClientID)},
+		{"TWITCH_CLIENT_SECRET", secret(&c.OAuth.Twitch.ClientSecret)},
+		{"GOOGLE_CLIENT_ID", str(&c.OAuth.Google.ClientID)},
+		{"GOOGLE_CLIENT_SECRET", secret(&c.OAuth.Google.ClientSecret)},
+		{"OAUTH_STATE_TIMEOUT", duration(&c.OAuth.StateTimeout)},
+
+		{"MAIL_DRIVER", str(&c.Mail.Driver)},
+		{"MAIL_FROM", str(&c.Mail.From)},
+		{"MAIL_DIR", str(&c.Mail.Dir)},
+		{"SMTP_HOST", str(&c.Mail.SMTP.Host)},
+		{"SMTP_PORT", integer(&c.Mail.SMTP.Port)},
+		{"SMTP_USERNAME", str(&c.Mail.SMTP.Username)},
+		{"SMTP_PASSWORD", secret(&c.Mail.SMTP.Password)},
+	}
+	for _, v := range vars {
+		value, ok := lookupEnv(v.name)
+		if !ok || value == "" {
+			continue
+		}
+		if err := v.set(value); err != nil {
+			return fmt.Errorf("invalid %s: %w", v.name, err)
+		}
+	}
+	return nil
+}
+
+// Validate checks that every required value is present and sensible,
+// returning a ValidationError listing every problem found.
+func (c *Config) Validate() error {
+	var problems []string
+
+	if c.Server.Port < 1 || c.Server.Port > 65535 {
+		problems = append(problems, "server port must be between 1 and 65535 (BACKEND_PORT)")
+	}
+
+	if c.Database.URL == "" && (c.Database.Host == "" || c.Database.User == "" || c.Database.Name == "") {
+		problems = append(problems, "a database is required: set DATABASE_URL, or POSTGRES_HOST, POSTGRES_USER and POSTGRES_DB")
+	}
+
+	if c.Server.FrontendURL == "" {
+		problems = append(problems, "the frontend URL can't be empty (FRONTEND_URL)")
+	}
+	for _, proxy := range c.Server.TrustedProxies {
+		if _, _, err := net.ParseCIDR(proxy); err != nil && net.ParseIP(proxy) == nil {
+			problems = append(problems, fmt.Sprintf("%q is not an IP or CIDR range (TRUSTED_PROXIES)", proxy))
+		}
+	}
+
+	if c.Auth.JWTSecret == "" {
+		if c.Auth.SigningKeyFile == "" {
+			problems = append(problems, "a JWT secret or signing key is required (JWT_SECRET or JWT_SIGNING_KEY_FILE)")
+		}
+	} else if len(c.Auth.JWTSecret) < MinSecretLength {
+		problems = append(problems, fmt.Sprintf("the JWT secret must be at least %d bytes (JWT_SECRET)", MinSecretLength))
+	}
+	if c.Auth.TokenSecret == "" {
+		problems = append(problems, "a token secret is required (TOKEN_SECRET)")
+	} else if len(c.Auth.TokenSecret) < MinSecretLength {
+		problems = append(problems, fmt.Sprintf("the token secret must be at least %d bytes (TOKEN_SECRET)", MinSecretLength))
+	}
+	if c.Auth.Realm == "" {
+		problems = append(problems, "the JWT realm can't be empty (JWT_REALM)")
+	}
+	if c.Auth.Timeout <= 0 {
+		problems = append(problems, "the JWT timeout must be positive (JWT_TIMEOUT)")
+	}
+	if c.Auth.MaxRefresh <= 0 {
+		problems = append(problems, "the refresh token lifetime must be positive (JWT_MAX_REFRESH)")
+	}
+	if c.Auth.VerificationTimeout <= 0 {
+		problems = append(problems, "the verification timeout must be positive (VERIFICATION_TIMEOUT)")
+	}
+	if c.Auth.VerificationResendInterval < 0 {
+		problems = append(problems, "the verification resend interval can't be negative (VERIFICATION_RESEND_INTERVAL)")
+	}
+	if c.Auth.PasswordResetTimeout <= 0 {
+		problems = append(problems, "the password reset timeout must be positive (PASSWORD_RESET_TIMEOUT)")
+	}
+	if c.Auth.UsernameChangeCooldown < 0 {
+		problems = append(problems, "the username change cooldown can't be negative (USERNAME_CHANGE_COOLDOWN)")
+	}
+	if c.Auth.TwoFactorTimeout <= 0 {
+		problems = append(problems, "the two-factor timeout must be positive (TWO_FACTOR_TIMEOUT)")
+	}
+	password := c.Auth.Password
+	switch password.Algorithm {
+	case PasswordBcrypt, PasswordArgon2id:
+	default:
+		problems = append(problems, "the password algorithm must be bcrypt or argon2id (PASSWORD_ALGORITHM)")
+	}
+	if password.BcryptCost < MinBcryptCost || password.BcryptCost > 31 {
+		problems = append(problems, fmt.Sprintf("the bcrypt cost must be between %d and 31 (BCRYPT_COST)", MinBcryptCost))
+	}
+	if password.Argon2Time < 1 {
+		problems = append(problems, "the argon2 time must be at least 1 (ARGON2_TIME)")
+	}
+	if password.Argon2Threads < 1 || password.Argon2Threads > 255 {
+		problems = append(problems, "the argon2 threads must be between 1 and 255 (ARGON2_THREADS)")
+	}
+	if password.Argon2Memory < 8*password.Argon2Threads {
+		problems = append(problems, "the argon2 memory must be at least 8 KiB per thread (ARGON2_MEMORY)")
+	}
+	throttle := c.Auth.LoginThrottle
+	switch throttle.Driver {
+	case ThrottleMemory, ThrottlePostgres:
+	default:
+		problems = append(problems, "the login throttle driver must be memory or postgres (LOGIN_THROTTLE_DRIVER)")
+	}
+	if throttle.AccountAttempts < 1 {
+		problems = append(problems, "the login attempts per account must be at least 1 (LOGIN_ACCOUNT_ATTEMPTS)")
+	}
+	if throttle.IPAttempts < 1 {
+		problems = append(problems, "the login attempts per IP must be at least 1 (LOGIN_IP_ATTEMPTS)")
+	}
+	if throttle.BaseDelay <= 0 {
+		problems = append(problems, "the login base delay must be positive (LOGIN_BASE_DELAY)")
+	}
+	if throttle.MaxDelay < throttle.BaseDelay {
+		problems = append(problems, "the login max delay can't be less than the base delay (LOGIN_MAX_DELAY)")
+	}
+	if throttle.Window < throttle.MaxDelay {
+		problems = append(problems, "the login failure window can't be less than the max delay (LOGIN_FAILURE_WINDOW)")
+	}
+
+	providers := []struct {
+		name     string
+		env      string
+		provider OAuthProvider
+	}{
+		{"discord", "DISCORD", c.OAuth.Discord},
+		{"twitch", "TWITCH", c.OAuth.Twitch},
+		{"google", "GOOGLE", c.OAuth.Google},
+	}
+	for _, p := range providers {
+		if !p.provider.Enabled() {
+			continue
+		}
+		if p.provider.ClientSecret == "" {
+			problems = append(problems, fmt.Sprintf("%s login needs a client secret (%s_CLIENT_SECRET)", p.name, p.env))
+		}
+		if p.provider.AuthURL == "" || p.provider.TokenURL == "" || p.provider.UserInfoURL == "" {
+			problems = append(problems, fmt.Sprintf("%s login needs an auth, token and userinfo URL", p.name))
+		}
+	}
+	if c.OAuth.StateTimeout <= 0 {
+		problems = append(problems, "the OAuth state timeout must be positive (OAUTH_STATE_TIMEOUT)")
+	}
+
+	switch c.Mail.Driver {
+	case MailLog:
+	case MailFile:
+		if c.Mail.Dir == "" {
+			problems = append(problems, "the file mail driver needs a directory (MAIL_DIR)")
+		}
+	case MailSMTP:
+		if c.Mail.SMTP.Host == "" {
+			problems = append(problems, "the smtp mail driver needs a host (SMTP_HOST)")
+		}
+	default:
+		problems = append(problems, "the mail driver must be log, file or smtp (MAIL_DRIVER)")
+	}
+	if c.Mail.From == "" {
+		problems = append(problems, "the mail sender can't be empty (MAIL_FROM)")
+	}
+
+	if len(problems) > 0 {
+		return ValidationError{
+			Problems: problems,
+		}
+	}
+	return nil
+}
+
+// String formats the configuration as YAML with every secret redacted,
+// so that it is safe to log.
+func (c Config) String() string {
+	out, err := yaml.Marshal(c)
+	if err != nil {
+		return err.Error()
+	}
+	return string(out)
+}
+
+type ValidationError struct {
+	Problems []string
+}
+
+func (e ValidationError) Error() string {
+	return "invalid configuration:\n  - " + strings.Join(e.Problems, "\n  - ")
+}
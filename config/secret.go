@@ -0,0 +1,33 @@
+package config
+
+import "encoding/json"
+
+// A Secret is a configuration value that must never be printed.
+// Formatting or marshalling a Secret redacts it; use Reveal
+// to get the actual value.
+type Secret string
+
+const redacted = "[redacted]"
+
+func (s Secret) Reveal() string {
+	return string(s)
+}
+
+func (s Secret) String() string {
+	if s == "" {
+		return ""
+	}
+	return redacted
+}
+
+func (s Secret) GoString() string {
+	return `"` + s.String() + `"`
+}
+
+func (s Secret) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
+func (s Secret) MarshalYAML() (interface{}, error) {
+	return s.String(), nil
+}
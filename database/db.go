@@ -1,65 +1,38 @@
 package database
 
 import (
-	"fmt"
 	"os"
+	"strconv"
 
 	_ "github.com/joho/godotenv/autoload"
+	"github.com/speedrun-website/leaderboard-backend/config"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 )
 
+// DB is the connection used by stores that aren't given one.
+// Only tests rely on it; the server passes its connection around.
 var DB *gorm.DB
 
-type dbConfig struct {
-	host     string
-	port     string
-	user     string
-	dbname   string
-	password string
+// Connect opens a connection to the configured database.
+func Connect(c config.DatabaseConfig) (*gorm.DB, error) {
+	return gorm.Open(postgres.Open(c.DSN()), &gorm.Config{})
 }
 
-func getDbConfig() dbConfig {
-	return dbConfig{
-		os.Getenv("POSTGRES_HOST"),
-		os.Getenv("POSTGRES_PORT"),
-		os.Getenv("POSTGRES_USER"),
-		os.Getenv("POSTGRES_DB"),
-		os.Getenv("POSTGRES_PASSWORD"),
+func getTestDbConfig() config.DatabaseConfig {
+	c := config.Default().Database
+	c.Host = os.Getenv("POSTGRES_HOST")
+	c.User = os.Getenv("POSTGRES_USER")
+	c.Password = config.Secret(os.Getenv("POSTGRES_PASSWORD"))
+	c.Name = os.Getenv("POSTGRES_TEST_DB")
+	if port, err := strconv.Atoi(os.Getenv("POSTGRES_TEST_PORT")); err == nil {
+		c.Port = port
 	}
-}
-
-func getTestDbConfig() dbConfig {
-	return dbConfig{
-		os.Getenv("POSTGRES_HOST"),
-		os.Getenv("POSTGRES_TEST_PORT"),
-		os.Getenv("POSTGRES_USER"),
-		os.Getenv("POSTGRES_TEST_DB"),
-		os.Getenv("POSTGRES_PASSWORD"),
-	}
-}
-
-func getDns(config dbConfig) string {
-	return fmt.Sprintf(
-		"host=%s port=%s user=%s dbname=%s password=%s sslmode=disable",
-		config.host, config.port, config.user, config.dbname, config.password)
-}
-
-func InitGlobalConnection() error {
-	config := getDbConfig()
-	dns := getDns(config)
-	db, err := gorm.Open(postgres.Open(dns), &gorm.Config{})
-	if err != nil {
-		return err
-	}
-	DB = db
-	return nil
+	return c
 }
 
 func InitGlobalTestConnection() error {
-	config := getTestDbConfig()
-	dns := getDns(config)
-	db, err := gorm.Open(postgres.Open(dns), &gorm.Config{})
+	db, err := Connect(getTestDbConfig())
 	if err != nil {
 		return err
 	}
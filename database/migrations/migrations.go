@@ -0,0 +1,282 @@
+// Package migrations keeps the database schema up to date.
+//
+// Each migration is a pair of SQL files in the sql directory, named
+// <version>_<name>.up.sql and <version>_<name>.down.sql. Versions are
+// applied in order and recorded in the schema_migrations table, so a
+// migration must never be edited once it has been merged; add a new one
+// instead.
+package migrations
+
+import (
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+//go:embed sql/*.sql
+var files embed.FS
+
+// A Migration is a single versioned change to the schema.
+type Migration struct {
+	Version uint
+	Name    string
+	Up      string
+	Down    string
+}
+
+// A MigrationStatus is a migration along with when it was applied.
+// AppliedAt is nil for pending migrations.
+type MigrationStatus struct {
+	Migration
+	AppliedAt *time.Time
+}
+
+// schemaMigration is a row of the schema_migrations table.
+type schemaMigration struct {
+	Version   uint `gorm:"primaryKey;autoIncrement:false"`
+	Name      string
+	AppliedAt time.Time
+}
+
+const createSchemaTable = `
+CREATE TABLE IF NOT EXISTS schema_migrations (
+	version bigint PRIMARY KEY,
+	name text NOT NULL,
+	applied_at timestamptz NOT NULL DEFAULT now()
+)`
+
+// lockKey is the Postgres advisory lock held while migrating, so that
+// two instances starting at once don't both apply a migration.
+const lockKey = 7413921
+
+var all []Migration
+
+func init() {
+	migrations, err := load(files)
+	if err != nil {
+		panic(err)
+	}
+	all = migrations
+}
+
+var fileName = regexp.MustCompile(`^(\d+)_([a-z0-9_]+)\.(up|down)\.sql$`)
+
+// load reads every migration in fsys's sql directory, ordered by version.
+// Every version must be unique and have both an up and a down file.
+func load(fsys fs.FS) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, "sql")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[uint]*Migration{}
+	for _, entry := range entries {
+		parts := fileName.FindStringSubmatch(entry.Name())
+		if parts == nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidFileName, entry.Name())
+		}
+		version, err := strconv.ParseUint(parts[1], 10, 0)
+		if err != nil || version == 0 {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidFileName, entry.Name())
+		}
+		contents, err := fs.ReadFile(fsys, path.Join("sql", entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[uint(version)]
+		if !ok {
+			m = &Migration{
+				Version: uint(version),
+				Name:    parts[2],
+			}
+			byVersion[m.Version] = m
+		} else if m.Name != parts[2] {
+			return nil, fmt.Errorf("%w: %d", ErrDuplicateVersion, version)
+		}
+
+		if parts[3] == "up" {
+			m.Up = string(contents)
+		} else {
+			m.Down = string(contents)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("%w: %d_%s", ErrIncompleteMigration, m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+// All returns every known migration, oldest first.
+func All() []Migration {
+	return all
+}
+
+// Up applies every pending migration in order, each in its own
+// transaction, and returns the migrations that were applied.
+func Up(db *gorm.DB) ([]Migration, error) {
+	if err := db.Exec(createSchemaTable).Error; err != nil {
+		return nil, err
+	}
+
+	var applied []Migration
+	for _, m := range all {
+		ran, err := apply(db, m)
+		if err != nil {
+			return applied, fmt.Errorf("migration %d_%s failed: %w", m.Version, m.Name, err)
+		}
+		if ran {
+			applied = append(applied, m)
+		}
+	}
+	return applied, nil
+}
+
+func apply(db *gorm.DB, m Migration) (ran bool, err error) {
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("SELECT pg_advisory_xact_lock(?)", lockKey).Error; err != nil {
+			return err
+		}
+		// Another instance may have applied it while we waited for the lock.
+		var count int64
+		err := tx.Model(&schemaMigration{}).Where("version = ?", m.Version).Count(&count).Error
+		if err != nil || count > 0 {
+			return err
+		}
+		if err := tx.Exec(m.Up).Error; err != nil {
+			return err
+		}
+		ran = true
+		return tx.Create(&schemaMigration{
+			Version:   m.Version,
+			Name:      m.Name,
+			AppliedAt: time.Now(),
+		}).Error
+	})
+	return ran, err
+}
+
+// Down reverts the latest steps applied migrations, newest first,
+// and returns the migrations that were reverted.
+func Down(db *gorm.DB, steps int) ([]Migration, error) {
+	if err := db.Exec(createSchemaTable).Error; err != nil {
+		return nil, err
+	}
+
+	var reverted []Migration
+	for len(reverted) < steps {
+		m, ok, err := revertLatest(db)
+		if err != nil {
+			return reverted, err
+		}
+		if !ok {
+			break
+		}
+		reverted = append(reverted, *m)
+	}
+	return reverted, nil
+}
+
+func revertLatest(db *gorm.DB) (m *Migration, ok bool, err error) {
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("SELECT pg_advisory_xact_lock(?)", lockKey).Error; err != nil {
+			return err
+		}
+		var latest schemaMigration
+		result := tx.Order("version DESC").Limit(1).Find(&latest)
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+
+		m = find(latest.Version)
+		if m == nil {
+			return fmt.Errorf("%w: %d_%s", ErrUnknownVersion, latest.Version, latest.Name)
+		}
+		if err := tx.Exec(m.Down).Error; err != nil {
+			return fmt.Errorf("reverting migration %d_%s failed: %w", m.Version, m.Name, err)
+		}
+		ok = true
+		return tx.Delete(&schemaMigration{}, latest.Version).Error
+	})
+	return m, ok, err
+}
+
+func find(version uint) *Migration {
+	for i := range all {
+		if all[i].Version == version {
+			return &all[i]
+		}
+	}
+	return nil
+}
+
+// Status lists every known migration and when it was applied.
+func Status(db *gorm.DB) ([]MigrationStatus, error) {
+	if err := db.Exec(createSchemaTable).Error; err != nil {
+		return nil, err
+	}
+
+	var rows []schemaMigration
+	if err := db.Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	appliedAt := map[uint]time.Time{}
+	for _, row := range rows {
+		appliedAt[row.Version] = row.AppliedAt
+	}
+
+	statuses := make([]MigrationStatus, len(all))
+	for i, m := range all {
+		statuses[i].Migration = m
+		if at, ok := appliedAt[m.Version]; ok {
+			statuses[i].AppliedAt = &at
+		}
+	}
+	return statuses, nil
+}
+
+// CheckCurrent returns ErrSchemaBehind if any migration is still pending.
+func CheckCurrent(db *gorm.DB) error {
+	statuses, err := Status(db)
+	if err != nil {
+		return err
+	}
+	var pending int
+	for _, status := range statuses {
+		if status.AppliedAt == nil {
+			pending++
+		}
+	}
+	if pending > 0 {
+		return fmt.Errorf("%w: %d pending migration(s), run `migrate up` first", ErrSchemaBehind, pending)
+	}
+	return nil
+}
+
+func (schemaMigration) TableName() string {
+	return "schema_migrations"
+}
+
+// Errors
+var ErrSchemaBehind = errors.New("the database schema is behind this build")
+var ErrUnknownVersion = errors.New("the database has a migration applied that this build doesn't know about")
+
+var ErrInvalidFileName = errors.New("migration files must be named <version>_<name>.(up|down).sql")
+var ErrDuplicateVersion = errors.New("two migrations have the same version")
+var ErrIncompleteMigration = errors.New("every migration needs both an up and a down file")
@@ -0,0 +1,85 @@
+package migrations
+
+import (
+	"errors"
+	"testing"
+	"testing/fstest"
+)
+
+func TestAllMigrations(t *testing.T) {
+	migrations := All()
+	if len(migrations) == 0 {
+		t.Fatal("expected at least one migration")
+	}
+	if migrations[0].Version != 1 || migrations[0].Name != "create_users" {
+		t.Fatalf("expected the first migration to be 0001_create_users, got %d_%s",
+			migrations[0].Version, migrations[0].Name)
+	}
+	for i, m := range migrations {
+		if m.Version != uint(i+1) {
+			t.Fatalf("expected migration %d to have version %d, got %d", i, i+1, m.Version)
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	valid := fstest.MapFS{
+		"sql/0002_second.up.sql":   {Data: []byte("up 2")},
+		"sql/0002_second.down.sql": {Data: []byte("down 2")},
+		"sql/0001_first.up.sql":    {Data: []byte("up 1")},
+		"sql/0001_first.down.sql":  {Data: []byte("down 1")},
+	}
+	migrations, err := load(valid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(migrations) != 2 || migrations[0].Name != "first" || migrations[1].Down != "down 2" {
+		t.Fatalf("unexpected migrations: %+v", migrations)
+	}
+
+	testCases := []struct {
+		name     string
+		files    fstest.MapFS
+		expected error
+	}{
+		{
+			name: "Bad name",
+			files: fstest.MapFS{
+				"sql/first.up.sql": {},
+			},
+			expected: ErrInvalidFileName,
+		},
+		{
+			name: "Version zero",
+			files: fstest.MapFS{
+				"sql/0000_first.up.sql":   {Data: []byte("up")},
+				"sql/0000_first.down.sql": {Data: []byte("down")},
+			},
+			expected: ErrInvalidFileName,
+		},
+		{
+			name: "Missing down",
+			files: fstest.MapFS{
+				"sql/0001_first.up.sql": {Data: []byte("up")},
+			},
+			expected: ErrIncompleteMigration,
+		},
+		{
+			name: "Duplicate version",
+			files: fstest.MapFS{
+				"sql/0001_first.up.sql":   {Data: []byte("up")},
+				"sql/0001_other.up.sql":   {Data: []byte("up")},
+				"sql/0001_first.down.sql": {Data: []byte("down")},
+			},
+			expected: ErrDuplicateVersion,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			if _, err := load(testCase.files); !errors.Is(err, testCase.expected) {
+				t.Fatalf("expected %v, got %v", testCase.expected, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,13 @@
+-- Databases created before migrations existed were set up by GORM's
+-- AutoMigrate, so the baseline tables are only created if they're missing.
+CREATE TABLE IF NOT EXISTS users (
+	id bigserial PRIMARY KEY,
+	created_at timestamptz,
+	updated_at timestamptz,
+	deleted_at timestamptz,
+	username text UNIQUE,
+	email text UNIQUE,
+	password bytea
+);
+
+CREATE INDEX IF NOT EXISTS idx_users_deleted_at ON users (deleted_at);
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS game_role_grants;
+DROP TABLE IF EXISTS site_role_grants;
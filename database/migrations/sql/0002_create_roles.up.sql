@@ -0,0 +1,18 @@
+CREATE TABLE IF NOT EXISTS site_role_grants (
+	user_id bigint NOT NULL,
+	role text NOT NULL,
+	created_at timestamptz,
+	PRIMARY KEY (user_id, role),
+	CONSTRAINT fk_site_role_grants_user FOREIGN KEY (user_id) REFERENCES users (id)
+);
+
+CREATE TABLE IF NOT EXISTS game_role_grants (
+	game_id bigint NOT NULL,
+	user_id bigint NOT NULL,
+	role text NOT NULL,
+	created_at timestamptz,
+	PRIMARY KEY (game_id, user_id, role),
+	CONSTRAINT fk_game_role_grants_user FOREIGN KEY (user_id) REFERENCES users (id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_game_role_grants_user_id ON game_role_grants (user_id);
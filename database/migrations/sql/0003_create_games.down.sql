@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS levels;
+DROP TABLE IF EXISTS categories;
+DROP TABLE IF EXISTS games;
@@ -0,0 +1,41 @@
+CREATE TABLE IF NOT EXISTS games (
+	id bigserial PRIMARY KEY,
+	created_at timestamptz,
+	updated_at timestamptz,
+	deleted_at timestamptz,
+	name text,
+	slug text UNIQUE
+);
+
+CREATE INDEX IF NOT EXISTS idx_games_deleted_at ON games (deleted_at);
+
+CREATE TABLE IF NOT EXISTS categories (
+	id bigserial PRIMARY KEY,
+	created_at timestamptz,
+	updated_at timestamptz,
+	deleted_at timestamptz,
+	game_id bigint,
+	name text,
+	slug text,
+	rules text,
+	primary_timing text DEFAULT 'realtime',
+	CONSTRAINT fk_games_categories FOREIGN KEY (game_id) REFERENCES games (id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_categories_deleted_at ON categories (deleted_at);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_categories_game_slug ON categories (game_id, slug);
+
+CREATE TABLE IF NOT EXISTS levels (
+	id bigserial PRIMARY KEY,
+	created_at timestamptz,
+	updated_at timestamptz,
+	deleted_at timestamptz,
+	game_id bigint,
+	name text,
+	slug text,
+	rules text,
+	CONSTRAINT fk_games_levels FOREIGN KEY (game_id) REFERENCES games (id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_levels_deleted_at ON levels (deleted_at);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_levels_game_slug ON levels (game_id, slug);
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS run_status_changes;
+DROP TABLE IF EXISTS runs;
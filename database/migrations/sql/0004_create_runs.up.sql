@@ -0,0 +1,38 @@
+CREATE TABLE IF NOT EXISTS runs (
+	id bigserial PRIMARY KEY,
+	created_at timestamptz,
+	updated_at timestamptz,
+	deleted_at timestamptz,
+	user_id bigint,
+	game_id bigint,
+	category_id bigint,
+	level_id bigint,
+	real_time bigint,
+	game_time bigint,
+	played_on date,
+	video_url text,
+	comment text,
+	status text DEFAULT 'pending',
+	rejection_reason text,
+	CONSTRAINT fk_runs_user FOREIGN KEY (user_id) REFERENCES users (id),
+	CONSTRAINT fk_runs_game FOREIGN KEY (game_id) REFERENCES games (id),
+	CONSTRAINT fk_runs_category FOREIGN KEY (category_id) REFERENCES categories (id),
+	CONSTRAINT fk_runs_level FOREIGN KEY (level_id) REFERENCES levels (id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_runs_deleted_at ON runs (deleted_at);
+CREATE INDEX IF NOT EXISTS idx_runs_status ON runs (status);
+
+CREATE TABLE IF NOT EXISTS run_status_changes (
+	id bigserial PRIMARY KEY,
+	run_id bigint,
+	moderator_id bigint,
+	from_status text,
+	to_status text,
+	reason text,
+	created_at timestamptz,
+	CONSTRAINT fk_runs_status_changes FOREIGN KEY (run_id) REFERENCES runs (id),
+	CONSTRAINT fk_run_status_changes_moderator FOREIGN KEY (moderator_id) REFERENCES users (id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_run_status_changes_run_id ON run_status_changes (run_id);
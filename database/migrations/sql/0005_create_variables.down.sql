@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS run_variable_values;
+DROP TABLE IF EXISTS variable_values;
+DROP TABLE IF EXISTS variables;
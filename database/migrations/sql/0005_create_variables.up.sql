@@ -0,0 +1,37 @@
+CREATE TABLE IF NOT EXISTS variables (
+	id bigserial PRIMARY KEY,
+	created_at timestamptz,
+	updated_at timestamptz,
+	deleted_at timestamptz,
+	game_id bigint,
+	category_id bigint,
+	name text,
+	is_subcategory boolean,
+	required boolean
+);
+
+CREATE INDEX IF NOT EXISTS idx_variables_deleted_at ON variables (deleted_at);
+CREATE INDEX IF NOT EXISTS idx_variables_game_id ON variables (game_id);
+
+CREATE TABLE IF NOT EXISTS variable_values (
+	id bigserial PRIMARY KEY,
+	created_at timestamptz,
+	updated_at timestamptz,
+	deleted_at timestamptz,
+	variable_id bigint,
+	label text,
+	CONSTRAINT fk_variables_values FOREIGN KEY (variable_id) REFERENCES variables (id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_variable_values_deleted_at ON variable_values (deleted_at);
+CREATE INDEX IF NOT EXISTS idx_variable_values_variable_id ON variable_values (variable_id);
+
+CREATE TABLE IF NOT EXISTS run_variable_values (
+	run_id bigint NOT NULL,
+	variable_id bigint NOT NULL,
+	value_id bigint,
+	PRIMARY KEY (run_id, variable_id),
+	CONSTRAINT fk_runs_variable_values FOREIGN KEY (run_id) REFERENCES runs (id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_run_variable_values_value_id ON run_variable_values (value_id);
@@ -0,0 +1,2 @@
+ALTER TABLE runs DROP COLUMN IF EXISTS real_time_no_loads;
+ALTER TABLE categories DROP COLUMN IF EXISTS timings;
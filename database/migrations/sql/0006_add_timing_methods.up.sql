@@ -0,0 +1,2 @@
+ALTER TABLE categories ADD COLUMN IF NOT EXISTS timings text;
+ALTER TABLE runs ADD COLUMN IF NOT EXISTS real_time_no_loads bigint;
@@ -0,0 +1,5 @@
+ALTER TABLE users ADD COLUMN email_verified_at timestamptz;
+ALTER TABLE users ADD COLUMN verification_sent_at timestamptz;
+
+-- Accounts from before email verification keep being able to submit runs.
+UPDATE users SET email_verified_at = created_at;
@@ -0,0 +1,13 @@
+ALTER TABLE users ADD COLUMN sessions_revoked_at timestamptz;
+
+CREATE TABLE password_resets (
+	id bigserial PRIMARY KEY,
+	created_at timestamptz,
+	user_id bigint NOT NULL,
+	token_hash bytea NOT NULL UNIQUE,
+	expires_at timestamptz NOT NULL,
+	used_at timestamptz,
+	CONSTRAINT fk_password_resets_user FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+
+CREATE INDEX idx_password_resets_user_id ON password_resets (user_id);
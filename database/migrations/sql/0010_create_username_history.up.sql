@@ -0,0 +1,10 @@
+CREATE TABLE username_history (
+	id bigserial PRIMARY KEY,
+	user_id bigint NOT NULL,
+	username text NOT NULL,
+	changed_at timestamptz NOT NULL,
+	CONSTRAINT fk_username_history_user FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+
+CREATE INDEX idx_username_history_user_id ON username_history (user_id, changed_at);
+CREATE INDEX idx_username_history_username ON username_history (username);
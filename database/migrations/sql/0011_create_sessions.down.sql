@@ -0,0 +1,3 @@
+ALTER TABLE users ADD COLUMN sessions_revoked_at timestamptz;
+
+DROP TABLE sessions;
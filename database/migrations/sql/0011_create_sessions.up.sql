@@ -0,0 +1,17 @@
+CREATE TABLE sessions (
+	id bigserial PRIMARY KEY,
+	created_at timestamptz,
+	user_id bigint NOT NULL,
+	token_id text NOT NULL UNIQUE,
+	user_agent text NOT NULL DEFAULT '',
+	ip text NOT NULL DEFAULT '',
+	last_seen_at timestamptz NOT NULL,
+	expires_at timestamptz NOT NULL,
+	revoked_at timestamptz,
+	CONSTRAINT fk_sessions_user FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+
+CREATE INDEX idx_sessions_user_id ON sessions (user_id);
+
+-- Sessions are revoked individually now, instead of by time.
+ALTER TABLE users DROP COLUMN sessions_revoked_at;
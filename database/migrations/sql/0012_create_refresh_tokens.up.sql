@@ -0,0 +1,11 @@
+CREATE TABLE refresh_tokens (
+	id bigserial PRIMARY KEY,
+	created_at timestamptz,
+	session_id bigint NOT NULL,
+	token_hash bytea NOT NULL UNIQUE,
+	expires_at timestamptz NOT NULL,
+	used_at timestamptz,
+	CONSTRAINT fk_refresh_tokens_session FOREIGN KEY (session_id) REFERENCES sessions (id) ON DELETE CASCADE
+);
+
+CREATE INDEX idx_refresh_tokens_session_id ON refresh_tokens (session_id);
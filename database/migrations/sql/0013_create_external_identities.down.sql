@@ -0,0 +1,2 @@
+DROP TABLE oauth_states;
+DROP TABLE external_identities;
@@ -0,0 +1,26 @@
+CREATE TABLE external_identities (
+	id bigserial PRIMARY KEY,
+	created_at timestamptz,
+	user_id bigint NOT NULL,
+	provider text NOT NULL,
+	subject text NOT NULL,
+	username text NOT NULL DEFAULT '',
+	email text NOT NULL DEFAULT '',
+	CONSTRAINT external_identities_provider_subject_key UNIQUE (provider, subject),
+	CONSTRAINT external_identities_user_id_provider_key UNIQUE (user_id, provider),
+	CONSTRAINT fk_external_identities_user FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+
+CREATE TABLE oauth_states (
+	id bigserial PRIMARY KEY,
+	created_at timestamptz,
+	state_hash bytea NOT NULL UNIQUE,
+	provider text NOT NULL,
+	code_verifier text NOT NULL,
+	user_id bigint,
+	cookie boolean NOT NULL DEFAULT false,
+	expires_at timestamptz NOT NULL,
+	CONSTRAINT fk_oauth_states_user FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+
+CREATE INDEX idx_oauth_states_expires_at ON oauth_states (expires_at);
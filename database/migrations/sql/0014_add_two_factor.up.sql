@@ -0,0 +1,27 @@
+ALTER TABLE users ADD COLUMN totp_secret text;
+ALTER TABLE users ADD COLUMN totp_enabled_at timestamptz;
+ALTER TABLE users ADD COLUMN totp_last_step bigint NOT NULL DEFAULT 0;
+
+CREATE TABLE recovery_codes (
+	id bigserial PRIMARY KEY,
+	created_at timestamptz,
+	user_id bigint NOT NULL,
+	code_hash bytea NOT NULL,
+	used_at timestamptz,
+	CONSTRAINT fk_recovery_codes_user FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+
+CREATE INDEX idx_recovery_codes_user_id ON recovery_codes (user_id);
+
+CREATE TABLE login_challenges (
+	id bigserial PRIMARY KEY,
+	created_at timestamptz,
+	user_id bigint NOT NULL,
+	token_hash bytea NOT NULL UNIQUE,
+	cookie boolean NOT NULL DEFAULT false,
+	attempts integer NOT NULL DEFAULT 0,
+	expires_at timestamptz NOT NULL,
+	CONSTRAINT fk_login_challenges_user FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+
+CREATE INDEX idx_login_challenges_expires_at ON login_challenges (expires_at);
@@ -0,0 +1,7 @@
+CREATE TABLE login_failures (
+	key text PRIMARY KEY,
+	failures integer NOT NULL,
+	last_failed_at timestamptz NOT NULL
+);
+
+CREATE INDEX idx_login_failures_last_failed_at ON login_failures (last_failed_at);
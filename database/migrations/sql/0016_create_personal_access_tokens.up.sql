@@ -0,0 +1,14 @@
+CREATE TABLE personal_access_tokens (
+	id bigserial PRIMARY KEY,
+	created_at timestamptz,
+	user_id bigint NOT NULL,
+	name text NOT NULL,
+	token_hash bytea NOT NULL UNIQUE,
+	prefix text NOT NULL,
+	scopes text NOT NULL,
+	last_used_at timestamptz,
+	expires_at timestamptz,
+	CONSTRAINT fk_personal_access_tokens_user FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+
+CREATE INDEX idx_personal_access_tokens_user_id ON personal_access_tokens (user_id);
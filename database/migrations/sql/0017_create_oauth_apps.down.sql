@@ -0,0 +1,6 @@
+DROP INDEX idx_sessions_app_id;
+ALTER TABLE sessions DROP CONSTRAINT fk_sessions_app;
+ALTER TABLE sessions DROP COLUMN scopes;
+ALTER TABLE sessions DROP COLUMN app_id;
+DROP TABLE authorization_codes;
+DROP TABLE oauth_apps;
@@ -0,0 +1,35 @@
+CREATE TABLE oauth_apps (
+	id bigserial PRIMARY KEY,
+	created_at timestamptz,
+	owner_id bigint NOT NULL,
+	name text NOT NULL,
+	client_id text NOT NULL UNIQUE,
+	client_secret_hash bytea,
+	redirect_uris text NOT NULL,
+	CONSTRAINT fk_oauth_apps_owner FOREIGN KEY (owner_id) REFERENCES users (id) ON DELETE CASCADE
+);
+
+CREATE INDEX idx_oauth_apps_owner_id ON oauth_apps (owner_id);
+
+CREATE TABLE authorization_codes (
+	id bigserial PRIMARY KEY,
+	created_at timestamptz,
+	app_id bigint NOT NULL,
+	user_id bigint NOT NULL,
+	code_hash bytea NOT NULL UNIQUE,
+	redirect_uri text NOT NULL DEFAULT '',
+	scopes text NOT NULL,
+	code_challenge text NOT NULL,
+	expires_at timestamptz NOT NULL,
+	CONSTRAINT fk_authorization_codes_app FOREIGN KEY (app_id) REFERENCES oauth_apps (id) ON DELETE CASCADE,
+	CONSTRAINT fk_authorization_codes_user FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+
+CREATE INDEX idx_authorization_codes_expires_at ON authorization_codes (expires_at);
+
+-- Sessions that an app started hold the scopes the user granted it, and
+-- end when the app is deleted.
+ALTER TABLE sessions ADD COLUMN app_id bigint;
+ALTER TABLE sessions ADD COLUMN scopes text NOT NULL DEFAULT '';
+ALTER TABLE sessions ADD CONSTRAINT fk_sessions_app FOREIGN KEY (app_id) REFERENCES oauth_apps (id) ON DELETE CASCADE;
+CREATE INDEX idx_sessions_app_id ON sessions (app_id);
@@ -0,0 +1,14 @@
+CREATE TABLE profiles (
+	user_id bigint PRIMARY KEY,
+	updated_at timestamptz,
+	display_name text NOT NULL DEFAULT '',
+	pronouns text NOT NULL DEFAULT '',
+	country text NOT NULL DEFAULT '',
+	bio text NOT NULL DEFAULT '',
+	timezone text NOT NULL DEFAULT '',
+	avatar_url text NOT NULL DEFAULT '',
+	twitch text NOT NULL DEFAULT '',
+	youtube text NOT NULL DEFAULT '',
+	twitter text NOT NULL DEFAULT '',
+	CONSTRAINT fk_profiles_user FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
@@ -0,0 +1,5 @@
+DROP INDEX idx_username_history_username_lower;
+DROP INDEX idx_users_username_lower;
+
+ALTER TABLE runs DROP COLUMN public_id;
+ALTER TABLE users DROP COLUMN public_id;
@@ -0,0 +1,14 @@
+-- Existing rows get random hex IDs, which fit in the same alphabet as the
+-- base 36 ones the API gives new rows.
+ALTER TABLE users ADD COLUMN public_id text;
+UPDATE users SET public_id = substr(md5(random()::text || id::text), 1, 13);
+ALTER TABLE users ALTER COLUMN public_id SET NOT NULL;
+ALTER TABLE users ADD CONSTRAINT users_public_id_key UNIQUE (public_id);
+
+ALTER TABLE runs ADD COLUMN public_id text;
+UPDATE runs SET public_id = substr(md5(random()::text || id::text), 1, 13);
+ALTER TABLE runs ALTER COLUMN public_id SET NOT NULL;
+ALTER TABLE runs ADD CONSTRAINT runs_public_id_key UNIQUE (public_id);
+
+CREATE INDEX idx_users_username_lower ON users (lower(username));
+CREATE INDEX idx_username_history_username_lower ON username_history (lower(username));
@@ -0,0 +1,8 @@
+CREATE INDEX idx_users_username_lower ON users (lower(username));
+CREATE INDEX idx_username_history_username_lower ON username_history (lower(username));
+
+DROP INDEX idx_username_history_username_canonical;
+ALTER TABLE username_history DROP COLUMN username_canonical;
+
+ALTER TABLE users DROP COLUMN email_canonical;
+ALTER TABLE users DROP COLUMN username_canonical;
@@ -0,0 +1,42 @@
+-- Canonical forms are worked out by the API (see CanonicalUsername and
+-- CanonicalEmail); this backfills them for existing users the same way, with
+-- lower() for case folding, which only differs for a handful of letters,
+-- like ß, that usernames can't have and addresses rarely do.
+ALTER TABLE users ADD COLUMN username_canonical text;
+ALTER TABLE users ADD COLUMN email_canonical text;
+UPDATE users SET
+	username_canonical = replace(replace(translate(lower(normalize(username, NFKC)), '01iıɑɡαικνορυχаеорсухѕіјһӏԁԛԝ', 'olllagalkvopuxaeopcyxsljhldqw'), 'rn', 'm'), 'vv', 'w'),
+	email_canonical = lower(normalize(trim(email), NFKC));
+
+-- Users who registered a name or address that only differs from an older
+-- one by case or lookalike letters keep it, but can't be found by it, which
+-- for an address means they can't log in with it until an admin sorts them
+-- out. Their canonical forms get their ID after a space, which neither can
+-- contain.
+UPDATE users SET username_canonical = username_canonical || ' ' || id
+WHERE EXISTS (
+	SELECT 1 FROM users older
+	WHERE older.username_canonical = users.username_canonical AND older.id < users.id
+);
+UPDATE users SET email_canonical = email_canonical || ' ' || id
+WHERE EXISTS (
+	SELECT 1 FROM users older
+	WHERE older.email_canonical = users.email_canonical AND older.id < users.id
+);
+
+ALTER TABLE users ALTER COLUMN username_canonical SET NOT NULL;
+ALTER TABLE users ALTER COLUMN email_canonical SET NOT NULL;
+ALTER TABLE users ADD CONSTRAINT users_username_canonical_key UNIQUE (username_canonical);
+ALTER TABLE users ADD CONSTRAINT users_email_canonical_key UNIQUE (email_canonical);
+
+-- Old usernames are compared by their canonical form too. They aren't unique,
+-- since a name can be given up by several users in turn.
+ALTER TABLE username_history ADD COLUMN username_canonical text;
+UPDATE username_history SET
+	username_canonical = replace(replace(translate(lower(normalize(username, NFKC)), '01iıɑɡαικνορυχаеорсухѕіјһӏԁԛԝ', 'olllagalkvopuxaeopcyxsljhldqw'), 'rn', 'm'), 'vv', 'w');
+ALTER TABLE username_history ALTER COLUMN username_canonical SET NOT NULL;
+CREATE INDEX idx_username_history_username_canonical ON username_history (username_canonical);
+
+-- Usernames are looked up by their canonical form instead.
+DROP INDEX idx_users_username_lower;
+DROP INDEX idx_username_history_username_lower;
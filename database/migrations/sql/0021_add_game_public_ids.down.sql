@@ -0,0 +1,5 @@
+ALTER TABLE variable_values DROP COLUMN public_id;
+ALTER TABLE variables DROP COLUMN public_id;
+ALTER TABLE levels DROP COLUMN public_id;
+ALTER TABLE categories DROP COLUMN public_id;
+ALTER TABLE games DROP COLUMN public_id;
@@ -0,0 +1,26 @@
+-- Games and everything under them get public IDs the same way users and
+-- runs did in 0019_add_public_ids.
+ALTER TABLE games ADD COLUMN public_id text;
+UPDATE games SET public_id = substr(md5(random()::text || id::text), 1, 13);
+ALTER TABLE games ALTER COLUMN public_id SET NOT NULL;
+ALTER TABLE games ADD CONSTRAINT games_public_id_key UNIQUE (public_id);
+
+ALTER TABLE categories ADD COLUMN public_id text;
+UPDATE categories SET public_id = substr(md5(random()::text || id::text), 1, 13);
+ALTER TABLE categories ALTER COLUMN public_id SET NOT NULL;
+ALTER TABLE categories ADD CONSTRAINT categories_public_id_key UNIQUE (public_id);
+
+ALTER TABLE levels ADD COLUMN public_id text;
+UPDATE levels SET public_id = substr(md5(random()::text || id::text), 1, 13);
+ALTER TABLE levels ALTER COLUMN public_id SET NOT NULL;
+ALTER TABLE levels ADD CONSTRAINT levels_public_id_key UNIQUE (public_id);
+
+ALTER TABLE variables ADD COLUMN public_id text;
+UPDATE variables SET public_id = substr(md5(random()::text || id::text), 1, 13);
+ALTER TABLE variables ALTER COLUMN public_id SET NOT NULL;
+ALTER TABLE variables ADD CONSTRAINT variables_public_id_key UNIQUE (public_id);
+
+ALTER TABLE variable_values ADD COLUMN public_id text;
+UPDATE variable_values SET public_id = substr(md5(random()::text || id::text), 1, 13);
+ALTER TABLE variable_values ALTER COLUMN public_id SET NOT NULL;
+ALTER TABLE variable_values ADD CONSTRAINT variable_values_public_id_key UNIQUE (public_id);
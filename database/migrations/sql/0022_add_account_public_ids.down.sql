@@ -0,0 +1,3 @@
+ALTER TABLE oauth_apps DROP COLUMN public_id;
+ALTER TABLE personal_access_tokens DROP COLUMN public_id;
+ALTER TABLE sessions DROP COLUMN public_id;
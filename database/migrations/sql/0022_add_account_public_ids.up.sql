@@ -0,0 +1,17 @@
+-- Sessions, personal access tokens and apps get public IDs the same way
+-- users and runs did in 0019_add_public_ids, since users address them by
+-- ID to revoke or delete them.
+ALTER TABLE sessions ADD COLUMN public_id text;
+UPDATE sessions SET public_id = substr(md5(random()::text || id::text), 1, 13);
+ALTER TABLE sessions ALTER COLUMN public_id SET NOT NULL;
+ALTER TABLE sessions ADD CONSTRAINT sessions_public_id_key UNIQUE (public_id);
+
+ALTER TABLE personal_access_tokens ADD COLUMN public_id text;
+UPDATE personal_access_tokens SET public_id = substr(md5(random()::text || id::text), 1, 13);
+ALTER TABLE personal_access_tokens ALTER COLUMN public_id SET NOT NULL;
+ALTER TABLE personal_access_tokens ADD CONSTRAINT personal_access_tokens_public_id_key UNIQUE (public_id);
+
+ALTER TABLE oauth_apps ADD COLUMN public_id text;
+UPDATE oauth_apps SET public_id = substr(md5(random()::text || id::text), 1, 13);
+ALTER TABLE oauth_apps ALTER COLUMN public_id SET NOT NULL;
+ALTER TABLE oauth_apps ADD CONSTRAINT oauth_apps_public_id_key UNIQUE (public_id);
@@ -0,0 +1,3 @@
+-- Existing sessions can't tell whether they were logged in to with a code,
+-- so they don't count as having been until their users log in again.
+ALTER TABLE sessions ADD COLUMN two_factor boolean NOT NULL DEFAULT false;
@@ -0,0 +1,51 @@
+package database
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"strconv"
+	"strings"
+)
+
+// The length of public IDs, which is enough to hold 64 bits in base 36.
+const PublicIDLength = 13
+
+// NewPublicID returns a random ID for a row to be known by outside of the
+// database, so that serial IDs, and with them how many rows a table has,
+// aren't exposed. It is 64 random bits in lower case base 36.
+func NewPublicID() (string, error) {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	id := strconv.FormatUint(binary.BigEndian.Uint64(b[:]), 36)
+	return strings.Repeat("0", PublicIDLength-len(id)) + id, nil
+}
+
+// SetPublicID gives a row that is about to be created a public ID in
+// publicId, unless it already has one. It is meant for BeforeCreate hooks.
+func SetPublicID(publicId *string) error {
+	if *publicId != "" {
+		return nil
+	}
+	id, err := NewPublicID()
+	if err != nil {
+		return err
+	}
+	*publicId = id
+	return nil
+}
+
+// IsPublicID reports whether id could be a public ID, so that lookups of
+// ones that can't be are turned away early.
+func IsPublicID(id string) bool {
+	if len(id) != PublicIDLength {
+		return false
+	}
+	for _, r := range id {
+		if (r < '0' || r > '9') && (r < 'a' || r > 'z') {
+			return false
+		}
+	}
+	return true
+}
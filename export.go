@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io"
+	"os"
+	"time"
+
+	"github.com/speedrun-website/leaderboard-backend/server"
+	"github.com/speedrun-website/leaderboard-backend/server/game"
+	"github.com/speedrun-website/leaderboard-backend/server/run"
+)
+
+type exportedGame struct {
+	*game.GameInfo
+	Categories []*game.CategoryInfo `json:"categories"`
+	Levels     []*game.LevelInfo    `json:"levels"`
+	Variables  []*game.VariableInfo `json:"variables"`
+	Runs       []*run.RunInfo       `json:"runs"`
+}
+
+type export struct {
+	ExportedAt time.Time       `json:"exported_at"`
+	Games      []*exportedGame `json:"games"`
+}
+
+// runExport writes every game, or a single one, as JSON along with all
+// of its runs. Only public data is exported, so it can be shared freely.
+func runExport(a *app, args []string) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	gameSlug := flags.String("game", "", "only export this game")
+	output := flags.String("o", "", "write to this file instead of stdout")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		return usageError("export [-game <slug>] [-o <file>]")
+	}
+	if err := server.InitStores(a.db); err != nil {
+		return err
+	}
+
+	var games []game.Game
+	if *gameSlug != "" {
+		g, err := game.Store.GetGameBySlug(*gameSlug)
+		if err != nil {
+			return err
+		}
+		games = append(games, *g)
+	} else {
+		var err error
+		if games, err = game.Store.GetGames(); err != nil {
+			return err
+		}
+	}
+
+	result := export{
+		ExportedAt: time.Now().UTC(),
+		Games:      make([]*exportedGame, len(games)),
+	}
+	for i, g := range games {
+		exported, err := exportGame(g)
+		if err != nil {
+			return err
+		}
+		result.Games[i] = exported
+	}
+
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(result)
+}
+
+func exportGame(g game.Game) (*exportedGame, error) {
+	exported := &exportedGame{
+		GameInfo: g.AsInfo(),
+	}
+
+	categories, err := game.Store.GetCategories(g.ID)
+	if err != nil {
+		return nil, err
+	}
+	exported.Categories = make([]*game.CategoryInfo, len(categories))
+	for i, category := range categories {
+		exported.Categories[i] = category.AsInfo()
+	}
+
+	levels, err := game.Store.GetLevels(g.ID)
+	if err != nil {
+		return nil, err
+	}
+	exported.Levels = make([]*game.LevelInfo, len(levels))
+	for i, level := range levels {
+		exported.Levels[i] = level.AsInfo()
+	}
+
+	variables, err := game.Store.GetGameVariables(g.ID)
+	if err != nil {
+		return nil, err
+	}
+	exported.Variables = make([]*game.VariableInfo, len(variables))
+	for i, variable := range variables {
+		exported.Variables[i] = variable.AsInfo()
+	}
+
+	runs, err := run.Store.GetGameRuns(g.ID)
+	if err != nil {
+		return nil, err
+	}
+	exported.Runs = make([]*run.RunInfo, len(runs))
+	for i, r := range runs {
+		exported.Runs[i] = r.AsInfo()
+	}
+	return exported, nil
+}
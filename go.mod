@@ -3,8 +3,10 @@ module github.com/speedrun-website/leaderboard-backend
 go 1.16
 
 require (
+	github.com/BurntSushi/toml v1.2.1
 	github.com/appleboy/gin-jwt/v2 v2.6.4
-	github.com/gin-gonic/gin v1.7.4
+	github.com/dgrijalva/jwt-go v3.2.0+incompatible
+	github.com/gin-gonic/gin v1.7.7
 	github.com/go-playground/validator/v10 v10.9.0 // indirect
 	github.com/golang/protobuf v1.5.2 // indirect
 	github.com/jackc/pgconn v1.10.0
@@ -16,8 +18,9 @@ require (
 	github.com/ugorji/go v1.2.6 // indirect
 	golang.org/x/crypto v0.0.0-20210915214749-c084706c2272
 	golang.org/x/sys v0.0.0-20210908160347-a851e7ddeee0 // indirect
+	golang.org/x/text v0.3.7
 	google.golang.org/protobuf v1.27.1 // indirect
-	gopkg.in/yaml.v2 v2.4.0 // indirect
+	gopkg.in/yaml.v2 v2.4.0
 	gorm.io/driver/postgres v1.1.1
 	gorm.io/gorm v1.21.15
 )
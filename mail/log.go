@@ -0,0 +1,51 @@
+package mail
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+)
+
+// LogSender writes messages to the standard logger instead of sending them.
+type LogSender struct {
+	From string
+}
+
+func (s LogSender) Send(m Message) error {
+	message, err := format(s.From, m, time.Now())
+	if err != nil {
+		return err
+	}
+	log.Printf("Not sending email:\n%s", message)
+	return nil
+}
+
+// FileSender writes each message to a new .eml file in Dir
+// instead of sending it.
+type FileSender struct {
+	From string
+	Dir  string
+}
+
+func (s FileSender) Send(m Message) error {
+	now := time.Now()
+	message, err := format(s.From, m, now)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.Dir, 0700); err != nil {
+		return err
+	}
+
+	file, err := ioutil.TempFile(s.Dir, fmt.Sprintf("%d-*.eml", now.UnixNano()))
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(message); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,73 @@
+// Package mail sends the emails that accounts need, such as address
+// verification. Senders are chosen by configuration; see NewSender.
+package mail
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"mime"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/speedrun-website/leaderboard-backend/config"
+)
+
+// A Message is a plain text email to a single recipient.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// A Sender delivers messages.
+type Sender interface {
+	Send(Message) error
+}
+
+var ErrInvalidHeader = errors.New("email headers can't contain line breaks")
+
+// NewSender returns the sender for the configured mail driver.
+func NewSender(c config.MailConfig) (Sender, error) {
+	switch c.Driver {
+	case config.MailLog:
+		return LogSender{From: c.From}, nil
+	case config.MailFile:
+		return FileSender{From: c.From, Dir: c.Dir}, nil
+	case config.MailSMTP:
+		return NewSMTPSender(c.From, c.SMTP), nil
+	default:
+		return nil, fmt.Errorf("unknown mail driver %q", c.Driver)
+	}
+}
+
+// format renders m as an RFC 5322 message from from.
+func format(from string, m Message, date time.Time) ([]byte, error) {
+	for _, header := range []string{from, m.To, m.Subject} {
+		if strings.ContainsAny(header, "\r\n") {
+			return nil, ErrInvalidHeader
+		}
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", m.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", m.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", date.Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(m.Body, "\n", "\r\n"))
+	return b.Bytes(), nil
+}
+
+// address returns the bare address in an address like
+// "Name <user@example.com>", for the SMTP envelope.
+func address(addr string) (string, error) {
+	parsed, err := mail.ParseAddress(addr)
+	if err != nil {
+		return "", err
+	}
+	return parsed.Address, nil
+}
@@ -0,0 +1,54 @@
+package mail_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/speedrun-website/leaderboard-backend/mail"
+)
+
+func TestFileSender(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sender := mail.FileSender{From: "noreply@example.com", Dir: dir}
+	err = sender.Send(mail.Message{
+		To:      "runner@example.com",
+		Subject: "Verify your email",
+		Body:    "Hello\nthere",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("expected one message to be written, got %v (%v)", files, err)
+	}
+	contents, err := ioutil.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"To: runner@example.com\r\n", "Subject: Verify your email\r\n", "\r\n\r\nHello\r\nthere"} {
+		if !strings.Contains(string(contents), expected) {
+			t.Fatalf("expected the message to contain %q, got %s", expected, contents)
+		}
+	}
+}
+
+func TestHeaderInjection(t *testing.T) {
+	err := mail.LogSender{From: "noreply@example.com"}.Send(mail.Message{
+		To:      "runner@example.com\r\nBcc: everyone@example.com",
+		Subject: "Hello",
+	})
+	if !errors.Is(err, mail.ErrInvalidHeader) {
+		t.Fatalf("expected %s, got %v", mail.ErrInvalidHeader, err)
+	}
+}
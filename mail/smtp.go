@@ -0,0 +1,46 @@
+package mail
+
+import (
+	"fmt"
+	"net/smtp"
+	"time"
+
+	"github.com/speedrun-website/leaderboard-backend/config"
+)
+
+// SMTPSender sends messages through an SMTP server, using STARTTLS
+// when the server supports it.
+type SMTPSender struct {
+	From string
+	Addr string
+	Auth smtp.Auth
+}
+
+// NewSMTPSender returns a sender for the configured server,
+// authenticating only if a username is set.
+func NewSMTPSender(from string, c config.SMTPConfig) SMTPSender {
+	s := SMTPSender{
+		From: from,
+		Addr: fmt.Sprintf("%s:%d", c.Host, c.Port),
+	}
+	if c.Username != "" {
+		s.Auth = smtp.PlainAuth("", c.Username, c.Password.Reveal(), c.Host)
+	}
+	return s
+}
+
+func (s SMTPSender) Send(m Message) error {
+	message, err := format(s.From, m, time.Now())
+	if err != nil {
+		return err
+	}
+	from, err := address(s.From)
+	if err != nil {
+		return err
+	}
+	to, err := address(m.To)
+	if err != nil {
+		return err
+	}
+	return smtp.SendMail(s.Addr, s.Auth, from, []string{to}, message)
+}
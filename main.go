@@ -1,59 +1,151 @@
 package main
 
 import (
-	"context"
 	"errors"
+	"flag"
+	"fmt"
 	"log"
-	"net/http"
 	"os"
-	"os/signal"
-	"time"
+	"sort"
 
-	"github.com/gin-gonic/gin"
-	"github.com/joho/godotenv"
+	"github.com/speedrun-website/leaderboard-backend/config"
 	"github.com/speedrun-website/leaderboard-backend/database"
-	"github.com/speedrun-website/leaderboard-backend/server"
+	"github.com/speedrun-website/leaderboard-backend/database/migrations"
+	"github.com/speedrun-website/leaderboard-backend/server/game"
+	"github.com/speedrun-website/leaderboard-backend/server/role"
+	"github.com/speedrun-website/leaderboard-backend/server/user"
+	"gorm.io/gorm"
 )
 
+// Exit codes, so that scripts can tell failures apart.
+const (
+	exitOK           = 0
+	exitFailure      = 1
+	exitUsage        = 2
+	exitConfig       = 3
+	exitSchemaBehind = 4
+	exitNotFound     = 5
+	exitConflict     = 6
+)
+
+// An app is what every command runs with: the loaded configuration and,
+// for commands that need it, a database connection.
+type app struct {
+	config *config.Config
+	db     *gorm.DB
+}
+
+// A command is a subcommand of the server binary.
+type command struct {
+	summary  string
+	database bool
+	run      func(a *app, args []string) error
+}
+
+var commands = map[string]command{
+	"serve":         {"run the HTTP server (the default)", true, runServe},
+	"migrate":       {"apply, revert or list database migrations", true, runMigrate},
+	"user":          {"create, promote, ban, unban or delete a user", true, runUser},
+	"purge-deleted": {"permanently remove soft-deleted records", true, runPurgeDeleted},
+	"seed":          {"add demo games for local development", true, runSeed},
+	"export":        {"write games and their runs as JSON", true, runExport},
+	"config":        {"print the configuration, with secrets redacted", false, runConfig},
+}
+
+// errUsage is returned by commands given bad arguments.
+var errUsage = errors.New("invalid arguments")
+
 func main() {
-	if err := godotenv.Load(os.Getenv("ENV")); err != nil {
-		log.Fatal(err)
+	os.Exit(runCommand(os.Args[1:]))
+}
+
+func runCommand(args []string) int {
+	if len(args) > 0 && (args[0] == "help" || args[0] == "-h" || args[0] == "--help") {
+		printUsage()
+		return exitOK
 	}
 
-	if err := database.InitGlobalConnection(); err != nil {
-		log.Fatal(err)
+	// Global flags come before the command, and are part of the configuration.
+	c, args, err := config.Load(args)
+	if err != nil {
+		log.Printf("Configuration error: %s", err)
+		return exitConfig
 	}
 
-	r := gin.Default()
-	server.Init(r)
-	port := os.Getenv("BACKEND_PORT")
-	srv := &http.Server{
-		Addr:    ":" + port,
-		Handler: r,
+	name := "serve"
+	if len(args) > 0 {
+		name, args = args[0], args[1:]
+	}
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", name)
+		printUsage()
+		return exitUsage
 	}
-	go func() {
-		err := srv.ListenAndServe()
-		if err != nil {
-			if errors.Is(err, http.ErrServerClosed) {
-				log.Print("Server shutdown complete!")
-			} else {
-				log.Printf("Server encountered unexpected error: %s", err)
-			}
+
+	a := &app{
+		config: c,
+	}
+	if cmd.database {
+		if a.db, err = database.Connect(c.Database); err != nil {
+			log.Printf("Database connection failed: %s", err)
+			return exitConfig
 		}
-	}()
+	}
+
+	err = cmd.run(a, args)
+	if err != nil && !errors.Is(err, flag.ErrHelp) {
+		log.Printf("%s: %s", name, err)
+	}
+	return exitCode(err)
+}
+
+func runConfig(a *app, args []string) error {
+	if len(args) > 0 {
+		return usageError("config")
+	}
+	fmt.Print(a.config)
+	return nil
+}
 
-	// Wait for interrupt signal to gracefully shutdown
-	quit := make(chan os.Signal, 1)
-	signal.Notify(quit, os.Interrupt)
-	<-quit
-	log.Println("Interrupt received. Server shutting down...")
+func exitCode(err error) int {
+	switch {
+	case err == nil, errors.Is(err, flag.ErrHelp):
+		return exitOK
+	case errors.Is(err, errUsage):
+		return exitUsage
+	case errors.Is(err, migrations.ErrSchemaBehind):
+		return exitSchemaBehind
+	case errors.Is(err, user.ErrUserNotFound),
+		errors.Is(err, game.ErrGameNotFound),
+		errors.Is(err, role.ErrRoleNotFound):
+		return exitNotFound
+	case errors.Is(err, user.ErrUserNotUnique),
+		errors.Is(err, game.ErrGameNotUnique),
+		errors.Is(err, role.ErrRoleNotUnique):
+		return exitConflict
+	}
+	return exitFailure
+}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+func printUsage() {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
 
-	if err := srv.Shutdown(ctx); err != nil {
-		log.Printf("Server forced to shutdown: %s", err)
+	fmt.Fprintln(os.Stderr, "usage: leaderboard-backend [-config <file>] [-port <port>] [-database-url <url>] <command> [arguments]")
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "commands:")
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-15s %s\n", name, commands[name].summary)
 	}
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "Run `leaderboard-backend <command> -h` for a command's arguments.")
+}
 
-	log.Println("Exiting")
+// usageError wraps errUsage with a command's usage line.
+func usageError(usage string) error {
+	return fmt.Errorf("%w\nusage: %s", errUsage, usage)
 }
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/speedrun-website/leaderboard-backend/database/migrations"
+)
+
+const migrateUsage = "migrate up | down [steps] | status"
+
+// runMigrate implements the migrate subcommand. `down` reverts a
+// single migration unless given a number of steps.
+func runMigrate(a *app, args []string) error {
+	if len(args) == 0 {
+		return usageError(migrateUsage)
+	}
+
+	switch args[0] {
+	case "up":
+		applied, err := migrations.Up(a.db)
+		for _, m := range applied {
+			log.Printf("Applied %04d_%s", m.Version, m.Name)
+		}
+		if err == nil && len(applied) == 0 {
+			log.Print("Schema is already up to date")
+		}
+		return err
+
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			n, err := strconv.Atoi(args[1])
+			if err != nil || n < 1 {
+				return usageError(migrateUsage)
+			}
+			steps = n
+		}
+		reverted, err := migrations.Down(a.db, steps)
+		for _, m := range reverted {
+			log.Printf("Reverted %04d_%s", m.Version, m.Name)
+		}
+		return err
+
+	case "status":
+		statuses, err := migrations.Status(a.db)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED")
+		for _, status := range statuses {
+			applied := "pending"
+			if status.AppliedAt != nil {
+				applied = status.AppliedAt.Format("2006-01-02 15:04:05 MST")
+			}
+			fmt.Fprintf(w, "%04d\t%s\t%s\n", status.Version, status.Name, applied)
+		}
+		return w.Flush()
+	}
+
+	return usageError(migrateUsage)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"log"
+
+	"github.com/speedrun-website/leaderboard-backend/database"
+	"github.com/speedrun-website/leaderboard-backend/server"
+	"github.com/speedrun-website/leaderboard-backend/server/game"
+	"github.com/speedrun-website/leaderboard-backend/server/role"
+	"github.com/speedrun-website/leaderboard-backend/server/run"
+	"github.com/speedrun-website/leaderboard-backend/server/user"
+)
+
+// runPurgeDeleted permanently removes soft-deleted records from every
+// store. Stores are purged in dependency order: runs go first, along with
+// the runs of deleted games and users, and role grants must go before
+// their users.
+func runPurgeDeleted(a *app, args []string) error {
+	if len(args) > 0 {
+		return usageError("purge-deleted")
+	}
+	if err := server.InitStores(a.db); err != nil {
+		return err
+	}
+
+	stores := []struct {
+		name  string
+		store database.DataStore
+	}{
+		{"runs", run.Store},
+		{"games", game.Store},
+		{"roles", role.Store},
+		{"users", user.Store},
+	}
+	for _, s := range stores {
+		if err := s.store.DumpDeleted(); err != nil {
+			return err
+		}
+		log.Printf("Purged deleted %s", s.name)
+	}
+	return nil
+}
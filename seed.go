@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"log"
+
+	"github.com/speedrun-website/leaderboard-backend/server"
+	"github.com/speedrun-website/leaderboard-backend/server/game"
+)
+
+// seedGame is a demo game along with everything in it.
+type seedGame struct {
+	game       game.Game
+	categories []game.Category
+	levels     []game.Level
+	variables  []game.Variable
+}
+
+var seedGames = []seedGame{
+	{
+		game: game.Game{Name: "Super Mario 64", Slug: "sm64"},
+		categories: []game.Category{
+			{Name: "120 Star", Slug: "120-star", PrimaryTiming: game.RealTime},
+			{Name: "70 Star", Slug: "70-star", PrimaryTiming: game.RealTime},
+			{Name: "16 Star", Slug: "16-star", PrimaryTiming: game.RealTime},
+		},
+		levels: []game.Level{
+			{Name: "Bob-omb Battlefield", Slug: "bob"},
+			{Name: "Whomp's Fortress", Slug: "wf"},
+		},
+		variables: []game.Variable{
+			{
+				Name:          "Platform",
+				IsSubcategory: true,
+				Required:      true,
+				Values: []game.VariableValue{
+					{Label: "N64"},
+					{Label: "Virtual Console"},
+				},
+			},
+		},
+	},
+	{
+		game: game.Game{Name: "Celeste", Slug: "celeste"},
+		categories: []game.Category{
+			{
+				Name:          "Any%",
+				Slug:          "any",
+				PrimaryTiming: game.RealTime,
+				Timings:       game.TimingMethods{game.RealTime, game.GameTime},
+			},
+		},
+		levels: []game.Level{
+			{Name: "Forsaken City", Slug: "forsaken-city"},
+		},
+	},
+}
+
+// runSeed adds demo games for local development. Games that already
+// exist are skipped, so seeding can be run repeatedly.
+func runSeed(a *app, args []string) error {
+	if len(args) > 0 {
+		return usageError("seed")
+	}
+	if err := server.InitStores(a.db); err != nil {
+		return err
+	}
+
+	for _, seed := range seedGames {
+		g := seed.game
+		if err := game.Store.CreateGame(&g); err != nil {
+			if errors.Is(err, game.ErrGameNotUnique) {
+				log.Printf("Skipping %s, which already exists", g.Slug)
+				continue
+			}
+			return err
+		}
+
+		for _, category := range seed.categories {
+			category.GameID = g.ID
+			if err := game.Store.CreateCategory(&category); err != nil {
+				return err
+			}
+		}
+		for _, level := range seed.levels {
+			level.GameID = g.ID
+			if err := game.Store.CreateLevel(&level); err != nil {
+				return err
+			}
+		}
+		for _, variable := range seed.variables {
+			variable.GameID = g.ID
+			variable.Values = append([]game.VariableValue(nil), variable.Values...)
+			if err := game.Store.CreateVariable(&variable); err != nil {
+				return err
+			}
+		}
+		log.Printf("Seeded %s", g.Slug)
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/speedrun-website/leaderboard-backend/server"
+)
+
+func runServe(a *app, args []string) error {
+	if len(args) > 0 {
+		return usageError("serve")
+	}
+
+	log.Printf("Starting with configuration:\n%s", a.config)
+
+	r := gin.Default()
+	// Client IPs are used to throttle logins, so forwarded ones are only
+	// believed from the proxies we run.
+	if err := r.SetTrustedProxies(a.config.Server.TrustedProxies); err != nil {
+		return err
+	}
+	if err := server.Init(r, a.config, a.db); err != nil {
+		return err
+	}
+	srv := &http.Server{
+		Addr:    fmt.Sprintf(":%d", a.config.Server.Port),
+		Handler: r,
+	}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- srv.ListenAndServe()
+	}()
+
+	// Wait for interrupt signal to gracefully shutdown
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, os.Interrupt)
+	select {
+	case err := <-serveErr:
+		log.Printf("Server encountered unexpected error: %s", err)
+		return err
+	case <-quit:
+	}
+	log.Println("Interrupt received. Server shutting down...")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("Server forced to shutdown: %s", err)
+		return err
+	}
+	if err := <-serveErr; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	log.Print("Server shutdown complete!")
+
+	log.Println("Exiting")
+	return nil
+}
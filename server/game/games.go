@@ -0,0 +1,271 @@
+package game
+
+import (
+	"errors"
+	"regexp"
+
+	"github.com/speedrun-website/leaderboard-backend/database"
+	"gorm.io/gorm"
+)
+
+// A Game is the top level of a leaderboard. Runs are always
+// submitted to one of its categories, and optionally one of its levels.
+type Game struct {
+	gorm.Model
+	PublicID   string `gorm:"unique"`
+	Name       string
+	Slug       string `gorm:"unique"`
+	Categories []Category
+	Levels     []Level
+}
+
+// A Category is a full-game ruleset that runs are ranked in.
+// Runs may be timed with any of the category's Timings, and are ranked
+// by its PrimaryTiming unless another allowed timing is asked for.
+type Category struct {
+	gorm.Model
+	PublicID      string `gorm:"unique"`
+	GameID        uint   `gorm:"uniqueIndex:idx_categories_game_slug"`
+	Name          string
+	Slug          string `gorm:"uniqueIndex:idx_categories_game_slug"`
+	Rules         string
+	PrimaryTiming TimingMethod  `gorm:"default:realtime"`
+	Timings       TimingMethods `gorm:"type:text"`
+}
+
+// A Level is an individual part of a game that can be run on its own.
+type Level struct {
+	gorm.Model
+	PublicID string `gorm:"unique"`
+	GameID   uint   `gorm:"uniqueIndex:idx_levels_game_slug"`
+	Name     string
+	Slug     string `gorm:"uniqueIndex:idx_levels_game_slug"`
+	Rules    string
+}
+
+// A Variable is an extra property of a run, such as its platform or
+// difficulty. Variables without a CategoryID apply to every category in
+// their game. Sub-category variables split a category's leaderboard into
+// separate boards and are always required; other variables only filter it.
+type Variable struct {
+	gorm.Model
+	PublicID      string `gorm:"unique"`
+	GameID        uint   `gorm:"index"`
+	CategoryID    *uint
+	Category      *Category
+	Name          string
+	IsSubcategory bool
+	Required      bool
+	Values        []VariableValue
+}
+
+// A VariableValue is one of the values a run can have for a variable.
+type VariableValue struct {
+	gorm.Model
+	PublicID   string `gorm:"unique"`
+	VariableID uint   `gorm:"index"`
+	Label      string
+}
+
+func (g *Game) BeforeCreate(tx *gorm.DB) error {
+	return database.SetPublicID(&g.PublicID)
+}
+
+func (c *Category) BeforeCreate(tx *gorm.DB) error {
+	return database.SetPublicID(&c.PublicID)
+}
+
+func (l *Level) BeforeCreate(tx *gorm.DB) error {
+	return database.SetPublicID(&l.PublicID)
+}
+
+func (v *Variable) BeforeCreate(tx *gorm.DB) error {
+	return database.SetPublicID(&v.PublicID)
+}
+
+func (v *VariableValue) BeforeCreate(tx *gorm.DB) error {
+	return database.SetPublicID(&v.PublicID)
+}
+
+type GameInfo struct {
+	ID       uint   `json:"-"`
+	PublicID string `json:"id"`
+	Name     string `json:"name"`
+	Slug     string `json:"slug"`
+}
+
+type CategoryInfo struct {
+	ID            uint          `json:"-"`
+	PublicID      string        `json:"id"`
+	GameID        uint          `json:"-"`
+	Name          string        `json:"name"`
+	Slug          string        `json:"slug"`
+	Rules         string        `json:"rules"`
+	PrimaryTiming TimingMethod  `json:"primary_timing"`
+	Timings       TimingMethods `json:"timings"`
+}
+
+type LevelInfo struct {
+	ID       uint   `json:"-"`
+	PublicID string `json:"id"`
+	GameID   uint   `json:"-"`
+	Name     string `json:"name"`
+	Slug     string `json:"slug"`
+	Rules    string `json:"rules"`
+}
+
+// Category is the slug of the category that the variable applies to,
+// and is left out for game-wide variables.
+type VariableInfo struct {
+	ID            uint                 `json:"-"`
+	PublicID      string               `json:"id"`
+	CategoryID    *uint                `json:"-"`
+	Category      string               `json:"category,omitempty"`
+	Name          string               `json:"name"`
+	IsSubcategory bool                 `json:"is_subcategory"`
+	Required      bool                 `json:"required"`
+	Values        []*VariableValueInfo `json:"values"`
+}
+
+type VariableValueInfo struct {
+	ID       uint   `json:"-"`
+	PublicID string `json:"id"`
+	Label    string `json:"label"`
+}
+
+func (g Game) AsInfo() *GameInfo {
+	return &GameInfo{
+		ID:       g.ID,
+		PublicID: g.PublicID,
+		Name:     g.Name,
+		Slug:     g.Slug,
+	}
+}
+
+func (c Category) AsInfo() *CategoryInfo {
+	return &CategoryInfo{
+		ID:            c.ID,
+		PublicID:      c.PublicID,
+		GameID:        c.GameID,
+		Name:          c.Name,
+		Slug:          c.Slug,
+		Rules:         c.Rules,
+		PrimaryTiming: c.PrimaryTiming,
+		Timings:       c.AllowedTimings(),
+	}
+}
+
+func (l Level) AsInfo() *LevelInfo {
+	return &LevelInfo{
+		ID:       l.ID,
+		PublicID: l.PublicID,
+		GameID:   l.GameID,
+		Name:     l.Name,
+		Slug:     l.Slug,
+		Rules:    l.Rules,
+	}
+}
+
+// AsInfo expects the variable's Values, and Category if it has one,
+// to be loaded.
+func (v Variable) AsInfo() *VariableInfo {
+	values := make([]*VariableValueInfo, len(v.Values))
+	for i, value := range v.Values {
+		values[i] = &VariableValueInfo{
+			ID:       value.ID,
+			PublicID: value.PublicID,
+			Label:    value.Label,
+		}
+	}
+	info := &VariableInfo{
+		ID:            v.ID,
+		PublicID:      v.PublicID,
+		CategoryID:    v.CategoryID,
+		Name:          v.Name,
+		IsSubcategory: v.IsSubcategory,
+		Required:      v.Required,
+		Values:        values,
+	}
+	if v.Category != nil {
+		info.Category = v.Category.Slug
+	}
+	return info
+}
+
+// ValueByPublicID returns the variable's value with the public ID
+// publicId, if it has one.
+func (v Variable) ValueByPublicID(publicId string) (*VariableValue, bool) {
+	for i := range v.Values {
+		if v.Values[i].PublicID == publicId {
+			return &v.Values[i], true
+		}
+	}
+	return nil, false
+}
+
+var slugPattern = regexp.MustCompile(`^[a-z0-9]+(?:-[a-z0-9]+)*$`)
+
+// IsValidSlug reports whether s can be used as a slug in a URL.
+// Slugs are lowercase alphanumeric words separated by single hyphens.
+func IsValidSlug(s string) bool {
+	return len(s) <= 64 && slugPattern.MatchString(s)
+}
+
+// The globally exported GameStore that the application will use.
+var Store GameStore
+
+// The GameStore interface, which defines ways that the application
+// can query for games and their categories and levels.
+type GameStore interface {
+	database.DataStore
+
+	GetGames() ([]Game, error)
+	GetGameBySlug(string) (*Game, error)
+	CreateGame(*Game) error
+	// UpdateGame saves the game's name and slug.
+	UpdateGame(*Game) error
+	DeleteGame(uint) error
+
+	GetCategories(gameId uint) ([]Category, error)
+	GetCategoryBySlug(gameId uint, slug string) (*Category, error)
+	CreateCategory(*Category) error
+	// UpdateCategory saves the category's name, slug, rules and timings.
+	UpdateCategory(*Category) error
+	// DeleteCategory deletes the category along with the variables that
+	// only apply to it.
+	DeleteCategory(categoryId uint) error
+
+	GetLevels(gameId uint) ([]Level, error)
+	GetLevelBySlug(gameId uint, slug string) (*Level, error)
+	CreateLevel(*Level) error
+	// UpdateLevel saves the level's name, slug and rules.
+	UpdateLevel(*Level) error
+	DeleteLevel(levelId uint) error
+
+	// GetVariables returns the variables that apply to a category,
+	// both game-wide and category specific, with their values loaded.
+	GetVariables(gameId uint, categoryId uint) ([]Variable, error)
+	GetGameVariables(gameId uint) ([]Variable, error)
+	// CreateVariable creates a variable along with its values. Existing
+	// runs that a new sub-category applies to get its first value.
+	CreateVariable(*Variable) error
+}
+
+// Errors
+var ErrGameNotFound = errors.New("the requested game was not found")
+var ErrCategoryNotFound = errors.New("the requested category was not found")
+var ErrLevelNotFound = errors.New("the requested level was not found")
+
+var ErrGameNotUnique = errors.New("attempted to create a game with a duplicate slug")
+var ErrCategoryNotUnique = errors.New("attempted to create a category with a duplicate slug")
+var ErrLevelNotUnique = errors.New("attempted to create a level with a duplicate slug")
+
+var ErrInvalidSlug = errors.New("slugs may only contain lowercase letters, digits and single hyphens")
+
+type GameCreationError struct {
+	Err error
+}
+
+func (e GameCreationError) Error() string {
+	return "the game data creation failed with the following error: " + e.Err.Error()
+}
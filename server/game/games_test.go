@@ -0,0 +1,598 @@
+package game_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/joho/godotenv"
+	"github.com/speedrun-website/leaderboard-backend/config"
+	"github.com/speedrun-website/leaderboard-backend/database"
+	"github.com/speedrun-website/leaderboard-backend/database/migrations"
+	"github.com/speedrun-website/leaderboard-backend/server/game"
+	"github.com/speedrun-website/leaderboard-backend/server/request"
+	"github.com/speedrun-website/leaderboard-backend/server/role"
+	"github.com/speedrun-website/leaderboard-backend/server/user"
+)
+
+func getEnvPath() string {
+	return fmt.Sprintf("../../%s", os.Getenv("ENV"))
+}
+
+func init() {
+	if err := godotenv.Load(getEnvPath()); err != nil {
+		log.Fatalf("Where's the .env file?")
+	}
+
+	if err := database.InitGlobalTestConnection(); err != nil {
+		log.Fatalf("DB failed to initialise.")
+	}
+	if _, err := migrations.Up(database.DB); err != nil {
+		log.Fatalf("Migrations failed: %s", err)
+	}
+
+	if err := user.InitGormStore(nil); err != nil {
+		log.Fatalf("User store failed to initialise.")
+	}
+	if err := role.InitGormStore(nil); err != nil {
+		log.Fatalf("Role store failed to initialise.")
+	}
+	if err := game.InitGormStore(nil); err != nil {
+		log.Fatalf("Gorm store failed to initialise.")
+	}
+}
+
+func TestGameFlow(t *testing.T) {
+	t.Parallel()
+
+	r, authMiddleware := getGamesContext()
+	creator := createUser(t, "GameCreator")
+	outsider := createUser(t, "GameOutsider")
+	defer cleanupUsers(t, creator, outsider)
+	if err := role.Store.GrantSiteRole(creator.ID, role.Staff); err != nil {
+		t.Fatalf("granting staff failed: %s", err)
+	}
+	token := generateToken(t, authMiddleware, creator)
+	outsiderToken := generateToken(t, authMiddleware, outsider)
+
+	cleanup := []uint{}
+	t.Run("Create and read a game", func(t *testing.T) {
+		responseBytes, err := testJsonPostRequest(r, "/games", token, game.GameCreate{
+			Name: "Super Mario 64",
+			Slug: "sm64",
+		}, http.StatusCreated)
+		if err != nil {
+			t.Fatalf("creating game failed: %s", err)
+		}
+		var created game.GameResponse
+		if _, err := request.UnmarshalSuccessResponseData(responseBytes, &created); err != nil {
+			t.Fatal("bad response format")
+		}
+		stored, err := game.Store.GetGameBySlug(created.Game.Slug)
+		if err != nil {
+			t.Fatalf("finding game failed: %s", err)
+		}
+		cleanup = append(cleanup, stored.ID)
+		if !database.IsPublicID(created.Game.PublicID) || created.Game.PublicID != stored.PublicID {
+			t.Fatalf("expected the game's public ID %s, got %q", stored.PublicID, created.Game.PublicID)
+		}
+
+		_, err = testJsonPostRequest(r, "/games/sm64/categories", token, game.CategoryCreate{
+			Name: "120 Star",
+			Slug: "120-star",
+		}, http.StatusCreated)
+		if err != nil {
+			t.Fatalf("creating category failed: %s", err)
+		}
+
+		_, err = testJsonPostRequest(r, "/games/sm64/levels", token, game.LevelCreate{
+			Name: "Bob-omb Battlefield",
+			Slug: "bob",
+		}, http.StatusCreated)
+		if err != nil {
+			t.Fatalf("creating level failed: %s", err)
+		}
+
+		responseBytes, err = testGetRequest(r, "/games/sm64", http.StatusOK)
+		if err != nil {
+			t.Fatalf("getting game failed: %s", err)
+		}
+		var fetched game.GameResponse
+		if _, err := request.UnmarshalSuccessResponseData(responseBytes, &fetched); err != nil {
+			t.Fatal("bad response format")
+		}
+		if fetched.Game.Name != "Super Mario 64" {
+			t.Fatalf("expected game name %q, got %q", "Super Mario 64", fetched.Game.Name)
+		}
+
+		responseBytes, err = testGetRequest(r, "/games/sm64/categories", http.StatusOK)
+		if err != nil {
+			t.Fatalf("getting categories failed: %s", err)
+		}
+		var categories game.CategoriesResponse
+		if _, err := request.UnmarshalSuccessResponseData(responseBytes, &categories); err != nil {
+			t.Fatal("bad response format")
+		}
+		if len(categories.Categories) != 1 || categories.Categories[0].Slug != "120-star" {
+			t.Fatalf("unexpected categories: %v", categories.Categories)
+		}
+		if timings := categories.Categories[0].Timings; len(timings) != 1 || timings[0] != game.RealTime {
+			t.Fatalf("expected only real time to be allowed, got %v", timings)
+		}
+
+		responseBytes, err = testGetRequest(r, "/games/sm64/levels", http.StatusOK)
+		if err != nil {
+			t.Fatalf("getting levels failed: %s", err)
+		}
+		var levels game.LevelsResponse
+		if _, err := request.UnmarshalSuccessResponseData(responseBytes, &levels); err != nil {
+			t.Fatal("bad response format")
+		}
+		if len(levels.Levels) != 1 || levels.Levels[0].Slug != "bob" {
+			t.Fatalf("unexpected levels: %v", levels.Levels)
+		}
+
+		_, err = testJsonPostRequest(r, "/games/sm64/categories", token, game.CategoryCreate{
+			Name:          "16 Star",
+			Slug:          "16-star",
+			PrimaryTiming: game.GameTime,
+			Timings:       game.TimingMethods{game.RealTime, game.RealTimeNoLoads},
+		}, http.StatusBadRequest)
+		if err != nil {
+			t.Fatalf("category with disallowed primary timing: %s", err)
+		}
+
+		_, err = testJsonPostRequest(r, "/games/sm64/categories", token, game.CategoryCreate{
+			Name: "120 Star again",
+			Slug: "120-star",
+		}, http.StatusConflict)
+		if err != nil {
+			t.Fatalf("duplicate category: %s", err)
+		}
+
+		_, err = testJsonPostRequest(r, "/games/sm64/levels", outsiderToken, game.LevelCreate{
+			Name: "Whomp's Fortress",
+			Slug: "wf",
+		}, http.StatusForbidden)
+		if err != nil {
+			t.Fatalf("non-moderator level: %s", err)
+		}
+
+		_, err = testJsonPostRequest(r, "/games/sm64/roles", outsiderToken, game.GameRoleCreate{
+			UserID: outsider.PublicID,
+			Role:   string(role.Moderator),
+		}, http.StatusForbidden)
+		if err != nil {
+			t.Fatalf("self-granted moderator: %s", err)
+		}
+
+		_, err = testJsonPostRequest(r, "/games/sm64/roles", token, game.GameRoleCreate{
+			UserID: outsider.PublicID,
+			Role:   string(role.Moderator),
+		}, http.StatusCreated)
+		if err != nil {
+			t.Fatalf("adding moderator failed: %s", err)
+		}
+		grants, err := role.Store.GetUserGameRoleGrants(outsider.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(grants) != 1 || grants[0].AsInfo().Game != "sm64" {
+			t.Fatalf("expected the outsider to moderate sm64, got %+v", grants)
+		}
+
+		_, err = testJsonPostRequest(r, "/games/sm64/levels", outsiderToken, game.LevelCreate{
+			Name: "Whomp's Fortress",
+			Slug: "wf",
+		}, http.StatusCreated)
+		if err != nil {
+			t.Fatalf("new moderator level: %s", err)
+		}
+	})
+	if err := cleanupGames(cleanup); err != nil {
+		t.Fatalf("cleanup failed: %s", err)
+	}
+}
+
+func TestPOSTGame400(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name string
+		body game.GameCreate
+	}{
+		{
+			name: "Missing name",
+			body: game.GameCreate{
+				Slug: "no-name",
+			},
+		},
+		{
+			name: "Uppercase slug",
+			body: game.GameCreate{
+				Name: "Bad Slug",
+				Slug: "BadSlug",
+			},
+		},
+		{
+			name: "Slug with spaces",
+			body: game.GameCreate{
+				Name: "Bad Slug",
+				Slug: "bad slug",
+			},
+		},
+	}
+
+	r, authMiddleware := getGamesContext()
+	u := createUser(t, "BadGameCreator")
+	defer cleanupUsers(t, u)
+	if err := role.Store.GrantSiteRole(u.ID, role.Staff); err != nil {
+		t.Fatalf("granting staff failed: %s", err)
+	}
+	token := generateToken(t, authMiddleware, u)
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			_, err := testJsonPostRequest(r, "/games", token, testCase.body, http.StatusBadRequest)
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestPOSTGame403(t *testing.T) {
+	t.Parallel()
+
+	r, authMiddleware := getGamesContext()
+	u := createUser(t, "NotStaff")
+	defer cleanupUsers(t, u)
+	token := generateToken(t, authMiddleware, u)
+
+	_, err := testJsonPostRequest(r, "/games", token, game.GameCreate{
+		Name: "Not Allowed",
+		Slug: "not-allowed",
+	}, http.StatusForbidden)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGameUpdateAndDelete(t *testing.T) {
+	t.Parallel()
+
+	r, authMiddleware := getGamesContext()
+	creator := createUser(t, "GameEditor")
+	outsider := createUser(t, "GameEditOutsider")
+	defer cleanupUsers(t, creator, outsider)
+	if err := role.Store.GrantSiteRole(creator.ID, role.Staff); err != nil {
+		t.Fatalf("granting staff failed: %s", err)
+	}
+	token := generateToken(t, authMiddleware, creator)
+	outsiderToken := generateToken(t, authMiddleware, outsider)
+
+	cleanup := []uint{}
+	t.Run("Update and delete a game", func(t *testing.T) {
+		for _, create := range []game.GameCreate{
+			{Name: "Ocarina of Time", Slug: "oot"},
+			{Name: "Majora's Mask", Slug: "mm"},
+		} {
+			if _, err := testJsonPostRequest(r, "/games", token, create, http.StatusCreated); err != nil {
+				t.Fatalf("creating game failed: %s", err)
+			}
+			stored, err := game.Store.GetGameBySlug(create.Slug)
+			if err != nil {
+				t.Fatalf("finding game failed: %s", err)
+			}
+			cleanup = append(cleanup, stored.ID)
+		}
+		for _, create := range []game.CategoryCreate{
+			{Name: "Any%", Slug: "any"},
+			{Name: "100%", Slug: "100"},
+		} {
+			if _, err := testJsonPostRequest(r, "/games/oot/categories", token, create, http.StatusCreated); err != nil {
+				t.Fatalf("creating category failed: %s", err)
+			}
+		}
+		for _, create := range []game.LevelCreate{
+			{Name: "Deku Tree", Slug: "deku"},
+			{Name: "Dodongo's Cavern", Slug: "dc"},
+		} {
+			if _, err := testJsonPostRequest(r, "/games/oot/levels", token, create, http.StatusCreated); err != nil {
+				t.Fatalf("creating level failed: %s", err)
+			}
+		}
+
+		name := "The Legend of Zelda: Ocarina of Time"
+		responseBytes, err := testJsonRequest(r, http.MethodPatch, "/games/oot", token, game.GameUpdate{
+			Name: &name,
+		}, http.StatusOK)
+		if err != nil {
+			t.Fatalf("updating game failed: %s", err)
+		}
+		var updatedGame game.GameResponse
+		if _, err := request.UnmarshalSuccessResponseData(responseBytes, &updatedGame); err != nil {
+			t.Fatal("bad response format")
+		}
+		if updatedGame.Game.Name != name || updatedGame.Game.Slug != "oot" {
+			t.Fatalf("unexpected game: %+v", updatedGame.Game)
+		}
+
+		taken := "mm"
+		_, err = testJsonRequest(r, http.MethodPatch, "/games/oot", token, game.GameUpdate{
+			Slug: &taken,
+		}, http.StatusConflict)
+		if err != nil {
+			t.Fatalf("duplicate game slug: %s", err)
+		}
+
+		primary := game.GameTime
+		responseBytes, err = testJsonRequest(r, http.MethodPatch, "/games/oot/categories/any", token, game.CategoryUpdate{
+			PrimaryTiming: &primary,
+			Timings:       game.TimingMethods{game.RealTime, game.GameTime},
+		}, http.StatusOK)
+		if err != nil {
+			t.Fatalf("updating category failed: %s", err)
+		}
+		var updatedCategory game.CategoryResponse
+		if _, err := request.UnmarshalSuccessResponseData(responseBytes, &updatedCategory); err != nil {
+			t.Fatal("bad response format")
+		}
+		if updatedCategory.Category.PrimaryTiming != game.GameTime || len(updatedCategory.Category.Timings) != 2 {
+			t.Fatalf("unexpected category timings: %+v", updatedCategory.Category)
+		}
+
+		_, err = testJsonRequest(r, http.MethodPatch, "/games/oot/categories/any", token, game.CategoryUpdate{
+			Timings: game.TimingMethods{game.RealTime},
+		}, http.StatusBadRequest)
+		if err != nil {
+			t.Fatalf("dropping the primary timing: %s", err)
+		}
+
+		taken = "100"
+		_, err = testJsonRequest(r, http.MethodPatch, "/games/oot/categories/any", token, game.CategoryUpdate{
+			Slug: &taken,
+		}, http.StatusConflict)
+		if err != nil {
+			t.Fatalf("duplicate category slug: %s", err)
+		}
+
+		slug := "deku-tree"
+		responseBytes, err = testJsonRequest(r, http.MethodPatch, "/games/oot/levels/deku", token, game.LevelUpdate{
+			Slug: &slug,
+		}, http.StatusOK)
+		if err != nil {
+			t.Fatalf("updating level failed: %s", err)
+		}
+		var updatedLevel game.LevelResponse
+		if _, err := request.UnmarshalSuccessResponseData(responseBytes, &updatedLevel); err != nil {
+			t.Fatal("bad response format")
+		}
+		if updatedLevel.Level.Slug != slug || updatedLevel.Level.Name != "Deku Tree" {
+			t.Fatalf("unexpected level: %+v", updatedLevel.Level)
+		}
+
+		taken = "dc"
+		_, err = testJsonRequest(r, http.MethodPatch, "/games/oot/levels/deku-tree", token, game.LevelUpdate{
+			Slug: &taken,
+		}, http.StatusConflict)
+		if err != nil {
+			t.Fatalf("duplicate level slug: %s", err)
+		}
+
+		for _, target := range []string{
+			"/games/oot/categories/any",
+			"/games/oot/levels/deku-tree",
+			"/games/oot",
+		} {
+			_, err = testJsonRequest(r, http.MethodDelete, target, outsiderToken, nil, http.StatusForbidden)
+			if err != nil {
+				t.Fatalf("non-moderator delete of %s: %s", target, err)
+			}
+		}
+		_, err = testJsonRequest(r, http.MethodPatch, "/games/oot", outsiderToken, game.GameUpdate{
+			Name: &name,
+		}, http.StatusForbidden)
+		if err != nil {
+			t.Fatalf("non-moderator update: %s", err)
+		}
+
+		for _, target := range []string{
+			"/games/oot/categories/any",
+			"/games/oot/levels/deku-tree",
+		} {
+			_, err = testJsonRequest(r, http.MethodDelete, target, token, nil, http.StatusNoContent)
+			if err != nil {
+				t.Fatalf("deleting %s failed: %s", target, err)
+			}
+		}
+		categories, err := game.Store.GetCategories(cleanup[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(categories) != 1 || categories[0].Slug != "100" {
+			t.Fatalf("expected only the 100%% category to remain, got %v", categories)
+		}
+		levels, err := game.Store.GetLevels(cleanup[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(levels) != 1 || levels[0].Slug != "dc" {
+			t.Fatalf("expected only Dodongo's Cavern to remain, got %v", levels)
+		}
+
+		_, err = testJsonRequest(r, http.MethodDelete, "/games/oot", token, nil, http.StatusNoContent)
+		if err != nil {
+			t.Fatalf("deleting game failed: %s", err)
+		}
+		_, err = testGetRequest(r, "/games/oot", http.StatusNotFound)
+		if err != nil {
+			t.Fatalf("deleted game: %s", err)
+		}
+	})
+	if err := cleanupGames(cleanup); err != nil {
+		t.Fatalf("cleanup failed: %s", err)
+	}
+}
+
+func TestGetGame404(t *testing.T) {
+	t.Parallel()
+
+	r, _ := getGamesContext()
+
+	for _, target := range []string{
+		"/games/not-a-game",
+		"/games/not-a-game/categories",
+		"/games/not-a-game/levels",
+	} {
+		t.Run(target, func(t *testing.T) {
+			_, err := testGetRequest(r, target, http.StatusNotFound)
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func getGamesContext() (*gin.Engine, *user.AuthMiddleware) {
+	w := httptest.NewRecorder()
+	_, r := gin.CreateTestContext(w)
+	api := r.Group("/")
+	auth := config.Default().Auth
+	auth.JWTSecret = "a test secret that is long enough"
+	authMiddleware, err := user.NewAuthMiddleware(auth)
+	if err != nil {
+		log.Fatal(err)
+	}
+	game.PublicRoutes(api)
+	api.Use(authMiddleware.MiddlewareFunc())
+	{
+		game.AuthRoutes(api)
+	}
+	return r, authMiddleware
+}
+
+func createUser(t *testing.T, username string) *user.User {
+	t.Helper()
+
+	hash, err := user.HashAndSaltPassword([]byte("beepboopbop"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := &user.User{
+		Username: username,
+		Email:    username + "@email.com",
+		Password: hash,
+	}
+	if err := user.Store.CreateUser(u); err != nil {
+		t.Fatalf("creating user failed: %s", err)
+	}
+	return u
+}
+
+func generateToken(t *testing.T, authMiddleware *user.AuthMiddleware, u *user.User) string {
+	t.Helper()
+
+	token, _, err := authMiddleware.TokenGenerator(u.AsPersonal())
+	if err != nil {
+		t.Fatalf("token generation failed: %s", err)
+	}
+	return token
+}
+
+func testJsonPostRequest(
+	r *gin.Engine,
+	target string,
+	token string,
+	content interface{},
+	expectedStatusCode int,
+) ([]byte, error) {
+	return testJsonRequest(r, http.MethodPost, target, token, content, expectedStatusCode)
+}
+
+func testJsonRequest(
+	r *gin.Engine,
+	method string,
+	target string,
+	token string,
+	content interface{},
+	expectedStatusCode int,
+) ([]byte, error) {
+	reqBodyBytes, err := json.Marshal(content)
+	if err != nil {
+		return nil, fmt.Errorf(
+			"could not marshal %s into json",
+			content,
+		)
+	}
+	reqBodyBuffer := ioutil.NopCloser(bytes.NewBuffer(reqBodyBytes))
+	req := httptest.NewRequest(method, target, reqBodyBuffer)
+	if token != "" {
+		req.Header.Add("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	res := w.Result()
+	if res.StatusCode != expectedStatusCode {
+		return nil, fmt.Errorf(
+			"expected status code %d, got %d",
+			expectedStatusCode,
+			res.StatusCode,
+		)
+	}
+	return w.Body.Bytes(), nil
+}
+
+func testGetRequest(
+	r *gin.Engine,
+	target string,
+	expectedStatusCode int,
+) ([]byte, error) {
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	res := w.Result()
+	if res.StatusCode != expectedStatusCode {
+		return nil, fmt.Errorf(
+			"expected status code %d, got %d",
+			expectedStatusCode,
+			res.StatusCode,
+		)
+	}
+	return w.Body.Bytes(), nil
+}
+
+func cleanupGames(gamesToDelete []uint) error {
+	for _, id := range gamesToDelete {
+		if err := game.Store.DeleteGame(id); err != nil {
+			return err
+		}
+		if err := game.Store.DumpDeleted(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func cleanupUsers(t *testing.T, users ...*user.User) {
+	t.Helper()
+
+	for _, u := range users {
+		if err := user.Store.DeleteUser(u.ID); err != nil {
+			t.Fatalf("cleanup failed: %s", err)
+		}
+	}
+	if err := role.Store.DumpDeleted(); err != nil {
+		t.Fatalf("cleanup failed: %s", err)
+	}
+	if err := user.Store.DumpDeleted(); err != nil {
+		t.Fatalf("cleanup failed: %s", err)
+	}
+}
@@ -0,0 +1,263 @@
+package game
+
+import (
+	"errors"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgerrcode"
+	"github.com/speedrun-website/leaderboard-backend/database"
+	"github.com/speedrun-website/leaderboard-backend/server/role"
+	"gorm.io/gorm"
+)
+
+type gormGameStore struct {
+	DB *gorm.DB
+}
+
+func (s gormGameStore) GetGames() ([]Game, error) {
+	var games []Game
+	if err := s.DB.Order("name").Find(&games).Error; err != nil {
+		return nil, err
+	}
+	return games, nil
+}
+
+func (s gormGameStore) GetGameBySlug(slug string) (*Game, error) {
+	var game Game
+	err := s.DB.Where(Game{
+		Slug: slug,
+	}).First(&game).Error
+	if err != nil {
+		return nil, ErrGameNotFound
+	}
+	return &game, nil
+}
+
+func (s gormGameStore) CreateGame(game *Game) error {
+	return createUnique(s.DB, game, ErrGameNotUnique)
+}
+
+func (s gormGameStore) UpdateGame(game *Game) error {
+	return updateUnique(s.DB, game, []string{"Name", "Slug"}, ErrGameNotUnique)
+}
+
+func (s gormGameStore) DeleteGame(gameId uint) error {
+	return s.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("game_id = ?", gameId).Delete(&Category{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("game_id = ?", gameId).Delete(&Level{}).Error; err != nil {
+			return err
+		}
+		variables := tx.Model(&Variable{}).Select("id").Where("game_id = ?", gameId)
+		if err := tx.Where("variable_id IN (?)", variables).Delete(&VariableValue{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("game_id = ?", gameId).Delete(&Variable{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("game_id = ?", gameId).Delete(&role.GameRoleGrant{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&Game{}, gameId).Error
+	})
+}
+
+func (s gormGameStore) GetCategories(gameId uint) ([]Category, error) {
+	var categories []Category
+	err := s.DB.Where(Category{
+		GameID: gameId,
+	}).Order("id").Find(&categories).Error
+	if err != nil {
+		return nil, err
+	}
+	return categories, nil
+}
+
+func (s gormGameStore) GetCategoryBySlug(gameId uint, slug string) (*Category, error) {
+	var category Category
+	err := s.DB.Where(Category{
+		GameID: gameId,
+		Slug:   slug,
+	}).First(&category).Error
+	if err != nil {
+		return nil, ErrCategoryNotFound
+	}
+	return &category, nil
+}
+
+func (s gormGameStore) CreateCategory(category *Category) error {
+	return createUnique(s.DB, category, ErrCategoryNotUnique)
+}
+
+func (s gormGameStore) UpdateCategory(category *Category) error {
+	columns := []string{"Name", "Slug", "Rules", "PrimaryTiming", "Timings"}
+	return updateUnique(s.DB, category, columns, ErrCategoryNotUnique)
+}
+
+func (s gormGameStore) DeleteCategory(categoryId uint) error {
+	return s.DB.Transaction(func(tx *gorm.DB) error {
+		variables := tx.Model(&Variable{}).Select("id").Where("category_id = ?", categoryId)
+		if err := tx.Where("variable_id IN (?)", variables).Delete(&VariableValue{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("category_id = ?", categoryId).Delete(&Variable{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&Category{}, categoryId).Error
+	})
+}
+
+func (s gormGameStore) GetLevels(gameId uint) ([]Level, error) {
+	var levels []Level
+	err := s.DB.Where(Level{
+		GameID: gameId,
+	}).Order("id").Find(&levels).Error
+	if err != nil {
+		return nil, err
+	}
+	return levels, nil
+}
+
+func (s gormGameStore) GetLevelBySlug(gameId uint, slug string) (*Level, error) {
+	var level Level
+	err := s.DB.Where(Level{
+		GameID: gameId,
+		Slug:   slug,
+	}).First(&level).Error
+	if err != nil {
+		return nil, ErrLevelNotFound
+	}
+	return &level, nil
+}
+
+func (s gormGameStore) CreateLevel(level *Level) error {
+	return createUnique(s.DB, level, ErrLevelNotUnique)
+}
+
+func (s gormGameStore) UpdateLevel(level *Level) error {
+	return updateUnique(s.DB, level, []string{"Name", "Slug", "Rules"}, ErrLevelNotUnique)
+}
+
+func (s gormGameStore) DeleteLevel(levelId uint) error {
+	return s.DB.Delete(&Level{}, levelId).Error
+}
+
+func (s gormGameStore) GetVariables(gameId uint, categoryId uint) ([]Variable, error) {
+	var variables []Variable
+	err := s.DB.
+		Preload("Values", orderById).
+		Preload("Category").
+		Where("game_id = ? AND (category_id IS NULL OR category_id = ?)", gameId, categoryId).
+		Order("id").
+		Find(&variables).Error
+	if err != nil {
+		return nil, err
+	}
+	return variables, nil
+}
+
+func (s gormGameStore) GetGameVariables(gameId uint) ([]Variable, error) {
+	var variables []Variable
+	err := s.DB.
+		Preload("Values", orderById).
+		Preload("Category").
+		Where(Variable{
+			GameID: gameId,
+		}).
+		Order("id").
+		Find(&variables).Error
+	if err != nil {
+		return nil, err
+	}
+	return variables, nil
+}
+
+// CreateVariable also creates the variable's values; its category
+// must already exist.
+func (s gormGameStore) CreateVariable(variable *Variable) error {
+	err := s.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Omit("Category").Create(variable).Error; err != nil {
+			return err
+		}
+		if !variable.IsSubcategory || len(variable.Values) == 0 {
+			return nil
+		}
+
+		// Leaderboards show the first value of a sub-category unless
+		// asked for another, so runs from before it existed go there.
+		backfill := `
+			INSERT INTO run_variable_values (run_id, variable_id, value_id)
+			SELECT runs.id, ?, ? FROM runs WHERE runs.game_id = ?`
+		args := []interface{}{variable.ID, variable.Values[0].ID, variable.GameID}
+		if variable.CategoryID != nil {
+			backfill += " AND runs.category_id = ?"
+			args = append(args, *variable.CategoryID)
+		}
+		return tx.Exec(backfill, args...).Error
+	})
+	if err != nil {
+		return GameCreationError{
+			Err: err,
+		}
+	}
+	return nil
+}
+
+func orderById(db *gorm.DB) *gorm.DB {
+	return db.Order("id")
+}
+
+// Children are purged before their parents so that
+// foreign keys never point at a missing row.
+func (s gormGameStore) DumpDeleted() error {
+	models := []interface{}{&VariableValue{}, &Variable{}, &Category{}, &Level{}, &Game{}}
+	for _, model := range models {
+		err := s.DB.Unscoped().Where("deleted_at IS NOT NULL").Delete(model).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createUnique inserts value, translating a unique violation into errNotUnique.
+func createUnique(db *gorm.DB, value interface{}, errNotUnique error) error {
+	return uniqueError(db.Create(value).Error, errNotUnique)
+}
+
+// updateUnique saves columns of value, translating a unique violation
+// into errNotUnique.
+func updateUnique(db *gorm.DB, value interface{}, columns []string, errNotUnique error) error {
+	return uniqueError(db.Model(value).Select(columns).Updates(value).Error, errNotUnique)
+}
+
+func uniqueError(err error, errNotUnique error) error {
+	if err != nil {
+		var pgErr *pgconn.PgError
+
+		if errors.As(err, &pgErr) && pgErr.Code == pgerrcode.UniqueViolation {
+			return errNotUnique
+		}
+		return GameCreationError{
+			Err: err,
+		}
+	}
+
+	return nil
+}
+
+// Initializes a GORM game store and sets the exported
+// game store for application use. The schema is expected to be
+// up to date; see the database/migrations package.
+func InitGormStore(db *gorm.DB) error {
+	if db == nil {
+		db = database.DB
+	}
+
+	// Store is defined in games.go
+	Store = &gormGameStore{
+		DB: db,
+	}
+	return nil
+}
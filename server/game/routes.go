@@ -0,0 +1,835 @@
+package game
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/speedrun-website/leaderboard-backend/database"
+	"github.com/speedrun-website/leaderboard-backend/server/request"
+	"github.com/speedrun-website/leaderboard-backend/server/role"
+	"github.com/speedrun-website/leaderboard-backend/server/user"
+)
+
+func PublicRoutes(r *gin.RouterGroup) {
+	r.GET("/games", GetGamesHandler)
+	r.GET("/games/:slug", GetGameHandler)
+	r.GET("/games/:slug/categories", GetCategoriesHandler)
+	r.GET("/games/:slug/categories/:cat", GetCategoryHandler)
+	r.GET("/games/:slug/levels", GetLevelsHandler)
+	r.GET("/games/:slug/levels/:level", GetLevelHandler)
+	r.GET("/games/:slug/roles", GetGameRolesHandler)
+	r.GET("/games/:slug/variables", GetGameVariablesHandler)
+	r.GET("/games/:slug/categories/:cat/variables", GetCategoryVariablesHandler)
+}
+
+func AuthRoutes(r *gin.RouterGroup) {
+	staffOnly := role.RequireRole(role.Admin, role.Staff)
+	moderatorOnly := role.RequireGameRole(GameIDFromParam, role.Moderator)
+
+	r.POST("/games", staffOnly, CreateGameHandler)
+	r.PATCH("/games/:slug", moderatorOnly, UpdateGameHandler)
+	r.DELETE("/games/:slug", staffOnly, DeleteGameHandler)
+	r.POST("/games/:slug/categories", moderatorOnly, CreateCategoryHandler)
+	r.PATCH("/games/:slug/categories/:cat", moderatorOnly, UpdateCategoryHandler)
+	r.DELETE("/games/:slug/categories/:cat", moderatorOnly, DeleteCategoryHandler)
+	r.POST("/games/:slug/levels", moderatorOnly, CreateLevelHandler)
+	r.PATCH("/games/:slug/levels/:level", moderatorOnly, UpdateLevelHandler)
+	r.DELETE("/games/:slug/levels/:level", moderatorOnly, DeleteLevelHandler)
+	r.POST("/games/:slug/variables", moderatorOnly, CreateVariableHandler)
+	r.POST("/games/:slug/roles", moderatorOnly, GrantGameRoleHandler)
+	r.DELETE("/games/:slug/roles/:role/:user", moderatorOnly, RevokeGameRoleHandler)
+}
+
+type GameCreate struct {
+	Name string `json:"name" binding:"required"`
+	Slug string `json:"slug" binding:"required"`
+}
+
+type CategoryCreate struct {
+	Name          string        `json:"name" binding:"required"`
+	Slug          string        `json:"slug" binding:"required"`
+	Rules         string        `json:"rules"`
+	PrimaryTiming TimingMethod  `json:"primary_timing"`
+	Timings       TimingMethods `json:"timings"`
+}
+
+type LevelCreate struct {
+	Name  string `json:"name" binding:"required"`
+	Slug  string `json:"slug" binding:"required"`
+	Rules string `json:"rules"`
+}
+
+// GameUpdate is the body of a game update. Only the fields that are set
+// are changed, as with categories and levels.
+type GameUpdate struct {
+	Name *string `json:"name" binding:"omitempty,min=1"`
+	Slug *string `json:"slug"`
+}
+
+// CategoryUpdate is the body of a category update. The primary timing
+// has to stay one of the allowed timings.
+type CategoryUpdate struct {
+	Name          *string       `json:"name" binding:"omitempty,min=1"`
+	Slug          *string       `json:"slug"`
+	Rules         *string       `json:"rules"`
+	PrimaryTiming *TimingMethod `json:"primary_timing"`
+	Timings       TimingMethods `json:"timings"`
+}
+
+type LevelUpdate struct {
+	Name  *string `json:"name" binding:"omitempty,min=1"`
+	Slug  *string `json:"slug"`
+	Rules *string `json:"rules"`
+}
+
+// VariableCreate is the body for creating a variable. Without a
+// category, the variable applies to every category in the game.
+type VariableCreate struct {
+	Name          string   `json:"name" binding:"required"`
+	Category      string   `json:"category"`
+	IsSubcategory bool     `json:"is_subcategory"`
+	Required      bool     `json:"required"`
+	Values        []string `json:"values" binding:"required,min=1,dive,required"`
+}
+
+// GameRoleCreate grants the user with the public ID UserID a role.
+type GameRoleCreate struct {
+	UserID string `json:"user_id" binding:"required"`
+	Role   string `json:"role" binding:"required,oneof=moderator verifier"`
+}
+
+type GameResponse struct {
+	Game *GameInfo `json:"game"`
+}
+
+type GamesResponse struct {
+	Games []*GameInfo `json:"games"`
+}
+
+type CategoryResponse struct {
+	Category *CategoryInfo `json:"category"`
+}
+
+type CategoriesResponse struct {
+	Categories []*CategoryInfo `json:"categories"`
+}
+
+type LevelResponse struct {
+	Level *LevelInfo `json:"level"`
+}
+
+type LevelsResponse struct {
+	Levels []*LevelInfo `json:"levels"`
+}
+
+type VariableResponse struct {
+	Variable *VariableInfo `json:"variable"`
+}
+
+type VariablesResponse struct {
+	Variables []*VariableInfo `json:"variables"`
+}
+
+type GameRolesResponse struct {
+	Roles []*role.GameRoleHolder `json:"roles"`
+}
+
+func GetGamesHandler(c *gin.Context) {
+	games, err := Store.GetGames()
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	infos := make([]*GameInfo, len(games))
+	for i, game := range games {
+		infos[i] = game.AsInfo()
+	}
+
+	c.JSON(http.StatusOK, request.SuccessResponse{
+		Data: GamesResponse{
+			Games: infos,
+		},
+	})
+}
+
+func GetGameHandler(c *gin.Context) {
+	game, ok := GameFromParam(c)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, request.SuccessResponse{
+		Data: GameResponse{
+			Game: game.AsInfo(),
+		},
+	})
+}
+
+func CreateGameHandler(c *gin.Context) {
+	identity, ok := user.IdentityFromContext(c)
+	if !ok {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	var createValue GameCreate
+	if err := c.BindJSON(&createValue); err != nil {
+		log.Println("Unable to bind value", err)
+		return
+	}
+
+	if !IsValidSlug(createValue.Slug) {
+		abortWithError(c, http.StatusBadRequest, ErrInvalidSlug)
+		return
+	}
+
+	game := Game{
+		Name: createValue.Name,
+		Slug: createValue.Slug,
+	}
+
+	if err := Store.CreateGame(&game); err != nil {
+		abortWithCreationError(c, err, ErrGameNotUnique)
+		return
+	}
+
+	// Whoever creates a game is its first moderator.
+	if err := role.Store.GrantGameRole(game.ID, identity.ID, role.Moderator); err != nil {
+		log.Println(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.Header("Location", fmt.Sprintf("/api/v1/games/%s", game.Slug))
+	c.JSON(http.StatusCreated, request.SuccessResponse{
+		Data: GameResponse{
+			Game: game.AsInfo(),
+		},
+	})
+}
+
+// UpdateGameHandler renames a game or changes its slug.
+func UpdateGameHandler(c *gin.Context) {
+	game, ok := GameFromParam(c)
+	if !ok {
+		return
+	}
+
+	var updateValue GameUpdate
+	if err := c.BindJSON(&updateValue); err != nil {
+		log.Println("Unable to bind value", err)
+		return
+	}
+
+	if updateValue.Name != nil {
+		game.Name = *updateValue.Name
+	}
+	if updateValue.Slug != nil {
+		if !IsValidSlug(*updateValue.Slug) {
+			abortWithError(c, http.StatusBadRequest, ErrInvalidSlug)
+			return
+		}
+		game.Slug = *updateValue.Slug
+	}
+
+	if err := Store.UpdateGame(game); err != nil {
+		abortWithCreationError(c, err, ErrGameNotUnique)
+		return
+	}
+
+	c.JSON(http.StatusOK, request.SuccessResponse{
+		Data: GameResponse{
+			Game: game.AsInfo(),
+		},
+	})
+}
+
+// DeleteGameHandler deletes a game, along with its categories, levels,
+// variables and roles. Its runs are purged with it.
+func DeleteGameHandler(c *gin.Context) {
+	game, ok := GameFromParam(c)
+	if !ok {
+		return
+	}
+
+	if err := Store.DeleteGame(game.ID); err != nil {
+		log.Println(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func GetCategoriesHandler(c *gin.Context) {
+	game, ok := GameFromParam(c)
+	if !ok {
+		return
+	}
+
+	categories, err := Store.GetCategories(game.ID)
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	infos := make([]*CategoryInfo, len(categories))
+	for i, category := range categories {
+		infos[i] = category.AsInfo()
+	}
+
+	c.JSON(http.StatusOK, request.SuccessResponse{
+		Data: CategoriesResponse{
+			Categories: infos,
+		},
+	})
+}
+
+func GetCategoryHandler(c *gin.Context) {
+	_, category, ok := CategoryFromParams(c)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, request.SuccessResponse{
+		Data: CategoryResponse{
+			Category: category.AsInfo(),
+		},
+	})
+}
+
+func CreateCategoryHandler(c *gin.Context) {
+	game, ok := GameFromParam(c)
+	if !ok {
+		return
+	}
+
+	var createValue CategoryCreate
+	if err := c.BindJSON(&createValue); err != nil {
+		log.Println("Unable to bind value", err)
+		return
+	}
+
+	if !IsValidSlug(createValue.Slug) {
+		abortWithError(c, http.StatusBadRequest, ErrInvalidSlug)
+		return
+	}
+
+	primary, timings, err := normalizeTimings(createValue.PrimaryTiming, createValue.Timings)
+	if err != nil {
+		abortWithError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	category := Category{
+		GameID:        game.ID,
+		Name:          createValue.Name,
+		Slug:          createValue.Slug,
+		Rules:         createValue.Rules,
+		PrimaryTiming: primary,
+		Timings:       timings,
+	}
+
+	if err := Store.CreateCategory(&category); err != nil {
+		abortWithCreationError(c, err, ErrCategoryNotUnique)
+		return
+	}
+
+	c.Header("Location", fmt.Sprintf("/api/v1/games/%s/categories/%s", game.Slug, category.Slug))
+	c.JSON(http.StatusCreated, request.SuccessResponse{
+		Data: CategoryResponse{
+			Category: category.AsInfo(),
+		},
+	})
+}
+
+func UpdateCategoryHandler(c *gin.Context) {
+	_, category, ok := CategoryFromParams(c)
+	if !ok {
+		return
+	}
+
+	var updateValue CategoryUpdate
+	if err := c.BindJSON(&updateValue); err != nil {
+		log.Println("Unable to bind value", err)
+		return
+	}
+
+	if updateValue.Name != nil {
+		category.Name = *updateValue.Name
+	}
+	if updateValue.Slug != nil {
+		if !IsValidSlug(*updateValue.Slug) {
+			abortWithError(c, http.StatusBadRequest, ErrInvalidSlug)
+			return
+		}
+		category.Slug = *updateValue.Slug
+	}
+	if updateValue.Rules != nil {
+		category.Rules = *updateValue.Rules
+	}
+
+	if updateValue.PrimaryTiming != nil || updateValue.Timings != nil {
+		primary, timings := category.PrimaryTiming, category.AllowedTimings()
+		if updateValue.PrimaryTiming != nil {
+			primary = *updateValue.PrimaryTiming
+		}
+		if updateValue.Timings != nil {
+			timings = updateValue.Timings
+		}
+		primary, timings, err := normalizeTimings(primary, timings)
+		if err != nil {
+			abortWithError(c, http.StatusBadRequest, err)
+			return
+		}
+		category.PrimaryTiming = primary
+		category.Timings = timings
+	}
+
+	if err := Store.UpdateCategory(category); err != nil {
+		abortWithCreationError(c, err, ErrCategoryNotUnique)
+		return
+	}
+
+	c.JSON(http.StatusOK, request.SuccessResponse{
+		Data: CategoryResponse{
+			Category: category.AsInfo(),
+		},
+	})
+}
+
+// DeleteCategoryHandler deletes a category and the variables that only
+// apply to it. Its runs are purged with it.
+func DeleteCategoryHandler(c *gin.Context) {
+	_, category, ok := CategoryFromParams(c)
+	if !ok {
+		return
+	}
+
+	if err := Store.DeleteCategory(category.ID); err != nil {
+		log.Println(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func GetLevelsHandler(c *gin.Context) {
+	game, ok := GameFromParam(c)
+	if !ok {
+		return
+	}
+
+	levels, err := Store.GetLevels(game.ID)
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	infos := make([]*LevelInfo, len(levels))
+	for i, level := range levels {
+		infos[i] = level.AsInfo()
+	}
+
+	c.JSON(http.StatusOK, request.SuccessResponse{
+		Data: LevelsResponse{
+			Levels: infos,
+		},
+	})
+}
+
+func GetLevelHandler(c *gin.Context) {
+	game, ok := GameFromParam(c)
+	if !ok {
+		return
+	}
+
+	level, err := Store.GetLevelBySlug(game.ID, c.Param("level"))
+	if err != nil {
+		abortWithLookupError(c, err, ErrLevelNotFound)
+		return
+	}
+
+	c.JSON(http.StatusOK, request.SuccessResponse{
+		Data: LevelResponse{
+			Level: level.AsInfo(),
+		},
+	})
+}
+
+func CreateLevelHandler(c *gin.Context) {
+	game, ok := GameFromParam(c)
+	if !ok {
+		return
+	}
+
+	var createValue LevelCreate
+	if err := c.BindJSON(&createValue); err != nil {
+		log.Println("Unable to bind value", err)
+		return
+	}
+
+	if !IsValidSlug(createValue.Slug) {
+		abortWithError(c, http.StatusBadRequest, ErrInvalidSlug)
+		return
+	}
+
+	level := Level{
+		GameID: game.ID,
+		Name:   createValue.Name,
+		Slug:   createValue.Slug,
+		Rules:  createValue.Rules,
+	}
+
+	if err := Store.CreateLevel(&level); err != nil {
+		abortWithCreationError(c, err, ErrLevelNotUnique)
+		return
+	}
+
+	c.Header("Location", fmt.Sprintf("/api/v1/games/%s/levels/%s", game.Slug, level.Slug))
+	c.JSON(http.StatusCreated, request.SuccessResponse{
+		Data: LevelResponse{
+			Level: level.AsInfo(),
+		},
+	})
+}
+
+func UpdateLevelHandler(c *gin.Context) {
+	game, ok := GameFromParam(c)
+	if !ok {
+		return
+	}
+
+	level, err := Store.GetLevelBySlug(game.ID, c.Param("level"))
+	if err != nil {
+		abortWithLookupError(c, err, ErrLevelNotFound)
+		return
+	}
+
+	var updateValue LevelUpdate
+	if err := c.BindJSON(&updateValue); err != nil {
+		log.Println("Unable to bind value", err)
+		return
+	}
+
+	if updateValue.Name != nil {
+		level.Name = *updateValue.Name
+	}
+	if updateValue.Slug != nil {
+		if !IsValidSlug(*updateValue.Slug) {
+			abortWithError(c, http.StatusBadRequest, ErrInvalidSlug)
+			return
+		}
+		level.Slug = *updateValue.Slug
+	}
+	if updateValue.Rules != nil {
+		level.Rules = *updateValue.Rules
+	}
+
+	if err := Store.UpdateLevel(level); err != nil {
+		abortWithCreationError(c, err, ErrLevelNotUnique)
+		return
+	}
+
+	c.JSON(http.StatusOK, request.SuccessResponse{
+		Data: LevelResponse{
+			Level: level.AsInfo(),
+		},
+	})
+}
+
+// DeleteLevelHandler deletes a level. Its runs are purged with it.
+func DeleteLevelHandler(c *gin.Context) {
+	game, ok := GameFromParam(c)
+	if !ok {
+		return
+	}
+
+	level, err := Store.GetLevelBySlug(game.ID, c.Param("level"))
+	if err != nil {
+		abortWithLookupError(c, err, ErrLevelNotFound)
+		return
+	}
+
+	if err := Store.DeleteLevel(level.ID); err != nil {
+		log.Println(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func GetGameVariablesHandler(c *gin.Context) {
+	game, ok := GameFromParam(c)
+	if !ok {
+		return
+	}
+
+	variables, err := Store.GetGameVariables(game.ID)
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	respondWithVariables(c, variables)
+}
+
+func GetCategoryVariablesHandler(c *gin.Context) {
+	game, category, ok := CategoryFromParams(c)
+	if !ok {
+		return
+	}
+
+	variables, err := Store.GetVariables(game.ID, category.ID)
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	respondWithVariables(c, variables)
+}
+
+func respondWithVariables(c *gin.Context, variables []Variable) {
+	infos := make([]*VariableInfo, len(variables))
+	for i, variable := range variables {
+		infos[i] = variable.AsInfo()
+	}
+
+	c.JSON(http.StatusOK, request.SuccessResponse{
+		Data: VariablesResponse{
+			Variables: infos,
+		},
+	})
+}
+
+func CreateVariableHandler(c *gin.Context) {
+	game, ok := GameFromParam(c)
+	if !ok {
+		return
+	}
+
+	var createValue VariableCreate
+	if err := c.BindJSON(&createValue); err != nil {
+		log.Println("Unable to bind value", err)
+		return
+	}
+
+	// Every run on a sub-category's board needs a value to be placed on it.
+	variable := Variable{
+		GameID:        game.ID,
+		Name:          createValue.Name,
+		IsSubcategory: createValue.IsSubcategory,
+		Required:      createValue.Required || createValue.IsSubcategory,
+	}
+
+	if createValue.Category != "" {
+		category, err := Store.GetCategoryBySlug(game.ID, createValue.Category)
+		if err != nil {
+			if errors.Is(err, ErrCategoryNotFound) {
+				abortWithError(c, http.StatusBadRequest, err)
+			} else {
+				abortWithError(c, http.StatusInternalServerError, err)
+			}
+			return
+		}
+		variable.CategoryID = &category.ID
+		variable.Category = category
+	}
+
+	for _, label := range createValue.Values {
+		variable.Values = append(variable.Values, VariableValue{
+			Label: label,
+		})
+	}
+
+	if err := Store.CreateVariable(&variable); err != nil {
+		log.Println(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusCreated, request.SuccessResponse{
+		Data: VariableResponse{
+			Variable: variable.AsInfo(),
+		},
+	})
+}
+
+func GetGameRolesHandler(c *gin.Context) {
+	game, ok := GameFromParam(c)
+	if !ok {
+		return
+	}
+
+	grants, err := role.Store.GetGameRoleGrants(game.ID)
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	holders := make([]*role.GameRoleHolder, len(grants))
+	for i, grant := range grants {
+		holders[i] = grant.AsHolder()
+	}
+
+	c.JSON(http.StatusOK, request.SuccessResponse{
+		Data: GameRolesResponse{
+			Roles: holders,
+		},
+	})
+}
+
+func GrantGameRoleHandler(c *gin.Context) {
+	game, ok := GameFromParam(c)
+	if !ok {
+		return
+	}
+
+	var grantValue GameRoleCreate
+	if err := c.BindJSON(&grantValue); err != nil {
+		log.Println("Unable to bind value", err)
+		return
+	}
+
+	holder, err := user.Store.GetUserIdentifierByPublicId(grantValue.UserID)
+	if err != nil {
+		abortWithError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	gameRole := role.GameRole(grantValue.Role)
+	if err := role.Store.GrantGameRole(game.ID, holder.ID, gameRole); err != nil {
+		if errors.Is(err, role.ErrRoleNotUnique) {
+			abortWithError(c, http.StatusConflict, err)
+		} else {
+			log.Println(err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+		}
+		return
+	}
+
+	c.JSON(http.StatusCreated, request.SuccessResponse{
+		Data: GameRolesResponse{
+			Roles: []*role.GameRoleHolder{
+				{
+					User: holder,
+					Role: gameRole,
+				},
+			},
+		},
+	})
+}
+
+func RevokeGameRoleHandler(c *gin.Context) {
+	game, ok := GameFromParam(c)
+	if !ok {
+		return
+	}
+
+	gameRole := c.Param("role")
+	if !role.IsGameRole(gameRole) {
+		abortWithError(c, http.StatusBadRequest, role.ErrUnknownRole)
+		return
+	}
+
+	publicId := c.Param("user")
+	if !database.IsPublicID(publicId) {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	holder, err := user.Store.GetUserIdentifierByPublicId(publicId)
+	if err != nil {
+		if errors.Is(err, user.ErrUserNotFound) {
+			abortWithError(c, http.StatusNotFound, err)
+		} else {
+			log.Println(err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+		}
+		return
+	}
+
+	err = role.Store.RevokeGameRole(game.ID, holder.ID, role.GameRole(gameRole))
+	if err != nil {
+		if errors.Is(err, role.ErrRoleNotFound) {
+			abortWithError(c, http.StatusNotFound, err)
+		} else {
+			log.Println(err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+		}
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// GameIDFromParam is a role.GameResolver for routes with a `:slug`
+// route parameter.
+func GameIDFromParam(c *gin.Context) (uint, bool) {
+	game, ok := GameFromParam(c)
+	if !ok {
+		return 0, false
+	}
+	return game.ID, true
+}
+
+// GameFromParam looks up the game named by the `:slug` route parameter.
+// If it can't be found the request is aborted and ok is false.
+func GameFromParam(c *gin.Context) (game *Game, ok bool) {
+	game, err := Store.GetGameBySlug(c.Param("slug"))
+	if err != nil {
+		abortWithLookupError(c, err, ErrGameNotFound)
+		return nil, false
+	}
+	return game, true
+}
+
+// CategoryFromParams looks up the game and category named by the
+// `:slug` and `:cat` route parameters.
+// If either can't be found the request is aborted and ok is false.
+func CategoryFromParams(c *gin.Context) (game *Game, category *Category, ok bool) {
+	game, ok = GameFromParam(c)
+	if !ok {
+		return nil, nil, false
+	}
+
+	category, err := Store.GetCategoryBySlug(game.ID, c.Param("cat"))
+	if err != nil {
+		abortWithLookupError(c, err, ErrCategoryNotFound)
+		return nil, nil, false
+	}
+	return game, category, true
+}
+
+func abortWithError(c *gin.Context, code int, err error) {
+	c.AbortWithStatusJSON(code, request.ErrorResponse{
+		Errors: []error{
+			err,
+		},
+	})
+}
+
+func abortWithLookupError(c *gin.Context, err error, errNotFound error) {
+	if errors.Is(err, errNotFound) {
+		abortWithError(c, http.StatusNotFound, err)
+	} else {
+		abortWithError(c, http.StatusInternalServerError, err)
+	}
+}
+
+func abortWithCreationError(c *gin.Context, err error, errNotUnique error) {
+	if errors.Is(err, errNotUnique) {
+		abortWithError(c, http.StatusConflict, err)
+	} else {
+		log.Println(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,122 @@
+package game
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// A TimingMethod is a way of timing a run.
+type TimingMethod string
+
+const (
+	RealTime        TimingMethod = "realtime"
+	RealTimeNoLoads TimingMethod = "realtime_noloads"
+	GameTime        TimingMethod = "gametime"
+)
+
+// AllTimingMethods lists every timing method in the order they are shown.
+var AllTimingMethods = TimingMethods{RealTime, RealTimeNoLoads, GameTime}
+
+func (t TimingMethod) IsValid() bool {
+	return AllTimingMethods.Contains(t)
+}
+
+// TimingMethods is a set of timing methods, stored as a comma separated
+// list so that it fits in a single category column.
+type TimingMethods []TimingMethod
+
+func (ts TimingMethods) Contains(t TimingMethod) bool {
+	for _, method := range ts {
+		if method == t {
+			return true
+		}
+	}
+	return false
+}
+
+// Scan implements sql.Scanner.
+func (ts *TimingMethods) Scan(value interface{}) error {
+	var raw string
+	switch v := value.(type) {
+	case nil:
+		*ts = nil
+		return nil
+	case string:
+		raw = v
+	case []byte:
+		raw = string(v)
+	default:
+		return fmt.Errorf("cannot scan %T into TimingMethods", value)
+	}
+
+	*ts = nil
+	if raw == "" {
+		return nil
+	}
+	for _, method := range strings.Split(raw, ",") {
+		*ts = append(*ts, TimingMethod(method))
+	}
+	return nil
+}
+
+// Value implements driver.Valuer.
+func (ts TimingMethods) Value() (driver.Value, error) {
+	methods := make([]string, len(ts))
+	for i, method := range ts {
+		methods[i] = string(method)
+	}
+	return strings.Join(methods, ","), nil
+}
+
+// AllowedTimings returns the timing methods runs in the category may
+// be submitted with. Categories created before timings could be
+// configured only allow their primary timing.
+func (c Category) AllowedTimings() TimingMethods {
+	if len(c.Timings) == 0 {
+		return TimingMethods{c.PrimaryTiming}
+	}
+	return c.Timings
+}
+
+// normalizeTimings fills in a new category's timing defaults and checks
+// that its primary timing is one of its allowed timings. Without a
+// primary timing, the first allowed timing is used.
+func normalizeTimings(primary TimingMethod, allowed TimingMethods) (TimingMethod, TimingMethods, error) {
+	if len(allowed) == 0 {
+		if primary == "" {
+			primary = RealTime
+		}
+		if !primary.IsValid() {
+			return "", nil, ErrInvalidTiming
+		}
+		return primary, TimingMethods{primary}, nil
+	}
+
+	// Keep the timings in their canonical order, without duplicates.
+	var timings TimingMethods
+	for _, method := range AllTimingMethods {
+		if allowed.Contains(method) {
+			timings = append(timings, method)
+		}
+	}
+	if len(timings) != len(allowed) {
+		for _, method := range allowed {
+			if !method.IsValid() {
+				return "", nil, ErrInvalidTiming
+			}
+		}
+	}
+
+	if primary == "" {
+		primary = allowed[0]
+	}
+	if !timings.Contains(primary) {
+		return "", nil, ErrPrimaryTimingNotAllowed
+	}
+	return primary, timings, nil
+}
+
+var ErrInvalidTiming = errors.New("timing methods must be one of realtime, realtime_noloads or gametime")
+var ErrPrimaryTimingNotAllowed = errors.New("the primary timing must be one of the category's allowed timings")
@@ -0,0 +1,146 @@
+package role
+
+import (
+	"errors"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgerrcode"
+	"github.com/speedrun-website/leaderboard-backend/database"
+	"github.com/speedrun-website/leaderboard-backend/server/user"
+	"gorm.io/gorm"
+)
+
+type gormRoleStore struct {
+	DB *gorm.DB
+}
+
+func (s gormRoleStore) GetSiteRoles(userId uint) ([]SiteRole, error) {
+	var roles []SiteRole
+	err := s.DB.Model(&SiteRoleGrant{}).Where(SiteRoleGrant{
+		UserID: userId,
+	}).Order("role").Pluck("role", &roles).Error
+	if err != nil {
+		return nil, err
+	}
+	return roles, nil
+}
+
+func (s gormRoleStore) GrantSiteRole(userId uint, role SiteRole) error {
+	return grant(s.DB, &SiteRoleGrant{
+		UserID: userId,
+		Role:   role,
+	})
+}
+
+func (s gormRoleStore) RevokeSiteRole(userId uint, role SiteRole) error {
+	return revoke(s.DB.Where(SiteRoleGrant{
+		UserID: userId,
+		Role:   role,
+	}), &SiteRoleGrant{})
+}
+
+func (s gormRoleStore) GetGameRoles(gameId uint, userId uint) ([]GameRole, error) {
+	var roles []GameRole
+	err := s.DB.Model(&GameRoleGrant{}).Where(GameRoleGrant{
+		GameID: gameId,
+		UserID: userId,
+	}).Order("role").Pluck("role", &roles).Error
+	if err != nil {
+		return nil, err
+	}
+	return roles, nil
+}
+
+func (s gormRoleStore) GetGameRoleGrants(gameId uint) ([]GameRoleGrant, error) {
+	var grants []GameRoleGrant
+	err := s.DB.Preload("User").Where(GameRoleGrant{
+		GameID: gameId,
+	}).Order("role, created_at").Find(&grants).Error
+	if err != nil {
+		return nil, err
+	}
+	return grants, nil
+}
+
+func (s gormRoleStore) GetUserGameRoleGrants(userId uint) ([]GameRoleGrant, error) {
+	var grants []GameRoleGrant
+	err := s.DB.
+		Select("game_role_grants.*, games.slug AS game_slug").
+		Joins("JOIN games ON games.id = game_role_grants.game_id").
+		Where("game_role_grants.user_id = ?", userId).
+		Order("games.slug, game_role_grants.role").
+		Find(&grants).Error
+	if err != nil {
+		return nil, err
+	}
+	return grants, nil
+}
+
+func (s gormRoleStore) GrantGameRole(gameId uint, userId uint, role GameRole) error {
+	return grant(s.DB, &GameRoleGrant{
+		GameID: gameId,
+		UserID: userId,
+		Role:   role,
+	})
+}
+
+func (s gormRoleStore) RevokeGameRole(gameId uint, userId uint, role GameRole) error {
+	return revoke(s.DB.Where(GameRoleGrant{
+		GameID: gameId,
+		UserID: userId,
+		Role:   role,
+	}), &GameRoleGrant{})
+}
+
+// Grants are purged along with soft deleted users, so this
+// must be called before the user store's DumpDeleted.
+func (s gormRoleStore) DumpDeleted() error {
+	deleted := s.DB.Unscoped().Model(&user.User{}).Select("id").Where("deleted_at IS NOT NULL")
+	for _, model := range []interface{}{&SiteRoleGrant{}, &GameRoleGrant{}} {
+		if err := s.DB.Where("user_id IN (?)", deleted).Delete(model).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func grant(db *gorm.DB, value interface{}) error {
+	err := db.Omit("User").Create(value).Error
+
+	if err != nil {
+		var pgErr *pgconn.PgError
+
+		if errors.As(err, &pgErr) && pgErr.Code == pgerrcode.UniqueViolation {
+			return ErrRoleNotUnique
+		}
+		return err
+	}
+
+	return nil
+}
+
+func revoke(db *gorm.DB, model interface{}) error {
+	result := db.Delete(model)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrRoleNotFound
+	}
+	return nil
+}
+
+// Initializes a GORM role store and sets the exported
+// role store for application use. The schema is expected to be
+// up to date; see the database/migrations package.
+func InitGormStore(db *gorm.DB) error {
+	if db == nil {
+		db = database.DB
+	}
+
+	// Store is defined in roles.go
+	Store = &gormRoleStore{
+		DB: db,
+	}
+	return nil
+}
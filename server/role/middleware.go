@@ -0,0 +1,204 @@
+package role
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/speedrun-website/leaderboard-backend/config"
+	"github.com/speedrun-website/leaderboard-backend/server/request"
+	"github.com/speedrun-website/leaderboard-backend/server/user"
+)
+
+// A GameResolver finds the game a request is about, such as by looking up
+// a slug in the route. If it can't, it must abort the request itself and
+// return false.
+type GameResolver func(c *gin.Context) (gameId uint, ok bool)
+
+// twoFactorRoles are the roles that only count for sessions logged in to
+// with two-factor authentication. They are set by Configure.
+var twoFactorRoles = map[string]bool{}
+
+// Configure sets which roles need two-factor authentication. It must be
+// called before any routes are served.
+func Configure(c config.AuthConfig) error {
+	roles := map[string]bool{}
+	for _, r := range c.TwoFactorRoles {
+		if !IsSiteRole(r) && !IsGameRole(r) {
+			return fmt.Errorf("%q is not a site or game role (TWO_FACTOR_ROLES)", r)
+		}
+		roles[r] = true
+	}
+	twoFactorRoles = roles
+	return nil
+}
+
+// RequireRole returns a middleware that aborts with a 403 unless the
+// logged-in user holds at least one of roles. It must come after the
+// auth middleware. Roles are looked up on every request so that
+// revoking a role takes effect immediately. Roles that need two-factor
+// authentication only count for sessions that were logged in to with a
+// code.
+func RequireRole(roles ...SiteRole) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		identity, ok := user.IdentityFromContext(c)
+		if !ok {
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		allowed, err := HasSiteRole(identity.ID, roles...)
+		if err != nil {
+			log.Println(err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		if !allowed {
+			abortForbidden(c)
+			return
+		}
+
+		// Without two-factor authentication, only the other roles count.
+		var others []SiteRole
+		for _, r := range roles {
+			if !twoFactorRoles[string(r)] {
+				others = append(others, r)
+			}
+		}
+		if len(others) < len(roles) && !usedTwoFactor(c) {
+			allowed, err := HasSiteRole(identity.ID, others...)
+			if err != nil {
+				log.Println(err)
+				c.AbortWithStatus(http.StatusInternalServerError)
+				return
+			}
+			if !allowed {
+				abortTwoFactorRequired(c)
+				return
+			}
+		}
+
+		c.Next()
+	}
+}
+
+// RequireGameRole returns a middleware that aborts with a 403 unless the
+// logged-in user holds at least one of roles in the game found by
+// resolve. Site admins hold every game role.
+func RequireGameRole(resolve GameResolver, roles ...GameRole) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		identity, ok := user.IdentityFromContext(c)
+		if !ok {
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		gameId, ok := resolve(c)
+		if !ok {
+			return
+		}
+
+		allowed, err := HasGameRole(gameId, identity.ID, roles...)
+		if err != nil {
+			log.Println(err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		if !allowed {
+			abortForbidden(c)
+			return
+		}
+
+		// Without two-factor authentication, only the other roles count.
+		var others []GameRole
+		for _, r := range roles {
+			if !twoFactorRoles[string(r)] {
+				others = append(others, r)
+			}
+		}
+		adminCounts := !twoFactorRoles[string(Admin)]
+		if (len(others) < len(roles) || !adminCounts) && !usedTwoFactor(c) {
+			allowed, err := hasGameRole(gameId, identity.ID, adminCounts, others...)
+			if err != nil {
+				log.Println(err)
+				c.AbortWithStatus(http.StatusInternalServerError)
+				return
+			}
+			if !allowed {
+				abortTwoFactorRequired(c)
+				return
+			}
+		}
+
+		c.Next()
+	}
+}
+
+// HasSiteRole reports whether the user holds at least one of roles.
+func HasSiteRole(userId uint, roles ...SiteRole) (bool, error) {
+	held, err := Store.GetSiteRoles(userId)
+	if err != nil {
+		return false, err
+	}
+	for _, h := range held {
+		for _, r := range roles {
+			if h == r {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// HasGameRole reports whether the user holds at least one of roles in
+// the game, or is a site admin.
+func HasGameRole(gameId uint, userId uint, roles ...GameRole) (bool, error) {
+	return hasGameRole(gameId, userId, true, roles...)
+}
+
+func hasGameRole(gameId uint, userId uint, adminCounts bool, roles ...GameRole) (bool, error) {
+	if adminCounts {
+		isAdmin, err := HasSiteRole(userId, Admin)
+		if err != nil || isAdmin {
+			return isAdmin, err
+		}
+	}
+
+	held, err := Store.GetGameRoles(gameId, userId)
+	if err != nil {
+		return false, err
+	}
+	for _, h := range held {
+		for _, r := range roles {
+			if h == r {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// usedTwoFactor reports whether the request's session was logged in to
+// with a code. Personal access tokens, and sessions from before the user
+// turned two-factor authentication on, never were.
+func usedTwoFactor(c *gin.Context) bool {
+	session, ok := user.SessionFromContext(c)
+	return ok && session.TwoFactor
+}
+
+func abortForbidden(c *gin.Context) {
+	c.AbortWithStatusJSON(http.StatusForbidden, request.ErrorResponse{
+		Errors: []error{
+			ErrForbidden,
+		},
+	})
+}
+
+func abortTwoFactorRequired(c *gin.Context) {
+	c.AbortWithStatusJSON(http.StatusForbidden, request.ErrorResponse{
+		Errors: []error{
+			ErrTwoFactorRequired,
+		},
+	})
+}
@@ -0,0 +1,117 @@
+package role
+
+import (
+	"errors"
+	"time"
+
+	"github.com/speedrun-website/leaderboard-backend/database"
+	"github.com/speedrun-website/leaderboard-backend/server/user"
+)
+
+// A SiteRole grants a user powers across the whole site.
+type SiteRole string
+
+const (
+	Admin SiteRole = "admin"
+	Staff SiteRole = "staff"
+)
+
+// A GameRole grants a user powers over a single game.
+// Moderators manage a game and its roles, verifiers only review runs.
+type GameRole string
+
+const (
+	Moderator GameRole = "moderator"
+	Verifier  GameRole = "verifier"
+)
+
+// IsSiteRole reports whether r is a known site role.
+func IsSiteRole(r string) bool {
+	switch SiteRole(r) {
+	case Admin, Staff:
+		return true
+	}
+	return false
+}
+
+// IsGameRole reports whether r is a known game role.
+func IsGameRole(r string) bool {
+	switch GameRole(r) {
+	case Moderator, Verifier:
+		return true
+	}
+	return false
+}
+
+type SiteRoleGrant struct {
+	UserID    uint     `gorm:"primaryKey;autoIncrement:false"`
+	Role      SiteRole `gorm:"primaryKey"`
+	User      user.User
+	CreatedAt time.Time
+}
+
+// GameSlug is only loaded by GetUserGameRoleGrants, since games depend
+// on roles and can't be referred to here.
+type GameRoleGrant struct {
+	GameID    uint     `gorm:"primaryKey;autoIncrement:false"`
+	GameSlug  string   `gorm:"->"`
+	UserID    uint     `gorm:"primaryKey;autoIncrement:false;index"`
+	Role      GameRole `gorm:"primaryKey"`
+	User      user.User
+	CreatedAt time.Time
+}
+
+type GameRoleInfo struct {
+	GameID uint     `json:"-"`
+	Game   string   `json:"game"`
+	Role   GameRole `json:"role"`
+}
+
+// GameRoleHolder is a user holding a role in a game.
+type GameRoleHolder struct {
+	User *user.UserIdentifier `json:"user"`
+	Role GameRole             `json:"role"`
+}
+
+func (g GameRoleGrant) AsInfo() *GameRoleInfo {
+	return &GameRoleInfo{
+		GameID: g.GameID,
+		Game:   g.GameSlug,
+		Role:   g.Role,
+	}
+}
+
+// AsHolder expects the grant's User to be loaded.
+func (g GameRoleGrant) AsHolder() *GameRoleHolder {
+	return &GameRoleHolder{
+		User: g.User.AsIdentifier(),
+		Role: g.Role,
+	}
+}
+
+// The globally exported RoleStore that the application will use.
+var Store RoleStore
+
+// The RoleStore interface, which defines ways that the application
+// can query for and grant site and game roles.
+type RoleStore interface {
+	database.DataStore
+
+	GetSiteRoles(userId uint) ([]SiteRole, error)
+	GrantSiteRole(userId uint, role SiteRole) error
+	RevokeSiteRole(userId uint, role SiteRole) error
+
+	GetGameRoles(gameId uint, userId uint) ([]GameRole, error)
+	GetGameRoleGrants(gameId uint) ([]GameRoleGrant, error)
+	GetUserGameRoleGrants(userId uint) ([]GameRoleGrant, error)
+	GrantGameRole(gameId uint, userId uint, role GameRole) error
+	RevokeGameRole(gameId uint, userId uint, role GameRole) error
+}
+
+// Errors
+var ErrForbidden = errors.New("you don't have a role that allows you to do this")
+var ErrTwoFactorRequired = errors.New("your role needs two-factor authentication, turn it on and log in with a code to do this")
+
+var ErrRoleNotUnique = errors.New("the user already has this role")
+var ErrRoleNotFound = errors.New("the user doesn't have this role")
+var ErrUnknownRole = errors.New("the requested role doesn't exist")
@@ -0,0 +1,256 @@
+package role_test
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/joho/godotenv"
+	"github.com/speedrun-website/leaderboard-backend/config"
+	"github.com/speedrun-website/leaderboard-backend/database"
+	"github.com/speedrun-website/leaderboard-backend/database/migrations"
+	"github.com/speedrun-website/leaderboard-backend/server/role"
+	"github.com/speedrun-website/leaderboard-backend/server/user"
+)
+
+func getEnvPath() string {
+	return fmt.Sprintf("../../%s", os.Getenv("ENV"))
+}
+
+func init() {
+	if err := godotenv.Load(getEnvPath()); err != nil {
+		log.Fatalf("Where's the .env file?")
+	}
+
+	if err := database.InitGlobalTestConnection(); err != nil {
+		log.Fatalf("DB failed to initialise.")
+	}
+	if _, err := migrations.Up(database.DB); err != nil {
+		log.Fatalf("Migrations failed: %s", err)
+	}
+
+	if err := user.InitGormStore(nil); err != nil {
+		log.Fatalf("User store failed to initialise.")
+	}
+	if err := role.InitGormStore(nil); err != nil {
+		log.Fatalf("Role store failed to initialise.")
+	}
+}
+
+// The game that every game role in these tests is granted in.
+// Game roles don't check that their game exists.
+const testGameId = 4242
+
+func TestRequireRole(t *testing.T) {
+	t.Parallel()
+
+	r, authMiddleware := getRolesContext()
+	admin := createUser(t, "RoleAdmin")
+	staff := createUser(t, "RoleStaff")
+	verifier := createUser(t, "RoleVerifier")
+	nobody := createUser(t, "RoleNobody")
+	defer cleanupUsers(t, admin, staff, verifier, nobody)
+
+	grants := []error{
+		role.Store.GrantSiteRole(admin.ID, role.Admin),
+		role.Store.GrantSiteRole(staff.ID, role.Staff),
+		role.Store.GrantGameRole(testGameId, verifier.ID, role.Verifier),
+	}
+	for _, err := range grants {
+		if err != nil {
+			t.Fatalf("granting role failed: %s", err)
+		}
+	}
+
+	testCases := []struct {
+		name     string
+		user     *user.User
+		target   string
+		expected int
+	}{
+		{"Admin on admin route", admin, "/admin", http.StatusOK},
+		{"Staff on admin route", staff, "/admin", http.StatusForbidden},
+		{"Staff on staff route", staff, "/staff", http.StatusOK},
+		{"Nobody on staff route", nobody, "/staff", http.StatusForbidden},
+		{"Verifier on verifier route", verifier, "/verify", http.StatusOK},
+		{"Verifier on moderator route", verifier, "/moderate", http.StatusForbidden},
+		{"Admin on moderator route", admin, "/moderate", http.StatusOK},
+		{"Staff on moderator route", staff, "/moderate", http.StatusForbidden},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			token, _, err := authMiddleware.TokenGenerator(testCase.user.AsPersonal())
+			if err != nil {
+				t.Fatalf("token generation failed: %s", err)
+			}
+			req := httptest.NewRequest(http.MethodGet, testCase.target, nil)
+			req.Header.Add("Authorization", "Bearer "+token)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != testCase.expected {
+				t.Fatalf("expected status code %d, got %d", testCase.expected, w.Code)
+			}
+		})
+	}
+
+	if err := role.Store.RevokeSiteRole(staff.ID, role.Staff); err != nil {
+		t.Fatalf("revoking role failed: %s", err)
+	}
+	if err := role.Store.RevokeSiteRole(staff.ID, role.Staff); err != role.ErrRoleNotFound {
+		t.Fatalf("expected revoking a missing role to fail with %q, got %v", role.ErrRoleNotFound, err)
+	}
+	if err := role.Store.RevokeGameRole(testGameId, verifier.ID, role.Verifier); err != nil {
+		t.Fatalf("revoking role failed: %s", err)
+	}
+}
+
+// TestRequireTwoFactorRole isn't parallel, since it changes which roles
+// need two-factor authentication for every test.
+func TestRequireTwoFactorRole(t *testing.T) {
+	if err := role.Configure(config.AuthConfig{TwoFactorRoles: []string{"owner"}}); err == nil {
+		t.Fatal("expected an unknown role to be rejected")
+	}
+	if err := role.Configure(config.AuthConfig{TwoFactorRoles: []string{"admin", "moderator"}}); err != nil {
+		t.Fatal(err)
+	}
+	defer role.Configure(config.Default().Auth)
+
+	r, authMiddleware := getRolesContext()
+	admin := createUser(t, "TwoFactorAdmin")
+	moderator := createUser(t, "TwoFactorModerator")
+	defer cleanupUsers(t, admin, moderator)
+
+	grants := []error{
+		role.Store.GrantSiteRole(admin.ID, role.Admin),
+		role.Store.GrantSiteRole(admin.ID, role.Staff),
+		role.Store.GrantGameRole(testGameId, moderator.ID, role.Moderator),
+		role.Store.GrantGameRole(testGameId, moderator.ID, role.Verifier),
+	}
+	for _, err := range grants {
+		if err != nil {
+			t.Fatalf("granting role failed: %s", err)
+		}
+	}
+
+	tokens := map[uint]string{}
+	for _, u := range []*user.User{admin, moderator} {
+		token, _, err := authMiddleware.TokenGenerator(u.AsPersonal())
+		if err != nil {
+			t.Fatalf("token generation failed: %s", err)
+		}
+		tokens[u.ID] = token
+	}
+	check := func(u *user.User, target string, expected int) {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.Header.Add("Authorization", "Bearer "+tokens[u.ID])
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != expected {
+			t.Fatalf("expected status code %d on %s, got %d", expected, target, w.Code)
+		}
+	}
+
+	// Roles that don't need two-factor authentication still count.
+	check(admin, "/admin", http.StatusForbidden)
+	check(admin, "/staff", http.StatusOK)
+	check(admin, "/moderate", http.StatusForbidden)
+	check(moderator, "/moderate", http.StatusForbidden)
+	check(moderator, "/verify", http.StatusOK)
+
+	// Turning it on doesn't help sessions that didn't log in with a code.
+	for _, u := range []*user.User{admin, moderator} {
+		if err := user.Store.SetTOTPSecret(u.ID, "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"); err != nil {
+			t.Fatal(err)
+		}
+		if err := user.Store.EnableTwoFactor(u.ID, 1, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check(admin, "/admin", http.StatusForbidden)
+	check(moderator, "/moderate", http.StatusForbidden)
+
+	// Logging in with a code is covered by the user tests, so the
+	// sessions are marked as having done it here.
+	err := database.DB.Model(&user.Session{}).
+		Where("user_id IN ?", []uint{admin.ID, moderator.ID}).
+		Update("two_factor", true).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(admin, "/admin", http.StatusOK)
+	check(admin, "/moderate", http.StatusOK)
+	check(moderator, "/moderate", http.StatusOK)
+
+	// Turning it off ends that.
+	if err := user.Store.DisableTwoFactor(moderator.ID); err != nil {
+		t.Fatal(err)
+	}
+	check(moderator, "/moderate", http.StatusForbidden)
+	check(moderator, "/verify", http.StatusOK)
+}
+
+func getRolesContext() (*gin.Engine, *user.AuthMiddleware) {
+	w := httptest.NewRecorder()
+	_, r := gin.CreateTestContext(w)
+	api := r.Group("/")
+	auth := config.Default().Auth
+	auth.JWTSecret = "a test secret that is long enough"
+	authMiddleware, err := user.NewAuthMiddleware(auth)
+	if err != nil {
+		log.Fatal(err)
+	}
+	testGame := func(c *gin.Context) (uint, bool) {
+		return testGameId, true
+	}
+	ok := func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	}
+	api.Use(authMiddleware.MiddlewareFunc())
+	{
+		api.GET("/admin", role.RequireRole(role.Admin), ok)
+		api.GET("/staff", role.RequireRole(role.Admin, role.Staff), ok)
+		api.GET("/verify", role.RequireGameRole(testGame, role.Moderator, role.Verifier), ok)
+		api.GET("/moderate", role.RequireGameRole(testGame, role.Moderator), ok)
+	}
+	return r, authMiddleware
+}
+
+func createUser(t *testing.T, username string) *user.User {
+	t.Helper()
+
+	hash, err := user.HashAndSaltPassword([]byte("beepboopbop"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := &user.User{
+		Username: username,
+		Email:    username + "@email.com",
+		Password: hash,
+	}
+	if err := user.Store.CreateUser(u); err != nil {
+		t.Fatalf("creating user failed: %s", err)
+	}
+	return u
+}
+
+func cleanupUsers(t *testing.T, users ...*user.User) {
+	t.Helper()
+
+	for _, u := range users {
+		if err := user.Store.DeleteUser(u.ID); err != nil {
+			t.Fatalf("cleanup failed: %s", err)
+		}
+	}
+	if err := role.Store.DumpDeleted(); err != nil {
+		t.Fatalf("cleanup failed: %s", err)
+	}
+	if err := user.Store.DumpDeleted(); err != nil {
+		t.Fatalf("cleanup failed: %s", err)
+	}
+}
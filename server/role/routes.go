@@ -0,0 +1,143 @@
+package role
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/speedrun-website/leaderboard-backend/database"
+	"github.com/speedrun-website/leaderboard-backend/server/request"
+	"github.com/speedrun-website/leaderboard-backend/server/user"
+)
+
+func PublicRoutes(r *gin.RouterGroup) {
+	r.GET("/users/:id/roles", GetUserRolesHandler)
+}
+
+func AuthRoutes(r *gin.RouterGroup) {
+	r.PUT("/users/:id/roles/:role", RequireRole(Admin), GrantSiteRoleHandler)
+	r.DELETE("/users/:id/roles/:role", RequireRole(Admin), RevokeSiteRoleHandler)
+}
+
+type UserRolesResponse struct {
+	SiteRoles []SiteRole      `json:"site_roles"`
+	GameRoles []*GameRoleInfo `json:"game_roles"`
+}
+
+func GetUserRolesHandler(c *gin.Context) {
+	u, ok := userFromParam(c)
+	if !ok {
+		return
+	}
+
+	siteRoles, err := Store.GetSiteRoles(u.ID)
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	grants, err := Store.GetUserGameRoleGrants(u.ID)
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	gameRoles := make([]*GameRoleInfo, len(grants))
+	for i, grant := range grants {
+		gameRoles[i] = grant.AsInfo()
+	}
+	if siteRoles == nil {
+		siteRoles = []SiteRole{}
+	}
+
+	c.JSON(http.StatusOK, request.SuccessResponse{
+		Data: UserRolesResponse{
+			SiteRoles: siteRoles,
+			GameRoles: gameRoles,
+		},
+	})
+}
+
+func GrantSiteRoleHandler(c *gin.Context) {
+	u, siteRole, ok := siteRoleFromParams(c)
+	if !ok {
+		return
+	}
+
+	if err := Store.GrantSiteRole(u.ID, siteRole); err != nil {
+		if errors.Is(err, ErrRoleNotUnique) {
+			abortWithError(c, http.StatusConflict, err)
+		} else {
+			log.Println(err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+		}
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+func RevokeSiteRoleHandler(c *gin.Context) {
+	u, siteRole, ok := siteRoleFromParams(c)
+	if !ok {
+		return
+	}
+
+	if err := Store.RevokeSiteRole(u.ID, siteRole); err != nil {
+		if errors.Is(err, ErrRoleNotFound) {
+			abortWithError(c, http.StatusNotFound, err)
+		} else {
+			log.Println(err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+		}
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// userFromParam looks up the user whose public ID is the `:id` route
+// parameter. If they can't be found the request is aborted and ok is false.
+func userFromParam(c *gin.Context) (u *user.UserIdentifier, ok bool) {
+	publicId := c.Param("id")
+	if !database.IsPublicID(publicId) {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return nil, false
+	}
+
+	u, err := user.Store.GetUserIdentifierByPublicId(publicId)
+	if err != nil {
+		if errors.Is(err, user.ErrUserNotFound) {
+			abortWithError(c, http.StatusNotFound, err)
+		} else {
+			abortWithError(c, http.StatusInternalServerError, err)
+		}
+		return nil, false
+	}
+	return u, true
+}
+
+func siteRoleFromParams(c *gin.Context) (*user.UserIdentifier, SiteRole, bool) {
+	u, ok := userFromParam(c)
+	if !ok {
+		return nil, "", false
+	}
+
+	siteRole := c.Param("role")
+	if !IsSiteRole(siteRole) {
+		abortWithError(c, http.StatusBadRequest, ErrUnknownRole)
+		return nil, "", false
+	}
+	return u, SiteRole(siteRole), true
+}
+
+func abortWithError(c *gin.Context, code int, err error) {
+	c.AbortWithStatusJSON(code, request.ErrorResponse{
+		Errors: []error{
+			err,
+		},
+	})
+}
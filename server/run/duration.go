@@ -0,0 +1,153 @@
+package run
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A Duration is a run time, precise to the millisecond.
+//
+// Durations are written to JSON as both a whole number of milliseconds and
+// an ISO 8601 duration using hours, minutes and seconds:
+//
+//	{"milliseconds": 5025123, "iso8601": "PT1H23M45.123S"}
+//
+// Either form, or a bare number of milliseconds, is accepted when reading.
+type Duration time.Duration
+
+type durationJSON struct {
+	Milliseconds *int64 `json:"milliseconds"`
+	ISO8601      string `json:"iso8601"`
+}
+
+func (d Duration) Milliseconds() int64 {
+	return time.Duration(d).Milliseconds()
+}
+
+// ISO8601 formats the duration with hours as its largest unit, since days
+// are not a fixed length. Seconds are only given a fraction if needed.
+func (d Duration) ISO8601() string {
+	ms := d.Milliseconds()
+	if ms == 0 {
+		return "PT0S"
+	}
+
+	var b strings.Builder
+	if ms < 0 {
+		b.WriteByte('-')
+		ms = -ms
+	}
+	b.WriteString("PT")
+
+	hours, ms := ms/3600000, ms%3600000
+	minutes, ms := ms/60000, ms%60000
+	seconds, ms := ms/1000, ms%1000
+
+	if hours > 0 {
+		fmt.Fprintf(&b, "%dH", hours)
+	}
+	if minutes > 0 {
+		fmt.Fprintf(&b, "%dM", minutes)
+	}
+	if ms > 0 {
+		fraction := strings.TrimRight(fmt.Sprintf("%03d", ms), "0")
+		fmt.Fprintf(&b, "%d.%sS", seconds, fraction)
+	} else if seconds > 0 {
+		fmt.Fprintf(&b, "%dS", seconds)
+	}
+	return b.String()
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	ms := d.Milliseconds()
+	return json.Marshal(durationJSON{
+		Milliseconds: &ms,
+		ISO8601:      d.ISO8601(),
+	})
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	switch {
+	case len(data) > 0 && data[0] == '"':
+		var raw string
+		if err := json.Unmarshal(data, &raw); err != nil {
+			return err
+		}
+		return d.parseISO8601(raw)
+
+	case len(data) > 0 && data[0] == '{':
+		var value durationJSON
+		if err := json.Unmarshal(data, &value); err != nil {
+			return err
+		}
+		if value.Milliseconds != nil {
+			*d = DurationFromMilliseconds(*value.Milliseconds)
+			return nil
+		}
+		return d.parseISO8601(value.ISO8601)
+
+	default:
+		var ms int64
+		if err := json.Unmarshal(data, &ms); err != nil {
+			return ErrInvalidDuration
+		}
+		*d = DurationFromMilliseconds(ms)
+		return nil
+	}
+}
+
+// iso8601Duration matches the time-based ISO 8601 durations that runs can
+// reasonably be timed in. Years, months and weeks are not accepted.
+var iso8601Duration = regexp.MustCompile(
+	`^P(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:(\d+)(?:[.,](\d{1,3}))?S)?)?$`,
+)
+
+func (d *Duration) parseISO8601(raw string) error {
+	parts := iso8601Duration.FindStringSubmatch(raw)
+	if parts == nil || raw == "P" || strings.HasSuffix(raw, "T") {
+		return ErrInvalidDuration
+	}
+
+	units := []int64{24 * 3600000, 3600000, 60000, 1000}
+	var ms int64
+	for i, unit := range units {
+		if parts[i+1] == "" {
+			continue
+		}
+		n, err := strconv.ParseInt(parts[i+1], 10, 64)
+		if err != nil {
+			return ErrInvalidDuration
+		}
+		ms += n * unit
+	}
+	if fraction := parts[5]; fraction != "" {
+		n, _ := strconv.ParseInt((fraction + "00")[:3], 10, 64)
+		ms += n
+	}
+
+	*d = DurationFromMilliseconds(ms)
+	return nil
+}
+
+func DurationFromMilliseconds(ms int64) Duration {
+	return Duration(time.Duration(ms) * time.Millisecond)
+}
+
+// durationPtr converts a stored duration to a Duration, keeping it nil
+// if the run wasn't timed that way.
+func durationPtr(d *time.Duration) *Duration {
+	if d == nil {
+		return nil
+	}
+	value := Duration(d.Truncate(time.Millisecond))
+	return &value
+}
+
+var ErrInvalidDuration = errors.New("durations must be a number of milliseconds or an ISO 8601 duration such as PT1H23M45.678S")
@@ -0,0 +1,366 @@
+package run
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/speedrun-website/leaderboard-backend/database"
+	"github.com/speedrun-website/leaderboard-backend/server/game"
+	"github.com/speedrun-website/leaderboard-backend/server/user"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type gormRunStore struct {
+	DB *gorm.DB
+}
+
+func (s gormRunStore) GetRunById(runId uint) (*Run, error) {
+	var run Run
+	err := s.preloadRun().First(&run, runId).Error
+	if err != nil {
+		return nil, ErrRunNotFound
+	}
+	return &run, nil
+}
+
+func (s gormRunStore) GetRunByPublicId(publicId string) (*Run, error) {
+	var run Run
+	err := s.preloadRun().Where("public_id = ?", publicId).First(&run).Error
+	if err != nil {
+		return nil, ErrRunNotFound
+	}
+	return &run, nil
+}
+
+// preloadRun loads everything that Run.AsInfo needs.
+func (s gormRunStore) preloadRun() *gorm.DB {
+	return s.DB.
+		Preload("User").
+		Preload("Game").
+		Preload("Category").
+		Preload("Level").
+		Preload("VariableValues.Variable").
+		Preload("VariableValues.Value")
+}
+
+// CreateRun inserts the run and its variable values; its user, game,
+// category and level must already exist.
+func (s gormRunStore) CreateRun(run *Run) error {
+	err := s.DB.Omit("User", "Game", "Category", "Level", "StatusChanges").Create(run).Error
+	if err != nil {
+		return RunCreationError{
+			Err: err,
+		}
+	}
+	return nil
+}
+
+func (s gormRunStore) GetPendingRuns(gameId uint) ([]Run, error) {
+	var runs []Run
+	err := s.preloadRun().
+		Where(Run{
+			GameID: gameId,
+			Status: Pending,
+		}).
+		Order("created_at").
+		Find(&runs).Error
+	if err != nil {
+		return nil, err
+	}
+	return runs, nil
+}
+
+func (s gormRunStore) GetGameRuns(gameId uint) ([]Run, error) {
+	var runs []Run
+	err := s.preloadRun().
+		Where(Run{
+			GameID: gameId,
+		}).
+		Order("created_at").
+		Find(&runs).Error
+	if err != nil {
+		return nil, err
+	}
+	return runs, nil
+}
+
+// ChangeRunStatus moves a run from change.FromStatus to change.ToStatus
+// and records the change. If the run is no longer in change.FromStatus,
+// nothing is changed and ErrStatusChangedConcurrently is returned.
+func (s gormRunStore) ChangeRunStatus(change *RunStatusChange) error {
+	return s.DB.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&Run{}).
+			Where("id = ? AND status = ?", change.RunID, change.FromStatus).
+			Updates(map[string]interface{}{
+				"status":           change.ToStatus,
+				"rejection_reason": change.Reason,
+			})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrStatusChangedConcurrently
+		}
+		return tx.Omit(clause.Associations).Create(change).Error
+	})
+}
+
+func (s gormRunStore) GetRunStatusChanges(runId uint) ([]RunStatusChange, error) {
+	var changes []RunStatusChange
+	err := s.DB.Preload("Moderator").Where(RunStatusChange{
+		RunID: runId,
+	}).Order("created_at").Find(&changes).Error
+	if err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
+
+func (s gormRunStore) DeleteRun(runId uint) error {
+	if err := s.DB.Delete(&Run{}, runId).Error; err != nil {
+		return err
+	}
+	return nil
+}
+
+// The leaderboard is built in a single query over verified runs. The inner
+// window numbers each runner's runs from fastest to slowest, so that their
+// personal best is numbered 1 and everything else is obsolete. The outer
+// window then ranks the personal bests, giving tied times the same place.
+// Variable filters are added to the inner query, so personal bests are
+// taken among the runs that match them.
+const leaderboardQuery = `
+WITH candidates AS (
+	SELECT
+		runs.*,
+		ROW_NUMBER() OVER (
+			PARTITION BY runs.user_id
+			ORDER BY runs.%[1]s, runs.played_on, runs.id
+		) AS personal_rank
+	FROM runs
+	WHERE runs.deleted_at IS NULL
+		AND runs.status = @status
+		AND runs.category_id = @category
+		AND runs.level_id IS NOT DISTINCT FROM @level
+		AND runs.%[1]s IS NOT NULL%[2]s
+)
+SELECT
+	CASE WHEN candidates.personal_rank = 1 THEN
+		RANK() OVER (
+			PARTITION BY candidates.personal_rank = 1
+			ORDER BY candidates.%[1]s
+		)
+	END AS place,
+	candidates.personal_rank > 1 AS obsolete,
+	candidates.public_id AS run_id,
+	candidates.user_id,
+	users.public_id AS user_public_id,
+	users.username,
+	candidates.real_time,
+	candidates.real_time_no_loads,
+	candidates.game_time,
+	candidates.played_on,
+	candidates.video_url
+FROM candidates
+JOIN users ON users.id = candidates.user_id AND users.deleted_at IS NULL
+WHERE @include_obsolete OR candidates.personal_rank = 1
+ORDER BY candidates.%[1]s, candidates.played_on, candidates.id
+`
+
+const leaderboardVariableFilter = `
+		AND EXISTS (
+			SELECT 1 FROM run_variable_values
+			WHERE run_variable_values.run_id = runs.id
+				AND run_variable_values.variable_id = @variable_%[1]d
+				AND run_variable_values.value_id = @value_%[1]d
+		)`
+
+func (s gormRunStore) GetLeaderboard(query LeaderboardQuery) ([]LeaderboardEntry, error) {
+	column, ok := timingColumns[query.Timing]
+	if !ok {
+		return nil, ErrInvalidTiming
+	}
+
+	params := map[string]interface{}{
+		"status":           Verified,
+		"category":         query.CategoryID,
+		"level":            query.LevelID,
+		"include_obsolete": query.IncludeObsolete,
+	}
+
+	variableIds := make([]uint, 0, len(query.Variables))
+	for variableId := range query.Variables {
+		variableIds = append(variableIds, variableId)
+	}
+	sort.Slice(variableIds, func(i, j int) bool {
+		return variableIds[i] < variableIds[j]
+	})
+
+	var filters strings.Builder
+	for i, variableId := range variableIds {
+		fmt.Fprintf(&filters, leaderboardVariableFilter, i)
+		params[fmt.Sprintf("variable_%d", i)] = variableId
+		params[fmt.Sprintf("value_%d", i)] = query.Variables[variableId]
+	}
+
+	var rows []leaderboardRow
+	err := s.DB.Raw(fmt.Sprintf(leaderboardQuery, column, filters.String()), params).Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]LeaderboardEntry, len(rows))
+	for i, row := range rows {
+		entries[i] = row.asEntry()
+	}
+	return entries, nil
+}
+
+// Personal bests are found like leaderboards, but over every board at
+// once. Each run's board is its category and level, along with its
+// sub-category values, and it is timed by its category's primary timing
+// method. Only the boards of categories the user has verified runs in are
+// ranked.
+const personalBestsQuery = `
+WITH timed AS (
+	SELECT
+		runs.*,
+		categories.primary_timing,
+		CASE categories.primary_timing
+			WHEN @real_time THEN runs.real_time
+			WHEN @real_time_no_loads THEN runs.real_time_no_loads
+			WHEN @game_time THEN runs.game_time
+		END AS primary_time,
+		COALESCE((
+			SELECT string_agg(
+				variables.public_id || ':' || variable_values.public_id,
+				',' ORDER BY run_variable_values.variable_id
+			)
+			FROM run_variable_values
+			JOIN variables ON variables.id = run_variable_values.variable_id
+			JOIN variable_values ON variable_values.id = run_variable_values.value_id
+			WHERE run_variable_values.run_id = runs.id AND variables.is_subcategory
+		), '') AS board
+	FROM runs
+	JOIN categories ON categories.id = runs.category_id AND categories.deleted_at IS NULL
+	WHERE runs.deleted_at IS NULL
+		AND runs.status = @status
+		AND runs.category_id IN (
+			SELECT category_id FROM runs
+			WHERE user_id = @user AND status = @status AND deleted_at IS NULL
+		)
+), candidates AS (
+	SELECT
+		timed.*,
+		ROW_NUMBER() OVER (
+			PARTITION BY timed.user_id, timed.category_id, timed.level_id, timed.board
+			ORDER BY timed.primary_time, timed.played_on, timed.id
+		) AS personal_rank
+	FROM timed
+	JOIN users ON users.id = timed.user_id AND users.deleted_at IS NULL
+	WHERE timed.primary_time IS NOT NULL
+), ranked AS (
+	SELECT
+		candidates.*,
+		RANK() OVER (
+			PARTITION BY candidates.category_id, candidates.level_id, candidates.board
+			ORDER BY candidates.primary_time
+		) AS place
+	FROM candidates
+	WHERE candidates.personal_rank = 1
+)
+SELECT
+	ranked.place,
+	ranked.public_id AS run_id,
+	games.slug AS game,
+	categories.slug AS category,
+	levels.slug AS level,
+	ranked.board,
+	ranked.primary_timing AS timing,
+	ranked.real_time,
+	ranked.real_time_no_loads,
+	ranked.game_time,
+	ranked.played_on,
+	ranked.video_url
+FROM ranked
+JOIN games ON games.id = ranked.game_id
+JOIN categories ON categories.id = ranked.category_id
+LEFT JOIN levels ON levels.id = ranked.level_id
+WHERE ranked.user_id = @user
+ORDER BY games.name, categories.name, levels.name NULLS FIRST, ranked.board
+`
+
+func (s gormRunStore) GetPersonalBests(userId uint) ([]PersonalBest, error) {
+	var rows []personalBestRow
+	err := s.DB.Raw(personalBestsQuery, map[string]interface{}{
+		"status":             Verified,
+		"user":               userId,
+		"real_time":          game.RealTime,
+		"real_time_no_loads": game.RealTimeNoLoads,
+		"game_time":          game.GameTime,
+	}).Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+
+	bests := make([]PersonalBest, len(rows))
+	for i, row := range rows {
+		bests[i] = row.asPersonalBest()
+	}
+	return bests, nil
+}
+
+// DumpDeleted purges deleted runs, along with the runs of deleted users,
+// games, categories and levels, which would otherwise keep them from
+// being purged. Status changes made by deleted moderators are kept, but
+// no longer name them. It must be called before the game and user
+// stores' DumpDeleted.
+func (s gormRunStore) DumpDeleted() error {
+	return s.DB.Transaction(func(tx *gorm.DB) error {
+		deletedUsers := tx.Unscoped().Model(&user.User{}).Select("id").Where("deleted_at IS NOT NULL")
+		err := tx.Model(&RunStatusChange{}).
+			Where("moderator_id IN (?)", deletedUsers).
+			Update("moderator_id", nil).Error
+		if err != nil {
+			return err
+		}
+
+		deleted := tx.Unscoped().Model(&Run{}).Select("id").Where(
+			"deleted_at IS NOT NULL OR user_id IN (?) OR game_id IN (?) OR category_id IN (?) OR level_id IN (?)",
+			deletedUsers,
+			tx.Unscoped().Model(&game.Game{}).Select("id").Where("deleted_at IS NOT NULL"),
+			tx.Unscoped().Model(&game.Category{}).Select("id").Where("deleted_at IS NOT NULL"),
+			tx.Unscoped().Model(&game.Level{}).Select("id").Where("deleted_at IS NOT NULL"),
+		)
+		var ids []uint
+		if err := deleted.Pluck("id", &ids).Error; err != nil {
+			return err
+		}
+		if len(ids) == 0 {
+			return nil
+		}
+		for _, model := range []interface{}{&RunStatusChange{}, &RunVariableValue{}} {
+			if err := tx.Where("run_id IN ?", ids).Delete(model).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Unscoped().Delete(&Run{}, ids).Error
+	})
+}
+
+// Initializes a GORM run store and sets the exported
+// run store for application use. The schema is expected to be
+// up to date; see the database/migrations package.
+func InitGormStore(db *gorm.DB) error {
+	if db == nil {
+		db = database.DB
+	}
+
+	// Store is defined in runs.go
+	Store = &gormRunStore{
+		DB: db,
+	}
+	return nil
+}
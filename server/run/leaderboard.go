@@ -0,0 +1,143 @@
+package run
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/speedrun-website/leaderboard-backend/server/game"
+	"github.com/speedrun-website/leaderboard-backend/server/user"
+)
+
+// A LeaderboardQuery selects which runs make up a leaderboard.
+// A nil LevelID selects full-game runs. Variables maps variable IDs to
+// the value IDs that runs must have.
+type LeaderboardQuery struct {
+	CategoryID      uint
+	LevelID         *uint
+	Timing          game.TimingMethod
+	Variables       map[uint]uint
+	IncludeObsolete bool
+}
+
+// A LeaderboardEntry is a single run on a leaderboard.
+// Place is shared between tied runs, so places may skip (1, 2, 2, 4).
+// Obsolete runs are not a runner's personal best and have no place.
+type LeaderboardEntry struct {
+	Place           *int                 `json:"place"`
+	Obsolete        bool                 `json:"obsolete"`
+	RunID           string               `json:"run_id"`
+	User            *user.UserIdentifier `json:"user"`
+	RealTime        *Duration            `json:"real_time"`
+	RealTimeNoLoads *Duration            `json:"real_time_noloads"`
+	GameTime        *Duration            `json:"game_time"`
+	Date            string               `json:"date"`
+	VideoURL        string               `json:"video_url"`
+}
+
+// timingColumns maps each timing method to the run column it is stored in.
+// Leaderboard queries must only ever interpolate columns from this map.
+var timingColumns = map[game.TimingMethod]string{
+	game.RealTime:        "real_time",
+	game.RealTimeNoLoads: "real_time_no_loads",
+	game.GameTime:        "game_time",
+}
+
+// leaderboardRow is a row of the leaderboard query.
+// Durations are read as nanoseconds.
+type leaderboardRow struct {
+	Place           *int
+	Obsolete        bool
+	RunID           string
+	UserID          uint
+	UserPublicID    string
+	Username        string
+	RealTime        *int64
+	RealTimeNoLoads *int64
+	GameTime        *int64
+	PlayedOn        time.Time
+	VideoURL        string
+}
+
+func (r leaderboardRow) asEntry() LeaderboardEntry {
+	return LeaderboardEntry{
+		Place:    r.Place,
+		Obsolete: r.Obsolete,
+		RunID:    r.RunID,
+		User: &user.UserIdentifier{
+			ID:       r.UserID,
+			PublicID: r.UserPublicID,
+			Username: r.Username,
+		},
+		RealTime:        durationPtr((*time.Duration)(r.RealTime)),
+		RealTimeNoLoads: durationPtr((*time.Duration)(r.RealTimeNoLoads)),
+		GameTime:        durationPtr((*time.Duration)(r.GameTime)),
+		Date:            r.PlayedOn.Format(DateLayout),
+		VideoURL:        r.VideoURL,
+	}
+}
+
+var ErrInvalidTiming = errors.New("the requested timing method is not supported")
+
+// A PersonalBest is a runner's best verified run on one board: a category,
+// or a level of it, split by its sub-categories. Its place is on that
+// board, ranked by the category's primary timing method. Subcategories
+// maps the public IDs of sub-category variables to the public IDs of the
+// run's values.
+type PersonalBest struct {
+	Place           int               `json:"place"`
+	RunID           string            `json:"run_id"`
+	Game            string            `json:"game"`
+	Category        string            `json:"category"`
+	Level           string            `json:"level,omitempty"`
+	Subcategories   map[string]string `json:"subcategories"`
+	Timing          game.TimingMethod `json:"timing"`
+	RealTime        *Duration         `json:"real_time"`
+	RealTimeNoLoads *Duration         `json:"real_time_noloads"`
+	GameTime        *Duration         `json:"game_time"`
+	Date            string            `json:"date"`
+	VideoURL        string            `json:"video_url"`
+}
+
+// personalBestRow is a row of the personal bests query. Board lists the
+// run's sub-category values as variable:value pairs of public IDs,
+// separated by commas.
+type personalBestRow struct {
+	Place           int
+	RunID           string
+	Game            string
+	Category        string
+	Level           *string
+	Board           string
+	Timing          game.TimingMethod
+	RealTime        *int64
+	RealTimeNoLoads *int64
+	GameTime        *int64
+	PlayedOn        time.Time
+	VideoURL        string
+}
+
+func (r personalBestRow) asPersonalBest() PersonalBest {
+	pb := PersonalBest{
+		Place:           r.Place,
+		RunID:           r.RunID,
+		Game:            r.Game,
+		Category:        r.Category,
+		Subcategories:   map[string]string{},
+		Timing:          r.Timing,
+		RealTime:        durationPtr((*time.Duration)(r.RealTime)),
+		RealTimeNoLoads: durationPtr((*time.Duration)(r.RealTimeNoLoads)),
+		GameTime:        durationPtr((*time.Duration)(r.GameTime)),
+		Date:            r.PlayedOn.Format(DateLayout),
+		VideoURL:        r.VideoURL,
+	}
+	if r.Level != nil {
+		pb.Level = *r.Level
+	}
+	for _, pair := range strings.Split(r.Board, ",") {
+		if ids := strings.SplitN(pair, ":", 2); len(ids) == 2 {
+			pb.Subcategories[ids[0]] = ids[1]
+		}
+	}
+	return pb
+}
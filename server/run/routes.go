@@ -0,0 +1,491 @@
+package run
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/speedrun-website/leaderboard-backend/database"
+	"github.com/speedrun-website/leaderboard-backend/server/game"
+	"github.com/speedrun-website/leaderboard-backend/server/request"
+	"github.com/speedrun-website/leaderboard-backend/server/role"
+	"github.com/speedrun-website/leaderboard-backend/server/user"
+)
+
+func PublicRoutes(r *gin.RouterGroup) {
+	r.GET("/runs/:id", GetRunHandler)
+	r.GET("/runs/:id/history", GetRunHistoryHandler)
+	r.GET("/games/:slug/categories/:cat/leaderboard", GetLeaderboardHandler)
+}
+
+func AuthRoutes(r *gin.RouterGroup) {
+	reviewers := []role.GameRole{role.Moderator, role.Verifier}
+
+	user.ScopedRoute(r, user.ScopeRunsWrite, http.MethodPost, "/runs", user.RequireVerifiedEmail(), SubmitRunHandler)
+	user.ScopedRoute(r, user.ScopeRunsReview, http.MethodPost, "/runs/:id/verify", role.RequireGameRole(gameIDFromRunParam, reviewers...), VerifyRunHandler)
+	user.ScopedRoute(r, user.ScopeRunsReview, http.MethodPost, "/runs/:id/reject", role.RequireGameRole(gameIDFromRunParam, reviewers...), RejectRunHandler)
+	user.ScopedRoute(r, user.ScopeRunsReview, http.MethodGet, "/games/:slug/runs/pending", role.RequireGameRole(game.GameIDFromParam, reviewers...), GetPendingRunsHandler)
+}
+
+// RunSubmit is the body of a run submission.
+// Each time must be allowed by the category, and Variables maps the
+// public IDs of variables to the public IDs of their values.
+type RunSubmit struct {
+	Game            string            `json:"game" binding:"required"`
+	Category        string            `json:"category" binding:"required"`
+	Level           string            `json:"level"`
+	RealTime        *Duration         `json:"real_time"`
+	RealTimeNoLoads *Duration         `json:"real_time_noloads"`
+	GameTime        *Duration         `json:"game_time"`
+	Date            string            `json:"date" binding:"required"`
+	VideoURL        string            `json:"video_url" binding:"required,url,max=255"`
+	Comment         string            `json:"comment" binding:"max=2000"`
+	Variables       map[string]string `json:"variables"`
+}
+
+// times maps each timing method to the submitted time for it.
+func (s RunSubmit) times() map[game.TimingMethod]*Duration {
+	return map[game.TimingMethod]*Duration{
+		game.RealTime:        s.RealTime,
+		game.RealTimeNoLoads: s.RealTimeNoLoads,
+		game.GameTime:        s.GameTime,
+	}
+}
+
+type RunReject struct {
+	Reason string `json:"reason" binding:"required,max=1000"`
+}
+
+type RunResponse struct {
+	Run *RunInfo `json:"run"`
+}
+
+type RunsResponse struct {
+	Runs []*RunInfo `json:"runs"`
+}
+
+type RunHistoryResponse struct {
+	History []*RunStatusChangeInfo `json:"history"`
+}
+
+// LeaderboardResponse echoes the query that built the leaderboard.
+// Variables maps the public IDs of variables to the public IDs of the
+// values runs were filtered by, including defaulted sub-categories.
+type LeaderboardResponse struct {
+	Game      string             `json:"game"`
+	Category  string             `json:"category"`
+	Level     string             `json:"level,omitempty"`
+	Timing    game.TimingMethod  `json:"timing"`
+	Variables map[string]string  `json:"variables"`
+	Entries   []LeaderboardEntry `json:"entries"`
+}
+
+func GetRunHandler(c *gin.Context) {
+	run, ok := runFromParam(c)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, request.SuccessResponse{
+		Data: RunResponse{
+			Run: run.AsInfo(),
+		},
+	})
+}
+
+func SubmitRunHandler(c *gin.Context) {
+	identity, ok := user.IdentityFromContext(c)
+	if !ok {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	var submitValue RunSubmit
+	if err := c.BindJSON(&submitValue); err != nil {
+		log.Println("Unable to bind value", err)
+		return
+	}
+
+	times := submitValue.times()
+	hasTime := false
+	for _, d := range times {
+		if d == nil {
+			continue
+		}
+		if *d <= 0 {
+			abortWithError(c, http.StatusBadRequest, ErrNonPositiveTime)
+			return
+		}
+		hasTime = true
+	}
+	if !hasTime {
+		abortWithError(c, http.StatusBadRequest, ErrNoTime)
+		return
+	}
+
+	playedOn, err := time.Parse(DateLayout, submitValue.Date)
+	if err != nil {
+		abortWithError(c, http.StatusBadRequest, ErrInvalidDate)
+		return
+	}
+	// Dates carry no time zone, so allow a day of slack for
+	// runners ahead of the server's clock.
+	if playedOn.After(time.Now().Add(24 * time.Hour)) {
+		abortWithError(c, http.StatusBadRequest, ErrDateInFuture)
+		return
+	}
+
+	if !isHttpURL(submitValue.VideoURL) {
+		abortWithError(c, http.StatusBadRequest, ErrInvalidVideoURL)
+		return
+	}
+
+	g, err := game.Store.GetGameBySlug(submitValue.Game)
+	if err != nil {
+		abortWithLookupError(c, err, game.ErrGameNotFound)
+		return
+	}
+
+	category, err := game.Store.GetCategoryBySlug(g.ID, submitValue.Category)
+	if err != nil {
+		abortWithLookupError(c, err, game.ErrCategoryNotFound)
+		return
+	}
+
+	if err := checkTimings(category, times); err != nil {
+		abortWithError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	var level *game.Level
+	if submitValue.Level != "" {
+		level, err = game.Store.GetLevelBySlug(g.ID, submitValue.Level)
+		if err != nil {
+			abortWithLookupError(c, err, game.ErrLevelNotFound)
+			return
+		}
+	}
+
+	variables, err := game.Store.GetVariables(g.ID, category.ID)
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	variableValues, err := variableValuesFromSubmission(variables, submitValue.Variables)
+	if err != nil {
+		abortWithError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	run := Run{
+		UserID:     identity.ID,
+		GameID:     g.ID,
+		CategoryID: category.ID,
+		PlayedOn:   playedOn,
+		VideoURL:   submitValue.VideoURL,
+		Comment:    submitValue.Comment,
+
+		RealTime:        (*time.Duration)(submitValue.RealTime),
+		RealTimeNoLoads: (*time.Duration)(submitValue.RealTimeNoLoads),
+		GameTime:        (*time.Duration)(submitValue.GameTime),
+
+		VariableValues: variableValues,
+	}
+	if level != nil {
+		run.LevelID = &level.ID
+	}
+
+	if err := Store.CreateRun(&run); err != nil {
+		log.Println(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	// Read the run back so that its associations are loaded.
+	created, err := Store.GetRunById(run.ID)
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.Header("Location", fmt.Sprintf("/api/v1/runs/%s", created.PublicID))
+	c.JSON(http.StatusCreated, request.SuccessResponse{
+		Data: RunResponse{
+			Run: created.AsInfo(),
+		},
+	})
+}
+
+func GetRunHistoryHandler(c *gin.Context) {
+	run, ok := runFromParam(c)
+	if !ok {
+		return
+	}
+
+	changes, err := Store.GetRunStatusChanges(run.ID)
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	infos := make([]*RunStatusChangeInfo, len(changes))
+	for i, change := range changes {
+		infos[i] = change.AsInfo()
+	}
+
+	c.JSON(http.StatusOK, request.SuccessResponse{
+		Data: RunHistoryResponse{
+			History: infos,
+		},
+	})
+}
+
+// GetPendingRunsHandler returns a game's moderation queue,
+// oldest submission first.
+func GetPendingRunsHandler(c *gin.Context) {
+	g, ok := game.GameFromParam(c)
+	if !ok {
+		return
+	}
+
+	runs, err := Store.GetPendingRuns(g.ID)
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	infos := make([]*RunInfo, len(runs))
+	for i, run := range runs {
+		infos[i] = run.AsInfo()
+	}
+
+	c.JSON(http.StatusOK, request.SuccessResponse{
+		Data: RunsResponse{
+			Runs: infos,
+		},
+	})
+}
+
+func VerifyRunHandler(c *gin.Context) {
+	changeRunStatus(c, Verified, "")
+}
+
+func RejectRunHandler(c *gin.Context) {
+	var rejectValue RunReject
+	if err := c.BindJSON(&rejectValue); err != nil {
+		log.Println("Unable to bind value", err)
+		return
+	}
+
+	changeRunStatus(c, Rejected, rejectValue.Reason)
+}
+
+// changeRunStatus moves the run named by the `:id` route parameter to
+// status on behalf of the logged-in user.
+func changeRunStatus(c *gin.Context, status RunStatus, reason string) {
+	identity, ok := user.IdentityFromContext(c)
+	if !ok {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	run, ok := runFromParam(c)
+	if !ok {
+		return
+	}
+
+	if run.Status == status {
+		abortWithError(c, http.StatusConflict, ErrStatusUnchanged)
+		return
+	}
+
+	err := Store.ChangeRunStatus(&RunStatusChange{
+		RunID:       run.ID,
+		ModeratorID: &identity.ID,
+		FromStatus:  run.Status,
+		ToStatus:    status,
+		Reason:      reason,
+	})
+	if err != nil {
+		if errors.Is(err, ErrStatusChangedConcurrently) {
+			abortWithError(c, http.StatusConflict, err)
+		} else {
+			log.Println(err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+		}
+		return
+	}
+
+	changed, err := Store.GetRunById(run.ID)
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, request.SuccessResponse{
+		Data: RunResponse{
+			Run: changed.AsInfo(),
+		},
+	})
+}
+
+// GetLeaderboardHandler returns every runner's verified personal best in a
+// category, ranked by the category's primary timing method or by any other
+// allowed method given as `timing`.
+// Full-game runs are returned unless a `level` slug is given, and
+// `include_obsolete=true` also returns runs that aren't personal bests.
+// Runs are filtered by any `var[<variable id>]=<value id>` parameters.
+func GetLeaderboardHandler(c *gin.Context) {
+	g, category, ok := game.CategoryFromParams(c)
+	if !ok {
+		return
+	}
+
+	query := LeaderboardQuery{
+		CategoryID: category.ID,
+		Timing:     category.PrimaryTiming,
+	}
+
+	if timing := game.TimingMethod(c.Query("timing")); timing != "" {
+		if !category.AllowedTimings().Contains(timing) {
+			abortWithError(c, http.StatusBadRequest, ErrTimingNotAllowed)
+			return
+		}
+		query.Timing = timing
+	}
+
+	if raw := c.Query("include_obsolete"); raw != "" {
+		includeObsolete, err := strconv.ParseBool(raw)
+		if err != nil {
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+		query.IncludeObsolete = includeObsolete
+	}
+
+	levelSlug := c.Query("level")
+	if levelSlug != "" {
+		level, err := game.Store.GetLevelBySlug(g.ID, levelSlug)
+		if err != nil {
+			abortWithLookupError(c, err, game.ErrLevelNotFound)
+			return
+		}
+		query.LevelID = &level.ID
+	}
+
+	variables, err := game.Store.GetVariables(g.ID, category.ID)
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	query.Variables, err = leaderboardFilters(variables, c.QueryMap("var"))
+	if err != nil {
+		abortWithError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	entries, err := Store.GetLeaderboard(query)
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, request.SuccessResponse{
+		Data: LeaderboardResponse{
+			Game:      g.Slug,
+			Category:  category.Slug,
+			Level:     levelSlug,
+			Timing:    query.Timing,
+			Variables: publicFilters(variables, query.Variables),
+			Entries:   entries,
+		},
+	})
+}
+
+// runFromParam looks up the run whose public ID is the `:id` route
+// parameter. If it can't be found the request is aborted and ok is false.
+func runFromParam(c *gin.Context) (run *Run, ok bool) {
+	publicId := c.Param("id")
+	if !database.IsPublicID(publicId) {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return nil, false
+	}
+
+	run, err := Store.GetRunByPublicId(publicId)
+	if err != nil {
+		var code int
+		if errors.Is(err, ErrRunNotFound) {
+			code = http.StatusNotFound
+		} else {
+			code = http.StatusInternalServerError
+		}
+		abortWithError(c, code, err)
+		return nil, false
+	}
+	return run, true
+}
+
+// gameIDFromRunParam is a role.GameResolver for routes with an `:id`
+// route parameter naming a run.
+func gameIDFromRunParam(c *gin.Context) (uint, bool) {
+	run, ok := runFromParam(c)
+	if !ok {
+		return 0, false
+	}
+	return run.GameID, true
+}
+
+// checkTimings checks that a submission only has times for the category's
+// allowed timing methods, including its primary one.
+func checkTimings(category *game.Category, times map[game.TimingMethod]*Duration) error {
+	allowed := category.AllowedTimings()
+	for method, d := range times {
+		if d != nil && !allowed.Contains(method) {
+			return fmt.Errorf("%w: %s", ErrTimingNotAllowed, method)
+		}
+	}
+	if times[category.PrimaryTiming] == nil {
+		return ErrMissingPrimaryTime
+	}
+	return nil
+}
+
+func isHttpURL(raw string) bool {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return false
+	}
+	return (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+func abortWithError(c *gin.Context, code int, err error) {
+	c.AbortWithStatusJSON(code, request.ErrorResponse{
+		Errors: []error{
+			err,
+		},
+	})
+}
+
+// Submissions name a game, category and level in the body rather than
+// the path, so a missing one is a bad request rather than a 404.
+func abortWithLookupError(c *gin.Context, err error, errNotFound error) {
+	if errors.Is(err, errNotFound) {
+		abortWithError(c, http.StatusBadRequest, err)
+	} else {
+		abortWithError(c, http.StatusInternalServerError, err)
+	}
+}
@@ -0,0 +1,208 @@
+package run
+
+import (
+	"errors"
+	"time"
+
+	"github.com/speedrun-website/leaderboard-backend/database"
+	"github.com/speedrun-website/leaderboard-backend/server/game"
+	"github.com/speedrun-website/leaderboard-backend/server/user"
+	"gorm.io/gorm"
+)
+
+// The layout dates are submitted and returned in.
+const DateLayout = "2006-01-02"
+
+// A RunStatus is where a run is in the verification workflow.
+// Runs start out pending and are then verified or rejected by a moderator.
+type RunStatus string
+
+const (
+	Pending  RunStatus = "pending"
+	Verified RunStatus = "verified"
+	Rejected RunStatus = "rejected"
+)
+
+// A Run is a single attempt at a category that a user has submitted.
+// A run always has a time for its category's primary timing method,
+// and may have times for any of its other allowed timing methods.
+// Runs are known outside of the database by their PublicID.
+type Run struct {
+	gorm.Model
+	PublicID        string `gorm:"unique"`
+	UserID          uint
+	User            user.User
+	GameID          uint
+	Game            game.Game
+	CategoryID      uint
+	Category        game.Category
+	LevelID         *uint
+	Level           *game.Level
+	RealTime        *time.Duration
+	RealTimeNoLoads *time.Duration
+	GameTime        *time.Duration
+	PlayedOn        time.Time `gorm:"type:date"`
+	VideoURL        string
+	Comment         string
+
+	Status          RunStatus `gorm:"default:pending;index"`
+	RejectionReason string
+	StatusChanges   []RunStatusChange
+	VariableValues  []RunVariableValue
+}
+
+// A RunStatusChange records a moderator moving a run between statuses.
+type RunStatusChange struct {
+	ID          uint `gorm:"primarykey"`
+	RunID       uint `gorm:"index"`
+	ModeratorID *uint
+	Moderator   *user.User
+	FromStatus  RunStatus
+	ToStatus    RunStatus
+	Reason      string
+	CreatedAt   time.Time
+}
+
+type RunStatusChangeInfo struct {
+	// Moderator is null once the moderator's account is purged.
+	Moderator *user.UserIdentifier `json:"moderator"`
+	From      RunStatus            `json:"from"`
+	To        RunStatus            `json:"to"`
+	Reason    string               `json:"reason,omitempty"`
+	ChangedAt time.Time            `json:"changed_at"`
+}
+
+// AsInfo expects the change's Moderator to be loaded.
+func (c RunStatusChange) AsInfo() *RunStatusChangeInfo {
+	var moderator *user.UserIdentifier
+	if c.Moderator != nil {
+		moderator = c.Moderator.AsIdentifier()
+	}
+	return &RunStatusChangeInfo{
+		Moderator: moderator,
+		From:      c.FromStatus,
+		To:        c.ToStatus,
+		Reason:    c.Reason,
+		ChangedAt: c.CreatedAt,
+	}
+}
+
+type RunInfo struct {
+	ID              string               `json:"id"`
+	User            *user.UserIdentifier `json:"user"`
+	Game            string               `json:"game"`
+	Category        string               `json:"category"`
+	Level           string               `json:"level,omitempty"`
+	RealTime        *Duration            `json:"real_time"`
+	RealTimeNoLoads *Duration            `json:"real_time_noloads"`
+	GameTime        *Duration            `json:"game_time"`
+	Date            string               `json:"date"`
+	VideoURL        string               `json:"video_url"`
+	Comment         string               `json:"comment"`
+	SubmittedAt     time.Time            `json:"submitted_at"`
+
+	Status          RunStatus `json:"status"`
+	RejectionReason string    `json:"rejection_reason,omitempty"`
+
+	// Variables maps the public IDs of variables to the public IDs of
+	// their values.
+	Variables map[string]string `json:"variables"`
+}
+
+// AsInfo expects the run's User, Game, Category, Level and
+// VariableValues, with their Variable and Value, to be loaded.
+func (r Run) AsInfo() *RunInfo {
+	info := &RunInfo{
+		ID:              r.PublicID,
+		User:            r.User.AsIdentifier(),
+		Game:            r.Game.Slug,
+		Category:        r.Category.Slug,
+		RealTime:        durationPtr(r.RealTime),
+		RealTimeNoLoads: durationPtr(r.RealTimeNoLoads),
+		GameTime:        durationPtr(r.GameTime),
+		Date:            r.PlayedOn.Format(DateLayout),
+		VideoURL:        r.VideoURL,
+		Comment:         r.Comment,
+		SubmittedAt:     r.CreatedAt,
+
+		Status:          r.Status,
+		RejectionReason: r.RejectionReason,
+
+		Variables: map[string]string{},
+	}
+	for _, value := range r.VariableValues {
+		info.Variables[value.Variable.PublicID] = value.Value.PublicID
+	}
+	if r.Level != nil {
+		info.Level = r.Level.Slug
+	}
+	return info
+}
+
+// BeforeCreate gives the run a public ID if it doesn't have one yet.
+func (r *Run) BeforeCreate(tx *gorm.DB) error {
+	return database.SetPublicID(&r.PublicID)
+}
+
+// Time returns the run's time for a timing method,
+// or nil if it wasn't timed that way.
+func (r Run) Time(method game.TimingMethod) *time.Duration {
+	switch method {
+	case game.RealTime:
+		return r.RealTime
+	case game.RealTimeNoLoads:
+		return r.RealTimeNoLoads
+	case game.GameTime:
+		return r.GameTime
+	}
+	return nil
+}
+
+// The globally exported RunStore that the application will use.
+var Store RunStore
+
+// The RunStore interface, which defines ways that the application
+// can query for runs.
+type RunStore interface {
+	database.DataStore
+
+	GetRunById(uint) (*Run, error)
+	GetRunByPublicId(string) (*Run, error)
+	CreateRun(*Run) error
+	DeleteRun(uint) error
+
+	GetLeaderboard(LeaderboardQuery) ([]LeaderboardEntry, error)
+	// GetPersonalBests returns the user's personal best on every board
+	// they have a verified run on, ordered by game, category and level.
+	GetPersonalBests(userId uint) ([]PersonalBest, error)
+
+	// GetGameRuns returns every run in a game, whatever its status,
+	// oldest submission first.
+	GetGameRuns(gameId uint) ([]Run, error)
+
+	GetPendingRuns(gameId uint) ([]Run, error)
+	ChangeRunStatus(*RunStatusChange) error
+	GetRunStatusChanges(runId uint) ([]RunStatusChange, error)
+}
+
+// Errors
+var ErrRunNotFound = errors.New("the requested run was not found")
+
+var ErrNoTime = errors.New("a run must have at least one time")
+var ErrNonPositiveTime = errors.New("run times must be greater than zero")
+var ErrTimingNotAllowed = errors.New("the category doesn't allow the timing method")
+var ErrMissingPrimaryTime = errors.New("a run must have a time for the category's primary timing method")
+var ErrInvalidDate = errors.New("the run date must be in the form YYYY-MM-DD")
+var ErrDateInFuture = errors.New("the run date cannot be in the future")
+var ErrInvalidVideoURL = errors.New("the video URL must be an http or https link")
+
+var ErrStatusUnchanged = errors.New("the run already has the requested status")
+var ErrStatusChangedConcurrently = errors.New("the run's status was changed by someone else")
+
+type RunCreationError struct {
+	Err error
+}
+
+func (e RunCreationError) Error() string {
+	return "the run creation failed with the following error: " + e.Err.Error()
+}
@@ -0,0 +1,940 @@
+package run_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/joho/godotenv"
+	"github.com/speedrun-website/leaderboard-backend/config"
+	"github.com/speedrun-website/leaderboard-backend/database"
+	"github.com/speedrun-website/leaderboard-backend/database/migrations"
+	"github.com/speedrun-website/leaderboard-backend/server/game"
+	"github.com/speedrun-website/leaderboard-backend/server/request"
+	"github.com/speedrun-website/leaderboard-backend/server/role"
+	"github.com/speedrun-website/leaderboard-backend/server/run"
+	"github.com/speedrun-website/leaderboard-backend/server/user"
+)
+
+func getEnvPath() string {
+	return fmt.Sprintf("../../%s", os.Getenv("ENV"))
+}
+
+func init() {
+	if err := godotenv.Load(getEnvPath()); err != nil {
+		log.Fatalf("Where's the .env file?")
+	}
+
+	if err := database.InitGlobalTestConnection(); err != nil {
+		log.Fatalf("DB failed to initialise.")
+	}
+	if _, err := migrations.Up(database.DB); err != nil {
+		log.Fatalf("Migrations failed: %s", err)
+	}
+
+	if err := user.InitGormStore(nil); err != nil {
+		log.Fatalf("User store failed to initialise.")
+	}
+	if err := role.InitGormStore(nil); err != nil {
+		log.Fatalf("Role store failed to initialise.")
+	}
+	if err := game.InitGormStore(nil); err != nil {
+		log.Fatalf("Game store failed to initialise.")
+	}
+	if err := run.InitGormStore(nil); err != nil {
+		log.Fatalf("Run store failed to initialise.")
+	}
+}
+
+func TestSubmitRun(t *testing.T) {
+	t.Parallel()
+
+	r, authMiddleware := getRunsContext()
+	f := createFixture(t, "submit-game", "RunSubmitter")
+	defer f.cleanup(t)
+
+	token, _, err := authMiddleware.TokenGenerator(f.user.AsPersonal())
+	if err != nil {
+		t.Fatalf("token generation failed: %s", err)
+	}
+
+	realTime := run.DurationFromMilliseconds(5025123)
+	responseBytes, err := testJsonPostRequest(r, "/runs", token, run.RunSubmit{
+		Game:     f.game.Slug,
+		Category: f.category.Slug,
+		RealTime: &realTime,
+		Date:     "2021-10-01",
+		VideoURL: "https://www.youtube.com/watch?v=dQw4w9WgXcQ",
+		Comment:  "pb!",
+	}, http.StatusCreated)
+	if err != nil {
+		t.Fatalf("submitting run failed: %s", err)
+	}
+	var created run.RunResponse
+	if _, err := request.UnmarshalSuccessResponseData(responseBytes, &created); err != nil {
+		t.Fatal("bad response format")
+	}
+	f.trackRun(t, created.Run.ID)
+
+	if created.Run.User.PublicID != f.user.PublicID {
+		t.Fatalf("expected runner %s, got %s", f.user.PublicID, created.Run.User.PublicID)
+	}
+	if created.Run.RealTime == nil || *created.Run.RealTime != realTime {
+		t.Fatalf("expected real time %d, got %v", realTime, created.Run.RealTime)
+	}
+	if iso := created.Run.RealTime.ISO8601(); iso != "PT1H23M45.123S" {
+		t.Fatalf("expected real time PT1H23M45.123S, got %s", iso)
+	}
+	if created.Run.GameTime != nil {
+		t.Fatalf("expected no game time, got %d", *created.Run.GameTime)
+	}
+
+	responseBytes, err = testGetRequest(r, fmt.Sprintf("/runs/%s", created.Run.ID), http.StatusOK)
+	if err != nil {
+		t.Fatalf("getting run failed: %s", err)
+	}
+	var fetched run.RunResponse
+	if _, err := request.UnmarshalSuccessResponseData(responseBytes, &fetched); err != nil {
+		t.Fatal("bad response format")
+	}
+	if fetched.Run.Date != "2021-10-01" || fetched.Run.Category != f.category.Slug {
+		t.Fatalf("unexpected run: %+v", fetched.Run)
+	}
+}
+
+func TestSubmitRun400(t *testing.T) {
+	t.Parallel()
+
+	r, authMiddleware := getRunsContext()
+	f := createFixture(t, "bad-submit-game", "BadRunSubmitter")
+	defer f.cleanup(t)
+
+	token, _, err := authMiddleware.TokenGenerator(f.user.AsPersonal())
+	if err != nil {
+		t.Fatalf("token generation failed: %s", err)
+	}
+
+	realTime := run.DurationFromMilliseconds(1000)
+	valid := run.RunSubmit{
+		Game:     f.game.Slug,
+		Category: f.category.Slug,
+		RealTime: &realTime,
+		Date:     "2021-10-01",
+		VideoURL: "https://www.twitch.tv/videos/1",
+	}
+
+	testCases := []struct {
+		name   string
+		modify func(*run.RunSubmit)
+	}{
+		{
+			name:   "No time",
+			modify: func(s *run.RunSubmit) { s.RealTime = nil },
+		},
+		{
+			name: "Zero time",
+			modify: func(s *run.RunSubmit) {
+				zero := run.DurationFromMilliseconds(0)
+				s.RealTime = &zero
+			},
+		},
+		{
+			name:   "Disallowed timing",
+			modify: func(s *run.RunSubmit) { s.RealTimeNoLoads = &realTime },
+		},
+		{
+			name: "No primary time",
+			modify: func(s *run.RunSubmit) {
+				s.RealTime = nil
+				s.GameTime = &realTime
+			},
+		},
+		{
+			name:   "Malformed date",
+			modify: func(s *run.RunSubmit) { s.Date = "01/10/2021" },
+		},
+		{
+			name:   "Future date",
+			modify: func(s *run.RunSubmit) { s.Date = "2999-01-01" },
+		},
+		{
+			name:   "Non-http video",
+			modify: func(s *run.RunSubmit) { s.VideoURL = "javascript:alert(1)" },
+		},
+		{
+			name:   "Unknown category",
+			modify: func(s *run.RunSubmit) { s.Category = "not-a-category" },
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			body := valid
+			testCase.modify(&body)
+			_, err := testJsonPostRequest(r, "/runs", token, body, http.StatusBadRequest)
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestSubmitRun401(t *testing.T) {
+	t.Parallel()
+
+	r, _ := getRunsContext()
+	_, err := testJsonPostRequest(r, "/runs", "", run.RunSubmit{}, http.StatusUnauthorized)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSubmitRun403(t *testing.T) {
+	t.Parallel()
+
+	r, authMiddleware := getRunsContext()
+	f := createFixture(t, "unverified-submit-game", "UnverifiedRunSubmitter")
+	defer f.cleanup(t)
+
+	hash, err := user.HashAndSaltPassword([]byte("beepboopbop"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	unverified := &user.User{
+		Username: "UnverifiedRunner",
+		Email:    "unverified-runner@email.com",
+		Password: hash,
+	}
+	if err := user.Store.CreateUser(unverified); err != nil {
+		t.Fatalf("creating user failed: %s", err)
+	}
+	f.users = append(f.users, unverified)
+
+	token, _, err := authMiddleware.TokenGenerator(unverified.AsPersonal())
+	if err != nil {
+		t.Fatalf("token generation failed: %s", err)
+	}
+	realTime := run.DurationFromMilliseconds(1000)
+	_, err = testJsonPostRequest(r, "/runs", token, run.RunSubmit{
+		Game:     f.game.Slug,
+		Category: f.category.Slug,
+		RealTime: &realTime,
+		Date:     "2021-10-01",
+		VideoURL: "https://www.twitch.tv/videos/1",
+	}, http.StatusForbidden)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLeaderboard(t *testing.T) {
+	t.Parallel()
+
+	r, _ := getRunsContext()
+	f := createFixture(t, "leaderboard-game", "Fastest", "TiedA", "TiedB", "Slowest")
+	defer f.cleanup(t)
+
+	fastest, tiedA, tiedB, slowest := f.users[0], f.users[1], f.users[2], f.users[3]
+	obsolete := f.createRun(t, fastest, 90*time.Second, "2021-01-01")
+	pb := f.createRun(t, fastest, 80*time.Second, "2021-02-01")
+	f.createRun(t, tiedA, 100*time.Second, "2021-01-01")
+	f.createRun(t, tiedB, 100*time.Second, "2021-01-02")
+	f.createRun(t, slowest, 120*time.Second, "2021-01-01")
+
+	target := fmt.Sprintf("/games/%s/categories/%s/leaderboard", f.game.Slug, f.category.Slug)
+	leaderboard := getLeaderboard(t, r, target)
+
+	expected := []struct {
+		place  int
+		userId string
+	}{
+		{1, fastest.PublicID},
+		{2, tiedA.PublicID},
+		{2, tiedB.PublicID},
+		{4, slowest.PublicID},
+	}
+	if len(leaderboard.Entries) != len(expected) {
+		t.Fatalf("expected %d entries, got %d", len(expected), len(leaderboard.Entries))
+	}
+	for i, e := range expected {
+		entry := leaderboard.Entries[i]
+		if entry.Place == nil || *entry.Place != e.place || entry.User.PublicID != e.userId {
+			t.Fatalf("entry %d: expected place %d for user %s, got %+v", i, e.place, e.userId, entry)
+		}
+	}
+	if leaderboard.Entries[0].RunID != pb {
+		t.Fatalf("expected personal best run %s, got %s", pb, leaderboard.Entries[0].RunID)
+	}
+
+	leaderboard = getLeaderboard(t, r, target+"?include_obsolete=true")
+	if len(leaderboard.Entries) != len(expected)+1 {
+		t.Fatalf("expected %d entries, got %d", len(expected)+1, len(leaderboard.Entries))
+	}
+	for _, entry := range leaderboard.Entries {
+		if entry.RunID == obsolete && (!entry.Obsolete || entry.Place != nil) {
+			t.Fatalf("expected run %s to be obsolete without a place, got %+v", obsolete, entry)
+		}
+	}
+}
+
+func TestPersonalBests(t *testing.T) {
+	t.Parallel()
+
+	f := createFixture(t, "personal-bests-game", "PBRunner", "PBRival")
+	defer f.cleanup(t)
+
+	runner, rival := f.users[0], f.users[1]
+	f.createRun(t, runner, 90*time.Second, "2021-01-01")
+	pb := f.createRun(t, runner, 85*time.Second, "2021-02-01")
+	f.createRun(t, rival, 80*time.Second, "2021-01-01")
+
+	bests, err := run.Store.GetPersonalBests(runner.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bests) != 1 {
+		t.Fatalf("expected 1 personal best, got %d", len(bests))
+	}
+	best := bests[0]
+	if best.RunID != pb || best.Place != 2 || best.Game != f.game.Slug || best.Category != f.category.Slug {
+		t.Fatalf("expected run %s in second place, got %+v", pb, best)
+	}
+
+	bests, err = run.Store.GetPersonalBests(rival.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bests) != 1 || bests[0].Place != 1 {
+		t.Fatalf("expected the rival to be first, got %+v", bests)
+	}
+}
+
+func TestLeaderboardTimings(t *testing.T) {
+	t.Parallel()
+
+	r, _ := getRunsContext()
+	f := createFixture(t, "timings-game", "RealTimeRunner", "GameTimeRunner")
+	defer f.cleanup(t)
+
+	playedOn, err := time.Parse(run.DateLayout, "2021-01-01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	times := []struct {
+		u                  *user.User
+		realTime, gameTime time.Duration
+	}{
+		{f.users[0], 95 * time.Second, 95 * time.Second},
+		{f.users[1], 100 * time.Second, 90 * time.Second},
+	}
+	for _, tm := range times {
+		realTime, gameTime := tm.realTime, tm.gameTime
+		f.storeRun(t, &run.Run{
+			UserID:     tm.u.ID,
+			GameID:     f.game.ID,
+			CategoryID: f.category.ID,
+			RealTime:   &realTime,
+			GameTime:   &gameTime,
+			PlayedOn:   playedOn,
+			VideoURL:   "https://www.twitch.tv/videos/1",
+			Status:     run.Verified,
+		})
+	}
+
+	target := fmt.Sprintf("/games/%s/categories/%s/leaderboard", f.game.Slug, f.category.Slug)
+	leaderboard := getLeaderboard(t, r, target)
+	if leaderboard.Timing != game.RealTime || leaderboard.Entries[0].User.PublicID != f.users[0].PublicID {
+		t.Fatalf("expected %s to lead by real time, got %+v", f.users[0].Username, leaderboard)
+	}
+
+	leaderboard = getLeaderboard(t, r, target+"?timing=gametime")
+	if leaderboard.Timing != game.GameTime || leaderboard.Entries[0].User.PublicID != f.users[1].PublicID {
+		t.Fatalf("expected %s to lead by game time, got %+v", f.users[1].Username, leaderboard)
+	}
+	if gameTime := leaderboard.Entries[0].GameTime; gameTime == nil || gameTime.ISO8601() != "PT1M30S" {
+		t.Fatalf("expected a game time of PT1M30S, got %v", gameTime)
+	}
+
+	for _, timing := range []string{"realtime_noloads", "sundial"} {
+		if _, err := testGetRequest(r, target+"?timing="+timing, http.StatusBadRequest); err != nil {
+			t.Fatalf("%s: %s", timing, err)
+		}
+	}
+}
+
+func TestDurationJSON(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		json         string
+		milliseconds int64
+		iso8601      string
+	}{
+		{`5025123`, 5025123, "PT1H23M45.123S"},
+		{`"PT1H23M45.123S"`, 5025123, "PT1H23M45.123S"},
+		{`{"milliseconds": 90500}`, 90500, "PT1M30.5S"},
+		{`{"iso8601": "P1DT2H"}`, 93600000, "PT26H"},
+		{`"PT59,9S"`, 59900, "PT59.9S"},
+		{`0`, 0, "PT0S"},
+	}
+	for _, testCase := range testCases {
+		var d run.Duration
+		if err := json.Unmarshal([]byte(testCase.json), &d); err != nil {
+			t.Fatalf("%s: %s", testCase.json, err)
+		}
+		if d.Milliseconds() != testCase.milliseconds || d.ISO8601() != testCase.iso8601 {
+			t.Fatalf("%s: expected %d (%s), got %d (%s)",
+				testCase.json, testCase.milliseconds, testCase.iso8601, d.Milliseconds(), d.ISO8601())
+		}
+
+		encoded, err := json.Marshal(d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := fmt.Sprintf(`{"milliseconds":%d,"iso8601":"%s"}`, testCase.milliseconds, testCase.iso8601)
+		if string(encoded) != expected {
+			t.Fatalf("expected %s, got %s", expected, encoded)
+		}
+	}
+
+	for _, invalid := range []string{`"P"`, `"PT"`, `"P1Y"`, `"-PT1S"`, `"1:23:45"`, `true`} {
+		var d run.Duration
+		if err := json.Unmarshal([]byte(invalid), &d); err == nil {
+			t.Fatalf("expected %s to be rejected", invalid)
+		}
+	}
+}
+
+func TestLeaderboardVariables(t *testing.T) {
+	t.Parallel()
+
+	r, authMiddleware := getRunsContext()
+	f := createFixture(t, "variables-game", "ConsoleRunner", "EmulatorRunner")
+	defer f.cleanup(t)
+
+	platform := &game.Variable{
+		GameID:        f.game.ID,
+		Name:          "Platform",
+		IsSubcategory: true,
+		Required:      true,
+		Values: []game.VariableValue{
+			{Label: "N64"},
+			{Label: "Virtual Console"},
+		},
+	}
+	difficulty := &game.Variable{
+		GameID:     f.game.ID,
+		CategoryID: &f.category.ID,
+		Name:       "Difficulty",
+		Values: []game.VariableValue{
+			{Label: "Easy"},
+			{Label: "Hard"},
+		},
+	}
+	for _, variable := range []*game.Variable{platform, difficulty} {
+		if err := game.Store.CreateVariable(variable); err != nil {
+			t.Fatalf("creating variable failed: %s", err)
+		}
+	}
+	n64, vc := platform.Values[0], platform.Values[1]
+	easy, hard := difficulty.Values[0], difficulty.Values[1]
+
+	console, emulator := f.users[0], f.users[1]
+	f.createRun(t, console, 100*time.Second, "2021-01-01",
+		run.RunVariableValue{VariableID: platform.ID, ValueID: n64.ID},
+		run.RunVariableValue{VariableID: difficulty.ID, ValueID: hard.ID})
+	f.createRun(t, console, 90*time.Second, "2021-01-02",
+		run.RunVariableValue{VariableID: platform.ID, ValueID: n64.ID},
+		run.RunVariableValue{VariableID: difficulty.ID, ValueID: easy.ID})
+	f.createRun(t, emulator, 80*time.Second, "2021-01-01",
+		run.RunVariableValue{VariableID: platform.ID, ValueID: vc.ID})
+
+	target := fmt.Sprintf("/games/%s/categories/%s/leaderboard", f.game.Slug, f.category.Slug)
+
+	leaderboard := getLeaderboard(t, r, target)
+	if len(leaderboard.Entries) != 1 || leaderboard.Entries[0].User.PublicID != console.PublicID {
+		t.Fatalf("expected only the N64 board by default, got %+v", leaderboard.Entries)
+	}
+	if leaderboard.Variables[platform.PublicID] != n64.PublicID {
+		t.Fatalf("expected the platform to default to N64, got %v", leaderboard.Variables)
+	}
+	if leaderboard.Entries[0].RealTime.Milliseconds() != 90000 {
+		t.Fatalf("expected the N64 personal best, got %s", leaderboard.Entries[0].RealTime.ISO8601())
+	}
+
+	leaderboard = getLeaderboard(t, r, fmt.Sprintf("%s?var[%s]=%s", target, platform.PublicID, vc.PublicID))
+	if len(leaderboard.Entries) != 1 || leaderboard.Entries[0].User.PublicID != emulator.PublicID {
+		t.Fatalf("expected only the Virtual Console board, got %+v", leaderboard.Entries)
+	}
+
+	leaderboard = getLeaderboard(t, r, fmt.Sprintf("%s?var[%s]=%s", target, difficulty.PublicID, hard.PublicID))
+	if len(leaderboard.Entries) != 1 || leaderboard.Entries[0].RealTime.Milliseconds() != 100000 {
+		t.Fatalf("expected the personal best on hard, got %+v", leaderboard.Entries)
+	}
+
+	for _, query := range []string{
+		fmt.Sprintf("var[%s]=%s", platform.PublicID, easy.PublicID),
+		fmt.Sprintf("var[%d]=%d", platform.ID, n64.ID),
+		"var[abc]=1",
+	} {
+		if _, err := testGetRequest(r, target+"?"+query, http.StatusBadRequest); err != nil {
+			t.Fatalf("%s: %s", query, err)
+		}
+	}
+
+	token, _, err := authMiddleware.TokenGenerator(console.AsPersonal())
+	if err != nil {
+		t.Fatalf("token generation failed: %s", err)
+	}
+	realTime := run.DurationFromMilliseconds(85000)
+	submission := run.RunSubmit{
+		Game:     f.game.Slug,
+		Category: f.category.Slug,
+		RealTime: &realTime,
+		Date:     "2021-10-01",
+		VideoURL: "https://www.twitch.tv/videos/3",
+	}
+	if _, err := testJsonPostRequest(r, "/runs", token, submission, http.StatusBadRequest); err != nil {
+		t.Fatalf("submission without sub-category: %s", err)
+	}
+
+	submission.Variables = map[string]string{platform.PublicID: n64.PublicID}
+	responseBytes, err := testJsonPostRequest(r, "/runs", token, submission, http.StatusCreated)
+	if err != nil {
+		t.Fatalf("submission with sub-category: %s", err)
+	}
+	var created run.RunResponse
+	if _, err := request.UnmarshalSuccessResponseData(responseBytes, &created); err != nil {
+		t.Fatal("bad response format")
+	}
+	f.trackRun(t, created.Run.ID)
+	if created.Run.Variables[platform.PublicID] != n64.PublicID {
+		t.Fatalf("expected the run to be on N64, got %v", created.Run.Variables)
+	}
+
+	bests, err := run.Store.GetPersonalBests(emulator.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bests) != 1 || bests[0].Subcategories[platform.PublicID] != vc.PublicID {
+		t.Fatalf("expected a Virtual Console personal best, got %+v", bests)
+	}
+
+	// Runs from before a sub-category existed stay on its default board.
+	region := &game.Variable{
+		GameID:        f.game.ID,
+		CategoryID:    &f.category.ID,
+		Name:          "Region",
+		IsSubcategory: true,
+		Required:      true,
+		Values: []game.VariableValue{
+			{Label: "NTSC"},
+			{Label: "PAL"},
+		},
+	}
+	if err := game.Store.CreateVariable(region); err != nil {
+		t.Fatalf("creating variable failed: %s", err)
+	}
+	leaderboard = getLeaderboard(t, r, target)
+	if leaderboard.Variables[region.PublicID] != region.Values[0].PublicID {
+		t.Fatalf("expected the region to default to NTSC, got %v", leaderboard.Variables)
+	}
+	if len(leaderboard.Entries) != 1 || leaderboard.Entries[0].RealTime.Milliseconds() != 90000 {
+		t.Fatalf("expected the N64 personal best to stay on the board, got %+v", leaderboard.Entries)
+	}
+}
+
+func TestVerifyRun(t *testing.T) {
+	t.Parallel()
+
+	r, authMiddleware := getRunsContext()
+	f := createFixture(t, "verify-game", "VerifyRunner", "VerifyVerifier")
+	defer f.cleanup(t)
+
+	runner, moderator := f.users[0], f.users[1]
+	if err := role.Store.GrantGameRole(f.game.ID, moderator.ID, role.Verifier); err != nil {
+		t.Fatalf("granting verifier failed: %s", err)
+	}
+	runnerToken, _, err := authMiddleware.TokenGenerator(runner.AsPersonal())
+	if err != nil {
+		t.Fatalf("token generation failed: %s", err)
+	}
+	moderatorToken, _, err := authMiddleware.TokenGenerator(moderator.AsPersonal())
+	if err != nil {
+		t.Fatalf("token generation failed: %s", err)
+	}
+
+	realTime := run.DurationFromMilliseconds(60000)
+	responseBytes, err := testJsonPostRequest(r, "/runs", runnerToken, run.RunSubmit{
+		Game:     f.game.Slug,
+		Category: f.category.Slug,
+		RealTime: &realTime,
+		Date:     "2021-10-01",
+		VideoURL: "https://www.twitch.tv/videos/2",
+	}, http.StatusCreated)
+	if err != nil {
+		t.Fatalf("submitting run failed: %s", err)
+	}
+	var created run.RunResponse
+	if _, err := request.UnmarshalSuccessResponseData(responseBytes, &created); err != nil {
+		t.Fatal("bad response format")
+	}
+	f.trackRun(t, created.Run.ID)
+	if created.Run.Status != run.Pending {
+		t.Fatalf("expected a new run to be pending, got %s", created.Run.Status)
+	}
+
+	target := fmt.Sprintf("/games/%s/categories/%s/leaderboard", f.game.Slug, f.category.Slug)
+	if entries := getLeaderboard(t, r, target).Entries; len(entries) != 0 {
+		t.Fatalf("expected pending runs to be left off the leaderboard, got %d entries", len(entries))
+	}
+
+	queueTarget := fmt.Sprintf("/games/%s/runs/pending", f.game.Slug)
+	if _, err := testGetRequestWithToken(r, queueTarget, runnerToken, http.StatusForbidden); err != nil {
+		t.Fatalf("non-moderator queue: %s", err)
+	}
+	responseBytes, err = testGetRequestWithToken(r, queueTarget, moderatorToken, http.StatusOK)
+	if err != nil {
+		t.Fatalf("getting queue failed: %s", err)
+	}
+	var queue run.RunsResponse
+	if _, err := request.UnmarshalSuccessResponseData(responseBytes, &queue); err != nil {
+		t.Fatal("bad response format")
+	}
+	if len(queue.Runs) != 1 || queue.Runs[0].ID != created.Run.ID {
+		t.Fatalf("expected run %s in the queue, got %v", created.Run.ID, queue.Runs)
+	}
+
+	verifyTarget := fmt.Sprintf("/runs/%s/verify", created.Run.ID)
+	if _, err := testJsonPostRequest(r, verifyTarget, runnerToken, nil, http.StatusForbidden); err != nil {
+		t.Fatalf("self verification: %s", err)
+	}
+	if _, err := testJsonPostRequest(r, verifyTarget, moderatorToken, nil, http.StatusOK); err != nil {
+		t.Fatalf("verification failed: %s", err)
+	}
+	if _, err := testJsonPostRequest(r, verifyTarget, moderatorToken, nil, http.StatusConflict); err != nil {
+		t.Fatalf("double verification: %s", err)
+	}
+	if entries := getLeaderboard(t, r, target).Entries; len(entries) != 1 {
+		t.Fatalf("expected the verified run on the leaderboard, got %d entries", len(entries))
+	}
+
+	rejectTarget := fmt.Sprintf("/runs/%s/reject", created.Run.ID)
+	if _, err := testJsonPostRequest(r, rejectTarget, moderatorToken, run.RunReject{}, http.StatusBadRequest); err != nil {
+		t.Fatalf("rejection without reason: %s", err)
+	}
+	_, err = testJsonPostRequest(r, rejectTarget, moderatorToken, run.RunReject{
+		Reason: "Video is private",
+	}, http.StatusOK)
+	if err != nil {
+		t.Fatalf("rejection failed: %s", err)
+	}
+
+	responseBytes, err = testGetRequest(r, fmt.Sprintf("/runs/%s/history", created.Run.ID), http.StatusOK)
+	if err != nil {
+		t.Fatalf("getting history failed: %s", err)
+	}
+	var history run.RunHistoryResponse
+	if _, err := request.UnmarshalSuccessResponseData(responseBytes, &history); err != nil {
+		t.Fatal("bad response format")
+	}
+	if len(history.History) != 2 {
+		t.Fatalf("expected 2 status changes, got %d", len(history.History))
+	}
+	last := history.History[1]
+	if last.Moderator.PublicID != moderator.PublicID || last.To != run.Rejected || last.Reason != "Video is private" {
+		t.Fatalf("unexpected status change: %+v", last)
+	}
+}
+
+func TestPurgeDeletedUser(t *testing.T) {
+	f := createFixture(t, "purge-deleted-test", "PurgedRunner", "PurgedModerator", "KeptRunner")
+	defer f.cleanup(t)
+
+	runner, moderator, kept := f.users[0], f.users[1], f.users[2]
+	purgedRun := f.createRun(t, runner, 90*time.Second, "2021-06-01")
+	keptRun := f.createRun(t, kept, 95*time.Second, "2021-06-02")
+
+	rn, err := run.Store.GetRunByPublicId(keptRun)
+	if err != nil {
+		t.Fatalf("finding run failed: %s", err)
+	}
+	err = run.Store.ChangeRunStatus(&run.RunStatusChange{
+		RunID:       rn.ID,
+		ModeratorID: &moderator.ID,
+		FromStatus:  run.Verified,
+		ToStatus:    run.Rejected,
+		Reason:      "Video is private",
+	})
+	if err != nil {
+		t.Fatalf("rejecting run failed: %s", err)
+	}
+
+	for _, u := range []*user.User{runner, moderator} {
+		if err := user.Store.DeleteUser(u.ID); err != nil {
+			t.Fatalf("deleting user failed: %s", err)
+		}
+	}
+	if err := run.Store.DumpDeleted(); err != nil {
+		t.Fatalf("purging runs failed: %s", err)
+	}
+	if err := role.Store.DumpDeleted(); err != nil {
+		t.Fatalf("purging roles failed: %s", err)
+	}
+	if err := user.Store.DumpDeleted(); err != nil {
+		t.Fatalf("purging users failed: %s", err)
+	}
+
+	if _, err := run.Store.GetRunByPublicId(purgedRun); !errors.Is(err, run.ErrRunNotFound) {
+		t.Fatalf("expected the purged user's run to be purged, got %v", err)
+	}
+	changes, err := run.Store.GetRunStatusChanges(rn.ID)
+	if err != nil {
+		t.Fatalf("getting status changes failed: %s", err)
+	}
+	if len(changes) != 1 || changes[0].ModeratorID != nil || changes[0].AsInfo().Moderator != nil {
+		t.Fatalf("expected the status change to be kept without its moderator, got %+v", changes)
+	}
+}
+
+func getLeaderboard(t *testing.T, r *gin.Engine, target string) run.LeaderboardResponse {
+	t.Helper()
+
+	responseBytes, err := testGetRequest(r, target, http.StatusOK)
+	if err != nil {
+		t.Fatalf("getting leaderboard failed: %s", err)
+	}
+	var leaderboard run.LeaderboardResponse
+	if _, err := request.UnmarshalSuccessResponseData(responseBytes, &leaderboard); err != nil {
+		t.Fatal("bad response format")
+	}
+	return leaderboard
+}
+
+// fixture holds users, a game and a category to submit runs to,
+// along with every run that needs cleaning up afterwards.
+type fixture struct {
+	users    []*user.User
+	user     *user.User
+	game     *game.Game
+	category *game.Category
+	runs     []uint
+}
+
+func createFixture(t *testing.T, gameSlug string, usernames ...string) *fixture {
+	t.Helper()
+
+	f := &fixture{}
+	for _, username := range usernames {
+		hash, err := user.HashAndSaltPassword([]byte("beepboopbop"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		verifiedAt := time.Now()
+		u := &user.User{
+			Username:        username,
+			Email:           username + "@email.com",
+			Password:        hash,
+			EmailVerifiedAt: &verifiedAt,
+		}
+		if err := user.Store.CreateUser(u); err != nil {
+			t.Fatalf("creating user failed: %s", err)
+		}
+		f.users = append(f.users, u)
+	}
+	f.user = f.users[0]
+
+	f.game = &game.Game{
+		Name: gameSlug,
+		Slug: gameSlug,
+	}
+	if err := game.Store.CreateGame(f.game); err != nil {
+		t.Fatalf("creating game failed: %s", err)
+	}
+
+	f.category = &game.Category{
+		GameID:        f.game.ID,
+		Name:          "Any%",
+		Slug:          "any",
+		PrimaryTiming: game.RealTime,
+		Timings:       game.TimingMethods{game.RealTime, game.GameTime},
+	}
+	if err := game.Store.CreateCategory(f.category); err != nil {
+		t.Fatalf("creating category failed: %s", err)
+	}
+
+	return f
+}
+
+// createRun stores a verified real time run by u directly,
+// skipping the handler and the moderation queue.
+func (f *fixture) createRun(
+	t *testing.T,
+	u *user.User,
+	realTime time.Duration,
+	date string,
+	values ...run.RunVariableValue,
+) string {
+	t.Helper()
+
+	playedOn, err := time.Parse(run.DateLayout, date)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rn := &run.Run{
+		UserID:     u.ID,
+		GameID:     f.game.ID,
+		CategoryID: f.category.ID,
+		RealTime:   &realTime,
+		PlayedOn:   playedOn,
+		VideoURL:   "https://www.twitch.tv/videos/1",
+		Status:     run.Verified,
+
+		VariableValues: values,
+	}
+	return f.storeRun(t, rn)
+}
+
+// storeRun stores rn directly and marks it for cleanup,
+// returning its public ID.
+func (f *fixture) storeRun(t *testing.T, rn *run.Run) string {
+	t.Helper()
+
+	if err := run.Store.CreateRun(rn); err != nil {
+		t.Fatalf("creating run failed: %s", err)
+	}
+	f.runs = append(f.runs, rn.ID)
+	return rn.PublicID
+}
+
+// trackRun marks the run with publicId, created through the API,
+// for cleanup.
+func (f *fixture) trackRun(t *testing.T, publicId string) {
+	t.Helper()
+
+	rn, err := run.Store.GetRunByPublicId(publicId)
+	if err != nil {
+		t.Fatalf("finding run failed: %s", err)
+	}
+	f.runs = append(f.runs, rn.ID)
+}
+
+func (f *fixture) cleanup(t *testing.T) {
+	t.Helper()
+
+	for _, id := range f.runs {
+		if err := run.Store.DeleteRun(id); err != nil {
+			t.Fatalf("cleanup failed: %s", err)
+		}
+	}
+	if err := run.Store.DumpDeleted(); err != nil {
+		t.Fatalf("cleanup failed: %s", err)
+	}
+	if err := game.Store.DeleteGame(f.game.ID); err != nil {
+		t.Fatalf("cleanup failed: %s", err)
+	}
+	if err := game.Store.DumpDeleted(); err != nil {
+		t.Fatalf("cleanup failed: %s", err)
+	}
+	for _, u := range f.users {
+		if err := user.Store.DeleteUser(u.ID); err != nil {
+			t.Fatalf("cleanup failed: %s", err)
+		}
+	}
+	if err := role.Store.DumpDeleted(); err != nil {
+		t.Fatalf("cleanup failed: %s", err)
+	}
+	if err := user.Store.DumpDeleted(); err != nil {
+		t.Fatalf("cleanup failed: %s", err)
+	}
+}
+
+func getRunsContext() (*gin.Engine, *user.AuthMiddleware) {
+	w := httptest.NewRecorder()
+	_, r := gin.CreateTestContext(w)
+	api := r.Group("/")
+	auth := config.Default().Auth
+	auth.JWTSecret = "a test secret that is long enough"
+	authMiddleware, err := user.NewAuthMiddleware(auth)
+	if err != nil {
+		log.Fatal(err)
+	}
+	run.PublicRoutes(api)
+	api.Use(authMiddleware.MiddlewareFunc())
+	{
+		run.AuthRoutes(api)
+	}
+	return r, authMiddleware
+}
+
+func testJsonPostRequest(
+	r *gin.Engine,
+	target string,
+	token string,
+	content interface{},
+	expectedStatusCode int,
+) ([]byte, error) {
+	reqBodyBytes, err := json.Marshal(content)
+	if err != nil {
+		return nil, fmt.Errorf(
+			"could not marshal %s into json",
+			content,
+		)
+	}
+	reqBodyBuffer := ioutil.NopCloser(bytes.NewBuffer(reqBodyBytes))
+	req := httptest.NewRequest(http.MethodPost, target, reqBodyBuffer)
+	if token != "" {
+		req.Header.Add("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	res := w.Result()
+	if res.StatusCode != expectedStatusCode {
+		return nil, fmt.Errorf(
+			"expected status code %d, got %d",
+			expectedStatusCode,
+			res.StatusCode,
+		)
+	}
+	return w.Body.Bytes(), nil
+}
+
+func testGetRequest(
+	r *gin.Engine,
+	target string,
+	expectedStatusCode int,
+) ([]byte, error) {
+	return testGetRequestWithToken(r, target, "", expectedStatusCode)
+}
+
+func testGetRequestWithToken(
+	r *gin.Engine,
+	target string,
+	token string,
+	expectedStatusCode int,
+) ([]byte, error) {
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	if token != "" {
+		req.Header.Add("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	res := w.Result()
+	if res.StatusCode != expectedStatusCode {
+		return nil, fmt.Errorf(
+			"expected status code %d, got %d",
+			expectedStatusCode,
+			res.StatusCode,
+		)
+	}
+	return w.Body.Bytes(), nil
+}
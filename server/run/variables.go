@@ -0,0 +1,118 @@
+package run
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/speedrun-website/leaderboard-backend/server/game"
+)
+
+// A RunVariableValue is the value a run has for one of its variables.
+type RunVariableValue struct {
+	RunID      uint `gorm:"primaryKey;autoIncrement:false"`
+	VariableID uint `gorm:"primaryKey;autoIncrement:false"`
+	Variable   game.Variable
+	ValueID    uint `gorm:"index"`
+	Value      game.VariableValue
+}
+
+var ErrUnknownVariable = errors.New("the variable doesn't apply to this category")
+var ErrInvalidVariableValue = errors.New("the value doesn't belong to the variable")
+var ErrMissingVariable = errors.New("a value is required for the variable")
+
+// variableValuesFromSubmission checks the values submitted with a run,
+// by their public IDs, against the variables that apply to its category.
+// Every value must belong to an applicable variable, and every required
+// variable must have a value.
+func variableValuesFromSubmission(
+	applicable []game.Variable,
+	submitted map[string]string,
+) ([]RunVariableValue, error) {
+	byPublicId := variablesByPublicId(applicable)
+	values := []RunVariableValue{}
+
+	for variablePublicId, valuePublicId := range submitted {
+		variable, ok := byPublicId[variablePublicId]
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", ErrUnknownVariable, variablePublicId)
+		}
+		value, ok := variable.ValueByPublicID(valuePublicId)
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidVariableValue, variable.Name)
+		}
+		values = append(values, RunVariableValue{
+			VariableID: variable.ID,
+			ValueID:    value.ID,
+		})
+	}
+
+	for _, variable := range applicable {
+		if _, ok := submitted[variable.PublicID]; variable.Required && !ok {
+			return nil, fmt.Errorf("%w: %s", ErrMissingVariable, variable.Name)
+		}
+	}
+
+	sort.Slice(values, func(i, j int) bool {
+		return values[i].VariableID < values[j].VariableID
+	})
+	return values, nil
+}
+
+// leaderboardFilters turns `var[<variable id>]=<value id>` query
+// parameters, by public IDs, into filters on the variables that apply to
+// a category. Sub-category variables that aren't given default to their
+// first value, since every leaderboard is one board of its sub-categories.
+func leaderboardFilters(
+	applicable []game.Variable,
+	requested map[string]string,
+) (map[uint]uint, error) {
+	byPublicId := variablesByPublicId(applicable)
+	filters := map[uint]uint{}
+
+	for variablePublicId, valuePublicId := range requested {
+		variable, ok := byPublicId[variablePublicId]
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", ErrUnknownVariable, variablePublicId)
+		}
+		value, ok := variable.ValueByPublicID(valuePublicId)
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidVariableValue, variable.Name)
+		}
+		filters[variable.ID] = value.ID
+	}
+
+	for _, variable := range applicable {
+		if _, ok := filters[variable.ID]; variable.IsSubcategory && !ok && len(variable.Values) > 0 {
+			filters[variable.ID] = variable.Values[0].ID
+		}
+	}
+
+	return filters, nil
+}
+
+// publicFilters maps the public IDs of the variables in filters to the
+// public IDs of their values.
+func publicFilters(applicable []game.Variable, filters map[uint]uint) map[string]string {
+	public := make(map[string]string, len(filters))
+	for _, variable := range applicable {
+		valueId, ok := filters[variable.ID]
+		if !ok {
+			continue
+		}
+		for _, value := range variable.Values {
+			if value.ID == valueId {
+				public[variable.PublicID] = value.PublicID
+			}
+		}
+	}
+	return public
+}
+
+func variablesByPublicId(variables []game.Variable) map[string]game.Variable {
+	byPublicId := make(map[string]game.Variable, len(variables))
+	for _, variable := range variables {
+		byPublicId[variable.PublicID] = variable
+	}
+	return byPublicId
+}
@@ -1,41 +1,91 @@
 package server
 
 import (
-	"log"
+	"fmt"
 	"net/http"
 
 	"github.com/gin-gonic/gin"
 	cors "github.com/rs/cors/wrapper/gin"
+	"gorm.io/gorm"
 
+	"github.com/speedrun-website/leaderboard-backend/config"
+	"github.com/speedrun-website/leaderboard-backend/database/migrations"
+	"github.com/speedrun-website/leaderboard-backend/mail"
+	"github.com/speedrun-website/leaderboard-backend/server/game"
+	"github.com/speedrun-website/leaderboard-backend/server/role"
+	"github.com/speedrun-website/leaderboard-backend/server/run"
 	"github.com/speedrun-website/leaderboard-backend/server/user"
 )
 
-func Init(router *gin.Engine) {
-	if err := initData(); err != nil {
-		log.Fatalf("Could not initialize data stores: %s", err)
+// Init sets up the data stores on db and registers every route on router.
+func Init(router *gin.Engine, c *config.Config, db *gorm.DB) error {
+	if err := InitStores(db); err != nil {
+		return fmt.Errorf("could not initialize data stores: %w", err)
 	}
 
 	router.Use(cors.New(cors.Options{
-		AllowedMethods:   []string{http.MethodGet, http.MethodPost, http.MethodOptions},
+		AllowedMethods:   []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete, http.MethodOptions},
 		AllowedHeaders:   []string{"*"},
 		AllowedOrigins:   []string{"*"},
 		AllowCredentials: true,
 		Debug:            true,
 	}))
 
-	authMiddleware := user.GetAuthMiddlewareHandler()
+	sender, err := mail.NewSender(c.Mail)
+	if err != nil {
+		return fmt.Errorf("could not initialize the mail sender: %w", err)
+	}
+	user.Configure(c, sender)
+	user.PersonalBestsLoader = func(userId uint) (interface{}, error) {
+		return run.Store.GetPersonalBests(userId)
+	}
+	user.GameSlugExists = func(slug string) bool {
+		_, err := game.Store.GetGameBySlug(slug)
+		return err == nil
+	}
+	if err := role.Configure(c.Auth); err != nil {
+		return fmt.Errorf("could not configure roles: %w", err)
+	}
+
+	authMiddleware, err := user.NewAuthMiddleware(c.Auth)
+	if err != nil {
+		return fmt.Errorf("could not initialize the auth middleware: %w", err)
+	}
+	router.GET("/.well-known/jwks.json", authMiddleware.JWKSHandler)
+
 	api := router.Group("/api/v1")
 
 	user.PublicRoutes(api, authMiddleware)
+	role.PublicRoutes(api)
+	game.PublicRoutes(api)
+	run.PublicRoutes(api)
 
 	api.Use(authMiddleware.MiddlewareFunc())
 	{
 		user.AuthRoutes(api, authMiddleware)
+		role.AuthRoutes(api)
+		game.AuthRoutes(api)
+		run.AuthRoutes(api)
 	}
+	return nil
 }
 
-func initData() error {
-	if err := user.InitGormStore(nil); err != nil {
+// InitStores sets up every data store on db,
+// which must have an up to date schema.
+func InitStores(db *gorm.DB) error {
+	if err := migrations.CheckCurrent(db); err != nil {
+		return err
+	}
+	if err := user.InitGormStore(db); err != nil {
+		return err
+	}
+	if err := role.InitGormStore(db); err != nil {
+		return err
+	}
+	if err := game.InitGormStore(db); err != nil {
+		return err
+	}
+	if err := run.InitGormStore(db); err != nil {
 		return err
 	}
 	return nil
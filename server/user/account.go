@@ -0,0 +1,241 @@
+package user
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/speedrun-website/leaderboard-backend/mail"
+	"github.com/speedrun-website/leaderboard-backend/server/request"
+)
+
+var ErrIncorrectPassword = errors.New("the current password is incorrect")
+var ErrLoginNotRecent = errors.New("log in again, or give a two-factor code, to do this")
+
+// How recently users without a password must have logged in to change
+// their email or set a password, unless they give a code instead.
+const recentLogin = 10 * time.Minute
+
+// UserSettings is the body of an account update. Only the fields that are
+// set are changed, and changing the email needs the current password.
+// Users without a password give a code, or must have logged in recently.
+type UserSettings struct {
+	Username        *string `json:"username" binding:"omitempty,min=1"`
+	Email           *string `json:"email" binding:"omitempty,email"`
+	CurrentPassword string  `json:"current_password"`
+	Code            string  `json:"code"`
+}
+
+// PasswordChange is the body of a password change. Users without a
+// password can set one the same way they change their email.
+type PasswordChange struct {
+	CurrentPassword string `json:"current_password"`
+	Code            string `json:"code"`
+	Password        string `json:"password" binding:"required,min=8"`
+	PasswordConfirm string `json:"password_confirm" binding:"eqfield=Password"`
+}
+
+// UpdateMeHandler changes the logged-in user's username or email.
+// A new email address has to be verified again.
+func UpdateMeHandler(c *gin.Context) {
+	var body UserSettings
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, request.ErrorResponse{
+			Errors: []error{
+				err,
+			},
+		})
+		return
+	}
+
+	user, ok := currentUser(c)
+	if !ok {
+		return
+	}
+
+	update := UserUpdate{}
+	if body.Username != nil && *body.Username != user.Username {
+		username, err := checkNewUsername(*body.Username)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, request.ErrorResponse{
+				Errors: []error{
+					err,
+				},
+			})
+			return
+		}
+		if username != user.Username {
+			update.Username = &username
+		}
+	}
+	if body.Email != nil && *body.Email != user.Email {
+		if !reauthenticate(c, user, body.CurrentPassword, body.Code) {
+			return
+		}
+		update.Email = body.Email
+	}
+
+	err := Store.UpdateUser(user.ID, update, settings.usernameChangeCooldown)
+	var cooldownErr UsernameCooldownError
+	if errors.Is(err, ErrUserNotUnique) {
+		c.AbortWithStatusJSON(http.StatusConflict, request.ErrorResponse{
+			Errors: []error{
+				err,
+			},
+		})
+		return
+	} else if errors.As(err, &cooldownErr) {
+		setRetryAfter(c, cooldownErr.Until)
+		c.AbortWithStatusJSON(http.StatusTooManyRequests, request.ErrorResponse{
+			Errors: []error{
+				err,
+			},
+		})
+		return
+	} else if err != nil {
+		log.Println(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	updated, err := Store.GetUserById(user.ID)
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	if update.Email != nil {
+		if err := sendVerificationEmail(updated); err != nil {
+			log.Printf("Could not send a verification email to user %d: %s", user.ID, err)
+		}
+		err := sendNotice(user, "Your email address was changed", fmt.Sprintf(
+			"The email address for your account was changed to %s. If it wasn't you, reset your password and get in touch with us.",
+			updated.Email,
+		))
+		if err != nil {
+			log.Printf("Could not notify user %d of their email change: %s", user.ID, err)
+		}
+	}
+
+	c.JSON(http.StatusOK, request.SuccessResponse{
+		Data: UserPersonalResponse{
+			User: updated.AsPersonal(),
+		},
+	})
+}
+
+// ChangePasswordHandler changes the logged-in user's password, or sets
+// one for users who only log in with other sites, and logs them out of
+// every other session.
+func ChangePasswordHandler(c *gin.Context) {
+	var body PasswordChange
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, request.ErrorResponse{
+			Errors: []error{
+				err,
+			},
+		})
+		return
+	}
+
+	user, ok := currentUser(c)
+	if !ok {
+		return
+	}
+	if !reauthenticate(c, user, body.CurrentPassword, body.Code) {
+		return
+	}
+
+	hash, err := HashAndSaltPassword([]byte(body.Password))
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if err := Store.ChangePassword(user.ID, hash); err != nil {
+		log.Println(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	// Stay logged in here, but nowhere else.
+	if session, ok := SessionFromContext(c); ok {
+		if err := Store.RevokeSessions(user.ID, session.TokenID); err != nil {
+			log.Println(err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if user.Password == nil {
+		err = sendNotice(user, "A password was added to your account", "A password was added to your account, so you can now log in with it too. If it wasn't you, reset your password and get in touch with us.")
+	} else {
+		err = sendNotice(user, "Your password was changed", "The password for your account was changed. If it wasn't you, reset your password and get in touch with us.")
+	}
+	if err != nil {
+		log.Printf("Could not notify user %d of their password change: %s", user.ID, err)
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// currentUser loads the logged-in user, aborting if that fails.
+func currentUser(c *gin.Context) (*User, bool) {
+	identity, ok := IdentityFromContext(c)
+	if !ok {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return nil, false
+	}
+	user, err := Store.GetUserById(identity.ID)
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return nil, false
+	}
+	return user, true
+}
+
+// reauthenticate checks that the logged-in user is really them before a
+// change to how they log in, aborting if not. Users with a password give
+// it. Users without one give a code if they have two-factor
+// authentication on, or must have logged in recently themselves rather
+// than through an app.
+func reauthenticate(c *gin.Context, user *User, password string, code string) bool {
+	if user.Password != nil {
+		if !ComparePasswords(user.Password, []byte(password)) {
+			abortIncorrectPassword(c)
+			return false
+		}
+		return true
+	}
+	if code != "" && user.HasTwoFactor() {
+		return checkSecondFactor(c, user, code, http.StatusForbidden)
+	}
+	if session, ok := SessionFromContext(c); ok && session.AppID == nil && time.Since(session.CreatedAt) < recentLogin {
+		return true
+	}
+	c.AbortWithStatusJSON(http.StatusForbidden, request.ErrorResponse{
+		Errors: []error{
+			ErrLoginNotRecent,
+		},
+	})
+	return false
+}
+
+func abortIncorrectPassword(c *gin.Context) {
+	c.AbortWithStatusJSON(http.StatusForbidden, request.ErrorResponse{
+		Errors: []error{
+			ErrIncorrectPassword,
+		},
+	})
+}
+
+// sendNotice emails user about a change to their account.
+func sendNotice(user *User, subject string, notice string) error {
+	return settings.sender.Send(mail.Message{
+		To:      user.Email,
+		Subject: subject,
+		Body:    fmt.Sprintf("Hi %s,\n\n%s\n", user.Username, notice),
+	})
+}
@@ -0,0 +1,246 @@
+package user
+
+import (
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/speedrun-website/leaderboard-backend/database"
+	"github.com/speedrun-website/leaderboard-backend/server/request"
+	"gorm.io/gorm"
+)
+
+// An OAuthApp is a third-party app that users can let act for them, with
+// the scopes they grant it. Apps that can keep a secret, because they run
+// on a server, are given a client secret, of which only a hash is stored.
+// Apps that can't, like desktop apps and browser extensions, have none
+// and rely on PKCE alone. Redirect URIs are separated by spaces.
+type OAuthApp struct {
+	ID               uint
+	PublicID         string `gorm:"unique"`
+	CreatedAt        time.Time
+	OwnerID          uint
+	Name             string
+	ClientID         string
+	ClientSecretHash []byte
+	RedirectURIs     string
+}
+
+func (OAuthApp) TableName() string {
+	return "oauth_apps"
+}
+
+func (a *OAuthApp) BeforeCreate(tx *gorm.DB) error {
+	return database.SetPublicID(&a.PublicID)
+}
+
+// OAuthAppCreate is the body of a request to register an app.
+// Confidential apps are given a client secret.
+type OAuthAppCreate struct {
+	Name         string   `json:"name" binding:"required,max=100"`
+	RedirectURIs []string `json:"redirect_uris" binding:"required,min=1,max=10"`
+	Confidential bool     `json:"confidential"`
+}
+
+type OAuthAppInfo struct {
+	ID           uint      `json:"-"`
+	PublicID     string    `json:"id"`
+	Name         string    `json:"name"`
+	ClientID     string    `json:"client_id"`
+	RedirectURIs []string  `json:"redirect_uris"`
+	Confidential bool      `json:"confidential"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// CreatedOAuthAppResponse holds a new app. Its client secret, if it has
+// one, is only shown once.
+type CreatedOAuthAppResponse struct {
+	App          *OAuthAppInfo `json:"app"`
+	ClientSecret string        `json:"client_secret,omitempty"`
+}
+
+type OAuthAppsResponse struct {
+	Apps []OAuthAppInfo `json:"apps"`
+}
+
+var ErrOAuthAppNotFound = errors.New("the app was not found")
+var ErrInvalidRedirectURI = errors.New("redirect URIs must be absolute https URLs without fragments, or http URLs on a loopback address")
+
+// How many random characters are in a client ID.
+const clientIDLength = 24
+
+func (a OAuthApp) Confidential() bool {
+	return a.ClientSecretHash != nil
+}
+
+func (a OAuthApp) AsInfo() *OAuthAppInfo {
+	return &OAuthAppInfo{
+		ID:           a.ID,
+		PublicID:     a.PublicID,
+		Name:         a.Name,
+		ClientID:     a.ClientID,
+		RedirectURIs: strings.Fields(a.RedirectURIs),
+		Confidential: a.Confidential(),
+		CreatedAt:    a.CreatedAt,
+	}
+}
+
+// HasRedirectURI reports whether uri is one of the app's redirect URIs.
+// They are compared exactly.
+func (a OAuthApp) HasRedirectURI(uri string) bool {
+	for _, u := range strings.Fields(a.RedirectURIs) {
+		if u == uri {
+			return true
+		}
+	}
+	return false
+}
+
+// GetOAuthAppsHandler lists the apps that the logged-in user registered.
+func GetOAuthAppsHandler(c *gin.Context) {
+	identity, ok := IdentityFromContext(c)
+	if !ok {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	apps, err := Store.GetOAuthApps(identity.ID)
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	infos := make([]OAuthAppInfo, 0, len(apps))
+	for _, app := range apps {
+		infos = append(infos, *app.AsInfo())
+	}
+	c.JSON(http.StatusOK, request.SuccessResponse{
+		Data: OAuthAppsResponse{
+			Apps: infos,
+		},
+	})
+}
+
+// CreateOAuthAppHandler registers an app owned by the logged-in user.
+func CreateOAuthAppHandler(c *gin.Context) {
+	var body OAuthAppCreate
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, request.ErrorResponse{
+			Errors: []error{
+				err,
+			},
+		})
+		return
+	}
+
+	identity, ok := IdentityFromContext(c)
+	if !ok {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	for _, uri := range body.RedirectURIs {
+		if !isValidRedirectURI(uri) {
+			c.AbortWithStatusJSON(http.StatusBadRequest, request.ErrorResponse{
+				Errors: []error{
+					ErrInvalidRedirectURI,
+				},
+			})
+			return
+		}
+	}
+
+	clientId, err := newOpaqueToken()
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	app := &OAuthApp{
+		OwnerID:      identity.ID,
+		Name:         body.Name,
+		ClientID:     clientId[:clientIDLength],
+		RedirectURIs: strings.Join(body.RedirectURIs, " "),
+	}
+	var secret string
+	if body.Confidential {
+		secret, err = newOpaqueToken()
+		if err != nil {
+			log.Println(err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		app.ClientSecretHash = hashToken(secret)
+	}
+	if err := Store.CreateOAuthApp(app); err != nil {
+		log.Println(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusCreated, request.SuccessResponse{
+		Data: CreatedOAuthAppResponse{
+			App:          app.AsInfo(),
+			ClientSecret: secret,
+		},
+	})
+}
+
+// DeleteOAuthAppHandler deletes one of the logged-in user's apps, which
+// logs it out of every account that authorized it.
+func DeleteOAuthAppHandler(c *gin.Context) {
+	identity, ok := IdentityFromContext(c)
+	if !ok {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	publicId := c.Param("id")
+	if !database.IsPublicID(publicId) {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	err := Store.DeleteOAuthApp(identity.ID, publicId)
+	if errors.Is(err, ErrOAuthAppNotFound) {
+		c.AbortWithStatusJSON(http.StatusNotFound, request.ErrorResponse{
+			Errors: []error{
+				err,
+			},
+		})
+		return
+	} else if err != nil {
+		log.Println(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// isValidRedirectURI reports whether uri can be an app's redirect URI.
+// Codes are only sent over https, except to apps listening on a loopback
+// address (RFC 8252).
+func isValidRedirectURI(uri string) bool {
+	u, err := url.Parse(uri)
+	if err != nil || !u.IsAbs() || u.Host == "" || u.Fragment != "" || u.User != nil {
+		return false
+	}
+	if strings.ContainsAny(uri, " \t\n") {
+		return false
+	}
+	switch u.Scheme {
+	case "https":
+		return true
+	case "http":
+		if u.Hostname() == "localhost" {
+			return true
+		}
+		ip := net.ParseIP(u.Hostname())
+		return ip != nil && ip.IsLoopback()
+	}
+	return false
+}
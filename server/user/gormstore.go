@@ -2,11 +2,13 @@ package user
 
 import (
 	"errors"
+	"time"
 
 	"github.com/jackc/pgconn"
 	"github.com/jackc/pgerrcode"
 	"github.com/speedrun-website/leaderboard-backend/database"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type gormUserStore struct {
@@ -22,9 +24,55 @@ func (s gormUserStore) GetUserIdentifierById(userId uint) (*UserIdentifier, erro
 	return &user, nil
 }
 
+func (s gormUserStore) GetUserIdentifierByPublicId(publicId string) (*UserIdentifier, error) {
+	var user UserIdentifier
+	err := s.DB.Model(&User{}).Where("public_id = ?", publicId).First(&user).Error
+	if err != nil {
+		return nil, ErrUserNotFound
+	}
+	return &user, nil
+}
+
+func (s gormUserStore) GetUserIdentifierByUsername(username string) (*UserIdentifier, bool, error) {
+	canonical := CanonicalUsername(username)
+
+	var users []UserIdentifier
+	err := s.DB.Model(&User{}).Where("username_canonical = ?", canonical).Limit(1).Find(&users).Error
+	if err != nil {
+		return nil, false, err
+	}
+	if len(users) > 0 {
+		return &users[0], false, nil
+	}
+
+	// The same name can have been given up by several users in turn,
+	// so the one who had it last is the one it leads to.
+	err = s.DB.Model(&User{}).
+		Joins("JOIN username_history ON username_history.user_id = users.id").
+		Where("username_history.username_canonical = ?", canonical).
+		Order("username_history.changed_at DESC").
+		Limit(1).
+		Find(&users).Error
+	if err != nil {
+		return nil, false, err
+	}
+	if len(users) == 0 {
+		return nil, false, ErrUserNotFound
+	}
+	return &users[0], true, nil
+}
+
 func (s gormUserStore) GetUserPersonalById(userId uint) (*UserPersonal, error) {
-	var user UserPersonal
-	err := s.DB.Model(&User{}).First(&user, userId).Error
+	user, err := s.GetUserById(userId)
+	if err != nil {
+		return nil, err
+	}
+	return user.AsPersonal(), nil
+}
+
+func (s gormUserStore) GetUserById(userId uint) (*User, error) {
+	var user User
+	err := s.DB.First(&user, userId).Error
 	if err != nil {
 		return nil, ErrUserNotFound
 	}
@@ -34,7 +82,7 @@ func (s gormUserStore) GetUserPersonalById(userId uint) (*UserPersonal, error) {
 func (s gormUserStore) GetUserByEmail(email string) (*User, error) {
 	var user User
 	err := s.DB.Where(User{
-		Email: email,
+		EmailCanonical: CanonicalEmail(email),
 	}).First(&user).Error
 	if err != nil {
 		return nil, ErrUserNotFound
@@ -59,6 +107,13 @@ func (s gormUserStore) CreateUser(user *User) error {
 	return nil
 }
 
+// isUniqueViolation reports whether err is a unique violation,
+// the same way CreateUser checks for one.
+func isUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == pgerrcode.UniqueViolation
+}
+
 func (s gormUserStore) DeleteUser(userId uint) error {
 	if err := s.DB.Delete(&User{}, userId).Error; err != nil {
 		return err
@@ -66,6 +121,751 @@ func (s gormUserStore) DeleteUser(userId uint) error {
 	return nil
 }
 
+func (s gormUserStore) BanUser(userId uint) error {
+	// Banned users are logged out everywhere, so that the tokens they
+	// already have stop working too.
+	return s.DB.Transaction(func(tx *gorm.DB) error {
+		if err := setBannedAt(tx, userId, time.Now()); err != nil {
+			return err
+		}
+		return revokeSessions(tx, userId, "")
+	})
+}
+
+func (s gormUserStore) UnbanUser(userId uint) error {
+	return setBannedAt(s.DB, userId, nil)
+}
+
+func setBannedAt(db *gorm.DB, userId uint, bannedAt interface{}) error {
+	result := db.Model(&User{}).Where("id = ?", userId).Update("banned_at", bannedAt)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+func (s gormUserStore) VerifyEmail(userId uint, email string) error {
+	result := s.DB.Model(&User{}).
+		Where("id = ? AND email = ? AND email_verified_at IS NULL", userId, email).
+		Update("email_verified_at", time.Now())
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+func (s gormUserStore) MarkVerificationSent(userId uint, since time.Time) error {
+	result := s.DB.Model(&User{}).
+		Where("id = ? AND (verification_sent_at IS NULL OR verification_sent_at <= ?)", userId, since).
+		Update("verification_sent_at", time.Now())
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrVerificationThrottled
+	}
+	return nil
+}
+
+func (s gormUserStore) CreatePasswordReset(reset *PasswordReset) error {
+	return s.DB.Create(reset).Error
+}
+
+func (s gormUserStore) ResetPassword(tokenHash []byte, passwordHash []byte) (uint, error) {
+	var userId uint
+	err := s.DB.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+
+		var userIds []uint
+		err := tx.Raw(`
+			UPDATE password_resets SET used_at = @now
+			WHERE token_hash = @hash AND used_at IS NULL AND expires_at > @now
+			RETURNING user_id`,
+			map[string]interface{}{
+				"now":  now,
+				"hash": tokenHash,
+			},
+		).Scan(&userIds).Error
+		if err != nil {
+			return err
+		}
+		if len(userIds) == 0 {
+			return ErrPasswordResetNotFound
+		}
+		userId = userIds[0]
+
+		// Any other resets that were sent shouldn't outlive the password.
+		err = tx.Model(&PasswordReset{}).
+			Where("user_id = ? AND used_at IS NULL", userId).
+			Update("used_at", now).Error
+		if err != nil {
+			return err
+		}
+
+		result := tx.Model(&User{}).Where("id = ?", userId).Update("password", passwordHash)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrPasswordResetNotFound
+		}
+		return revokeSessions(tx, userId, "")
+	})
+	if err != nil {
+		return 0, err
+	}
+	return userId, nil
+}
+
+func (s gormUserStore) UpdateUser(userId uint, update UserUpdate, usernameCooldown time.Duration) error {
+	err := s.DB.Transaction(func(tx *gorm.DB) error {
+		// Lock the user so that two renames can't both pass the cooldown.
+		var user User
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&user, userId).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrUserNotFound
+		} else if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		changes := map[string]interface{}{}
+
+		if update.Username != nil && *update.Username != user.Username {
+			var last []UsernameChange
+			err := tx.Where("user_id = ?", userId).Order("changed_at DESC").Limit(1).Find(&last).Error
+			if err != nil {
+				return err
+			}
+			if len(last) > 0 && now.Before(last[0].ChangedAt.Add(usernameCooldown)) {
+				return UsernameCooldownError{
+					Until: last[0].ChangedAt.Add(usernameCooldown),
+				}
+			}
+
+			err = tx.Create(&UsernameChange{
+				UserID:    userId,
+				Username:  user.Username,
+				ChangedAt: now,
+			}).Error
+			if err != nil {
+				return err
+			}
+			changes["username"] = *update.Username
+			changes["username_canonical"] = CanonicalUsername(*update.Username)
+		}
+
+		if update.Email != nil && *update.Email != user.Email {
+			changes["email"] = *update.Email
+			changes["email_canonical"] = CanonicalEmail(*update.Email)
+			changes["email_verified_at"] = nil
+			changes["verification_sent_at"] = now
+		}
+
+		if len(changes) == 0 {
+			return nil
+		}
+		return tx.Model(&User{}).Where("id = ?", userId).Updates(changes).Error
+	})
+
+	if isUniqueViolation(err) {
+		return ErrUserNotUnique
+	}
+	return err
+}
+
+func (s gormUserStore) ChangePassword(userId uint, passwordHash []byte) error {
+	result := s.DB.Model(&User{}).Where("id = ?", userId).Update("password", passwordHash)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+func (s gormUserStore) UpgradePasswordHash(userId uint, oldHash []byte, newHash []byte) error {
+	return s.DB.Model(&User{}).
+		Where("id = ? AND password = ?", userId, oldHash).
+		Update("password", newHash).Error
+}
+
+func (s gormUserStore) CreateSession(session *Session) error {
+	return s.DB.Create(session).Error
+}
+
+func (s gormUserStore) GetSession(tokenId string) (*Session, error) {
+	var session Session
+	err := s.DB.Where("token_id = ?", tokenId).First(&session).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrSessionNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+func (s gormUserStore) GetActiveSessions(userId uint) ([]Session, error) {
+	var sessions []Session
+	err := s.DB.
+		Preload("App").
+		Where("user_id = ? AND revoked_at IS NULL AND expires_at > ?", userId, time.Now()).
+		Order("last_seen_at DESC").
+		Find(&sessions).Error
+	if err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+func (s gormUserStore) TouchSession(sessionId uint, ip string) error {
+	return s.DB.Model(&Session{}).Where("id = ?", sessionId).Updates(map[string]interface{}{
+		"last_seen_at": time.Now(),
+		"ip":           ip,
+	}).Error
+}
+
+func (s gormUserStore) RevokeSession(userId uint, publicId string) error {
+	result := s.DB.Model(&Session{}).
+		Where("public_id = ? AND user_id = ? AND revoked_at IS NULL", publicId, userId).
+		Update("revoked_at", time.Now())
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+func (s gormUserStore) RevokeSessions(userId uint, except string) error {
+	return revokeSessions(s.DB, userId, except)
+}
+
+func revokeSessions(db *gorm.DB, userId uint, except string) error {
+	query := db.Model(&Session{}).Where("user_id = ? AND revoked_at IS NULL", userId)
+	if except != "" {
+		query = query.Where("token_id <> ?", except)
+	}
+	return query.Update("revoked_at", time.Now()).Error
+}
+
+func (s gormUserStore) CreateRefreshToken(token *RefreshToken) error {
+	return s.DB.Create(token).Error
+}
+
+func (s gormUserStore) RotateRefreshToken(tokenHash []byte, next *RefreshToken) (*Session, error) {
+	var session Session
+	reused := false
+	err := s.DB.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+
+		var current RefreshToken
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("token_hash = ?", tokenHash).
+			First(&current).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrInvalidRefreshToken
+		} else if err != nil {
+			return err
+		}
+
+		err = tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&session, current.SessionID).Error
+		if err != nil {
+			return err
+		}
+		if session.RevokedAt != nil {
+			return ErrInvalidRefreshToken
+		}
+
+		// A token that was already used has been stolen, or is being
+		// replayed. Either way, nothing in its session can be trusted.
+		if current.UsedAt != nil {
+			reused = true
+			return tx.Model(&session).Update("revoked_at", now).Error
+		}
+		if !now.Before(current.ExpiresAt) {
+			return ErrInvalidRefreshToken
+		}
+
+		if err := tx.Model(&current).Update("used_at", now).Error; err != nil {
+			return err
+		}
+		next.SessionID = session.ID
+		if err := tx.Create(next).Error; err != nil {
+			return err
+		}
+		return tx.Model(&session).Update("expires_at", next.ExpiresAt).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	if reused {
+		return nil, ErrRefreshTokenReused
+	}
+	return &session, nil
+}
+
+func (s gormUserStore) CreateOAuthState(state *OAuthState) error {
+	// Clear out logins that were never finished while we're here.
+	if err := s.DB.Where("expires_at < ?", time.Now()).Delete(&OAuthState{}).Error; err != nil {
+		return err
+	}
+	return s.DB.Create(state).Error
+}
+
+func (s gormUserStore) TakeOAuthState(provider string, stateHash []byte) (*OAuthState, error) {
+	var states []OAuthState
+	err := s.DB.Raw(
+		"DELETE FROM oauth_states WHERE provider = @provider AND state_hash = @hash AND expires_at > @now RETURNING *",
+		map[string]interface{}{
+			"provider": provider,
+			"hash":     stateHash,
+			"now":      time.Now(),
+		},
+	).Scan(&states).Error
+	if err != nil {
+		return nil, err
+	}
+	if len(states) == 0 {
+		return nil, ErrInvalidOAuthState
+	}
+	return &states[0], nil
+}
+
+func (s gormUserStore) GetExternalIdentity(provider string, subject string) (*ExternalIdentity, error) {
+	var identity ExternalIdentity
+	err := s.DB.Where("provider = ? AND subject = ?", provider, subject).First(&identity).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrIdentityNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return &identity, nil
+}
+
+func (s gormUserStore) GetExternalIdentities(userId uint) ([]ExternalIdentity, error) {
+	var identities []ExternalIdentity
+	err := s.DB.Where("user_id = ?", userId).Order("provider").Find(&identities).Error
+	if err != nil {
+		return nil, err
+	}
+	return identities, nil
+}
+
+func (s gormUserStore) CreateExternalIdentity(identity *ExternalIdentity) error {
+	return createExternalIdentity(s.DB, identity)
+}
+
+func createExternalIdentity(db *gorm.DB, identity *ExternalIdentity) error {
+	err := db.Create(identity).Error
+	var pgErr *pgconn.PgError
+	if isUniqueViolation(err) && errors.As(err, &pgErr) {
+		if pgErr.ConstraintName == "external_identities_user_id_provider_key" {
+			return ErrProviderAlreadyLinked
+		}
+		return ErrIdentityTaken
+	}
+	return err
+}
+
+func (s gormUserStore) CreateUserWithIdentity(user *User, identity *ExternalIdentity) error {
+	err := s.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(user).Error; err != nil {
+			if isUniqueViolation(err) {
+				return ErrUserNotUnique
+			}
+			return err
+		}
+		identity.UserID = user.ID
+		return createExternalIdentity(tx, identity)
+	})
+	if err != nil {
+		// Nothing was saved, so the user can be created again.
+		user.ID = 0
+		identity.UserID = 0
+	}
+	return err
+}
+
+func (s gormUserStore) DeleteExternalIdentity(userId uint, provider string) error {
+	return s.DB.Transaction(func(tx *gorm.DB) error {
+		var user User
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&user, userId).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrUserNotFound
+		} else if err != nil {
+			return err
+		}
+
+		var identities []ExternalIdentity
+		if err := tx.Where("user_id = ?", userId).Find(&identities).Error; err != nil {
+			return err
+		}
+		var unlinked *ExternalIdentity
+		for i := range identities {
+			if identities[i].Provider == provider {
+				unlinked = &identities[i]
+			}
+		}
+		if unlinked == nil {
+			return ErrIdentityNotFound
+		}
+		if user.Password == nil && len(identities) == 1 {
+			return ErrLastLoginMethod
+		}
+		return tx.Delete(unlinked).Error
+	})
+}
+
+func (s gormUserStore) SetTOTPSecret(userId uint, secret string) error {
+	result := s.DB.Model(&User{}).
+		Where("id = ? AND totp_enabled_at IS NULL", userId).
+		Update("totp_secret", secret)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrTwoFactorAlreadyEnabled
+	}
+	return nil
+}
+
+func (s gormUserStore) EnableTwoFactor(userId uint, step int64, codeHashes [][]byte) error {
+	return s.DB.Transaction(func(tx *gorm.DB) error {
+		var user User
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&user, userId).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrUserNotFound
+		} else if err != nil {
+			return err
+		}
+		if user.HasTwoFactor() {
+			return ErrTwoFactorAlreadyEnabled
+		}
+		if user.TOTPSecret == nil {
+			return ErrNoTOTPEnrollment
+		}
+
+		err = tx.Model(&user).Updates(map[string]interface{}{
+			"totp_enabled_at": time.Now(),
+			"totp_last_step":  step,
+		}).Error
+		if err != nil {
+			return err
+		}
+		return replaceRecoveryCodes(tx, userId, codeHashes)
+	})
+}
+
+func (s gormUserStore) DisableTwoFactor(userId uint) error {
+	return s.DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&User{}).Where("id = ?", userId).Updates(map[string]interface{}{
+			"totp_secret":     nil,
+			"totp_enabled_at": nil,
+			"totp_last_step":  0,
+		}).Error
+		if err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", userId).Delete(&LoginChallenge{}).Error; err != nil {
+			return err
+		}
+		// Sessions logged in to with a code no longer count as having
+		// used two-factor authentication.
+		err = tx.Model(&Session{}).Where("user_id = ? AND two_factor", userId).Update("two_factor", false).Error
+		if err != nil {
+			return err
+		}
+		return tx.Where("user_id = ?", userId).Delete(&RecoveryCode{}).Error
+	})
+}
+
+func (s gormUserStore) UseTOTPStep(userId uint, step int64) error {
+	result := s.DB.Model(&User{}).
+		Where("id = ? AND totp_last_step < ?", userId, step).
+		Update("totp_last_step", step)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrIncorrectCode
+	}
+	return nil
+}
+
+func (s gormUserStore) ReplaceRecoveryCodes(userId uint, codeHashes [][]byte) error {
+	return s.DB.Transaction(func(tx *gorm.DB) error {
+		return replaceRecoveryCodes(tx, userId, codeHashes)
+	})
+}
+
+func replaceRecoveryCodes(db *gorm.DB, userId uint, codeHashes [][]byte) error {
+	if err := db.Where("user_id = ?", userId).Delete(&RecoveryCode{}).Error; err != nil {
+		return err
+	}
+	if len(codeHashes) == 0 {
+		return nil
+	}
+	codes := make([]RecoveryCode, len(codeHashes))
+	for i, hash := range codeHashes {
+		codes[i] = RecoveryCode{
+			UserID:   userId,
+			CodeHash: hash,
+		}
+	}
+	return db.Create(&codes).Error
+}
+
+func (s gormUserStore) UseRecoveryCode(userId uint, codeHash []byte) error {
+	result := s.DB.Model(&RecoveryCode{}).
+		Where("user_id = ? AND code_hash = ? AND used_at IS NULL", userId, codeHash).
+		Update("used_at", time.Now())
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrIncorrectCode
+	}
+	return nil
+}
+
+func (s gormUserStore) CountRecoveryCodes(userId uint) (int, error) {
+	var count int64
+	err := s.DB.Model(&RecoveryCode{}).
+		Where("user_id = ? AND used_at IS NULL", userId).
+		Count(&count).Error
+	return int(count), err
+}
+
+func (s gormUserStore) CreateLoginChallenge(challenge *LoginChallenge) error {
+	// Clear out challenges that were never finished.
+	if err := s.DB.Where("expires_at <= ?", time.Now()).Delete(&LoginChallenge{}).Error; err != nil {
+		return err
+	}
+	return s.DB.Create(challenge).Error
+}
+
+func (s gormUserStore) GetLoginChallenge(tokenHash []byte) (*LoginChallenge, error) {
+	var challenge LoginChallenge
+	err := s.DB.Where("token_hash = ? AND expires_at > ?", tokenHash, time.Now()).Take(&challenge).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrInvalidLoginChallenge
+	} else if err != nil {
+		return nil, err
+	}
+	return &challenge, nil
+}
+
+func (s gormUserStore) UseLoginChallenge(tokenHash []byte, maxAttempts int) (*LoginChallenge, error) {
+	var challenges []LoginChallenge
+	err := s.DB.Raw(
+		"UPDATE login_challenges SET attempts = attempts + 1 WHERE token_hash = @hash AND expires_at > @now AND attempts < @max RETURNING *",
+		map[string]interface{}{
+			"hash": tokenHash,
+			"now":  time.Now(),
+			"max":  maxAttempts,
+		},
+	).Scan(&challenges).Error
+	if err != nil {
+		return nil, err
+	}
+	if len(challenges) == 0 {
+		return nil, ErrInvalidLoginChallenge
+	}
+	return &challenges[0], nil
+}
+
+func (s gormUserStore) DeleteLoginChallenge(challengeId uint) error {
+	return s.DB.Delete(&LoginChallenge{}, challengeId).Error
+}
+
+func (s gormUserStore) CreatePersonalAccessToken(token *PersonalAccessToken) error {
+	return s.DB.Create(token).Error
+}
+
+func (s gormUserStore) GetPersonalAccessTokens(userId uint) ([]PersonalAccessToken, error) {
+	var tokens []PersonalAccessToken
+	err := s.DB.Where("user_id = ?", userId).Order("created_at DESC").Find(&tokens).Error
+	if err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+func (s gormUserStore) GetPersonalAccessToken(tokenHash []byte) (*PersonalAccessToken, error) {
+	var token PersonalAccessToken
+	err := s.DB.
+		Joins("JOIN users ON users.id = personal_access_tokens.user_id AND users.banned_at IS NULL AND users.deleted_at IS NULL").
+		Where("personal_access_tokens.token_hash = ?", tokenHash).
+		Where("personal_access_tokens.expires_at IS NULL OR personal_access_tokens.expires_at > ?", time.Now()).
+		Take(&token).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrInvalidPersonalToken
+	} else if err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+func (s gormUserStore) TouchPersonalAccessToken(tokenId uint) error {
+	return s.DB.Model(&PersonalAccessToken{}).Where("id = ?", tokenId).Update("last_used_at", time.Now()).Error
+}
+
+func (s gormUserStore) DeletePersonalAccessToken(userId uint, publicId string) error {
+	result := s.DB.Where("public_id = ? AND user_id = ?", publicId, userId).Delete(&PersonalAccessToken{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrPersonalTokenNotFound
+	}
+	return nil
+}
+
+func (s gormUserStore) GetProfile(userId uint) (*Profile, error) {
+	profile := Profile{
+		UserID: userId,
+	}
+	err := s.DB.Where("user_id = ?", userId).Take(&profile).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+	return &profile, nil
+}
+
+func (s gormUserStore) SaveProfile(profile *Profile) error {
+	return s.DB.Clauses(clause.OnConflict{UpdateAll: true}).Create(profile).Error
+}
+
+func (s gormUserStore) CreateOAuthApp(app *OAuthApp) error {
+	return s.DB.Create(app).Error
+}
+
+func (s gormUserStore) GetOAuthApps(ownerId uint) ([]OAuthApp, error) {
+	var apps []OAuthApp
+	err := s.DB.Where("owner_id = ?", ownerId).Order("created_at DESC").Find(&apps).Error
+	if err != nil {
+		return nil, err
+	}
+	return apps, nil
+}
+
+func (s gormUserStore) GetOAuthAppByClientID(clientId string) (*OAuthApp, error) {
+	var app OAuthApp
+	err := s.DB.Where("client_id = ?", clientId).Take(&app).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrOAuthAppNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return &app, nil
+}
+
+func (s gormUserStore) DeleteOAuthApp(ownerId uint, publicId string) error {
+	result := s.DB.Where("public_id = ? AND owner_id = ?", publicId, ownerId).Delete(&OAuthApp{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrOAuthAppNotFound
+	}
+	return nil
+}
+
+func (s gormUserStore) CreateAuthorizationCode(code *AuthorizationCode) error {
+	// Clear out codes that were never used while we're here.
+	if err := s.DB.Where("expires_at < ?", time.Now()).Delete(&AuthorizationCode{}).Error; err != nil {
+		return err
+	}
+	return s.DB.Create(code).Error
+}
+
+func (s gormUserStore) TakeAuthorizationCode(codeHash []byte) (*AuthorizationCode, error) {
+	var codes []AuthorizationCode
+	err := s.DB.Raw(
+		"DELETE FROM authorization_codes WHERE code_hash = @hash AND expires_at > @now RETURNING *",
+		map[string]interface{}{
+			"hash": codeHash,
+			"now":  time.Now(),
+		},
+	).Scan(&codes).Error
+	if err != nil {
+		return nil, err
+	}
+	if len(codes) == 0 {
+		return nil, ErrInvalidAuthorizationCode
+	}
+	return &codes[0], nil
+}
+
+func (s gormUserStore) GetRefreshTokenSession(tokenHash []byte) (*Session, error) {
+	var session Session
+	err := s.DB.
+		Joins("JOIN refresh_tokens ON refresh_tokens.session_id = sessions.id").
+		Where("refresh_tokens.token_hash = ? AND refresh_tokens.used_at IS NULL AND refresh_tokens.expires_at > ?", tokenHash, time.Now()).
+		Where("sessions.revoked_at IS NULL").
+		Take(&session).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrInvalidRefreshToken
+	} else if err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// A LoginFailure is how many times a key, such as an account or an IP,
+// has failed to log in, for the postgres login throttle.
+type LoginFailure struct {
+	Key          string `gorm:"primaryKey"`
+	Failures     int
+	LastFailedAt time.Time
+}
+
+func (s gormUserStore) GetLoginFailures(key string, since time.Time) (int, time.Time, error) {
+	var failure LoginFailure
+	err := s.DB.Where("key = ? AND last_failed_at >= ?", key, since).Take(&failure).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return 0, time.Time{}, nil
+	} else if err != nil {
+		return 0, time.Time{}, err
+	}
+	return failure.Failures, failure.LastFailedAt, nil
+}
+
+func (s gormUserStore) AddLoginFailure(key string, now time.Time, since time.Time) (int, error) {
+	// Clear out keys that haven't failed in a while.
+	if err := s.DB.Where("last_failed_at < ?", since).Delete(&LoginFailure{}).Error; err != nil {
+		return 0, err
+	}
+
+	var failures int
+	err := s.DB.Raw(
+		`INSERT INTO login_failures (key, failures, last_failed_at) VALUES (@key, 1, @now)
+		ON CONFLICT (key) DO UPDATE SET
+			failures = CASE WHEN login_failures.last_failed_at < @since THEN 1 ELSE login_failures.failures + 1 END,
+			last_failed_at = @now
+		RETURNING failures`,
+		map[string]interface{}{
+			"key":   key,
+			"now":   now,
+			"since": since,
+		},
+	).Row().Scan(&failures)
+	return failures, err
+}
+
+func (s gormUserStore) ResetLoginFailures(key string) error {
+	return s.DB.Where("key = ?", key).Delete(&LoginFailure{}).Error
+}
+
 func (s gormUserStore) DumpDeleted() error {
 	err := s.DB.Unscoped().Where("deleted_at IS NOT NULL").Delete(&User{}).Error
 	if err != nil {
@@ -75,16 +875,13 @@ func (s gormUserStore) DumpDeleted() error {
 }
 
 // Initializes a GORM user store and sets the exported
-// user store for application use.
+// user store for application use. The schema is expected to be
+// up to date; see the database/migrations package.
 func InitGormStore(db *gorm.DB) error {
 	if db == nil {
 		db = database.DB
 	}
 
-	if err := db.AutoMigrate(&User{}); err != nil {
-		return err
-	}
-
 	// Store is defined in users.go
 	Store = &gormUserStore{
 		DB: db,
@@ -1,111 +1,360 @@
 package user
 
 import (
+	"errors"
 	"log"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	jwt "github.com/appleboy/gin-jwt/v2"
+	jwtgo "github.com/dgrijalva/jwt-go"
 	"github.com/gin-gonic/gin"
-	"github.com/speedrun-website/leaderboard-backend/server/request"
+	"github.com/speedrun-website/leaderboard-backend/config"
 )
 
 const identityKey = "id"
 
+// TokenResponse is the response to logging in or refreshing. The tokens
+// are left out when they are sent as cookies instead.
 type TokenResponse struct {
-	Token  string `json:"token"`
-	Expiry string `json:"expiry"`
-}
-
-var JwtConfig = &jwt.GinJWTMiddleware{
-	Realm:       "test zone",
-	Key:         []byte("secret key"),
-	Timeout:     time.Hour,
-	MaxRefresh:  time.Hour,
-	IdentityKey: identityKey,
-	PayloadFunc: func(d interface{}) jwt.MapClaims {
-		if v, ok := d.(*UserPersonal); ok {
-			return jwt.MapClaims{
-				identityKey: strconv.FormatUint(uint64(v.ID), 36),
-			}
+	Token         string `json:"token,omitempty"`
+	Expiry        string `json:"expiry"`
+	RefreshToken  string `json:"refresh_token,omitempty"`
+	RefreshExpiry string `json:"refresh_expiry"`
+}
+
+// AuthMiddleware handles logging in and authenticates requests. Tokens
+// are signed and checked with its key set rather than by gin-jwt, which
+// only knows one key and can't set the kid header; everything else about
+// a login is configured on the embedded gin-jwt middleware.
+type AuthMiddleware struct {
+	*jwt.GinJWTMiddleware
+	keys *keySet
+}
+
+// NewAuthMiddleware creates the JWT middleware that handles logging in
+// and authenticates requests, signing tokens with the configured keys.
+func NewAuthMiddleware(c config.AuthConfig) (*AuthMiddleware, error) {
+	keys, err := newKeySet(c)
+	if err != nil {
+		return nil, err
+	}
+	return &AuthMiddleware{
+		GinJWTMiddleware: newJwtConfig(c),
+		keys:             keys,
+	}, nil
+}
+
+// TokenGenerator creates an access token for data, which is either a
+// *sessionIdentity or a *UserPersonal.
+func (mw *AuthMiddleware) TokenGenerator(data interface{}) (string, time.Time, error) {
+	claims := jwtgo.MapClaims{}
+	for key, value := range mw.PayloadFunc(data) {
+		claims[key] = value
+	}
+	now := mw.TimeFunc()
+	expire := now.UTC().Add(mw.Timeout)
+	claims["exp"] = expire.Unix()
+	claims["orig_iat"] = now.Unix()
+
+	token, err := mw.keys.sign(claims)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return token, expire, nil
+}
+
+// LoginHandler checks a user's password with the Authenticator and logs
+// them in, unless they have two-factor authentication on, in which case
+// they are challenged for a code first. Accounts and clients that have
+// failed to log in too often are turned away until their lockout ends.
+func (mw *AuthMiddleware) LoginHandler(c *gin.Context) {
+	data, err := mw.Authenticator(c)
+	var throttledErr LoginThrottledError
+	if errors.As(err, &throttledErr) {
+		mw.throttled(c, throttledErr)
+		return
+	} else if err != nil {
+		mw.unauthorized(c, http.StatusUnauthorized, err)
+		return
+	}
+	login := data.(*pendingLogin)
+	mw.login(c, login.user, login.cookie)
+}
+
+// login logs user in, or challenges them for a code if they have
+// two-factor authentication on.
+func (mw *AuthMiddleware) login(c *gin.Context, user *User, cookie bool) {
+	if user.HasTwoFactor() {
+		challengeLogin(c, user, cookie)
+		return
+	}
+	mw.finishLogin(c, user, cookie, false)
+}
+
+// finishLogin starts a session for user and responds with its tokens.
+// Their account's failed logins are forgotten, now that every factor has
+// been checked. twoFactor is whether one of them was a code.
+func (mw *AuthMiddleware) finishLogin(c *gin.Context, user *User, cookie bool, twoFactor bool) {
+	resetLoginFailures(user.Email)
+	identity, err := startLogin(c, user, cookie, twoFactor)
+	if err != nil {
+		mw.unauthorized(c, http.StatusUnauthorized, err)
+		return
+	}
+	token, expire, err := mw.TokenGenerator(identity)
+	if err != nil {
+		log.Println(err)
+		mw.unauthorized(c, http.StatusUnauthorized, jwt.ErrFailedTokenCreation)
+		return
+	}
+	mw.LoginResponse(c, http.StatusOK, token, expire)
+}
+
+// MiddlewareFunc returns the middleware that only lets requests through
+// if they carry a valid access token, and stores its claims and
+// identity in the context. Personal access tokens are accepted too, on
+// the routes their scopes allow, as are the access tokens of apps.
+func (mw *AuthMiddleware) MiddlewareFunc() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if token, ok := personalTokenFromRequest(c); ok {
+			mw.authenticatePersonalToken(c, token)
+			return
+		}
+		tokenString, err := tokenFromRequest(c)
+		if err != nil {
+			mw.unauthorized(c, http.StatusUnauthorized, err)
+			return
 		}
-		return jwt.MapClaims{}
-	},
-	IdentityHandler: func(c *gin.Context) interface{} {
-		claims := jwt.ExtractClaims(c)
-		idStr := claims[identityKey].(string)
-		id, _ := strconv.ParseUint(idStr, 36, 0)
-		return &UserPersonal{
-			ID: uint(id),
+		token, err := mw.keys.parse(tokenString)
+		if err != nil {
+			mw.unauthorized(c, http.StatusUnauthorized, err)
+			return
 		}
-	},
-	Authenticator: func(c *gin.Context) (interface{}, error) {
-		var loginVals UserLogin
-		if err := c.ShouldBindJSON(&loginVals); err != nil {
-			return nil, jwt.ErrMissingLoginValues
+		claims := jwt.MapClaims(token.Claims.(jwtgo.MapClaims))
+		if _, ok := claims["exp"].(float64); !ok {
+			mw.unauthorized(c, http.StatusBadRequest, jwt.ErrMissingExpField)
+			return
 		}
 
-		email := loginVals.Email
-		password := loginVals.Password
-
-		user, err := Store.GetUserByEmail(email)
-		if err != nil {
-			return nil, jwt.ErrFailedAuthentication
+		c.Set("JWT_PAYLOAD", claims)
+		c.Set("JWT_TOKEN", tokenString)
+		identity := mw.IdentityHandler(c)
+		if identity != nil {
+			c.Set(mw.IdentityKey, identity)
+		}
+		if !mw.Authorizator(identity, c) {
+			mw.unauthorized(c, http.StatusForbidden, jwt.ErrForbidden)
+			return
 		}
+		// Apps only get as far as the scopes the user granted them.
+		if session, ok := SessionFromContext(c); ok && session.AppID != nil && !checkScopes(c, session.Scopes) {
+			return
+		}
+		c.Next()
+	}
+}
 
-		if !ComparePasswords(user.Password, []byte(password)) {
-			return nil, jwt.ErrFailedAuthentication
+// JWKSHandler publishes the public keys that access tokens are signed
+// with, so that other services can check tokens themselves. Tokens name
+// their key in the kid header. The response is a plain JWK set (RFC 7517)
+// rather than one of our usual responses, since that is what JWT
+// libraries expect.
+func (mw *AuthMiddleware) JWKSHandler(c *gin.Context) {
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, mw.keys.jwks())
+}
+
+func (mw *AuthMiddleware) unauthorized(c *gin.Context, code int, err error) {
+	c.Header("WWW-Authenticate", "JWT realm="+mw.Realm)
+	c.Abort()
+	mw.Unauthorized(c, code, err.Error())
+}
+
+// throttled turns away a login to an account or from a client that is
+// locked out, until the lockout ends.
+func (mw *AuthMiddleware) throttled(c *gin.Context, err LoginThrottledError) {
+	setRetryAfter(c, err.Until)
+	c.Abort()
+	mw.Unauthorized(c, http.StatusTooManyRequests, err.Error())
+}
+
+// tokenFromRequest finds the access token in the Authorization header,
+// the token query parameter or the access token cookie, in that order.
+func tokenFromRequest(c *gin.Context) (string, error) {
+	if header := c.GetHeader("Authorization"); header != "" {
+		parts := strings.SplitN(header, " ", 2)
+		if len(parts) != 2 || parts[0] != "Bearer" {
+			return "", jwt.ErrInvalidAuthHeader
 		}
+		return parts[1], nil
+	}
+	if token := c.Query("token"); token != "" {
+		return token, nil
+	}
+	if token, _ := c.Cookie(accessCookie); token != "" {
+		return token, nil
+	}
+	return "", jwt.ErrEmptyAuthHeader
+}
 
-		return user.AsPersonal(), nil
-	},
-	LoginResponse: func(c *gin.Context, code int, token string, expire time.Time) {
-		c.JSON(http.StatusOK, request.SuccessResponse{
-			Data: TokenResponse{
-				Token:  token,
-				Expiry: expire.Format(time.RFC3339),
-			},
-		})
-	},
-	Unauthorized: func(c *gin.Context, code int, message string) {
-		c.JSON(code, gin.H{
-			"code":    code,
-			"message": message,
-		})
-	},
-	// TokenLookup is a string in the form of "<source>:<name>" that is used
-	// to extract token from the request.
-	// Optional. Default value "header:Authorization".
-	// Possible values:
-	// - "header:<name>"
-	// - "query:<name>"
-	// - "cookie:<name>"
-	// - "param:<name>"
-	TokenLookup: "header: Authorization, query: token, cookie: jwt",
-	// TokenLookup: "query:token",
-	// TokenLookup: "cookie:token",
-
-	// TokenHeadName is a string in the header. Default value is "Bearer"
-	TokenHeadName: "Bearer",
-
-	// TimeFunc provides the current time. You can override it to use another time value. This is useful for testing or if your server uses a different time zone than your tokens.
-	TimeFunc: time.Now,
-}
-
-func GetAuthMiddlewareHandler() *jwt.GinJWTMiddleware {
-	// the jwt middleware
-	authMiddlware, err := jwt.New(JwtConfig)
+// A pendingLogin is a user whose password the Authenticator accepted.
+type pendingLogin struct {
+	user   *User
+	cookie bool
+}
+
+// A sessionIdentity is a user who just logged in, and their new session.
+type sessionIdentity struct {
+	user    *UserPersonal
+	session *Session
+}
+
+// startLogin starts a session for user on the device making the request,
+// and issues its first refresh token for the LoginResponse to send.
+func startLogin(c *gin.Context, user *User, cookie bool, twoFactor bool) (*sessionIdentity, error) {
+	refreshExpiry := time.Now().Add(settings.refreshTimeout)
+	session, err := newSession(user.ID, c.Request.UserAgent(), c.ClientIP(), refreshExpiry)
+	if err == nil {
+		session.TwoFactor = twoFactor
+		err = Store.CreateSession(session)
+	}
 	if err != nil {
-		log.Fatal("JWT Error:" + err.Error())
+		log.Printf("Could not start a session for user %d: %s", user.ID, err)
+		return nil, jwt.ErrFailedTokenCreation
 	}
-
-	// When you use jwt.New(), the function is already automatically called for checking,
-	// which means you don't need to call it again.
-	err = authMiddlware.MiddlewareInit()
+	refreshToken, err := issueRefreshToken(session)
 	if err != nil {
-		log.Fatalf("authMiddleware.MiddlewareInit() Error: %s", err)
+		log.Printf("Could not issue a refresh token for user %d: %s", user.ID, err)
+		return nil, jwt.ErrFailedTokenCreation
 	}
+	c.Set(issuedTokensKey, &issuedTokens{
+		refreshToken:  refreshToken,
+		refreshExpiry: refreshExpiry,
+		cookie:        cookie,
+	})
+
+	return &sessionIdentity{
+		user:    user.AsPersonal(),
+		session: session,
+	}, nil
+}
+
+func newJwtConfig(c config.AuthConfig) *jwt.GinJWTMiddleware {
+	timeout := c.Timeout
+	return &jwt.GinJWTMiddleware{
+		Realm:       c.Realm,
+		Timeout:     c.Timeout,
+		IdentityKey: identityKey,
+		PayloadFunc: func(d interface{}) jwt.MapClaims {
+			switch v := d.(type) {
+			case *sessionIdentity:
+				return jwt.MapClaims{
+					identityKey: strconv.FormatUint(uint64(v.user.ID), 36),
+					sessionKey:  v.session.TokenID,
+				}
+			case *UserPersonal:
+				// Tokens generated outside of logging in get a session
+				// without any device details. Without one, the token
+				// won't be accepted.
+				claims := jwt.MapClaims{
+					identityKey: strconv.FormatUint(uint64(v.ID), 36),
+				}
+				session, err := startSession(v.ID, "", "", time.Now().Add(timeout))
+				if err != nil {
+					log.Printf("Could not start a session for user %d: %s", v.ID, err)
+					return claims
+				}
+				claims[sessionKey] = session.TokenID
+				return claims
+			}
+			return jwt.MapClaims{}
+		},
+		IdentityHandler: func(c *gin.Context) interface{} {
+			claims := jwt.ExtractClaims(c)
+			idStr := claims[identityKey].(string)
+			id, _ := strconv.ParseUint(idStr, 36, 0)
+			return &UserPersonal{
+				ID: uint(id),
+			}
+		},
+		// Tokens are only accepted while their session is active.
+		Authorizator: func(data interface{}, c *gin.Context) bool {
+			identity, ok := data.(*UserPersonal)
+			if !ok {
+				return false
+			}
+			return checkSession(c, identity.ID)
+		},
+		Authenticator: func(c *gin.Context) (interface{}, error) {
+			var loginVals UserLogin
+			if err := c.ShouldBindJSON(&loginVals); err != nil {
+				return nil, jwt.ErrMissingLoginValues
+			}
+
+			email := loginVals.Email
+			password := loginVals.Password
+			ip := c.ClientIP()
+
+			if err := checkLoginThrottle(email, ip); err != nil {
+				return nil, err
+			}
+
+			user, err := Store.GetUserByEmail(email)
+			if err != nil {
+				recordLoginFailure(email, ip, nil)
+				return nil, jwt.ErrFailedAuthentication
+			}
 
-	return authMiddlware
+			if !ComparePasswords(user.Password, []byte(password)) {
+				recordLoginFailure(email, ip, user)
+				return nil, jwt.ErrFailedAuthentication
+			}
+
+			if user.BannedAt != nil {
+				return nil, ErrUserBanned
+			}
+
+			// The password is only known now, so this is the chance to
+			// bring its hash up to date with the configuration.
+			if NeedsRehash(user.Password) {
+				upgradePasswordHash(user, []byte(password))
+			}
+
+			return &pendingLogin{
+				user:   user,
+				cookie: loginVals.Cookie,
+			}, nil
+		},
+		LoginResponse: func(c *gin.Context, code int, token string, expire time.Time) {
+			rawIssued, _ := c.Get(issuedTokensKey)
+			issued, ok := rawIssued.(*issuedTokens)
+			if !ok {
+				c.AbortWithStatus(http.StatusInternalServerError)
+				return
+			}
+			writeTokens(c, token, expire, issued.refreshToken, issued.refreshExpiry, issued.cookie)
+		},
+		Unauthorized: func(c *gin.Context, code int, message string) {
+			// The Authorizator is the only source of 403s, and it only
+			// rejects tokens for sessions that have ended.
+			if code == http.StatusForbidden {
+				code = http.StatusUnauthorized
+				message = ErrSessionRevoked.Error()
+			}
+			c.JSON(code, gin.H{
+				"code":    code,
+				"message": message,
+			})
+		},
+		LogoutResponse: func(c *gin.Context, code int) {
+			c.JSON(code, gin.H{
+				"code": code,
+			})
+		},
+		// TimeFunc provides the current time. You can override it to use another time value. This is useful for testing or if your server uses a different time zone than your tokens.
+		TimeFunc: time.Now,
+	}
 }
@@ -0,0 +1,294 @@
+package user
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+
+	jwtgo "github.com/dgrijalva/jwt-go"
+	"github.com/speedrun-website/leaderboard-backend/config"
+)
+
+var ErrUnknownSigningKey = errors.New("the token was not signed by a known key")
+
+// The smallest RSA key, in bits, that tokens are signed or checked with.
+const minRSAKeyBits = 2048
+
+// JWK is a public key in the JSON Web Key format (RFC 7517).
+type JWK struct {
+	KeyType   string `json:"kty"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+
+	// RSA keys
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+
+	// Ed25519 keys
+	Curve string `json:"crv,omitempty"`
+	X     string `json:"x,omitempty"`
+}
+
+// JWKS is the set of public keys that access tokens are checked with.
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// A signingKey is a key that access tokens are signed or checked with.
+// Public keys are identified by their JWK thumbprint (RFC 7638), which is
+// put in the kid header of the tokens they sign. The JWT secret has no ID.
+type signingKey struct {
+	id      string
+	method  jwtgo.SigningMethod
+	private interface{}
+	public  interface{}
+}
+
+// A keySet is the key that signs new access tokens, along with every key
+// that tokens are still accepted from.
+type keySet struct {
+	signer *signingKey
+	keys   []*signingKey
+}
+
+// newKeySet loads the keys in c. New tokens are signed with the signing
+// key if there is one, and with the JWT secret otherwise.
+func newKeySet(c config.AuthConfig) (*keySet, error) {
+	set := &keySet{}
+	if c.SigningKeyFile != "" {
+		key, err := readKeyFile(c.SigningKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		if key.private == nil {
+			return nil, fmt.Errorf("%s holds a public key, but signing needs a private key", c.SigningKeyFile)
+		}
+		set.add(key)
+	}
+	for _, file := range c.VerificationKeyFiles {
+		key, err := readKeyFile(file)
+		if err != nil {
+			return nil, err
+		}
+		set.add(key)
+	}
+	if c.JWTSecret != "" {
+		secret := []byte(c.JWTSecret.Reveal())
+		set.add(&signingKey{
+			method:  jwtgo.SigningMethodHS256,
+			private: secret,
+			public:  secret,
+		})
+	}
+	if c.SigningKeyFile != "" {
+		set.signer = set.keys[0]
+	} else if c.JWTSecret != "" {
+		set.signer = set.find("")
+	} else {
+		return nil, errors.New("a JWT secret or signing key is needed to sign tokens")
+	}
+	return set, nil
+}
+
+func (s *keySet) add(key *signingKey) {
+	if s.find(key.id) == nil {
+		s.keys = append(s.keys, key)
+	}
+}
+
+func (s *keySet) find(id string) *signingKey {
+	for _, key := range s.keys {
+		if key.id == id {
+			return key
+		}
+	}
+	return nil
+}
+
+// sign creates a token with claims, signed by the signing key.
+func (s *keySet) sign(claims jwtgo.MapClaims) (string, error) {
+	token := jwtgo.NewWithClaims(s.signer.method, claims)
+	if s.signer.id != "" {
+		token.Header["kid"] = s.signer.id
+	}
+	return token.SignedString(s.signer.private)
+}
+
+// parse checks that token was signed by one of the keys, using the
+// algorithm that goes with the key, and hasn't expired.
+func (s *keySet) parse(token string) (*jwtgo.Token, error) {
+	return jwtgo.Parse(token, func(t *jwtgo.Token) (interface{}, error) {
+		id, _ := t.Header["kid"].(string)
+		key := s.find(id)
+		if key == nil {
+			return nil, ErrUnknownSigningKey
+		}
+		if t.Method != key.method {
+			return nil, ErrUnknownSigningKey
+		}
+		return key.public, nil
+	})
+}
+
+// jwks returns the public keys, leaving out the JWT secret.
+func (s *keySet) jwks() JWKS {
+	jwks := JWKS{
+		Keys: []JWK{},
+	}
+	for _, key := range s.keys {
+		if key.id != "" {
+			jwks.Keys = append(jwks.Keys, key.jwk())
+		}
+	}
+	return jwks
+}
+
+// readKeyFile reads a PEM encoded RSA or Ed25519 key. Both private and
+// public keys can be read, but only private keys can sign.
+func readKeyFile(path string) (*signingKey, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read the key in %s: %w", path, err)
+	}
+	block, _ := pem.Decode(contents)
+	if block == nil {
+		return nil, fmt.Errorf("%s is not a PEM file", path)
+	}
+
+	var key interface{}
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("%s holds a %s, not a key", path, block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not parse the key in %s: %w", path, err)
+	}
+
+	signingKey, err := newSigningKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("could not use the key in %s: %w", path, err)
+	}
+	return signingKey, nil
+}
+
+// newSigningKey chooses the algorithm for an RSA or Ed25519 key,
+// and works out its ID.
+func newSigningKey(key interface{}) (*signingKey, error) {
+	signingKey := &signingKey{}
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		signingKey.private = key
+		signingKey.public = &key.PublicKey
+	case *rsa.PublicKey:
+		signingKey.public = key
+	case ed25519.PrivateKey:
+		signingKey.private = key
+		signingKey.public = key.Public()
+	case ed25519.PublicKey:
+		signingKey.public = key
+	default:
+		return nil, fmt.Errorf("%T keys are not supported; use RSA or Ed25519", key)
+	}
+
+	switch public := signingKey.public.(type) {
+	case *rsa.PublicKey:
+		if public.N.BitLen() < minRSAKeyBits {
+			return nil, fmt.Errorf("RSA keys must be at least %d bits", minRSAKeyBits)
+		}
+		signingKey.method = jwtgo.SigningMethodRS256
+	case ed25519.PublicKey:
+		signingKey.method = signingMethodEdDSA
+	}
+	signingKey.id = signingKey.thumbprint()
+	return signingKey, nil
+}
+
+// jwk returns the public half of the key as a JWK.
+func (k *signingKey) jwk() JWK {
+	jwk := JWK{
+		Use:       "sig",
+		Algorithm: k.method.Alg(),
+		KeyID:     k.id,
+	}
+	switch public := k.public.(type) {
+	case *rsa.PublicKey:
+		jwk.KeyType = "RSA"
+		jwk.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+		jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+	case ed25519.PublicKey:
+		jwk.KeyType = "OKP"
+		jwk.Curve = "Ed25519"
+		jwk.X = base64.RawURLEncoding.EncodeToString(public)
+	}
+	return jwk
+}
+
+// thumbprint is the RFC 7638 thumbprint of the key: the hash of its
+// required JWK members, in lexicographic order and without whitespace.
+func (k *signingKey) thumbprint() string {
+	jwk := k.jwk()
+	var members string
+	switch jwk.KeyType {
+	case "RSA":
+		members = fmt.Sprintf(`{"e":"%s","kty":"RSA","n":"%s"}`, jwk.E, jwk.N)
+	case "OKP":
+		members = fmt.Sprintf(`{"crv":"%s","kty":"OKP","x":"%s"}`, jwk.Curve, jwk.X)
+	}
+	sum := sha256.Sum256([]byte(members))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// signingMethodEdDSA signs tokens with Ed25519 keys (RFC 8037),
+// which jwt-go doesn't support itself.
+var signingMethodEdDSA jwtgo.SigningMethod = edDSA{}
+
+type edDSA struct{}
+
+func init() {
+	jwtgo.RegisterSigningMethod(signingMethodEdDSA.Alg(), func() jwtgo.SigningMethod {
+		return signingMethodEdDSA
+	})
+}
+
+func (edDSA) Alg() string {
+	return "EdDSA"
+}
+
+func (edDSA) Sign(signingString string, key interface{}) (string, error) {
+	private, ok := key.(ed25519.PrivateKey)
+	if !ok || len(private) != ed25519.PrivateKeySize {
+		return "", jwtgo.ErrInvalidKeyType
+	}
+	return jwtgo.EncodeSegment(ed25519.Sign(private, []byte(signingString))), nil
+}
+
+func (edDSA) Verify(signingString string, signature string, key interface{}) error {
+	public, ok := key.(ed25519.PublicKey)
+	if !ok || len(public) != ed25519.PublicKeySize {
+		return jwtgo.ErrInvalidKeyType
+	}
+	sig, err := jwtgo.DecodeSegment(signature)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(public, []byte(signingString), sig) {
+		return jwtgo.ErrSignatureInvalid
+	}
+	return nil
+}
@@ -0,0 +1,496 @@
+package user
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/speedrun-website/leaderboard-backend/server/request"
+	"golang.org/x/text/unicode/norm"
+)
+
+// An ExternalIdentity is an account on another site, such as Discord,
+// that a user can log in with. Subject is the account's ID on that site.
+type ExternalIdentity struct {
+	ID        uint
+	CreatedAt time.Time
+	UserID    uint
+	Provider  string
+	Subject   string
+	Username  string
+	Email     string
+}
+
+// An OAuthState is a login with a provider that has been started but not
+// finished. It is looked up by a hash of the state parameter, which the
+// provider hands back, and holds the PKCE verifier that goes with it.
+// States that link an account to a logged-in user have a UserID.
+type OAuthState struct {
+	ID           uint
+	CreatedAt    time.Time
+	StateHash    []byte
+	Provider     string
+	CodeVerifier string
+	UserID       *uint
+	Cookie       bool
+	ExpiresAt    time.Time
+}
+
+func (OAuthState) TableName() string {
+	return "oauth_states"
+}
+
+// OAuthStart is the body of a request to log in with a provider.
+// Clients that set Cookie get their tokens as cookies, as when logging in
+// with a password.
+type OAuthStart struct {
+	Cookie bool `json:"cookie"`
+}
+
+// OAuthCallback is what the provider sent back to the website.
+type OAuthCallback struct {
+	Code  string `json:"code" binding:"required"`
+	State string `json:"state" binding:"required"`
+}
+
+// OAuthRedirectResponse is where to send the user to log in with a provider.
+type OAuthRedirectResponse struct {
+	URL string `json:"url"`
+}
+
+type OAuthProvidersResponse struct {
+	Providers []string `json:"providers"`
+}
+
+type ExternalIdentityInfo struct {
+	Provider  string    `json:"provider"`
+	Username  string    `json:"username"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type ExternalIdentitiesResponse struct {
+	Identities []ExternalIdentityInfo `json:"identities"`
+}
+
+var ErrUnknownProvider = errors.New("logging in with that provider isn't supported")
+var ErrInvalidOAuthState = errors.New("the login is invalid or has expired, please try again")
+var ErrProviderFailed = errors.New("the provider could not log you in, please try again")
+var ErrProviderEmailMissing = errors.New("the provider didn't share an email address")
+var ErrProviderEmailInUse = errors.New("an account already uses this email address; log in to it and link the provider from your settings")
+
+// How many times to try picking a free username for a new account.
+const usernameAttempts = 5
+
+// How many digits are added to a provider's username that is taken.
+const usernameSuffixLength = 4
+
+func (i ExternalIdentity) AsInfo() ExternalIdentityInfo {
+	return ExternalIdentityInfo{
+		Provider:  i.Provider,
+		Username:  i.Username,
+		CreatedAt: i.CreatedAt,
+	}
+}
+
+// GetOAuthProvidersHandler lists the providers users can log in with.
+func GetOAuthProvidersHandler(c *gin.Context) {
+	providers := make([]string, 0, len(settings.oauthProviders))
+	for name := range settings.oauthProviders {
+		providers = append(providers, name)
+	}
+	sort.Strings(providers)
+	c.JSON(http.StatusOK, request.SuccessResponse{
+		Data: OAuthProvidersResponse{
+			Providers: providers,
+		},
+	})
+}
+
+// StartOAuthLoginHandler starts logging in with a provider, responding
+// with where to send the user. The provider sends them back to the
+// website with a code and state, which go to the callback endpoint.
+func StartOAuthLoginHandler(c *gin.Context) {
+	var body OAuthStart
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, request.ErrorResponse{
+				Errors: []error{
+					err,
+				},
+			})
+			return
+		}
+	}
+
+	provider, ok := providerFromContext(c)
+	if !ok {
+		return
+	}
+	startOAuth(c, provider, nil, body.Cookie)
+}
+
+// newOAuthCallbackHandler finishes logging in with a provider. Someone
+// logging in with an account that isn't linked to anyone gets a new
+// account, unless its email address is already in use.
+func newOAuthCallbackHandler(authMiddleware *AuthMiddleware) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		provider, ok := providerFromContext(c)
+		if !ok {
+			return
+		}
+		state, profile, ok := finishOAuth(c, provider, nil)
+		if !ok {
+			return
+		}
+
+		user, err := userForProfile(provider, profile)
+		if errors.Is(err, ErrProviderEmailMissing) {
+			c.AbortWithStatusJSON(http.StatusBadRequest, request.ErrorResponse{
+				Errors: []error{
+					err,
+				},
+			})
+			return
+		} else if errors.Is(err, ErrProviderEmailInUse) {
+			c.AbortWithStatusJSON(http.StatusConflict, request.ErrorResponse{
+				Errors: []error{
+					err,
+				},
+			})
+			return
+		} else if err != nil {
+			log.Println(err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		if user.BannedAt != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, request.ErrorResponse{
+				Errors: []error{
+					ErrUserBanned,
+				},
+			})
+			return
+		}
+
+		authMiddleware.login(c, user, state.Cookie)
+	}
+}
+
+// GetIdentitiesHandler lists the accounts on other sites that the
+// logged-in user can log in with.
+func GetIdentitiesHandler(c *gin.Context) {
+	identity, ok := IdentityFromContext(c)
+	if !ok {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	respondWithIdentities(c, identity.ID)
+}
+
+// StartLinkIdentityHandler starts linking an account on a provider's
+// site to the logged-in user. It works like logging in with the
+// provider, finishing at the link callback endpoint instead.
+func StartLinkIdentityHandler(c *gin.Context) {
+	identity, ok := IdentityFromContext(c)
+	if !ok {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	provider, ok := providerFromContext(c)
+	if !ok {
+		return
+	}
+	startOAuth(c, provider, &identity.ID, false)
+}
+
+// LinkIdentityHandler finishes linking an account on a provider's site
+// to the logged-in user.
+func LinkIdentityHandler(c *gin.Context) {
+	identity, ok := IdentityFromContext(c)
+	if !ok {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	provider, ok := providerFromContext(c)
+	if !ok {
+		return
+	}
+	_, profile, ok := finishOAuth(c, provider, &identity.ID)
+	if !ok {
+		return
+	}
+
+	err := Store.CreateExternalIdentity(&ExternalIdentity{
+		UserID:   identity.ID,
+		Provider: provider.name,
+		Subject:  profile.Subject,
+		Username: profile.Username,
+		Email:    profile.Email,
+	})
+	if errors.Is(err, ErrIdentityTaken) || errors.Is(err, ErrProviderAlreadyLinked) {
+		c.AbortWithStatusJSON(http.StatusConflict, request.ErrorResponse{
+			Errors: []error{
+				err,
+			},
+		})
+		return
+	} else if err != nil {
+		log.Println(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	respondWithIdentities(c, identity.ID)
+}
+
+// UnlinkIdentityHandler stops the logged-in user from logging in with a
+// provider. Users without a password have to keep one provider linked.
+func UnlinkIdentityHandler(c *gin.Context) {
+	identity, ok := IdentityFromContext(c)
+	if !ok {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	err := Store.DeleteExternalIdentity(identity.ID, c.Param("provider"))
+	if errors.Is(err, ErrIdentityNotFound) {
+		c.AbortWithStatusJSON(http.StatusNotFound, request.ErrorResponse{
+			Errors: []error{
+				err,
+			},
+		})
+		return
+	} else if errors.Is(err, ErrLastLoginMethod) {
+		c.AbortWithStatusJSON(http.StatusConflict, request.ErrorResponse{
+			Errors: []error{
+				err,
+			},
+		})
+		return
+	} else if err != nil {
+		log.Println(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func respondWithIdentities(c *gin.Context, userId uint) {
+	identities, err := Store.GetExternalIdentities(userId)
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	infos := make([]ExternalIdentityInfo, 0, len(identities))
+	for _, identity := range identities {
+		infos = append(infos, identity.AsInfo())
+	}
+	c.JSON(http.StatusOK, request.SuccessResponse{
+		Data: ExternalIdentitiesResponse{
+			Identities: infos,
+		},
+	})
+}
+
+// providerFromContext returns the provider named in the route,
+// aborting if it isn't turned on.
+func providerFromContext(c *gin.Context) (*oauthProvider, bool) {
+	provider, ok := settings.oauthProviders[c.Param("provider")]
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusNotFound, request.ErrorResponse{
+			Errors: []error{
+				ErrUnknownProvider,
+			},
+		})
+		return nil, false
+	}
+	return provider, true
+}
+
+// startOAuth saves a new state for logging in with provider, or linking
+// it to userId if it's set, and responds with where to send the user.
+func startOAuth(c *gin.Context, provider *oauthProvider, userId *uint, cookie bool) {
+	state, err := newOpaqueToken()
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	verifier, err := newOpaqueToken()
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	err = Store.CreateOAuthState(&OAuthState{
+		StateHash:    hashToken(state),
+		Provider:     provider.name,
+		CodeVerifier: verifier,
+		UserID:       userId,
+		Cookie:       cookie,
+		ExpiresAt:    time.Now().Add(settings.oauthStateTimeout),
+	})
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, request.SuccessResponse{
+		Data: OAuthRedirectResponse{
+			URL: provider.authorizationURL(state, verifier),
+		},
+	})
+}
+
+// finishOAuth uses up the state in the callback, which must have been
+// started for userId, and fetches the profile of whoever logged in with
+// the provider. It aborts if any of that fails.
+func finishOAuth(c *gin.Context, provider *oauthProvider, userId *uint) (*OAuthState, *externalProfile, bool) {
+	var body OAuthCallback
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, request.ErrorResponse{
+			Errors: []error{
+				err,
+			},
+		})
+		return nil, nil, false
+	}
+
+	state, err := Store.TakeOAuthState(provider.name, hashToken(body.State))
+	if err != nil && !errors.Is(err, ErrInvalidOAuthState) {
+		log.Println(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return nil, nil, false
+	}
+	if err != nil || !sameUser(state.UserID, userId) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, request.ErrorResponse{
+			Errors: []error{
+				ErrInvalidOAuthState,
+			},
+		})
+		return nil, nil, false
+	}
+
+	accessToken, err := provider.exchange(c.Request.Context(), body.Code, state.CodeVerifier)
+	var profile *externalProfile
+	if err == nil {
+		profile, err = provider.fetchProfile(c.Request.Context(), accessToken)
+	}
+	if err != nil {
+		log.Printf("Could not log in with %s: %s", provider.name, err)
+		c.AbortWithStatusJSON(http.StatusBadGateway, request.ErrorResponse{
+			Errors: []error{
+				ErrProviderFailed,
+			},
+		})
+		return nil, nil, false
+	}
+	return state, profile, true
+}
+
+func sameUser(a *uint, b *uint) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// userForProfile finds the user linked to profile, or signs them up.
+func userForProfile(provider *oauthProvider, profile *externalProfile) (*User, error) {
+	identity, err := Store.GetExternalIdentity(provider.name, profile.Subject)
+	if err == nil {
+		return Store.GetUserById(identity.UserID)
+	} else if !errors.Is(err, ErrIdentityNotFound) {
+		return nil, err
+	}
+
+	if profile.Email == "" {
+		return nil, ErrProviderEmailMissing
+	}
+	// Linking to an existing account has to be done by someone logged
+	// in to it, or anyone could take over an account by signing up to a
+	// provider with its email address.
+	if _, err := Store.GetUserByEmail(profile.Email); err == nil {
+		return nil, ErrProviderEmailInUse
+	} else if !errors.Is(err, ErrUserNotFound) {
+		return nil, err
+	}
+
+	now := time.Now()
+	user := &User{
+		Email:              profile.Email,
+		VerificationSentAt: &now,
+	}
+	if profile.EmailVerified {
+		user.EmailVerifiedAt = &now
+	}
+	username := providerUsername(profile.Username)
+
+	// The provider's username may be taken here, so try adding numbers.
+	for attempt := 0; ; attempt++ {
+		user.Username = username
+		if attempt > 0 {
+			suffix, err := rand.Int(rand.Reader, big.NewInt(10000))
+			if err != nil {
+				return nil, err
+			}
+			user.Username = fmt.Sprintf("%s%0*d", username, usernameSuffixLength, suffix)
+		}
+		err = Store.CreateUserWithIdentity(user, &ExternalIdentity{
+			Provider: provider.name,
+			Subject:  profile.Subject,
+			Username: profile.Username,
+			Email:    profile.Email,
+		})
+		if !errors.Is(err, ErrUserNotUnique) || attempt == usernameAttempts-1 {
+			break
+		}
+	}
+	if errors.Is(err, ErrIdentityTaken) {
+		// Someone else logged in with the same account at the same time.
+		identity, err := Store.GetExternalIdentity(provider.name, profile.Subject)
+		if err != nil {
+			return nil, err
+		}
+		return Store.GetUserById(identity.UserID)
+	} else if err != nil {
+		return nil, err
+	}
+
+	if !user.IsVerified() {
+		if err := sendVerificationEmail(user); err != nil {
+			log.Printf("Could not send a verification email to user %d: %s", user.ID, err)
+		}
+	}
+	return user, nil
+}
+
+// providerUsername turns a username on another site into one that is
+// allowed here, leaving room for a suffix in case it is taken. Names with
+// nothing left, or that are reserved, become "runner".
+func providerUsername(name string) string {
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r == ' ' || r == '.':
+			return '_'
+		case !usernamePattern.MatchString(string(r)):
+			return -1
+		}
+		return r
+	}, norm.NFKC.String(strings.TrimSpace(name)))
+	if len(name) > maxUsernameLength-usernameSuffixLength {
+		name = name[:maxUsernameLength-usernameSuffixLength]
+	}
+	if len(name) < minUsernameLength || IsReservedUsername(name) {
+		return "runner"
+	}
+	return name
+}
@@ -0,0 +1,229 @@
+package user
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/speedrun-website/leaderboard-backend/config"
+)
+
+// The largest response that is read from a provider.
+const maxProviderResponse = 1 << 20
+
+// An oauthProvider is a site users can log in with, using the OAuth 2
+// authorization code flow with PKCE.
+type oauthProvider struct {
+	name   string
+	config config.OAuthProvider
+	scopes []string
+	// profile reads the user's profile from a userinfo response.
+	profile func(body []byte) (*externalProfile, error)
+}
+
+// An externalProfile is who a user is on a provider's site.
+type externalProfile struct {
+	Subject       string
+	Username      string
+	Email         string
+	EmailVerified bool
+}
+
+// newOAuthProviders returns the providers that are turned on in c, by name.
+func newOAuthProviders(c config.OAuthConfig) map[string]*oauthProvider {
+	all := []*oauthProvider{
+		{
+			name:    "discord",
+			config:  c.Discord,
+			scopes:  []string{"identify", "email"},
+			profile: discordProfile,
+		},
+		{
+			name:    "twitch",
+			config:  c.Twitch,
+			scopes:  []string{"user:read:email"},
+			profile: twitchProfile,
+		},
+		{
+			name:    "google",
+			config:  c.Google,
+			scopes:  []string{"openid", "email", "profile"},
+			profile: googleProfile,
+		},
+	}
+	providers := map[string]*oauthProvider{}
+	for _, provider := range all {
+		if provider.config.Enabled() {
+			providers[provider.name] = provider
+		}
+	}
+	return providers
+}
+
+// redirectURI is the page on the website that the provider sends the
+// user back to. The website passes the code and state on to the API.
+func (p *oauthProvider) redirectURI() string {
+	return fmt.Sprintf("%s/oauth/%s/callback", settings.frontendURL, p.name)
+}
+
+// authorizationURL is where to send the user to log in with the provider.
+func (p *oauthProvider) authorizationURL(state string, verifier string) string {
+	challenge := sha256.Sum256([]byte(verifier))
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.config.ClientID},
+		"redirect_uri":          {p.redirectURI()},
+		"scope":                 {strings.Join(p.scopes, " ")},
+		"state":                 {state},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	separator := "?"
+	if strings.Contains(p.config.AuthURL, "?") {
+		separator = "&"
+	}
+	return p.config.AuthURL + separator + query.Encode()
+}
+
+// exchange swaps an authorization code for an access token.
+func (p *oauthProvider) exchange(ctx context.Context, code string, verifier string) (string, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.redirectURI()},
+		"code_verifier": {verifier},
+		"client_id":     {p.config.ClientID},
+		"client_secret": {p.config.ClientSecret.Reveal()},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.config.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	body, err := p.do(req)
+	if err != nil {
+		return "", err
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.Unmarshal(body, &token); err != nil {
+		return "", fmt.Errorf("%s sent a malformed token response: %w", p.name, err)
+	}
+	if token.AccessToken == "" {
+		return "", fmt.Errorf("%s sent no access token", p.name)
+	}
+	return token.AccessToken, nil
+}
+
+// fetchProfile looks up the user that accessToken belongs to.
+func (p *oauthProvider) fetchProfile(ctx context.Context, accessToken string) (*externalProfile, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.config.UserInfoURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("Accept", "application/json")
+	// Twitch wants to know which app is asking.
+	req.Header.Set("Client-Id", p.config.ClientID)
+
+	body, err := p.do(req)
+	if err != nil {
+		return nil, err
+	}
+	profile, err := p.profile(body)
+	if err != nil {
+		return nil, fmt.Errorf("%s sent a malformed profile: %w", p.name, err)
+	}
+	if profile.Subject == "" {
+		return nil, fmt.Errorf("%s sent a profile without an ID", p.name)
+	}
+	return profile, nil
+}
+
+func (p *oauthProvider) do(req *http.Request) ([]byte, error) {
+	res, err := settings.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(http.MaxBytesReader(nil, res.Body, maxProviderResponse))
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s responded to %s with %s", p.name, req.URL.Path, res.Status)
+	}
+	return body, nil
+}
+
+func discordProfile(body []byte) (*externalProfile, error) {
+	var user struct {
+		ID       string `json:"id"`
+		Username string `json:"username"`
+		Email    string `json:"email"`
+		Verified bool   `json:"verified"`
+	}
+	if err := json.Unmarshal(body, &user); err != nil {
+		return nil, err
+	}
+	return &externalProfile{
+		Subject:       user.ID,
+		Username:      user.Username,
+		Email:         user.Email,
+		EmailVerified: user.Verified,
+	}, nil
+}
+
+// twitchProfile reads a response from Twitch's Get Users endpoint.
+// Twitch doesn't say whether the email address has been verified.
+func twitchProfile(body []byte) (*externalProfile, error) {
+	var users struct {
+		Data []struct {
+			ID    string `json:"id"`
+			Login string `json:"login"`
+			Email string `json:"email"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &users); err != nil {
+		return nil, err
+	}
+	if len(users.Data) != 1 {
+		return nil, errors.New("expected exactly one user")
+	}
+	user := users.Data[0]
+	return &externalProfile{
+		Subject:  user.ID,
+		Username: user.Login,
+		Email:    user.Email,
+	}, nil
+}
+
+// googleProfile reads an OpenID Connect userinfo response. Google
+// accounts don't have usernames, so the name is used instead.
+func googleProfile(body []byte) (*externalProfile, error) {
+	var user struct {
+		Subject       string `json:"sub"`
+		Name          string `json:"name"`
+		Email         string `json:"email"`
+		EmailVerified bool   `json:"email_verified"`
+	}
+	if err := json.Unmarshal(body, &user); err != nil {
+		return nil, err
+	}
+	return &externalProfile{
+		Subject:       user.Subject,
+		Username:      strings.Join(strings.Fields(user.Name), ""),
+		Email:         user.Email,
+		EmailVerified: user.EmailVerified,
+	}, nil
+}
@@ -0,0 +1,635 @@
+package user
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"time"
+
+	jwt "github.com/appleboy/gin-jwt/v2"
+	jwtgo "github.com/dgrijalva/jwt-go"
+	"github.com/gin-gonic/gin"
+	"github.com/speedrun-website/leaderboard-backend/server/request"
+)
+
+// An AuthorizationCode is handed to an app once a user consents to it,
+// for the app to swap for tokens. Only a hash of the code is stored,
+// along with the PKCE challenge the app started with (RFC 7636).
+type AuthorizationCode struct {
+	ID            uint
+	CreatedAt     time.Time
+	AppID         uint
+	UserID        uint
+	CodeHash      []byte
+	RedirectURI   string
+	Scopes        string
+	CodeChallenge string
+	ExpiresAt     time.Time
+}
+
+// AuthorizationRequest is what an app asks a user for, as the query of
+// its link to the consent screen (RFC 6749 section 4.1.1). The redirect
+// URI can be left out if the app only has one. Only S256 PKCE challenges
+// are accepted, and every app has to use one.
+type AuthorizationRequest struct {
+	ResponseType        string `form:"response_type" json:"response_type"`
+	ClientID            string `form:"client_id" json:"client_id" binding:"required"`
+	RedirectURI         string `form:"redirect_uri" json:"redirect_uri"`
+	Scope               string `form:"scope" json:"scope"`
+	State               string `form:"state" json:"state"`
+	CodeChallenge       string `form:"code_challenge" json:"code_challenge"`
+	CodeChallengeMethod string `form:"code_challenge_method" json:"code_challenge_method"`
+}
+
+// AuthorizationDecision is the user's answer to an AuthorizationRequest.
+type AuthorizationDecision struct {
+	AuthorizationRequest
+	Approve bool `json:"approve"`
+}
+
+// ConsentApp is an app as shown on the consent screen.
+type ConsentApp struct {
+	Name     string `json:"name"`
+	ClientID string `json:"client_id"`
+	Owner    string `json:"owner"`
+}
+
+// AuthorizationConsent is what the consent screen asks the user to
+// agree to.
+type AuthorizationConsent struct {
+	App         ConsentApp `json:"app"`
+	Scopes      []Scope    `json:"scopes"`
+	RedirectURI string     `json:"redirect_uri"`
+}
+
+// AuthorizationRedirect is where to send the user back to the app, with
+// either a code or an error.
+type AuthorizationRedirect struct {
+	RedirectTo string `json:"redirect_to"`
+}
+
+// OAuthTokenRequest is the form an app posts to the token endpoint
+// (RFC 6749 sections 4.1.3 and 6). Confidential apps authenticate with
+// HTTP Basic or with ClientSecret.
+type OAuthTokenRequest struct {
+	GrantType    string `form:"grant_type"`
+	Code         string `form:"code"`
+	RedirectURI  string `form:"redirect_uri"`
+	CodeVerifier string `form:"code_verifier"`
+	RefreshToken string `form:"refresh_token"`
+	ClientID     string `form:"client_id"`
+	ClientSecret string `form:"client_secret"`
+}
+
+// OAuthTokenResponse is the standard response of the token endpoint
+// (RFC 6749 section 5.1), rather than one of our usual responses, since
+// that is what OAuth libraries expect.
+type OAuthTokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+	Scope        string `json:"scope"`
+}
+
+// IntrospectionResponse describes a token to the app it was issued to
+// (RFC 7662). Every other field is left out of inactive tokens.
+type IntrospectionResponse struct {
+	Active    bool   `json:"active"`
+	Scope     string `json:"scope,omitempty"`
+	ClientID  string `json:"client_id,omitempty"`
+	Username  string `json:"username,omitempty"`
+	Subject   string `json:"sub,omitempty"`
+	TokenType string `json:"token_type,omitempty"`
+	ExpiresAt int64  `json:"exp,omitempty"`
+	IssuedAt  int64  `json:"iat,omitempty"`
+}
+
+// An OAuthError is an error in the standard form of RFC 6749 section 5.2.
+type OAuthError struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+func (e *OAuthError) Error() string {
+	return e.Code + ": " + e.Description
+}
+
+var ErrInvalidAuthorizationCode = errors.New("the authorization code is invalid or has expired")
+var ErrMissingRedirectURI = errors.New("the app has more than one redirect URI, so one has to be given")
+var ErrUnknownRedirectURI = errors.New("the redirect URI isn't one of the app's")
+
+// How long an app has to swap an authorization code for tokens.
+const authorizationCodeTimeout = 5 * time.Minute
+
+// PKCE code verifiers, and so their S256 challenges, are 43 to 128
+// unreserved characters (RFC 7636 section 4.1).
+var codeVerifierPattern = regexp.MustCompile(`^[A-Za-z0-9\-._~]{43,128}$`)
+
+// GetAuthorizationHandler checks what an app is asking the logged-in user
+// for, and returns what the consent screen needs to show. Requests with
+// an unknown app or redirect URI are refused outright. Other problems are
+// reported to the app, by sending the user to the returned redirect.
+func GetAuthorizationHandler(c *gin.Context) {
+	var query AuthorizationRequest
+	if err := c.ShouldBindQuery(&query); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, request.ErrorResponse{
+			Errors: []error{
+				err,
+			},
+		})
+		return
+	}
+
+	app, redirectURI, scopes, ok := checkAuthorizationRequest(c, query)
+	if !ok {
+		return
+	}
+
+	owner, err := Store.GetUserIdentifierById(app.OwnerID)
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, request.SuccessResponse{
+		Data: AuthorizationConsent{
+			App: ConsentApp{
+				Name:     app.Name,
+				ClientID: app.ClientID,
+				Owner:    owner.Username,
+			},
+			Scopes:      splitScopes(scopes),
+			RedirectURI: redirectURI,
+		},
+	})
+}
+
+// AuthorizeHandler records the logged-in user's answer to an app, and
+// returns where to send them back to it: with an authorization code if
+// they approved, or an access_denied error otherwise.
+func AuthorizeHandler(c *gin.Context) {
+	var body AuthorizationDecision
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, request.ErrorResponse{
+			Errors: []error{
+				err,
+			},
+		})
+		return
+	}
+
+	identity, ok := IdentityFromContext(c)
+	if !ok {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	app, redirectURI, scopes, ok := checkAuthorizationRequest(c, body.AuthorizationRequest)
+	if !ok {
+		return
+	}
+	if !body.Approve {
+		redirectWithError(c, redirectURI, body.State, &OAuthError{
+			Code:        "access_denied",
+			Description: "the user didn't allow access",
+		})
+		return
+	}
+
+	code, err := newOpaqueToken()
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	err = Store.CreateAuthorizationCode(&AuthorizationCode{
+		AppID:         app.ID,
+		UserID:        identity.ID,
+		CodeHash:      hashToken(code),
+		RedirectURI:   body.RedirectURI,
+		Scopes:        scopes,
+		CodeChallenge: body.CodeChallenge,
+		ExpiresAt:     time.Now().Add(authorizationCodeTimeout),
+	})
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	params := url.Values{}
+	params.Set("code", code)
+	if body.State != "" {
+		params.Set("state", body.State)
+	}
+	c.JSON(http.StatusOK, request.SuccessResponse{
+		Data: AuthorizationRedirect{
+			RedirectTo: withQuery(redirectURI, params),
+		},
+	})
+}
+
+// checkAuthorizationRequest finds the app that req is from, and which of
+// its redirect URIs to answer on, then checks the rest of req. It returns
+// the scopes asked for, in the order they are stored. If req is invalid,
+// the request is aborted and ok is false.
+func checkAuthorizationRequest(c *gin.Context, req AuthorizationRequest) (app *OAuthApp, redirectURI string, scopes string, ok bool) {
+	app, err := Store.GetOAuthAppByClientID(req.ClientID)
+	if errors.Is(err, ErrOAuthAppNotFound) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, request.ErrorResponse{
+			Errors: []error{
+				err,
+			},
+		})
+		return nil, "", "", false
+	} else if err != nil {
+		log.Println(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return nil, "", "", false
+	}
+
+	redirectURI = req.RedirectURI
+	if redirectURI == "" {
+		uris := app.AsInfo().RedirectURIs
+		if len(uris) != 1 {
+			c.AbortWithStatusJSON(http.StatusBadRequest, request.ErrorResponse{
+				Errors: []error{
+					ErrMissingRedirectURI,
+				},
+			})
+			return nil, "", "", false
+		}
+		redirectURI = uris[0]
+	} else if !app.HasRedirectURI(redirectURI) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, request.ErrorResponse{
+			Errors: []error{
+				ErrUnknownRedirectURI,
+			},
+		})
+		return nil, "", "", false
+	}
+
+	// The redirect URI can be trusted from here on, so the app is told
+	// about anything else that is wrong.
+	if req.ResponseType != "code" {
+		redirectWithError(c, redirectURI, req.State, &OAuthError{
+			Code:        "unsupported_response_type",
+			Description: "only the code response type is supported",
+		})
+		return nil, "", "", false
+	}
+	if req.CodeChallengeMethod != "S256" || !codeVerifierPattern.MatchString(req.CodeChallenge) {
+		redirectWithError(c, redirectURI, req.State, &OAuthError{
+			Code:        "invalid_request",
+			Description: "an S256 code challenge is required",
+		})
+		return nil, "", "", false
+	}
+	scopes, err = joinScopes(splitScopes(req.Scope))
+	if err != nil || scopes == "" {
+		redirectWithError(c, redirectURI, req.State, &OAuthError{
+			Code:        "invalid_scope",
+			Description: "the scope is missing or unknown",
+		})
+		return nil, "", "", false
+	}
+	return app, redirectURI, scopes, true
+}
+
+// redirectWithError reports err to the app, by returning a redirect to
+// redirectURI for the consent screen to send the user to.
+func redirectWithError(c *gin.Context, redirectURI string, state string, err *OAuthError) {
+	params := url.Values{}
+	params.Set("error", err.Code)
+	params.Set("error_description", err.Description)
+	if state != "" {
+		params.Set("state", state)
+	}
+	c.AbortWithStatusJSON(http.StatusOK, request.SuccessResponse{
+		Data: AuthorizationRedirect{
+			RedirectTo: withQuery(redirectURI, params),
+		},
+	})
+}
+
+// withQuery adds params to the query of uri, which is known to parse.
+func withQuery(uri string, params url.Values) string {
+	u, _ := url.Parse(uri)
+	query := u.Query()
+	for key, values := range params {
+		query[key] = values
+	}
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// newOAuthTokenHandler swaps an authorization code, or a refresh token,
+// for an access token and a refresh token. Access tokens from apps are
+// ordinary access tokens, for a session that only has the scopes the user
+// granted.
+func newOAuthTokenHandler(authMiddleware *AuthMiddleware) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("Cache-Control", "no-store")
+		c.Header("Pragma", "no-cache")
+
+		var form OAuthTokenRequest
+		if err := c.ShouldBind(&form); err != nil {
+			abortOAuth(c, http.StatusBadRequest, &OAuthError{
+				Code:        "invalid_request",
+				Description: err.Error(),
+			})
+			return
+		}
+
+		app, ok := authenticateClient(c, form.ClientID, form.ClientSecret)
+		if !ok {
+			return
+		}
+
+		var session *Session
+		var refreshToken string
+		switch form.GrantType {
+		case "authorization_code":
+			session, refreshToken, ok = redeemAuthorizationCode(c, app, form)
+		case "refresh_token":
+			session, refreshToken, ok = refreshAppSession(c, app, form.RefreshToken)
+		default:
+			abortOAuth(c, http.StatusBadRequest, &OAuthError{
+				Code:        "unsupported_grant_type",
+				Description: "only the authorization_code and refresh_token grants are supported",
+			})
+			return
+		}
+		if !ok {
+			return
+		}
+
+		user, err := Store.GetUserById(session.UserID)
+		if err != nil || user.BannedAt != nil {
+			abortInvalidGrant(c)
+			return
+		}
+		access, expire, err := authMiddleware.TokenGenerator(&sessionIdentity{
+			user:    user.AsPersonal(),
+			session: session,
+		})
+		if err != nil {
+			log.Println(err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		c.JSON(http.StatusOK, OAuthTokenResponse{
+			AccessToken:  access,
+			TokenType:    "Bearer",
+			ExpiresIn:    int64(time.Until(expire).Seconds()),
+			RefreshToken: refreshToken,
+			Scope:        session.Scopes,
+		})
+	}
+}
+
+// redeemAuthorizationCode uses up the code in form, and starts a session
+// for app with the scopes the user granted it. If the code can't be used,
+// the request is aborted and ok is false.
+func redeemAuthorizationCode(c *gin.Context, app *OAuthApp, form OAuthTokenRequest) (session *Session, refreshToken string, ok bool) {
+	code, err := Store.TakeAuthorizationCode(hashToken(form.Code))
+	if errors.Is(err, ErrInvalidAuthorizationCode) {
+		abortInvalidGrant(c)
+		return nil, "", false
+	} else if err != nil {
+		log.Println(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return nil, "", false
+	}
+	if code.AppID != app.ID || code.RedirectURI != form.RedirectURI || !verifyCodeChallenge(code.CodeChallenge, form.CodeVerifier) {
+		abortInvalidGrant(c)
+		return nil, "", false
+	}
+
+	session, err = newSession(code.UserID, c.Request.UserAgent(), c.ClientIP(), time.Now().Add(settings.refreshTimeout))
+	if err == nil {
+		session.AppID = &app.ID
+		session.Scopes = code.Scopes
+		err = Store.CreateSession(session)
+	}
+	if err == nil {
+		refreshToken, err = issueRefreshToken(session)
+	}
+	if err != nil {
+		log.Printf("Could not start a session for app %d and user %d: %s", app.ID, code.UserID, err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return nil, "", false
+	}
+	return session, refreshToken, true
+}
+
+// refreshAppSession swaps token, a refresh token from a session of app,
+// for a new one. If it can't be used, the request is aborted and ok is
+// false.
+func refreshAppSession(c *gin.Context, app *OAuthApp, token string) (session *Session, refreshToken string, ok bool) {
+	refreshToken, err := newOpaqueToken()
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return nil, "", false
+	}
+	session, err = Store.RotateRefreshToken(hashToken(token), &RefreshToken{
+		TokenHash: hashToken(refreshToken),
+		ExpiresAt: time.Now().Add(settings.refreshTimeout),
+	})
+	if errors.Is(err, ErrInvalidRefreshToken) || errors.Is(err, ErrRefreshTokenReused) {
+		abortInvalidGrant(c)
+		return nil, "", false
+	} else if err != nil {
+		log.Println(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return nil, "", false
+	}
+	if session.AppID == nil || *session.AppID != app.ID {
+		abortInvalidGrant(c)
+		return nil, "", false
+	}
+	return session, refreshToken, true
+}
+
+// newIntrospectionHandler tells an app whether one of its access or
+// refresh tokens is active, and what it grants (RFC 7662). Tokens of
+// other apps and of users are reported as inactive.
+func newIntrospectionHandler(authMiddleware *AuthMiddleware) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		app, ok := authenticateClient(c, c.PostForm("client_id"), c.PostForm("client_secret"))
+		if !ok {
+			return
+		}
+
+		session, claims, err := authMiddleware.appTokenSession(app, c.PostForm("token"))
+		if err != nil {
+			log.Println(err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		if session == nil {
+			c.JSON(http.StatusOK, IntrospectionResponse{})
+			return
+		}
+		user, err := Store.GetUserById(session.UserID)
+		if err != nil || user.BannedAt != nil {
+			c.JSON(http.StatusOK, IntrospectionResponse{})
+			return
+		}
+
+		response := IntrospectionResponse{
+			Active:    true,
+			Scope:     session.Scopes,
+			ClientID:  app.ClientID,
+			Username:  user.Username,
+			Subject:   user.PublicID,
+			ExpiresAt: session.ExpiresAt.Unix(),
+		}
+		if claims != nil {
+			response.TokenType = "Bearer"
+			if exp, ok := claims["exp"].(float64); ok {
+				response.ExpiresAt = int64(exp)
+			}
+			if iat, ok := claims["orig_iat"].(float64); ok {
+				response.IssuedAt = int64(iat)
+			}
+		}
+		c.JSON(http.StatusOK, response)
+	}
+}
+
+// newOAuthRevocationHandler ends the session of one of an app's access or
+// refresh tokens, logging the app out of the user's account (RFC 7009).
+// Unknown tokens are ignored.
+func newOAuthRevocationHandler(authMiddleware *AuthMiddleware) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		app, ok := authenticateClient(c, c.PostForm("client_id"), c.PostForm("client_secret"))
+		if !ok {
+			return
+		}
+
+		session, _, err := authMiddleware.appTokenSession(app, c.PostForm("token"))
+		if err == nil && session != nil {
+			err = Store.RevokeSession(session.UserID, session.PublicID)
+		}
+		if err != nil && !errors.Is(err, ErrSessionNotFound) {
+			log.Println(err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		c.Status(http.StatusOK)
+	}
+}
+
+// appTokenSession returns the active session of token, an access token or
+// a refresh token, as long as app started it. The claims are returned for
+// access tokens. Tokens that aren't active give a nil session.
+func (mw *AuthMiddleware) appTokenSession(app *OAuthApp, token string) (*Session, jwt.MapClaims, error) {
+	var session *Session
+	var claims jwt.MapClaims
+	if parsed, err := mw.keys.parse(token); err == nil {
+		claims = jwt.MapClaims(parsed.Claims.(jwtgo.MapClaims))
+		tokenId, _ := claims[sessionKey].(string)
+		session, err = Store.GetSession(tokenId)
+		if errors.Is(err, ErrSessionNotFound) {
+			return nil, nil, nil
+		} else if err != nil {
+			return nil, nil, err
+		}
+	} else {
+		var err error
+		session, err = Store.GetRefreshTokenSession(hashToken(token))
+		if errors.Is(err, ErrInvalidRefreshToken) {
+			return nil, nil, nil
+		} else if err != nil {
+			return nil, nil, err
+		}
+	}
+	if session.RevokedAt != nil || session.AppID == nil || *session.AppID != app.ID {
+		return nil, nil, nil
+	}
+	return session, claims, nil
+}
+
+// authenticateClient finds the app making the request, by HTTP Basic or
+// by the clientId and clientSecret it posted. Confidential apps have to
+// give their secret. If the app can't be authenticated, the request is
+// aborted and ok is false.
+func authenticateClient(c *gin.Context, clientId string, clientSecret string) (app *OAuthApp, ok bool) {
+	basicId, basicSecret, basic := c.Request.BasicAuth()
+	if basic {
+		// Basic credentials are form-encoded first (RFC 6749 section 2.3.1).
+		var err1, err2 error
+		clientId, err1 = url.QueryUnescape(basicId)
+		clientSecret, err2 = url.QueryUnescape(basicSecret)
+		if err1 != nil || err2 != nil {
+			abortInvalidClient(c, basic)
+			return nil, false
+		}
+	}
+	if clientId == "" {
+		abortInvalidClient(c, basic)
+		return nil, false
+	}
+
+	app, err := Store.GetOAuthAppByClientID(clientId)
+	if errors.Is(err, ErrOAuthAppNotFound) {
+		abortInvalidClient(c, basic)
+		return nil, false
+	} else if err != nil {
+		log.Println(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return nil, false
+	}
+	if app.Confidential() {
+		if subtle.ConstantTimeCompare(hashToken(clientSecret), app.ClientSecretHash) != 1 {
+			abortInvalidClient(c, basic)
+			return nil, false
+		}
+	} else if clientSecret != "" {
+		abortInvalidClient(c, basic)
+		return nil, false
+	}
+	return app, true
+}
+
+// verifyCodeChallenge reports whether verifier is the one that challenge
+// was made from with S256.
+func verifyCodeChallenge(challenge string, verifier string) bool {
+	if !codeVerifierPattern.MatchString(verifier) {
+		return false
+	}
+	hash := sha256.Sum256([]byte(verifier))
+	expected := base64.RawURLEncoding.EncodeToString(hash[:])
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(challenge)) == 1
+}
+
+func abortOAuth(c *gin.Context, code int, err *OAuthError) {
+	c.AbortWithStatusJSON(code, err)
+}
+
+func abortInvalidGrant(c *gin.Context) {
+	abortOAuth(c, http.StatusBadRequest, &OAuthError{
+		Code:        "invalid_grant",
+		Description: "the code or refresh token is invalid, has expired, or is for another app",
+	})
+}
+
+func abortInvalidClient(c *gin.Context, basic bool) {
+	if basic {
+		c.Header("WWW-Authenticate", `Basic realm="oauth"`)
+	}
+	abortOAuth(c, http.StatusUnauthorized, &OAuthError{
+		Code:        "invalid_client",
+		Description: "the app could not be authenticated",
+	})
+}
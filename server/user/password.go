@@ -1,24 +1,180 @@
 package user
 
 import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/speedrun-website/leaderboard-backend/config"
+	"golang.org/x/crypto/argon2"
 	"golang.org/x/crypto/bcrypt"
 )
 
-func HashAndSaltPassword(pwd []byte) ([]byte, error) {
-	// Use GenerateFromPassword to hash & salt pwd.
-	// MinCost is just an integer constant provided by the bcrypt
-	// package along with DefaultCost & MaxCost.
-	// The cost can be any value you want provided it isn't lower
-	// than the MinCost (4)
-	hash, err := bcrypt.GenerateFromPassword(pwd, bcrypt.MinCost)
-	if err != nil {
-		return nil, err
+// A PasswordHasher hashes passwords with one algorithm and set of
+// parameters. Its hashes record both, so that passwords can still be
+// checked after the configuration changes.
+type PasswordHasher interface {
+	Hash(password []byte) ([]byte, error)
+	// Current reports whether hash was made with this hasher's algorithm
+	// and parameters, rather than ones that have since been changed.
+	Current(hash []byte) bool
+}
+
+// passwordHasher hashes new passwords. It is set by ConfigurePasswords.
+var passwordHasher = NewPasswordHasher(config.Default().Auth.Password)
+
+// NewPasswordHasher returns the hasher that c chooses. It expects c to be
+// valid.
+func NewPasswordHasher(c config.PasswordConfig) PasswordHasher {
+	if c.Algorithm == config.PasswordBcrypt {
+		return bcryptHasher{
+			cost: c.BcryptCost,
+		}
 	}
+	return argon2idHasher{
+		params: argon2idParams{
+			time:    uint32(c.Argon2Time),
+			memory:  uint32(c.Argon2Memory),
+			threads: uint8(c.Argon2Threads),
+		},
+	}
+}
+
+// ConfigurePasswords sets how new passwords are hashed. Configure calls
+// it, but commands that only create users can call it on its own.
+func ConfigurePasswords(c config.PasswordConfig) {
+	passwordHasher = NewPasswordHasher(c)
+}
 
-	return hash, nil
+// HashAndSaltPassword hashes pwd with a random salt, using the
+// configured algorithm.
+func HashAndSaltPassword(pwd []byte) ([]byte, error) {
+	return passwordHasher.Hash(pwd)
 }
 
+// ComparePasswords reports whether plainPwd matches hashedPwd, whichever
+// algorithm made the hash.
 func ComparePasswords(hashedPwd []byte, plainPwd []byte) bool {
+	if bytes.HasPrefix(hashedPwd, []byte(argon2idPrefix)) {
+		params, salt, key, err := decodeArgon2id(hashedPwd)
+		if err != nil {
+			return false
+		}
+		return subtle.ConstantTimeCompare(params.key(plainPwd, salt, uint32(len(key))), key) == 1
+	}
 	err := bcrypt.CompareHashAndPassword(hashedPwd, plainPwd)
 	return err == nil
 }
+
+// NeedsRehash reports whether hashedPwd was made with an algorithm or
+// parameters other than the configured ones, so should be replaced the
+// next time the password is known.
+func NeedsRehash(hashedPwd []byte) bool {
+	return !passwordHasher.Current(hashedPwd)
+}
+
+// upgradePasswordHash rehashes the user's password with the configured
+// algorithm. Logging in still works if it fails, so errors are only logged.
+func upgradePasswordHash(user *User, password []byte) {
+	hash, err := HashAndSaltPassword(password)
+	if err == nil {
+		err = Store.UpgradePasswordHash(user.ID, user.Password, hash)
+	}
+	if err != nil {
+		log.Printf("Could not upgrade the password hash of user %d: %s", user.ID, err)
+		return
+	}
+	user.Password = hash
+}
+
+type bcryptHasher struct {
+	cost int
+}
+
+func (h bcryptHasher) Hash(password []byte) ([]byte, error) {
+	return bcrypt.GenerateFromPassword(password, h.cost)
+}
+
+func (h bcryptHasher) Current(hash []byte) bool {
+	cost, err := bcrypt.Cost(hash)
+	return err == nil && cost == h.cost
+}
+
+// Argon2id hashes are encoded in the PHC string format, like
+// $argon2id$v=19$m=19456,t=2,p=1$<salt>$<key>, in unpadded base64.
+const argon2idPrefix = "$argon2id$"
+
+const (
+	argon2idSaltLength = 16
+	argon2idKeyLength  = 32
+)
+
+var errMalformedArgon2id = errors.New("malformed argon2id hash")
+
+type argon2idParams struct {
+	time    uint32
+	memory  uint32
+	threads uint8
+}
+
+func (p argon2idParams) key(password []byte, salt []byte, length uint32) []byte {
+	return argon2.IDKey(password, salt, p.time, p.memory, p.threads, length)
+}
+
+type argon2idHasher struct {
+	params argon2idParams
+}
+
+func (h argon2idHasher) Hash(password []byte) ([]byte, error) {
+	salt := make([]byte, argon2idSaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	key := h.params.key(password, salt, argon2idKeyLength)
+	return []byte(fmt.Sprintf(
+		"%sv=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2idPrefix,
+		argon2.Version,
+		h.params.memory,
+		h.params.time,
+		h.params.threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	)), nil
+}
+
+func (h argon2idHasher) Current(hash []byte) bool {
+	params, _, key, err := decodeArgon2id(hash)
+	return err == nil && params == h.params && len(key) == argon2idKeyLength
+}
+
+func decodeArgon2id(hash []byte) (argon2idParams, []byte, []byte, error) {
+	var params argon2idParams
+	parts := strings.Split(strings.TrimPrefix(string(hash), argon2idPrefix), "$")
+	if len(parts) != 4 {
+		return params, nil, nil, errMalformedArgon2id
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[0], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, nil, nil, errMalformedArgon2id
+	}
+	_, err := fmt.Sscanf(parts[1], "m=%d,t=%d,p=%d", &params.memory, &params.time, &params.threads)
+	if err != nil || params.time == 0 || params.threads == 0 {
+		return params, nil, nil, errMalformedArgon2id
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return params, nil, nil, errMalformedArgon2id
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil || len(key) == 0 {
+		return params, nil, nil, errMalformedArgon2id
+	}
+	return params, salt, key, nil
+}
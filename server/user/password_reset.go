@@ -0,0 +1,136 @@
+package user
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/speedrun-website/leaderboard-backend/mail"
+	"github.com/speedrun-website/leaderboard-backend/server/request"
+)
+
+// A PasswordReset is a single-use token emailed to a user so they can
+// choose a new password. Only a hash of the token is stored.
+type PasswordReset struct {
+	ID        uint
+	CreatedAt time.Time
+	UserID    uint
+	TokenHash []byte
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+}
+
+type PasswordForgot struct {
+	Email string `json:"email" binding:"required,email"`
+}
+
+type PasswordResetRequest struct {
+	Token           string `json:"token" binding:"required"`
+	Password        string `json:"password" binding:"required,min=8"`
+	PasswordConfirm string `json:"password_confirm" binding:"eqfield=Password"`
+}
+
+// ForgotPasswordHandler emails a password reset link to the address in
+// the request. It responds the same way whether or not an account uses
+// that address, so it can't be used to find out who has an account.
+func ForgotPasswordHandler(c *gin.Context) {
+	var body PasswordForgot
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, request.ErrorResponse{
+			Errors: []error{
+				err,
+			},
+		})
+		return
+	}
+
+	// Sending happens after responding, so that the response time
+	// doesn't give away whether the account exists either.
+	go func(email string) {
+		if err := sendPasswordReset(email); err != nil {
+			log.Printf("Could not send a password reset: %s", err)
+		}
+	}(body.Email)
+
+	c.Status(http.StatusAccepted)
+}
+
+// ResetPasswordHandler sets a new password using the token from a
+// password reset email, and logs the user out everywhere.
+func ResetPasswordHandler(c *gin.Context) {
+	var body PasswordResetRequest
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, request.ErrorResponse{
+			Errors: []error{
+				err,
+			},
+		})
+		return
+	}
+
+	hash, err := HashAndSaltPassword([]byte(body.Password))
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	_, err = Store.ResetPassword(hashToken(body.Token), hash)
+	if errors.Is(err, ErrPasswordResetNotFound) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, request.ErrorResponse{
+			Errors: []error{
+				ErrInvalidEmailToken,
+			},
+		})
+		return
+	} else if err != nil {
+		log.Println(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// sendPasswordReset emails a new reset token to the user with email,
+// if there is one.
+func sendPasswordReset(email string) error {
+	user, err := Store.GetUserByEmail(email)
+	if errors.Is(err, ErrUserNotFound) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if user.BannedAt != nil {
+		return nil
+	}
+
+	token, err := newOpaqueToken()
+	if err != nil {
+		return err
+	}
+	err = Store.CreatePasswordReset(&PasswordReset{
+		UserID:    user.ID,
+		TokenHash: hashToken(token),
+		ExpiresAt: time.Now().Add(settings.passwordResetTimeout),
+	})
+	if err != nil {
+		return err
+	}
+
+	link := fmt.Sprintf("%s/reset-password?token=%s", settings.frontendURL, url.QueryEscape(token))
+	return settings.sender.Send(mail.Message{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf(
+			"Hi %s,\n\nSomeone asked to reset the password for your account. Open this link to choose a new one:\n\n%s\n\nThe link expires in %s and can only be used once. If it wasn't you, you can ignore this email.\n",
+			user.Username,
+			link,
+			settings.passwordResetTimeout,
+		),
+	})
+}
@@ -0,0 +1,261 @@
+package user
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/speedrun-website/leaderboard-backend/database"
+	"github.com/speedrun-website/leaderboard-backend/server/request"
+	"gorm.io/gorm"
+)
+
+// A PersonalAccessToken lets bots and tools act for the user who created
+// it, on the routes its scopes allow. Only a hash of the token is stored,
+// along with its first few characters so that the user can tell their
+// tokens apart. Scopes are separated by spaces.
+type PersonalAccessToken struct {
+	ID         uint
+	PublicID   string `gorm:"unique"`
+	CreatedAt  time.Time
+	UserID     uint
+	Name       string
+	TokenHash  []byte
+	Prefix     string
+	Scopes     string
+	LastUsedAt *time.Time
+	ExpiresAt  *time.Time
+}
+
+func (t *PersonalAccessToken) BeforeCreate(tx *gorm.DB) error {
+	return database.SetPublicID(&t.PublicID)
+}
+
+// PersonalTokenCreate is the body of a request for a new token. Tokens
+// without an ExpiresAt last until they are deleted.
+type PersonalTokenCreate struct {
+	Name      string     `json:"name" binding:"required,max=100"`
+	Scopes    []Scope    `json:"scopes" binding:"required,min=1"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+type PersonalTokenInfo struct {
+	ID         uint       `json:"-"`
+	PublicID   string     `json:"id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []Scope    `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+}
+
+// CreatedPersonalTokenResponse holds a new token. It is only shown once.
+type CreatedPersonalTokenResponse struct {
+	Token string             `json:"token"`
+	Info  *PersonalTokenInfo `json:"info"`
+}
+
+type PersonalTokensResponse struct {
+	Tokens []PersonalTokenInfo `json:"tokens"`
+}
+
+var ErrExpiryInPast = errors.New("the expiry must be in the future")
+var ErrPersonalTokenNotFound = errors.New("the personal access token was not found")
+var ErrInvalidPersonalToken = errors.New("the personal access token is invalid or has expired")
+
+// Personal access tokens start with this, so that they can be told apart
+// from access tokens and spotted by secret scanners.
+const personalTokenPrefix = "lbp_"
+
+// How many characters of a token are kept to show to its user.
+const personalTokenPrefixLength = 8
+
+const personalTokenKey = "personal_token"
+
+func (t PersonalAccessToken) AsInfo() *PersonalTokenInfo {
+	return &PersonalTokenInfo{
+		ID:         t.ID,
+		PublicID:   t.PublicID,
+		Name:       t.Name,
+		Prefix:     t.Prefix,
+		Scopes:     splitScopes(t.Scopes),
+		CreatedAt:  t.CreatedAt,
+		LastUsedAt: t.LastUsedAt,
+		ExpiresAt:  t.ExpiresAt,
+	}
+}
+
+// GetPersonalTokensHandler lists the logged-in user's personal access tokens.
+func GetPersonalTokensHandler(c *gin.Context) {
+	identity, ok := IdentityFromContext(c)
+	if !ok {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	tokens, err := Store.GetPersonalAccessTokens(identity.ID)
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	infos := make([]PersonalTokenInfo, 0, len(tokens))
+	for _, token := range tokens {
+		infos = append(infos, *token.AsInfo())
+	}
+	c.JSON(http.StatusOK, request.SuccessResponse{
+		Data: PersonalTokensResponse{
+			Tokens: infos,
+		},
+	})
+}
+
+// CreatePersonalTokenHandler creates a personal access token for the
+// logged-in user. The token is only ever shown in this response.
+func CreatePersonalTokenHandler(c *gin.Context) {
+	var body PersonalTokenCreate
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, request.ErrorResponse{
+			Errors: []error{
+				err,
+			},
+		})
+		return
+	}
+
+	identity, ok := IdentityFromContext(c)
+	if !ok {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	scopes, err := joinScopes(body.Scopes)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, request.ErrorResponse{
+			Errors: []error{
+				err,
+			},
+		})
+		return
+	}
+
+	if body.ExpiresAt != nil && !body.ExpiresAt.After(time.Now()) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, request.ErrorResponse{
+			Errors: []error{
+				ErrExpiryInPast,
+			},
+		})
+		return
+	}
+
+	secret, err := newOpaqueToken()
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	token := personalTokenPrefix + secret
+	personalToken := &PersonalAccessToken{
+		UserID:    identity.ID,
+		Name:      body.Name,
+		TokenHash: hashToken(token),
+		Prefix:    token[:personalTokenPrefixLength],
+		Scopes:    scopes,
+		ExpiresAt: body.ExpiresAt,
+	}
+	if err := Store.CreatePersonalAccessToken(personalToken); err != nil {
+		log.Println(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusCreated, request.SuccessResponse{
+		Data: CreatedPersonalTokenResponse{
+			Token: token,
+			Info:  personalToken.AsInfo(),
+		},
+	})
+}
+
+// DeletePersonalTokenHandler revokes one of the logged-in user's personal
+// access tokens.
+func DeletePersonalTokenHandler(c *gin.Context) {
+	identity, ok := IdentityFromContext(c)
+	if !ok {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	publicId := c.Param("id")
+	if !database.IsPublicID(publicId) {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	err := Store.DeletePersonalAccessToken(identity.ID, publicId)
+	if errors.Is(err, ErrPersonalTokenNotFound) {
+		c.AbortWithStatusJSON(http.StatusNotFound, request.ErrorResponse{
+			Errors: []error{
+				err,
+			},
+		})
+		return
+	} else if err != nil {
+		log.Println(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// PersonalTokenFromContext returns the personal access token that
+// authenticated the current request, if one did.
+func PersonalTokenFromContext(c *gin.Context) (*PersonalAccessToken, bool) {
+	rawToken, ok := c.Get(personalTokenKey)
+	if !ok {
+		return nil, false
+	}
+	token, ok := rawToken.(*PersonalAccessToken)
+	return token, ok
+}
+
+// personalTokenFromRequest finds a personal access token in the
+// Authorization header. They aren't accepted anywhere else, since they
+// last too long to risk ending up in logs or cookies.
+func personalTokenFromRequest(c *gin.Context) (string, bool) {
+	token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+	return token, strings.HasPrefix(token, personalTokenPrefix)
+}
+
+// authenticatePersonalToken lets the request through as the user who
+// created token, if the token has the scope its route needs.
+func (mw *AuthMiddleware) authenticatePersonalToken(c *gin.Context, token string) {
+	personalToken, err := Store.GetPersonalAccessToken(hashToken(token))
+	if errors.Is(err, ErrInvalidPersonalToken) {
+		mw.unauthorized(c, http.StatusUnauthorized, err)
+		return
+	} else if err != nil {
+		log.Println(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	if !checkScopes(c, personalToken.Scopes) {
+		return
+	}
+
+	if personalToken.LastUsedAt == nil || time.Since(*personalToken.LastUsedAt) > lastSeenResolution {
+		if err := Store.TouchPersonalAccessToken(personalToken.ID); err != nil {
+			log.Println(err)
+		}
+	}
+
+	c.Set(personalTokenKey, personalToken)
+	c.Set(mw.IdentityKey, &UserPersonal{
+		ID: personalToken.UserID,
+	})
+	c.Next()
+}
@@ -0,0 +1,341 @@
+package user
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+	// Time zones are checked against the IANA database, which isn't on
+	// every server the API runs on.
+	_ "time/tzdata"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/speedrun-website/leaderboard-backend/server/request"
+	"golang.org/x/text/language"
+)
+
+// A Profile is what a user shows about themselves on their public page.
+// Every field is optional. Country is an ISO 3166-1 alpha-2 code, and
+// Timezone an IANA time zone name. Links are stored in a canonical form,
+// so that they can be shown as they are.
+type Profile struct {
+	UserID      uint `gorm:"primaryKey;autoIncrement:false"`
+	UpdatedAt   time.Time
+	DisplayName string
+	Pronouns    string
+	Country     string
+	Bio         string
+	Timezone    string
+	AvatarURL   string
+	Twitch      string
+	YouTube     string `gorm:"column:youtube"`
+	Twitter     string
+}
+
+// ProfileLinks are a user's accounts on other sites, as links.
+type ProfileLinks struct {
+	Twitch  string `json:"twitch,omitempty"`
+	YouTube string `json:"youtube,omitempty"`
+	Twitter string `json:"twitter,omitempty"`
+}
+
+type ProfileInfo struct {
+	DisplayName string       `json:"display_name"`
+	Pronouns    string       `json:"pronouns"`
+	Country     string       `json:"country"`
+	Bio         string       `json:"bio"`
+	Timezone    string       `json:"timezone"`
+	AvatarURL   string       `json:"avatar_url"`
+	Links       ProfileLinks `json:"links"`
+}
+
+// ProfileUpdate is the body of a profile edit. Only the fields that are
+// given are changed, and empty strings clear them. Links replace all of
+// the user's links.
+type ProfileUpdate struct {
+	DisplayName *string       `json:"display_name" binding:"omitempty,max=50"`
+	Pronouns    *string       `json:"pronouns" binding:"omitempty,max=30"`
+	Country     *string       `json:"country"`
+	Bio         *string       `json:"bio"`
+	Timezone    *string       `json:"timezone"`
+	AvatarURL   *string       `json:"avatar_url" binding:"omitempty,max=500"`
+	Links       *ProfileLinks `json:"links"`
+}
+
+type ProfileResponse struct {
+	Profile *ProfileInfo `json:"profile"`
+}
+
+// UserProfileResponse is a user's public page. PersonalBests is left
+// empty if nothing provides them.
+type UserProfileResponse struct {
+	User          *UserIdentifier `json:"user"`
+	Profile       *ProfileInfo    `json:"profile"`
+	PersonalBests interface{}     `json:"personal_bests"`
+}
+
+var ErrInvalidProfileText = errors.New("profile text can't have control characters")
+var ErrBioTooLong = fmt.Errorf("bios can be at most %d characters", maxBioLength)
+var ErrInvalidCountry = errors.New("the country must be an ISO 3166-1 alpha-2 code")
+var ErrInvalidTimezone = errors.New("the time zone must be an IANA time zone name, like Europe/Berlin")
+var ErrInvalidAvatarURL = errors.New("the avatar must be an https URL")
+var ErrInvalidLink = errors.New("the link isn't a profile on the site")
+
+const maxBioLength = 1000
+
+// PersonalBestsLoader returns a user's personal bests for their public
+// page. Runs depend on users, so the run package provides it; see
+// server.Init.
+var PersonalBestsLoader func(userId uint) (interface{}, error)
+
+func (p Profile) AsInfo() *ProfileInfo {
+	return &ProfileInfo{
+		DisplayName: p.DisplayName,
+		Pronouns:    p.Pronouns,
+		Country:     p.Country,
+		Bio:         p.Bio,
+		Timezone:    p.Timezone,
+		AvatarURL:   p.AvatarURL,
+		Links: ProfileLinks{
+			Twitch:  p.Twitch,
+			YouTube: p.YouTube,
+			Twitter: p.Twitter,
+		},
+	}
+}
+
+// apply checks update and applies it to p.
+func (p *Profile) apply(update ProfileUpdate) error {
+	if update.DisplayName != nil {
+		name := strings.TrimSpace(*update.DisplayName)
+		if !isPlainText(name, false) {
+			return ErrInvalidProfileText
+		}
+		p.DisplayName = name
+	}
+	if update.Pronouns != nil {
+		pronouns := strings.TrimSpace(*update.Pronouns)
+		if !isPlainText(pronouns, false) {
+			return ErrInvalidProfileText
+		}
+		p.Pronouns = pronouns
+	}
+	if update.Country != nil {
+		country, err := canonicalCountry(*update.Country)
+		if err != nil {
+			return err
+		}
+		p.Country = country
+	}
+	if update.Bio != nil {
+		bio := strings.TrimSpace(*update.Bio)
+		if utf8.RuneCountInString(bio) > maxBioLength {
+			return ErrBioTooLong
+		}
+		if !isPlainText(bio, true) {
+			return ErrInvalidProfileText
+		}
+		p.Bio = bio
+	}
+	if update.Timezone != nil {
+		timezone := strings.TrimSpace(*update.Timezone)
+		if timezone != "" {
+			// Local is whatever zone the server is in.
+			if _, err := time.LoadLocation(timezone); err != nil || timezone == "Local" {
+				return ErrInvalidTimezone
+			}
+		}
+		p.Timezone = timezone
+	}
+	if update.AvatarURL != nil {
+		avatar := strings.TrimSpace(*update.AvatarURL)
+		if avatar != "" && !isHttpsURL(avatar) {
+			return ErrInvalidAvatarURL
+		}
+		p.AvatarURL = avatar
+	}
+	if update.Links != nil {
+		var err error
+		if p.Twitch, err = canonicalLink(update.Links.Twitch, twitchLinks); err != nil {
+			return fmt.Errorf("%w: twitch", err)
+		}
+		if p.YouTube, err = canonicalLink(update.Links.YouTube, youtubeLinks); err != nil {
+			return fmt.Errorf("%w: youtube", err)
+		}
+		if p.Twitter, err = canonicalLink(update.Links.Twitter, twitterLinks); err != nil {
+			return fmt.Errorf("%w: twitter", err)
+		}
+	}
+	return nil
+}
+
+// GetMyProfileHandler returns the logged-in user's profile.
+func GetMyProfileHandler(c *gin.Context) {
+	identity, ok := IdentityFromContext(c)
+	if !ok {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	profile, err := Store.GetProfile(identity.ID)
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	c.JSON(http.StatusOK, request.SuccessResponse{
+		Data: ProfileResponse{
+			Profile: profile.AsInfo(),
+		},
+	})
+}
+
+// UpdateProfileHandler edits the logged-in user's profile.
+func UpdateProfileHandler(c *gin.Context) {
+	var body ProfileUpdate
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, request.ErrorResponse{
+			Errors: []error{
+				err,
+			},
+		})
+		return
+	}
+
+	identity, ok := IdentityFromContext(c)
+	if !ok {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	profile, err := Store.GetProfile(identity.ID)
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if err := profile.apply(body); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, request.ErrorResponse{
+			Errors: []error{
+				err,
+			},
+		})
+		return
+	}
+	if err := Store.SaveProfile(profile); err != nil {
+		log.Println(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, request.SuccessResponse{
+		Data: ProfileResponse{
+			Profile: profile.AsInfo(),
+		},
+	})
+}
+
+// isPlainText reports whether s has no control characters, other than
+// line breaks if multiline is set.
+func isPlainText(s string, multiline bool) bool {
+	if !utf8.ValidString(s) {
+		return false
+	}
+	for _, r := range s {
+		if multiline && (r == '\n' || r == '\r') {
+			continue
+		}
+		if unicode.IsControl(r) || unicode.Is(unicode.Bidi_Control, r) {
+			return false
+		}
+	}
+	return true
+}
+
+// canonicalCountry returns the upper case code of country, which can be
+// empty to clear it.
+func canonicalCountry(country string) (string, error) {
+	country = strings.TrimSpace(country)
+	if country == "" {
+		return "", nil
+	}
+	if len(country) != 2 {
+		return "", ErrInvalidCountry
+	}
+	region, err := language.ParseRegion(country)
+	if err != nil || !region.IsCountry() {
+		return "", ErrInvalidCountry
+	}
+	return region.String(), nil
+}
+
+func isHttpsURL(raw string) bool {
+	u, err := url.Parse(raw)
+	return err == nil && u.Scheme == "https" && u.Host != "" && u.User == nil
+}
+
+// A linkSite is how profile links on another site look. Paths are
+// matched against the path of a link, and the first submatch is kept.
+type linkSite struct {
+	hosts []string
+	paths []*regexp.Regexp
+	// canonical is the link to a profile with the submatch.
+	canonical string
+}
+
+var twitchLinks = linkSite{
+	hosts: []string{"twitch.tv", "www.twitch.tv", "m.twitch.tv"},
+	paths: []*regexp.Regexp{
+		regexp.MustCompile(`^/([A-Za-z0-9_]{4,25})/?$`),
+	},
+	canonical: "https://www.twitch.tv/%s",
+}
+
+var youtubeLinks = linkSite{
+	hosts: []string{"youtube.com", "www.youtube.com", "m.youtube.com"},
+	paths: []*regexp.Regexp{
+		regexp.MustCompile(`^/(@[A-Za-z0-9._\-]{3,30})/?$`),
+		regexp.MustCompile(`^/(channel/UC[A-Za-z0-9_\-]{22})/?$`),
+		regexp.MustCompile(`^/((?:c|user)/[A-Za-z0-9]{1,100})/?$`),
+	},
+	canonical: "https://www.youtube.com/%s",
+}
+
+var twitterLinks = linkSite{
+	hosts: []string{"twitter.com", "www.twitter.com", "mobile.twitter.com", "x.com", "www.x.com"},
+	paths: []*regexp.Regexp{
+		regexp.MustCompile(`^/([A-Za-z0-9_]{1,15})/?$`),
+	},
+	canonical: "https://twitter.com/%s",
+}
+
+// canonicalLink checks that link is a profile on site, and returns the
+// canonical link to it. Empty links are kept empty.
+func canonicalLink(link string, site linkSite) (string, error) {
+	link = strings.TrimSpace(link)
+	if link == "" {
+		return "", nil
+	}
+	u, err := url.Parse(link)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.User != nil || u.Port() != "" || u.RawQuery != "" || u.Fragment != "" {
+		return "", ErrInvalidLink
+	}
+	host := strings.ToLower(u.Host)
+	for _, h := range site.hosts {
+		if host != h {
+			continue
+		}
+		for _, path := range site.paths {
+			if match := path.FindStringSubmatch(u.Path); match != nil {
+				return fmt.Sprintf(site.canonical, match[1]), nil
+			}
+		}
+	}
+	return "", ErrInvalidLink
+}
@@ -0,0 +1,176 @@
+package user
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/speedrun-website/leaderboard-backend/server/request"
+)
+
+// A RefreshToken can be swapped once for a new access token and a new
+// refresh token in the same session. Only a hash of the token is stored.
+type RefreshToken struct {
+	ID        uint
+	CreatedAt time.Time
+	SessionID uint
+	TokenHash []byte
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+}
+
+// RefreshRequest is the body of a refresh. Clients that logged in with
+// cookies send their refresh token as a cookie instead.
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// Cookie names. The access token cookie is the one the auth middleware reads.
+const (
+	accessCookie  = "jwt"
+	refreshCookie = "refresh_token"
+)
+
+// issuedTokens is the refresh token handed out while logging in,
+// kept in the context until the login response is written.
+type issuedTokens struct {
+	refreshToken  string
+	refreshExpiry time.Time
+	cookie        bool
+}
+
+const issuedTokensKey = "issued_tokens"
+
+// issueRefreshToken creates the first refresh token of a session.
+func issueRefreshToken(session *Session) (string, error) {
+	token, err := newOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+	err = Store.CreateRefreshToken(&RefreshToken{
+		SessionID: session.ID,
+		TokenHash: hashToken(token),
+		ExpiresAt: session.ExpiresAt,
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// newRefreshHandler swaps a refresh token for a new access token and
+// refresh token. The old refresh token stops working.
+func newRefreshHandler(authMiddleware *AuthMiddleware) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var body RefreshRequest
+		if c.Request.ContentLength != 0 {
+			if err := c.ShouldBindJSON(&body); err != nil {
+				c.AbortWithStatusJSON(http.StatusBadRequest, request.ErrorResponse{
+					Errors: []error{
+						err,
+					},
+				})
+				return
+			}
+		}
+
+		token, cookie := body.RefreshToken, false
+		if token == "" {
+			token, _ = c.Cookie(refreshCookie)
+			cookie = true
+		}
+		if token == "" {
+			abortInvalidRefresh(c, cookie, ErrInvalidRefreshToken)
+			return
+		}
+
+		next, err := newOpaqueToken()
+		if err != nil {
+			log.Println(err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		refreshExpiry := time.Now().Add(settings.refreshTimeout)
+		session, err := Store.RotateRefreshToken(hashToken(token), &RefreshToken{
+			TokenHash: hashToken(next),
+			ExpiresAt: refreshExpiry,
+		})
+		if errors.Is(err, ErrInvalidRefreshToken) || errors.Is(err, ErrRefreshTokenReused) {
+			abortInvalidRefresh(c, cookie, err)
+			return
+		} else if err != nil {
+			log.Println(err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		user, err := Store.GetUserById(session.UserID)
+		if err != nil {
+			abortInvalidRefresh(c, cookie, ErrInvalidRefreshToken)
+			return
+		}
+		if user.BannedAt != nil {
+			abortInvalidRefresh(c, cookie, ErrUserBanned)
+			return
+		}
+
+		access, accessExpiry, err := authMiddleware.TokenGenerator(&sessionIdentity{
+			user:    user.AsPersonal(),
+			session: session,
+		})
+		if err != nil {
+			log.Println(err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		writeTokens(c, access, accessExpiry, next, refreshExpiry, cookie)
+	}
+}
+
+// writeTokens responds with an access token and a refresh token, as
+// HttpOnly cookies if the client asked for them and in the body otherwise.
+func writeTokens(c *gin.Context, access string, accessExpiry time.Time, refresh string, refreshExpiry time.Time, cookie bool) {
+	response := TokenResponse{
+		Expiry:        accessExpiry.Format(time.RFC3339),
+		RefreshExpiry: refreshExpiry.Format(time.RFC3339),
+	}
+	if cookie {
+		setTokenCookie(c, accessCookie, "/", access, time.Until(accessExpiry))
+		setTokenCookie(c, refreshCookie, refreshPath, refresh, time.Until(refreshExpiry))
+	} else {
+		response.Token = access
+		response.RefreshToken = refresh
+	}
+
+	c.JSON(http.StatusOK, request.SuccessResponse{
+		Data: response,
+	})
+}
+
+// clearTokenCookies removes any token cookies the client has.
+func clearTokenCookies(c *gin.Context) {
+	setTokenCookie(c, accessCookie, "/", "", -1)
+	setTokenCookie(c, refreshCookie, refreshPath, "", -1)
+}
+
+func setTokenCookie(c *gin.Context, name string, cookiePath string, value string, maxAge time.Duration) {
+	c.SetSameSite(http.SameSiteStrictMode)
+	c.SetCookie(name, value, int(maxAge.Seconds()), cookiePath, settings.cookieDomain, settings.cookieSecure, true)
+}
+
+// refreshPath is where the refresh endpoint is served, which the refresh
+// token cookie is limited to. It is set by PublicRoutes.
+var refreshPath = "/refresh_token"
+
+func abortInvalidRefresh(c *gin.Context, cookie bool, err error) {
+	if cookie {
+		clearTokenCookies(c)
+	}
+	c.AbortWithStatusJSON(http.StatusUnauthorized, request.ErrorResponse{
+		Errors: []error{
+			err,
+		},
+	})
+}
@@ -5,24 +5,62 @@ import (
 	"fmt"
 	"log"
 	"net/http"
-	"strconv"
+	"path"
+	"time"
 
-	jwt "github.com/appleboy/gin-jwt/v2"
 	"github.com/gin-gonic/gin"
+	"github.com/speedrun-website/leaderboard-backend/database"
 	"github.com/speedrun-website/leaderboard-backend/server/request"
 )
 
-func PublicRoutes(r *gin.RouterGroup, authMiddleware *jwt.GinJWTMiddleware) {
+func PublicRoutes(r *gin.RouterGroup, authMiddleware *AuthMiddleware) {
 	r.POST("/register", RegisterUserHandler)
 	r.POST("/login", authMiddleware.LoginHandler)
-	r.POST("/logout", authMiddleware.LogoutHandler)
+	r.POST("/login/2fa", newTwoFactorLoginHandler(authMiddleware))
+	r.POST("/refresh_token", newRefreshHandler(authMiddleware))
+	refreshPath = path.Join(r.BasePath(), "refresh_token")
+	r.POST("/verify-email", VerifyEmailHandler)
+	r.POST("/password/forgot", ForgotPasswordHandler)
+	r.POST("/password/reset", ResetPasswordHandler)
+	r.GET("/oauth/providers", GetOAuthProvidersHandler)
+	r.POST("/oauth/:provider/login", StartOAuthLoginHandler)
+	r.POST("/oauth/:provider/callback", newOAuthCallbackHandler(authMiddleware))
+	r.POST("/oauth/token", newOAuthTokenHandler(authMiddleware))
+	r.POST("/oauth/introspect", newIntrospectionHandler(authMiddleware))
+	r.POST("/oauth/revoke", newOAuthRevocationHandler(authMiddleware))
 
 	r.GET("/users/:id", GetUserHandler)
+	r.GET("/users/by-name/:username", GetUserByNameHandler)
 }
 
-func AuthRoutes(r *gin.RouterGroup, authMiddleware *jwt.GinJWTMiddleware) {
-	r.GET("/me", MeHandler)
-	r.GET("/refresh_token", authMiddleware.RefreshHandler)
+func AuthRoutes(r *gin.RouterGroup, authMiddleware *AuthMiddleware) {
+	r.POST("/logout", newLogoutHandler(authMiddleware))
+	ScopedRoute(r, ScopeProfileRead, http.MethodGet, "/me", MeHandler)
+	r.PATCH("/me", UpdateMeHandler)
+	r.POST("/me/password", ChangePasswordHandler)
+	ScopedRoute(r, ScopeProfileRead, http.MethodGet, "/me/profile", GetMyProfileHandler)
+	r.PATCH("/me/profile", UpdateProfileHandler)
+	r.GET("/me/sessions", GetSessionsHandler)
+	r.DELETE("/me/sessions", RevokeSessionsHandler)
+	r.DELETE("/me/sessions/:id", RevokeSessionHandler)
+	r.GET("/me/identities", GetIdentitiesHandler)
+	r.POST("/me/identities/:provider", StartLinkIdentityHandler)
+	r.POST("/me/identities/:provider/callback", LinkIdentityHandler)
+	r.DELETE("/me/identities/:provider", UnlinkIdentityHandler)
+	r.GET("/me/2fa", GetTwoFactorHandler)
+	r.DELETE("/me/2fa", DisableTwoFactorHandler)
+	r.POST("/me/2fa/totp", EnrollTOTPHandler)
+	r.POST("/me/2fa/totp/confirm", ConfirmTOTPHandler)
+	r.POST("/me/2fa/recovery-codes", RegenerateRecoveryCodesHandler)
+	r.GET("/me/tokens", GetPersonalTokensHandler)
+	r.POST("/me/tokens", CreatePersonalTokenHandler)
+	r.DELETE("/me/tokens/:id", DeletePersonalTokenHandler)
+	r.GET("/me/apps", GetOAuthAppsHandler)
+	r.POST("/me/apps", RequireVerifiedEmail(), CreateOAuthAppHandler)
+	r.DELETE("/me/apps/:id", DeleteOAuthAppHandler)
+	r.GET("/oauth/authorize", GetAuthorizationHandler)
+	r.POST("/oauth/authorize", AuthorizeHandler)
+	r.POST("/verify-email/resend", ResendVerificationHandler)
 }
 
 type UserRegister struct {
@@ -32,9 +70,12 @@ type UserRegister struct {
 	PasswordConfirm string `json:"password_confirm" binding:"eqfield=Password"`
 }
 
+// UserLogin is the body of a login. Clients that set Cookie get their
+// tokens as HttpOnly cookies rather than in the response.
 type UserLogin struct {
 	Email    string `json:"email" binding:"required,email"`
 	Password string `json:"password" binding:"required"`
+	Cookie   bool   `json:"cookie"`
 }
 
 type UserIdentifierResponse struct {
@@ -45,18 +86,16 @@ type UserPersonalResponse struct {
 	User *UserPersonal `json:"user"`
 }
 
+// GetUserHandler returns a user's public page, found by their public ID:
+// their profile, and their personal bests across games.
 func GetUserHandler(c *gin.Context) {
-	// Maybe we shouldn't use the increment ID but generate a UUID instead to avoid
-	// exposing the amount of users registered in the database.
-	id, err := strconv.ParseUint(c.Param("id"), 10, 0)
-
-	if err != nil {
+	publicId := c.Param("id")
+	if !database.IsPublicID(publicId) {
 		c.AbortWithStatus(http.StatusBadRequest)
 		return
 	}
 
-	user, err := Store.GetUserIdentifierById(uint(id))
-
+	user, err := Store.GetUserIdentifierByPublicId(publicId)
 	if err != nil {
 		var code int
 		if errors.Is(err, ErrUserNotFound) {
@@ -73,13 +112,66 @@ func GetUserHandler(c *gin.Context) {
 		return
 	}
 
+	respondWithUserPage(c, user)
+}
+
+// GetUserByNameHandler returns a user's public page, found by their
+// username in any case. Usernames that were given up redirect to the
+// page of the user who had them last, by public ID, since the name may
+// be taken again later.
+func GetUserByNameHandler(c *gin.Context) {
+	user, renamed, err := Store.GetUserIdentifierByUsername(c.Param("username"))
+	if errors.Is(err, ErrUserNotFound) {
+		c.AbortWithStatusJSON(http.StatusNotFound, request.ErrorResponse{
+			Errors: []error{
+				err,
+			},
+		})
+		return
+	} else if err != nil {
+		log.Println(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	if renamed {
+		c.Redirect(http.StatusMovedPermanently, userPath(user))
+		return
+	}
+	respondWithUserPage(c, user)
+}
+
+func respondWithUserPage(c *gin.Context, user *UserIdentifier) {
+	profile, err := Store.GetProfile(user.ID)
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	var personalBests interface{} = []struct{}{}
+	if PersonalBestsLoader != nil {
+		personalBests, err = PersonalBestsLoader(user.ID)
+		if err != nil {
+			log.Println(err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+	}
+
 	c.JSON(http.StatusOK, request.SuccessResponse{
-		Data: UserIdentifierResponse{
-			User: user,
+		Data: UserProfileResponse{
+			User:          user,
+			Profile:       profile.AsInfo(),
+			PersonalBests: personalBests,
 		},
 	})
 }
 
+// userPath is where a user's public page is.
+func userPath(user *UserIdentifier) string {
+	return fmt.Sprintf("/api/v1/users/%s", user.PublicID)
+}
+
 func RegisterUserHandler(c *gin.Context) {
 	var registerValue UserRegister
 	if err := c.BindJSON(&registerValue); err != nil {
@@ -87,6 +179,16 @@ func RegisterUserHandler(c *gin.Context) {
 		return
 	}
 
+	username, err := checkNewUsername(registerValue.Username)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, request.ErrorResponse{
+			Errors: []error{
+				err,
+			},
+		})
+		return
+	}
+
 	hash, err := HashAndSaltPassword([]byte(registerValue.Password))
 	if err != nil {
 		log.Println(err)
@@ -94,10 +196,12 @@ func RegisterUserHandler(c *gin.Context) {
 		return
 	}
 
+	now := time.Now()
 	user := User{
-		Username: registerValue.Username,
-		Email:    registerValue.Email,
-		Password: hash,
+		Username:           username,
+		Email:              registerValue.Email,
+		Password:           hash,
+		VerificationSentAt: &now,
 	}
 
 	err = Store.CreateUser(&user)
@@ -125,34 +229,45 @@ func RegisterUserHandler(c *gin.Context) {
 		return
 	}
 
-	c.Header("Location", fmt.Sprintf("/api/v1/users/%d", user.ID))
+	// The account is usable without a verified email, so a failure here
+	// isn't fatal; the user can ask for the email again.
+	if err := sendVerificationEmail(&user); err != nil {
+		log.Printf("Could not send a verification email to user %d: %s", user.ID, err)
+	}
+
+	c.Header("Location", userPath(user.AsIdentifier()))
 	c.JSON(http.StatusCreated, request.SuccessResponse{
 		Data: UserIdentifierResponse{
-			User: &UserIdentifier{
-				ID:       user.ID,
-				Username: user.Username,
-			},
+			User: user.AsIdentifier(),
 		},
 	})
 }
 
 func MeHandler(c *gin.Context) {
-	rawUser, ok := c.Get(JwtConfig.IdentityKey)
+	user, ok := IdentityFromContext(c)
 	if ok {
-		user, ok := rawUser.(*UserPersonal)
-		if ok {
-			userInfo, err := Store.GetUserPersonalById(uint(user.ID))
-
-			if err == nil {
-				c.JSON(http.StatusOK, request.SuccessResponse{
-					Data: UserPersonalResponse{
-						User: userInfo,
-					},
-				})
-				return
-			}
+		userInfo, err := Store.GetUserPersonalById(uint(user.ID))
+
+		if err == nil {
+			c.JSON(http.StatusOK, request.SuccessResponse{
+				Data: UserPersonalResponse{
+					User: userInfo,
+				},
+			})
+			return
 		}
 	}
 
 	c.AbortWithStatus(http.StatusInternalServerError)
 }
+
+// IdentityFromContext returns the identity that the auth middleware
+// stored for the current request. Only the ID is filled in.
+func IdentityFromContext(c *gin.Context) (*UserPersonal, bool) {
+	rawUser, ok := c.Get(identityKey)
+	if !ok {
+		return nil, false
+	}
+	user, ok := rawUser.(*UserPersonal)
+	return user, ok
+}
@@ -0,0 +1,115 @@
+package user
+
+import (
+	"errors"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/speedrun-website/leaderboard-backend/server/request"
+)
+
+// A Scope is something a personal access token, or an app a user has
+// authorized, is allowed to do.
+type Scope string
+
+const (
+	ScopeProfileRead Scope = "profile:read"
+	ScopeRunsWrite   Scope = "runs:write"
+	ScopeRunsReview  Scope = "runs:review"
+)
+
+// IsScope reports whether s is a known scope.
+func IsScope(s string) bool {
+	switch Scope(s) {
+	case ScopeProfileRead, ScopeRunsWrite, ScopeRunsReview:
+		return true
+	}
+	return false
+}
+
+var ErrUnknownScope = errors.New("the requested scope doesn't exist")
+var ErrTokenNotAllowed = errors.New("this token can't be used for this")
+var ErrMissingScope = errors.New("the token doesn't have the scope this needs")
+
+// scopedRoutes are the routes that scoped tokens can be used on, by method
+// and full path, along with the scope each needs. Scoped tokens are
+// refused everywhere else. They are added by ScopedRoute.
+var scopedRoutes = struct {
+	sync.Mutex
+	scopes map[string]Scope
+}{
+	scopes: map[string]Scope{},
+}
+
+// ScopedRoute registers a route that tokens with scope can be used on, as
+// well as access tokens from logging in.
+func ScopedRoute(r *gin.RouterGroup, scope Scope, method string, relativePath string, handlers ...gin.HandlerFunc) {
+	scopedRoutes.Lock()
+	scopedRoutes.scopes[method+" "+path.Join(r.BasePath(), relativePath)] = scope
+	scopedRoutes.Unlock()
+	r.Handle(method, relativePath, handlers...)
+}
+
+// routeScope returns the scope that the route of the request needs from
+// scoped tokens, if they can be used on it at all.
+func routeScope(c *gin.Context) (Scope, bool) {
+	scopedRoutes.Lock()
+	defer scopedRoutes.Unlock()
+	scope, ok := scopedRoutes.scopes[c.Request.Method+" "+c.FullPath()]
+	return scope, ok
+}
+
+// checkScopes reports whether a token with scopes can be used on the
+// route of the request. If not, the request is aborted.
+func checkScopes(c *gin.Context, scopes string) bool {
+	scope, ok := routeScope(c)
+	if !ok {
+		abortTokenForbidden(c, ErrTokenNotAllowed)
+		return false
+	}
+	for _, s := range splitScopes(scopes) {
+		if s == scope {
+			return true
+		}
+	}
+	abortTokenForbidden(c, ErrMissingScope)
+	return false
+}
+
+// joinScopes checks that scopes are known, and joins them with spaces in
+// order without duplicates, as they are stored.
+func joinScopes(scopes []Scope) (string, error) {
+	unique := map[string]bool{}
+	for _, scope := range scopes {
+		if !IsScope(string(scope)) {
+			return "", ErrUnknownScope
+		}
+		unique[string(scope)] = true
+	}
+	list := make([]string, 0, len(unique))
+	for scope := range unique {
+		list = append(list, scope)
+	}
+	sort.Strings(list)
+	return strings.Join(list, " "), nil
+}
+
+func splitScopes(scopes string) []Scope {
+	var list []Scope
+	for _, s := range strings.Fields(scopes) {
+		list = append(list, Scope(s))
+	}
+	return list
+}
+
+func abortTokenForbidden(c *gin.Context, err error) {
+	c.AbortWithStatusJSON(http.StatusForbidden, request.ErrorResponse{
+		Errors: []error{
+			err,
+		},
+	})
+}
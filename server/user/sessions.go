@@ -0,0 +1,250 @@
+package user
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	jwt "github.com/appleboy/gin-jwt/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/speedrun-website/leaderboard-backend/database"
+	"github.com/speedrun-website/leaderboard-backend/server/request"
+	"gorm.io/gorm"
+)
+
+// A Session is a login. Each access token carries the ID of its session
+// in the jti claim, and stops working once the session is revoked, as do
+// the session's refresh tokens. A session lasts as long as its latest
+// refresh token. Sessions that an app started with the user's consent
+// have the app's ID and the scopes the user granted it. TwoFactor is set
+// on sessions that were logged in to with a code as well as a password.
+type Session struct {
+	ID         uint
+	PublicID   string `gorm:"unique"`
+	CreatedAt  time.Time
+	UserID     uint
+	TokenID    string
+	UserAgent  string
+	IP         string
+	LastSeenAt time.Time
+	ExpiresAt  time.Time
+	RevokedAt  *time.Time
+	AppID      *uint
+	App        *OAuthApp
+	Scopes     string
+	TwoFactor  bool
+}
+
+func (s *Session) BeforeCreate(tx *gorm.DB) error {
+	return database.SetPublicID(&s.PublicID)
+}
+
+// SessionInfo is a session as shown to the user it belongs to.
+// Current is set on the session making the request, and AppPublicID on
+// sessions started by an app.
+type SessionInfo struct {
+	ID          uint      `json:"-"`
+	PublicID    string    `json:"id"`
+	UserAgent   string    `json:"user_agent"`
+	IP          string    `json:"ip"`
+	CreatedAt   time.Time `json:"created_at"`
+	LastSeenAt  time.Time `json:"last_seen_at"`
+	Current     bool      `json:"current"`
+	AppPublicID string    `json:"app_id,omitempty"`
+}
+
+type SessionsResponse struct {
+	Sessions []SessionInfo `json:"sessions"`
+}
+
+const sessionKey = "jti"
+
+// How often a session's last seen time and IP are written.
+const lastSeenResolution = time.Minute
+
+// The longest user agent that is kept for a session.
+const maxUserAgentLength = 512
+
+// AsInfo expects the session's App to be loaded if it has one.
+func (s Session) AsInfo(current bool) SessionInfo {
+	info := SessionInfo{
+		ID:         s.ID,
+		PublicID:   s.PublicID,
+		UserAgent:  s.UserAgent,
+		IP:         s.IP,
+		CreatedAt:  s.CreatedAt,
+		LastSeenAt: s.LastSeenAt,
+		Current:    current,
+	}
+	if s.App != nil {
+		info.AppPublicID = s.App.PublicID
+	}
+	return info
+}
+
+// GetSessionsHandler lists the logged-in user's active sessions.
+func GetSessionsHandler(c *gin.Context) {
+	current, ok := SessionFromContext(c)
+	if !ok {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	sessions, err := Store.GetActiveSessions(current.UserID)
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	infos := make([]SessionInfo, 0, len(sessions))
+	for _, session := range sessions {
+		infos = append(infos, session.AsInfo(session.ID == current.ID))
+	}
+	c.JSON(http.StatusOK, request.SuccessResponse{
+		Data: SessionsResponse{
+			Sessions: infos,
+		},
+	})
+}
+
+// RevokeSessionHandler logs the logged-in user out of one of their sessions.
+func RevokeSessionHandler(c *gin.Context) {
+	current, ok := SessionFromContext(c)
+	if !ok {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	publicId := c.Param("id")
+	if !database.IsPublicID(publicId) {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	err := Store.RevokeSession(current.UserID, publicId)
+	if errors.Is(err, ErrSessionNotFound) {
+		c.AbortWithStatusJSON(http.StatusNotFound, request.ErrorResponse{
+			Errors: []error{
+				err,
+			},
+		})
+		return
+	} else if err != nil {
+		log.Println(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// RevokeSessionsHandler logs the logged-in user out everywhere,
+// including the session making the request.
+func RevokeSessionsHandler(c *gin.Context) {
+	current, ok := SessionFromContext(c)
+	if !ok {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if err := Store.RevokeSessions(current.UserID, ""); err != nil {
+		log.Println(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// newLogoutHandler revokes the session making the request and clears any
+// token cookies, then lets the auth middleware finish logging out.
+func newLogoutHandler(authMiddleware *AuthMiddleware) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		current, ok := SessionFromContext(c)
+		if !ok {
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		err := Store.RevokeSession(current.UserID, current.PublicID)
+		if err != nil && !errors.Is(err, ErrSessionNotFound) {
+			log.Println(err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		clearTokenCookies(c)
+		authMiddleware.LogoutHandler(c)
+	}
+}
+
+// SessionFromContext returns the session of the token that
+// authenticated the current request.
+func SessionFromContext(c *gin.Context) (*Session, bool) {
+	rawSession, ok := c.Get(sessionKey)
+	if !ok {
+		return nil, false
+	}
+	session, ok := rawSession.(*Session)
+	return session, ok
+}
+
+// startSession creates a session that lasts until expiresAt.
+func startSession(userId uint, userAgent string, ip string, expiresAt time.Time) (*Session, error) {
+	session, err := newSession(userId, userAgent, ip, expiresAt)
+	if err != nil {
+		return nil, err
+	}
+	if err := Store.CreateSession(session); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// newSession returns a session that lasts until expiresAt, for the caller
+// to fill in and create.
+func newSession(userId uint, userAgent string, ip string, expiresAt time.Time) (*Session, error) {
+	tokenId := make([]byte, 16)
+	if _, err := rand.Read(tokenId); err != nil {
+		return nil, err
+	}
+	if len(userAgent) > maxUserAgentLength {
+		userAgent = userAgent[:maxUserAgentLength]
+	}
+
+	return &Session{
+		UserID:     userId,
+		TokenID:    base64.RawURLEncoding.EncodeToString(tokenId),
+		UserAgent:  userAgent,
+		IP:         ip,
+		LastSeenAt: time.Now(),
+		ExpiresAt:  expiresAt,
+	}, nil
+}
+
+// checkSession reports whether the request's token belongs to an active
+// session of the user it identifies, and if so stores the session in c.
+func checkSession(c *gin.Context, userId uint) bool {
+	tokenId, ok := jwt.ExtractClaims(c)[sessionKey].(string)
+	if !ok {
+		return false
+	}
+	session, err := Store.GetSession(tokenId)
+	if err != nil {
+		if !errors.Is(err, ErrSessionNotFound) {
+			log.Println(err)
+		}
+		return false
+	}
+	if session.UserID != userId || session.RevokedAt != nil {
+		return false
+	}
+
+	ip := c.ClientIP()
+	if time.Since(session.LastSeenAt) > lastSeenResolution || session.IP != ip {
+		if err := Store.TouchSession(session.ID, ip); err != nil {
+			log.Println(err)
+		}
+	}
+
+	c.Set(sessionKey, session)
+	return true
+}
@@ -0,0 +1,57 @@
+package user
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/speedrun-website/leaderboard-backend/config"
+	"github.com/speedrun-website/leaderboard-backend/mail"
+)
+
+// settings holds what the account handlers need beyond the store.
+// It is set by Configure.
+var settings struct {
+	sender                     mail.Sender
+	frontendURL                string
+	tokenSecret                []byte
+	verificationTimeout        time.Duration
+	verificationResendInterval time.Duration
+	passwordResetTimeout       time.Duration
+	usernameChangeCooldown     time.Duration
+	refreshTimeout             time.Duration
+	cookieDomain               string
+	cookieSecure               bool
+	oauthProviders             map[string]*oauthProvider
+	oauthStateTimeout          time.Duration
+	httpClient                 *http.Client
+	issuer                     string
+	twoFactorTimeout           time.Duration
+}
+
+// How long requests to other sites, such as OAuth providers, can take.
+const httpClientTimeout = 10 * time.Second
+
+// Configure sets the configuration and mail sender used by the
+// account handlers. It must be called before any routes are served.
+func Configure(c *config.Config, sender mail.Sender) {
+	settings.sender = sender
+	settings.frontendURL = strings.TrimSuffix(c.Server.FrontendURL, "/")
+	settings.tokenSecret = []byte(c.Auth.TokenSecret.Reveal())
+	settings.verificationTimeout = c.Auth.VerificationTimeout
+	settings.verificationResendInterval = c.Auth.VerificationResendInterval
+	settings.passwordResetTimeout = c.Auth.PasswordResetTimeout
+	settings.usernameChangeCooldown = c.Auth.UsernameChangeCooldown
+	settings.refreshTimeout = c.Auth.MaxRefresh
+	settings.cookieDomain = c.Auth.CookieDomain
+	settings.cookieSecure = c.Auth.CookieSecure
+	settings.oauthProviders = newOAuthProviders(c.OAuth)
+	settings.oauthStateTimeout = c.OAuth.StateTimeout
+	settings.httpClient = &http.Client{
+		Timeout: httpClientTimeout,
+	}
+	settings.issuer = c.Auth.Realm
+	settings.twoFactorTimeout = c.Auth.TwoFactorTimeout
+	ConfigurePasswords(c.Auth.Password)
+	configureLoginThrottle(c.Auth.LoginThrottle)
+}
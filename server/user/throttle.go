@@ -0,0 +1,231 @@
+package user
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/speedrun-website/leaderboard-backend/config"
+)
+
+// A LoginThrottle counts failed logins by key, such as an account or an
+// IP. Failures are forgotten once a key has gone a while without any.
+type LoginThrottle interface {
+	// GetLoginFailures returns how many times key has failed to log in,
+	// and when it last did, not counting failures from before since.
+	GetLoginFailures(key string, since time.Time) (int, time.Time, error)
+	// AddLoginFailure records that key failed to log in at now, first
+	// forgetting its failures if the last one was before since, and
+	// returns how many failures it has.
+	AddLoginFailure(key string, now time.Time, since time.Time) (int, error)
+	ResetLoginFailures(key string) error
+}
+
+// LoginThrottledError is returned when an account or IP has failed to log
+// in too often, and has to wait before trying again.
+type LoginThrottledError struct {
+	Until time.Time
+}
+
+func (e LoginThrottledError) Error() string {
+	return "there were too many failed logins, try again after " + e.Until.UTC().Format(time.RFC3339)
+}
+
+// A loginPolicy is how many failures a kind of key gets before it is
+// locked out, and for how long.
+type loginPolicy struct {
+	attempts  int
+	baseDelay time.Duration
+	maxDelay  time.Duration
+}
+
+// lockedUntil is when a key with failures, the last at last, can try to
+// log in again. The lockout doubles with each failure past the limit.
+func (p loginPolicy) lockedUntil(failures int, last time.Time) time.Time {
+	if failures < p.attempts {
+		return time.Time{}
+	}
+	delay := p.baseDelay
+	for i := p.attempts; i < failures && delay < p.maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > p.maxDelay {
+		delay = p.maxDelay
+	}
+	return last.Add(delay)
+}
+
+// loginThrottle is the throttle and policies that logins are checked with.
+// It is set by Configure.
+var loginThrottle struct {
+	LoginThrottle
+	account loginPolicy
+	ip      loginPolicy
+	window  time.Duration
+}
+
+// configureLoginThrottle chooses where failures are counted. The postgres
+// driver counts them in the store.
+func configureLoginThrottle(c config.LoginThrottleConfig) {
+	if c.Driver == config.ThrottlePostgres {
+		loginThrottle.LoginThrottle = Store
+	} else {
+		loginThrottle.LoginThrottle = newMemoryLoginThrottle()
+	}
+	loginThrottle.account = loginPolicy{
+		attempts:  c.AccountAttempts,
+		baseDelay: c.BaseDelay,
+		maxDelay:  c.MaxDelay,
+	}
+	loginThrottle.ip = loginPolicy{
+		attempts:  c.IPAttempts,
+		baseDelay: c.BaseDelay,
+		maxDelay:  c.MaxDelay,
+	}
+	loginThrottle.window = c.Window
+}
+
+func accountKey(email string) string {
+	return "account:" + CanonicalEmail(email)
+}
+
+func ipKey(ip string) string {
+	return "ip:" + ip
+}
+
+// checkLoginThrottle returns a LoginThrottledError if the account with
+// email, or the client at ip, is locked out. Logins are let through if
+// the failures can't be counted.
+func checkLoginThrottle(email string, ip string) error {
+	now := time.Now()
+	since := now.Add(-loginThrottle.window)
+	var until time.Time
+	for _, check := range []struct {
+		key    string
+		policy loginPolicy
+	}{
+		{accountKey(email), loginThrottle.account},
+		{ipKey(ip), loginThrottle.ip},
+	} {
+		failures, last, err := loginThrottle.GetLoginFailures(check.key, since)
+		if err != nil {
+			log.Printf("Could not check the login failures of %s: %s", check.key, err)
+			continue
+		}
+		if locked := check.policy.lockedUntil(failures, last); locked.After(until) {
+			until = locked
+		}
+	}
+	if until.After(now) {
+		return LoginThrottledError{Until: until}
+	}
+	return nil
+}
+
+// recordLoginFailure counts a failed login to the account with email, from
+// the client at ip. The user is told when their account gets locked out,
+// if it exists.
+func recordLoginFailure(email string, ip string, user *User) {
+	now := time.Now()
+	since := now.Add(-loginThrottle.window)
+	if _, err := loginThrottle.AddLoginFailure(ipKey(ip), now, since); err != nil {
+		log.Printf("Could not record a login failure from %s: %s", ip, err)
+	}
+	failures, err := loginThrottle.AddLoginFailure(accountKey(email), now, since)
+	if err != nil {
+		log.Printf("Could not record a login failure for %s: %s", email, err)
+		return
+	}
+
+	if user != nil && failures == loginThrottle.account.attempts {
+		until := loginThrottle.account.lockedUntil(failures, now)
+		err := sendNotice(user, "Logging in to your account was paused", fmt.Sprintf(
+			"There were %d failed attempts to log in to your account, so logging in is paused until %s. If it wasn't you, someone may be guessing your password; consider changing it and turning on two-factor authentication.",
+			failures,
+			until.UTC().Format(time.RFC1123),
+		))
+		if err != nil {
+			log.Printf("Could not notify user %d of their login being paused: %s", user.ID, err)
+		}
+	}
+}
+
+// resetLoginFailures forgets the failed logins to the account with email,
+// once someone has logged in to it. Failures from IPs are kept, so that
+// logging in to one account doesn't allow guessing at others.
+func resetLoginFailures(email string) {
+	if err := loginThrottle.ResetLoginFailures(accountKey(email)); err != nil {
+		log.Printf("Could not reset the login failures for %s: %s", email, err)
+	}
+}
+
+// setRetryAfter tells the client to wait until until before trying again.
+func setRetryAfter(c *gin.Context, until time.Time) {
+	retryAfter := time.Until(until)
+	c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+}
+
+// memoryLoginThrottle counts failures in memory, so each server counts
+// them separately and forgets them when it restarts.
+type memoryLoginThrottle struct {
+	sync.Mutex
+	failures  map[string]*loginFailures
+	lastPrune time.Time
+}
+
+type loginFailures struct {
+	count int
+	last  time.Time
+}
+
+func newMemoryLoginThrottle() *memoryLoginThrottle {
+	return &memoryLoginThrottle{
+		failures:  map[string]*loginFailures{},
+		lastPrune: time.Now(),
+	}
+}
+
+func (t *memoryLoginThrottle) GetLoginFailures(key string, since time.Time) (int, time.Time, error) {
+	t.Lock()
+	defer t.Unlock()
+	failures, ok := t.failures[key]
+	if !ok || failures.last.Before(since) {
+		return 0, time.Time{}, nil
+	}
+	return failures.count, failures.last, nil
+}
+
+func (t *memoryLoginThrottle) AddLoginFailure(key string, now time.Time, since time.Time) (int, error) {
+	t.Lock()
+	defer t.Unlock()
+
+	// Forget keys that haven't failed in a while, now and then.
+	if t.lastPrune.Before(since) {
+		for k, failures := range t.failures {
+			if failures.last.Before(since) {
+				delete(t.failures, k)
+			}
+		}
+		t.lastPrune = now
+	}
+
+	failures, ok := t.failures[key]
+	if !ok || failures.last.Before(since) {
+		failures = &loginFailures{}
+		t.failures[key] = failures
+	}
+	failures.count++
+	failures.last = now
+	return failures.count, nil
+}
+
+func (t *memoryLoginThrottle) ResetLoginFailures(key string) error {
+	t.Lock()
+	defer t.Unlock()
+	delete(t.failures, key)
+	return nil
+}
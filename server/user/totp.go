@@ -0,0 +1,116 @@
+package user
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// TOTP codes (RFC 6238) use the settings that every authenticator app
+// supports: HMAC-SHA1, six digits and a new code every 30 seconds.
+const (
+	totpDigits  = 6
+	totpModulus = 1000000
+	totpPeriod  = 30 * time.Second
+	// Codes from one period either side of now are accepted too,
+	// to allow for clocks that are slightly off.
+	totpSkew = 1
+	// The length of TOTP secrets, in bytes.
+	totpSecretLength = 20
+)
+
+// How many recovery codes a user is given, and how many letters each has.
+const (
+	recoveryCodeCount  = 10
+	recoveryCodeLength = 10
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// newTOTPSecret returns a random TOTP secret, encoded for authenticator apps.
+func newTOTPSecret() (string, error) {
+	secret := make([]byte, totpSecretLength)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(secret), nil
+}
+
+// totpURI is the otpauth URI that authenticator apps read from QR codes.
+func totpURI(issuer string, account string, secret string) string {
+	label := url.PathEscape(issuer + ":" + account)
+	query := url.Values{
+		"secret":    {secret},
+		"issuer":    {issuer},
+		"algorithm": {"SHA1"},
+		"digits":    {fmt.Sprint(totpDigits)},
+		"period":    {fmt.Sprint(int(totpPeriod.Seconds()))},
+	}
+	return "otpauth://totp/" + label + "?" + query.Encode()
+}
+
+// matchTOTP returns the time step that code is valid for at now,
+// and whether it is valid at all.
+func matchTOTP(secret string, code string, now time.Time) (int64, bool) {
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+	current := now.Unix() / int64(totpPeriod.Seconds())
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// totpCode is the code for a time step, as in RFC 4226.
+func totpCode(key []byte, step int64) string {
+	counter := make([]byte, 8)
+	binary.BigEndian.PutUint64(counter, uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%totpModulus)
+}
+
+// newRecoveryCodes returns a fresh set of recovery codes, which look
+// like "abcde-fghij".
+func newRecoveryCodes() ([]string, error) {
+	const alphabet = "abcdefghijkmnpqrstuvwxyz23456789"
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		random := make([]byte, recoveryCodeLength)
+		if _, err := rand.Read(random); err != nil {
+			return nil, err
+		}
+		var code strings.Builder
+		for j, b := range random {
+			if j == recoveryCodeLength/2 {
+				code.WriteByte('-')
+			}
+			code.WriteByte(alphabet[int(b)%len(alphabet)])
+		}
+		codes[i] = code.String()
+	}
+	return codes, nil
+}
+
+// hashRecoveryCode hashes a recovery code the way the user typed it in,
+// ignoring case, spaces and dashes.
+func hashRecoveryCode(code string) []byte {
+	code = strings.ToLower(code)
+	code = strings.NewReplacer(" ", "", "-", "").Replace(code)
+	return hashToken(code)
+}
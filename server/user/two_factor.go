@@ -0,0 +1,477 @@
+package user
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/speedrun-website/leaderboard-backend/server/request"
+)
+
+// A RecoveryCode lets a user log in once without their authenticator app.
+// Only a hash of the code is stored.
+type RecoveryCode struct {
+	ID        uint
+	CreatedAt time.Time
+	UserID    uint
+	CodeHash  []byte
+	UsedAt    *time.Time
+}
+
+// A LoginChallenge is a login by a user with two-factor authentication
+// on, who has given their password but not yet a code. It is looked up
+// by a hash of its token, and only allows a few wrong codes.
+type LoginChallenge struct {
+	ID        uint
+	CreatedAt time.Time
+	UserID    uint
+	TokenHash []byte
+	Cookie    bool
+	Attempts  int
+	ExpiresAt time.Time
+}
+
+// TOTPEnrollment is a new TOTP secret, along with the otpauth URI for
+// showing it as a QR code. It isn't used until it is confirmed.
+type TOTPEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+// TwoFactorCode is a code from an authenticator app, or a recovery code.
+type TwoFactorCode struct {
+	Code string `json:"code" binding:"required"`
+}
+
+// TwoFactorDisable is the body of a request to turn two-factor
+// authentication off. Users without a password only need a code.
+type TwoFactorDisable struct {
+	CurrentPassword string `json:"current_password"`
+	Code            string `json:"code" binding:"required"`
+}
+
+// RecoveryCodesResponse holds new recovery codes. They are only shown once.
+type RecoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+type TwoFactorStatus struct {
+	Enabled           bool `json:"enabled"`
+	RecoveryCodesLeft int  `json:"recovery_codes_left"`
+}
+
+// LoginChallengeResponse is the response to logging in when two-factor
+// authentication is on. The challenge token goes to /login/2fa along with
+// a code to finish logging in.
+type LoginChallengeResponse struct {
+	TwoFactorRequired bool   `json:"two_factor_required"`
+	ChallengeToken    string `json:"challenge_token"`
+	ChallengeExpiry   string `json:"challenge_expiry"`
+}
+
+// TwoFactorLogin is the second step of logging in.
+type TwoFactorLogin struct {
+	ChallengeToken string `json:"challenge_token" binding:"required"`
+	Code           string `json:"code" binding:"required"`
+}
+
+var ErrTwoFactorAlreadyEnabled = errors.New("two-factor authentication is already turned on")
+var ErrTwoFactorNotEnabled = errors.New("two-factor authentication is not turned on")
+var ErrNoTOTPEnrollment = errors.New("set up an authenticator app first")
+var ErrIncorrectCode = errors.New("the code is incorrect or has already been used")
+var ErrInvalidLoginChallenge = errors.New("the login is invalid or has expired, please log in again")
+
+// How many codes can be tried for one login challenge.
+const maxChallengeAttempts = 5
+
+// GetTwoFactorHandler tells the logged-in user whether two-factor
+// authentication is on, and how many unused recovery codes they have.
+func GetTwoFactorHandler(c *gin.Context) {
+	user, ok := currentUser(c)
+	if !ok {
+		return
+	}
+
+	status := TwoFactorStatus{
+		Enabled: user.HasTwoFactor(),
+	}
+	if status.Enabled {
+		left, err := Store.CountRecoveryCodes(user.ID)
+		if err != nil {
+			log.Println(err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		status.RecoveryCodesLeft = left
+	}
+	c.JSON(http.StatusOK, request.SuccessResponse{
+		Data: status,
+	})
+}
+
+// EnrollTOTPHandler gives the logged-in user a new TOTP secret to add to
+// their authenticator app. Two-factor authentication is turned on once
+// they confirm it with a code.
+func EnrollTOTPHandler(c *gin.Context) {
+	user, ok := currentUser(c)
+	if !ok {
+		return
+	}
+	if user.HasTwoFactor() {
+		abortTwoFactorConflict(c, ErrTwoFactorAlreadyEnabled)
+		return
+	}
+
+	secret, err := newTOTPSecret()
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	err = Store.SetTOTPSecret(user.ID, secret)
+	if errors.Is(err, ErrTwoFactorAlreadyEnabled) {
+		abortTwoFactorConflict(c, err)
+		return
+	} else if err != nil {
+		log.Println(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, request.SuccessResponse{
+		Data: TOTPEnrollment{
+			Secret: secret,
+			URI:    totpURI(settings.issuer, user.Email, secret),
+		},
+	})
+}
+
+// ConfirmTOTPHandler turns two-factor authentication on once the user
+// shows that their authenticator app works, and responds with their
+// recovery codes. Every other session is logged out, since none of them
+// gave a code.
+func ConfirmTOTPHandler(c *gin.Context) {
+	var body TwoFactorCode
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, request.ErrorResponse{
+			Errors: []error{
+				err,
+			},
+		})
+		return
+	}
+
+	user, ok := currentUser(c)
+	if !ok {
+		return
+	}
+	if user.HasTwoFactor() {
+		abortTwoFactorConflict(c, ErrTwoFactorAlreadyEnabled)
+		return
+	}
+	if user.TOTPSecret == nil {
+		abortTwoFactorConflict(c, ErrNoTOTPEnrollment)
+		return
+	}
+	step, ok := matchTOTP(*user.TOTPSecret, strings.TrimSpace(body.Code), time.Now())
+	if !ok {
+		abortIncorrectCode(c, http.StatusForbidden)
+		return
+	}
+
+	codes, hashes, err := recoveryCodes()
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	err = Store.EnableTwoFactor(user.ID, step, hashes)
+	if errors.Is(err, ErrTwoFactorAlreadyEnabled) || errors.Is(err, ErrNoTOTPEnrollment) {
+		abortTwoFactorConflict(c, err)
+		return
+	} else if err != nil {
+		log.Println(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	if session, ok := SessionFromContext(c); ok {
+		if err := Store.RevokeSessions(user.ID, session.TokenID); err != nil {
+			log.Println(err)
+		}
+	}
+	err = sendNotice(user, "Two-factor authentication was turned on", "Two-factor authentication was turned on for your account, and you were logged out everywhere else. If it wasn't you, reset your password and get in touch with us.")
+	if err != nil {
+		log.Printf("Could not notify user %d of two-factor authentication being turned on: %s", user.ID, err)
+	}
+
+	c.JSON(http.StatusOK, request.SuccessResponse{
+		Data: RecoveryCodesResponse{
+			RecoveryCodes: codes,
+		},
+	})
+}
+
+// DisableTwoFactorHandler turns two-factor authentication off, which
+// takes the user's password, if they have one, and a code.
+func DisableTwoFactorHandler(c *gin.Context) {
+	var body TwoFactorDisable
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, request.ErrorResponse{
+			Errors: []error{
+				err,
+			},
+		})
+		return
+	}
+
+	user, ok := currentUser(c)
+	if !ok {
+		return
+	}
+	if !user.HasTwoFactor() {
+		abortTwoFactorConflict(c, ErrTwoFactorNotEnabled)
+		return
+	}
+	if user.Password != nil && !ComparePasswords(user.Password, []byte(body.CurrentPassword)) {
+		abortIncorrectPassword(c)
+		return
+	}
+	if !checkSecondFactor(c, user, body.Code, http.StatusForbidden) {
+		return
+	}
+
+	if err := Store.DisableTwoFactor(user.ID); err != nil {
+		log.Println(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	err := sendNotice(user, "Two-factor authentication was turned off", "Two-factor authentication was turned off for your account. If it wasn't you, reset your password and get in touch with us.")
+	if err != nil {
+		log.Printf("Could not notify user %d of two-factor authentication being turned off: %s", user.ID, err)
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// RegenerateRecoveryCodesHandler replaces the logged-in user's recovery
+// codes with new ones, which takes a code.
+func RegenerateRecoveryCodesHandler(c *gin.Context) {
+	var body TwoFactorCode
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, request.ErrorResponse{
+			Errors: []error{
+				err,
+			},
+		})
+		return
+	}
+
+	user, ok := currentUser(c)
+	if !ok {
+		return
+	}
+	if !user.HasTwoFactor() {
+		abortTwoFactorConflict(c, ErrTwoFactorNotEnabled)
+		return
+	}
+	if !checkSecondFactor(c, user, body.Code, http.StatusForbidden) {
+		return
+	}
+
+	codes, hashes, err := recoveryCodes()
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if err := Store.ReplaceRecoveryCodes(user.ID, hashes); err != nil {
+		log.Println(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	c.JSON(http.StatusOK, request.SuccessResponse{
+		Data: RecoveryCodesResponse{
+			RecoveryCodes: codes,
+		},
+	})
+}
+
+// newTwoFactorLoginHandler finishes a login that was challenged for a
+// code, responding like the login endpoint.
+func newTwoFactorLoginHandler(authMiddleware *AuthMiddleware) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var body TwoFactorLogin
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, request.ErrorResponse{
+				Errors: []error{
+					err,
+				},
+			})
+			return
+		}
+
+		// The challenge is looked up before it is used, so that guesses
+		// at a locked out account don't use up its attempts.
+		tokenHash := hashToken(body.ChallengeToken)
+		challenge, err := Store.GetLoginChallenge(tokenHash)
+		if errors.Is(err, ErrInvalidLoginChallenge) {
+			abortInvalidLoginChallenge(c)
+			return
+		} else if err != nil {
+			log.Println(err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		user, err := Store.GetUserById(challenge.UserID)
+		if err != nil {
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		if user.BannedAt != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, request.ErrorResponse{
+				Errors: []error{
+					ErrUserBanned,
+				},
+			})
+			return
+		}
+		// Turning two-factor authentication off ends the user's
+		// challenges, but one could still be racing it.
+		if !user.HasTwoFactor() {
+			abortInvalidLoginChallenge(c)
+			return
+		}
+
+		// Wrong codes count as failed logins to the account, since each
+		// new challenge only takes the password.
+		ip := c.ClientIP()
+		var throttledErr LoginThrottledError
+		if err := checkLoginThrottle(user.Email, ip); errors.As(err, &throttledErr) {
+			authMiddleware.throttled(c, throttledErr)
+			return
+		}
+		challenge, err = Store.UseLoginChallenge(tokenHash, maxChallengeAttempts)
+		if errors.Is(err, ErrInvalidLoginChallenge) {
+			abortInvalidLoginChallenge(c)
+			return
+		} else if err != nil {
+			log.Println(err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		err = useSecondFactor(user, body.Code)
+		if errors.Is(err, ErrIncorrectCode) {
+			recordLoginFailure(user.Email, ip, user)
+			abortIncorrectCode(c, http.StatusUnauthorized)
+			return
+		} else if err != nil {
+			log.Println(err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		if err := Store.DeleteLoginChallenge(challenge.ID); err != nil {
+			log.Println(err)
+		}
+		authMiddleware.finishLogin(c, user, challenge.Cookie, true)
+	}
+}
+
+// challengeLogin responds with a new login challenge for user, who has
+// given their password and now needs to give a code.
+func challengeLogin(c *gin.Context, user *User, cookie bool) {
+	token, err := newOpaqueToken()
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	expiresAt := time.Now().Add(settings.twoFactorTimeout)
+	err = Store.CreateLoginChallenge(&LoginChallenge{
+		UserID:    user.ID,
+		TokenHash: hashToken(token),
+		Cookie:    cookie,
+		ExpiresAt: expiresAt,
+	})
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, request.SuccessResponse{
+		Data: LoginChallengeResponse{
+			TwoFactorRequired: true,
+			ChallengeToken:    token,
+			ChallengeExpiry:   expiresAt.Format(time.RFC3339),
+		},
+	})
+}
+
+// checkSecondFactor checks a code from the user's authenticator app, or
+// one of their recovery codes, and uses it up. If it's wrong, it aborts
+// with status.
+func checkSecondFactor(c *gin.Context, user *User, code string, status int) bool {
+	err := useSecondFactor(user, code)
+	if errors.Is(err, ErrIncorrectCode) {
+		abortIncorrectCode(c, status)
+		return false
+	} else if err != nil {
+		log.Println(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
+
+// useSecondFactor uses up code, which is either from the user's
+// authenticator app or one of their recovery codes. It returns
+// ErrIncorrectCode if it's neither.
+func useSecondFactor(user *User, code string) error {
+	code = strings.TrimSpace(code)
+	if step, ok := matchTOTP(*user.TOTPSecret, code, time.Now()); ok {
+		return Store.UseTOTPStep(user.ID, step)
+	}
+	return Store.UseRecoveryCode(user.ID, hashRecoveryCode(code))
+}
+
+// recoveryCodes returns a new set of recovery codes, and their hashes.
+func recoveryCodes() ([]string, [][]byte, error) {
+	codes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, nil, err
+	}
+	hashes := make([][]byte, len(codes))
+	for i, code := range codes {
+		hashes[i] = hashRecoveryCode(code)
+	}
+	return codes, hashes, nil
+}
+
+func abortTwoFactorConflict(c *gin.Context, err error) {
+	c.AbortWithStatusJSON(http.StatusConflict, request.ErrorResponse{
+		Errors: []error{
+			err,
+		},
+	})
+}
+
+func abortIncorrectCode(c *gin.Context, status int) {
+	c.AbortWithStatusJSON(status, request.ErrorResponse{
+		Errors: []error{
+			ErrIncorrectCode,
+		},
+	})
+}
+
+func abortInvalidLoginChallenge(c *gin.Context) {
+	c.AbortWithStatusJSON(http.StatusUnauthorized, request.ErrorResponse{
+		Errors: []error{
+			ErrInvalidLoginChallenge,
+		},
+	})
+}
@@ -0,0 +1,150 @@
+package user
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Usernames and email addresses are unique by their canonical forms, so
+// that names that only differ by case, width or lookalike letters, like
+// RageCage, ragecage and RageCаge with a Cyrillic а, can't be told apart.
+// The canonical forms are only for comparing; the names are shown as
+// they were given.
+
+const (
+	minUsernameLength = 2
+	maxUsernameLength = 32
+)
+
+var ErrInvalidUsername = fmt.Errorf("usernames must be %d to %d letters, digits, underscores or hyphens", minUsernameLength, maxUsernameLength)
+var ErrReservedUsername = errors.New("this username is reserved")
+
+var usernamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// reservedUsernames can't be registered, since they could pass for the
+// site itself or its staff.
+var reservedUsernames = []string{
+	"admin",
+	"administrator",
+	"api",
+	"mod",
+	"moderator",
+	"moderators",
+	"root",
+	"staff",
+	"support",
+	"system",
+	"verifier",
+}
+
+// GameSlugExists reports whether a game has slug. Usernames can't be the
+// same as a game's slug, so that links to users and games can't be
+// confused. Games depend on users, so the game package provides it; see
+// server.Init.
+var GameSlugExists func(slug string) bool
+
+// confusables maps letters to the ASCII letters they look like, once case
+// folded. Usernames can only be ASCII, but older ones may not be, and the
+// skeleton of an ASCII name still folds digits that pass for letters.
+// The migration that added canonical usernames does the same with SQL;
+// see 0020_add_canonical_names.
+var confusables = map[rune]rune{
+	'0': 'o',
+	'1': 'l',
+	'i': 'l',
+	'ı': 'l',
+	'ɑ': 'a',
+	'ɡ': 'g',
+	'α': 'a',
+	'ι': 'l',
+	'κ': 'k',
+	'ν': 'v',
+	'ο': 'o',
+	'ρ': 'p',
+	'υ': 'u',
+	'χ': 'x',
+	'а': 'a',
+	'е': 'e',
+	'о': 'o',
+	'р': 'p',
+	'с': 'c',
+	'у': 'y',
+	'х': 'x',
+	'ѕ': 's',
+	'і': 'l',
+	'ј': 'j',
+	'һ': 'h',
+	'ӏ': 'l',
+	'ԁ': 'd',
+	'ԛ': 'q',
+	'ԝ': 'w',
+}
+
+// Pairs of letters that look like a single one.
+var confusableSequences = strings.NewReplacer("rn", "m", "vv", "w")
+
+// NormalizeUsername returns username as it is stored, or
+// ErrInvalidUsername if it breaks the rules for usernames. Usernames are
+// NFKC normalized first, so that full-width letters count as ASCII ones.
+func NormalizeUsername(username string) (string, error) {
+	username = norm.NFKC.String(strings.TrimSpace(username))
+	if len(username) < minUsernameLength || len(username) > maxUsernameLength || !usernamePattern.MatchString(username) {
+		return "", ErrInvalidUsername
+	}
+	return username, nil
+}
+
+// IsReservedUsername reports whether username is reserved for the site or
+// is a game's slug. Reserved names are matched by their canonical form,
+// so that lookalikes of them are reserved too.
+func IsReservedUsername(username string) bool {
+	canonical := CanonicalUsername(username)
+	for _, reserved := range reservedUsernames {
+		if canonical == CanonicalUsername(reserved) {
+			return true
+		}
+	}
+	return GameSlugExists != nil && GameSlugExists(strings.ToLower(username))
+}
+
+// checkNewUsername normalizes a username that a user picked for themselves,
+// which also mustn't be reserved.
+func checkNewUsername(username string) (string, error) {
+	username, err := NormalizeUsername(username)
+	if err != nil {
+		return "", err
+	}
+	if IsReservedUsername(username) {
+		return "", ErrReservedUsername
+	}
+	return username, nil
+}
+
+// CanonicalUsername returns the skeleton of username: its case folded NFKC
+// form, with lookalike letters replaced by the ASCII ones they pass for.
+func CanonicalUsername(username string) string {
+	folded := foldString(username)
+	skeleton := strings.Map(func(r rune) rune {
+		if c, ok := confusables[r]; ok {
+			return c
+		}
+		return r
+	}, folded)
+	return confusableSequences.Replace(skeleton)
+}
+
+// CanonicalEmail returns the case folded NFKC form of email. Lookalikes
+// aren't replaced, since different addresses can look alike and still
+// belong to different people.
+func CanonicalEmail(email string) string {
+	return foldString(strings.TrimSpace(email))
+}
+
+func foldString(s string) string {
+	return norm.NFKC.String(cases.Fold().String(norm.NFKC.String(s)))
+}
@@ -2,44 +2,115 @@ package user
 
 import (
 	"errors"
+	"time"
 
 	"github.com/speedrun-website/leaderboard-backend/database"
 	"gorm.io/gorm"
 )
 
+// A User is an account on the site. Banned users can't log in, and
+// users who haven't verified their email can log in but can't submit runs.
+// Users with a TOTPEnabledAt have two-factor authentication turned on;
+// TOTPLastStep is the time step of the last code they used, so that no
+// code can be used twice. Users are known outside of the database by
+// their PublicID, which is given to them when they are created.
+// UsernameCanonical and EmailCanonical are kept up to date by the store;
+// see CanonicalUsername and CanonicalEmail.
 type User struct {
 	gorm.Model
-	Username string `gorm:"unique"`
-	Email    string `gorm:"unique"`
-	Password []byte `gorm:"size:60"`
+	PublicID           string `gorm:"unique"`
+	Username           string `gorm:"unique"`
+	UsernameCanonical  string `gorm:"unique"`
+	Email              string `gorm:"unique"`
+	EmailCanonical     string `gorm:"unique"`
+	Password           []byte
+	BannedAt           *time.Time
+	EmailVerifiedAt    *time.Time
+	VerificationSentAt *time.Time
+	TOTPSecret         *string
+	TOTPEnabledAt      *time.Time
+	TOTPLastStep       int64
 }
 
+// UserIdentifier and UserPersonal show a user by their public ID.
+// Their ID is only for use within the API.
 type UserIdentifier struct {
-	ID       uint   `json:"id"`
+	ID       uint   `json:"-"`
+	PublicID string `json:"id"`
 	Username string `json:"username"`
 }
 
 type UserPersonal struct {
-	ID       uint   `json:"id"`
-	Username string `json:"username"`
-	Email    string `json:"email"`
+	ID               uint       `json:"-"`
+	PublicID         string     `json:"id"`
+	Username         string     `json:"username"`
+	Email            string     `json:"email"`
+	EmailVerifiedAt  *time.Time `json:"email_verified_at"`
+	TwoFactorEnabled bool       `json:"two_factor_enabled"`
+}
+
+// A UsernameChange records a username that a user used to have,
+// so that links to their old profile can still find them.
+type UsernameChange struct {
+	ID                uint
+	UserID            uint
+	Username          string
+	UsernameCanonical string
+	ChangedAt         time.Time
+}
+
+func (UsernameChange) TableName() string {
+	return "username_history"
+}
+
+func (c *UsernameChange) BeforeCreate(tx *gorm.DB) error {
+	c.UsernameCanonical = CanonicalUsername(c.Username)
+	return nil
+}
+
+// A UserUpdate is a change to a user's account. Nil fields are left as they are.
+type UserUpdate struct {
+	Username *string
+	Email    *string
 }
 
 func (u User) AsIdentifier() *UserIdentifier {
 	return &UserIdentifier{
 		ID:       u.ID,
+		PublicID: u.PublicID,
 		Username: u.Username,
 	}
 }
 
 func (u User) AsPersonal() *UserPersonal {
 	return &UserPersonal{
-		ID:       u.ID,
-		Username: u.Username,
-		Email:    u.Email,
+		ID:               u.ID,
+		PublicID:         u.PublicID,
+		Username:         u.Username,
+		Email:            u.Email,
+		EmailVerifiedAt:  u.EmailVerifiedAt,
+		TwoFactorEnabled: u.HasTwoFactor(),
 	}
 }
 
+// BeforeCreate gives the user a public ID if they don't have one yet,
+// and canonical forms of their username and email.
+func (u *User) BeforeCreate(tx *gorm.DB) error {
+	u.UsernameCanonical = CanonicalUsername(u.Username)
+	u.EmailCanonical = CanonicalEmail(u.Email)
+	return database.SetPublicID(&u.PublicID)
+}
+
+// HasTwoFactor reports whether the user has two-factor authentication on.
+func (u User) HasTwoFactor() bool {
+	return u.TOTPEnabledAt != nil
+}
+
+// IsVerified reports whether the user has verified their email address.
+func (u User) IsVerified() bool {
+	return u.EmailVerifiedAt != nil
+}
+
 // The globally exported UserStore that the application will use.
 var Store UserStore
 
@@ -49,17 +120,160 @@ type UserStore interface {
 	database.DataStore
 
 	GetUserIdentifierById(uint) (*UserIdentifier, error)
+	GetUserIdentifierByPublicId(string) (*UserIdentifier, error)
+	// GetUserIdentifierByUsername finds the user with username, by its
+	// canonical form. If nobody has it, the user who used to have it is returned,
+	// with renamed set.
+	GetUserIdentifierByUsername(username string) (user *UserIdentifier, renamed bool, err error)
 	GetUserPersonalById(uint) (*UserPersonal, error)
+	GetUserById(uint) (*User, error)
+	// GetUserByEmail finds the user with email, by its canonical form.
 	GetUserByEmail(string) (*User, error)
 	CreateUser(*User) error
 	DeleteUser(uint) error
+
+	// BanUser bans the user and revokes all of their sessions.
+	BanUser(uint) error
+	UnbanUser(uint) error
+
+	// VerifyEmail marks the user's email as verified, as long as it
+	// still matches the given one.
+	VerifyEmail(userId uint, email string) error
+	// MarkVerificationSent records that a verification email is being
+	// sent, unless one was already sent after since.
+	MarkVerificationSent(userId uint, since time.Time) error
+
+	CreatePasswordReset(*PasswordReset) error
+	// ResetPassword uses up the unexpired password reset with tokenHash,
+	// sets the user's password to passwordHash and revokes their sessions.
+	ResetPassword(tokenHash []byte, passwordHash []byte) (uint, error)
+
+	// UpdateUser applies update, refusing to change the username again
+	// within usernameCooldown of the last change. A new email address
+	// needs to be verified again.
+	UpdateUser(userId uint, update UserUpdate, usernameCooldown time.Duration) error
+	ChangePassword(userId uint, passwordHash []byte) error
+	// UpgradePasswordHash replaces the user's password hash with newHash,
+	// a hash of the same password, as long as it is still oldHash.
+	UpgradePasswordHash(userId uint, oldHash []byte, newHash []byte) error
+
+	CreateSession(*Session) error
+	GetSession(tokenId string) (*Session, error)
+	GetActiveSessions(userId uint) ([]Session, error)
+	// TouchSession records that a session was used from ip.
+	TouchSession(sessionId uint, ip string) error
+	RevokeSession(userId uint, publicId string) error
+	// RevokeSessions revokes all of a user's sessions,
+	// except the one with the token ID except if it's set.
+	RevokeSessions(userId uint, except string) error
+
+	CreateRefreshToken(*RefreshToken) error
+	// RotateRefreshToken uses up the refresh token with tokenHash and
+	// adds next to the same session, returning the session. Using a
+	// refresh token twice revokes its session and every token in it.
+	RotateRefreshToken(tokenHash []byte, next *RefreshToken) (*Session, error)
+
+	CreateOAuthState(*OAuthState) error
+	// TakeOAuthState deletes and returns the unexpired state for
+	// provider with stateHash, so that each state is only used once.
+	TakeOAuthState(provider string, stateHash []byte) (*OAuthState, error)
+
+	GetExternalIdentity(provider string, subject string) (*ExternalIdentity, error)
+	GetExternalIdentities(userId uint) ([]ExternalIdentity, error)
+	CreateExternalIdentity(*ExternalIdentity) error
+	// CreateUserWithIdentity signs up user, linked to identity.
+	CreateUserWithIdentity(*User, *ExternalIdentity) error
+	// DeleteExternalIdentity unlinks the user's identity on provider,
+	// unless the user would have no way left to log in.
+	DeleteExternalIdentity(userId uint, provider string) error
+
+	// SetTOTPSecret gives the user a TOTP secret to confirm, unless they
+	// already have two-factor authentication on.
+	SetTOTPSecret(userId uint, secret string) error
+	// EnableTwoFactor turns two-factor authentication on with the user's
+	// TOTP secret, whose code for step was just used, and gives the user
+	// recovery codes with codeHashes.
+	EnableTwoFactor(userId uint, step int64, codeHashes [][]byte) error
+	// DisableTwoFactor removes the user's TOTP secret, recovery codes and
+	// pending login challenges, and their sessions stop counting as
+	// logged in with a code.
+	DisableTwoFactor(userId uint) error
+	// UseTOTPStep records that the user used the code for step, unless
+	// they already used that code or a later one.
+	UseTOTPStep(userId uint, step int64) error
+	ReplaceRecoveryCodes(userId uint, codeHashes [][]byte) error
+	// UseRecoveryCode uses up the user's recovery code with codeHash.
+	UseRecoveryCode(userId uint, codeHash []byte) error
+	CountRecoveryCodes(userId uint) (int, error)
+
+	CreateLoginChallenge(*LoginChallenge) error
+	// GetLoginChallenge returns the unexpired challenge with tokenHash.
+	GetLoginChallenge(tokenHash []byte) (*LoginChallenge, error)
+	// UseLoginChallenge counts an attempt at the unexpired challenge with
+	// tokenHash, unless it has already had maxAttempts.
+	UseLoginChallenge(tokenHash []byte, maxAttempts int) (*LoginChallenge, error)
+	DeleteLoginChallenge(challengeId uint) error
+
+	CreatePersonalAccessToken(*PersonalAccessToken) error
+	GetPersonalAccessTokens(userId uint) ([]PersonalAccessToken, error)
+	// GetPersonalAccessToken returns the unexpired token with tokenHash,
+	// as long as its user isn't banned or deleted.
+	GetPersonalAccessToken(tokenHash []byte) (*PersonalAccessToken, error)
+	// TouchPersonalAccessToken records that a token was just used.
+	TouchPersonalAccessToken(tokenId uint) error
+	DeletePersonalAccessToken(userId uint, publicId string) error
+
+	// GetProfile returns the user's profile, which is empty if they
+	// haven't filled it in.
+	GetProfile(userId uint) (*Profile, error)
+	SaveProfile(*Profile) error
+
+	CreateOAuthApp(*OAuthApp) error
+	GetOAuthApps(ownerId uint) ([]OAuthApp, error)
+	GetOAuthAppByClientID(clientId string) (*OAuthApp, error)
+	// DeleteOAuthApp deletes one of the owner's apps, ending every
+	// session it started.
+	DeleteOAuthApp(ownerId uint, publicId string) error
+	CreateAuthorizationCode(*AuthorizationCode) error
+	// TakeAuthorizationCode deletes and returns the unexpired code with
+	// codeHash, so that each code is only used once.
+	TakeAuthorizationCode(codeHash []byte) (*AuthorizationCode, error)
+	// GetRefreshTokenSession returns the active session of the unused,
+	// unexpired refresh token with tokenHash.
+	GetRefreshTokenSession(tokenHash []byte) (*Session, error)
+
+	// The store can count failed logins for the postgres login throttle,
+	// which servers share.
+	LoginThrottle
 }
 
 // Errors
 var ErrUserNotFound = errors.New("the requested user was not found")
+var ErrUserBanned = errors.New("this account has been banned")
+var ErrEmailNotVerified = errors.New("you need to verify your email address first")
+var ErrEmailAlreadyVerified = errors.New("this email address is already verified")
+var ErrVerificationThrottled = errors.New("a verification email was sent recently")
+var ErrPasswordResetNotFound = errors.New("the password reset was not found")
+var ErrSessionRevoked = errors.New("this session has ended, please log in again")
+var ErrSessionNotFound = errors.New("the session was not found")
+var ErrInvalidRefreshToken = errors.New("the refresh token is invalid or has expired")
+var ErrRefreshTokenReused = errors.New("the refresh token was already used, so its session has been revoked")
+var ErrIdentityNotFound = errors.New("no account on that provider is linked")
+var ErrIdentityTaken = errors.New("that account is already linked to another user")
+var ErrProviderAlreadyLinked = errors.New("an account on that provider is already linked, unlink it first")
+var ErrLastLoginMethod = errors.New("you can't unlink your only way to log in; set a password first by resetting it")
 
 var ErrUserNotUnique = errors.New("attempted to create a user with duplicate data")
 
+// UsernameCooldownError is returned when a username was changed too recently.
+type UsernameCooldownError struct {
+	Until time.Time
+}
+
+func (e UsernameCooldownError) Error() string {
+	return "your username was changed recently, it can be changed again after " + e.Until.UTC().Format(time.RFC3339)
+}
+
 type UserCreationError struct {
 	Err error
 }
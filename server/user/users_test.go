@@ -2,18 +2,41 @@ package user_test
 
 import (
 	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"math/big"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	jwtgo "github.com/dgrijalva/jwt-go"
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
+	"github.com/speedrun-website/leaderboard-backend/config"
 	"github.com/speedrun-website/leaderboard-backend/database"
+	"github.com/speedrun-website/leaderboard-backend/database/migrations"
+	"github.com/speedrun-website/leaderboard-backend/mail"
 	"github.com/speedrun-website/leaderboard-backend/server/request"
 	"github.com/speedrun-website/leaderboard-backend/server/user"
 )
@@ -30,145 +53,1891 @@ func init() {
 	if err := database.InitGlobalTestConnection(); err != nil {
 		log.Fatalf("DB failed to initialise.")
 	}
+	if _, err := migrations.Up(database.DB); err != nil {
+		log.Fatalf("Migrations failed: %s", err)
+	}
+
+	if err := user.InitGormStore(nil); err != nil {
+		log.Fatalf("Gorm store failed to initialise.")
+	}
+
+	c := config.Default()
+	c.Auth.TokenSecret = "a test token secret that is long enough"
+	// Every test request comes from the same IP, so only accounts are
+	// locked out.
+	c.Auth.LoginThrottle.IPAttempts = 1000
+	c.OAuth.Discord = config.OAuthProvider{
+		ClientID:     testClientID,
+		ClientSecret: "a test client secret",
+		AuthURL:      provider.URL + "/authorize",
+		TokenURL:     provider.URL + "/token",
+		UserInfoURL:  provider.URL + "/userinfo",
+	}
+	user.Configure(c, outbox)
+}
+
+// testOutbox is a mail sender that keeps every message, by recipient.
+type testOutbox struct {
+	sync.Mutex
+	messages map[string][]mail.Message
+}
+
+var outbox = &testOutbox{messages: map[string][]mail.Message{}}
+
+const testClientID = "test-client"
+
+// testProvider is a stub OAuth provider, standing in for Discord. Tests
+// log in with it by asking it for a code for the profile they want, as if
+// the user had logged in on its site.
+type testProvider struct {
+	sync.Mutex
+	*httptest.Server
+	codes    int
+	grants   map[string]testGrant
+	profiles map[string]map[string]interface{}
+}
+
+type testGrant struct {
+	challenge string
+	profile   map[string]interface{}
+}
+
+var provider = newTestProvider()
+
+func newTestProvider() *testProvider {
+	p := &testProvider{
+		grants:   map[string]testGrant{},
+		profiles: map[string]map[string]interface{}{},
+	}
+	p.Server = httptest.NewServer(p)
+	return p
+}
+
+func (p *testProvider) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.Lock()
+	defer p.Unlock()
+
+	switch r.URL.Path {
+	case "/token":
+		code := r.PostFormValue("code")
+		grant, ok := p.grants[code]
+		delete(p.grants, code)
+		challenge := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+		if !ok || r.PostFormValue("client_id") != testClientID ||
+			base64.RawURLEncoding.EncodeToString(challenge[:]) != grant.challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		token := code + "-token"
+		p.profiles[token] = grant.profile
+		json.NewEncoder(w).Encode(map[string]string{
+			"access_token": token,
+			"token_type":   "Bearer",
+		})
+	case "/userinfo":
+		profile, ok := p.profiles[strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")]
+		if !ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(profile)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// authorize logs in to the provider as profile, returning the code
+// and state that the provider sends back to the website.
+func (p *testProvider) authorize(t *testing.T, authorizationURL string, profile map[string]interface{}) (string, string) {
+	t.Helper()
+
+	parsed, err := url.Parse(authorizationURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := parsed.Query()
+	if query.Get("client_id") != testClientID || query.Get("code_challenge_method") != "S256" || query.Get("state") == "" {
+		t.Fatalf("unexpected authorization URL %s", authorizationURL)
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	p.codes++
+	code := fmt.Sprintf("code-%d", p.codes)
+	p.grants[code] = testGrant{
+		challenge: query.Get("code_challenge"),
+		profile:   profile,
+	}
+	return code, query.Get("state")
+}
+
+func (o *testOutbox) Send(m mail.Message) error {
+	o.Lock()
+	defer o.Unlock()
+	o.messages[m.To] = append(o.messages[m.To], m)
+	return nil
+}
+
+// waitFor waits for at least count emails to have been sent to address.
+func (o *testOutbox) waitFor(t *testing.T, address string, count int) {
+	t.Helper()
+
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		o.Lock()
+		sent := len(o.messages[address])
+		o.Unlock()
+		if sent >= count {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("expected %d emails to %s", count, address)
+}
+
+var tokenPattern = regexp.MustCompile(`token=([^\s]+)`)
+
+// lastToken returns the token from the latest email sent to address.
+func (o *testOutbox) lastToken(t *testing.T, address string) string {
+	t.Helper()
+
+	o.Lock()
+	defer o.Unlock()
+	messages := o.messages[address]
+	if len(messages) == 0 {
+		t.Fatalf("no email was sent to %s", address)
+	}
+	match := tokenPattern.FindStringSubmatch(messages[len(messages)-1].Body)
+	if match == nil {
+		t.Fatalf("the email to %s had no token", address)
+	}
+	token, err := url.QueryUnescape(match[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestAuthFlow(t *testing.T) {
+	t.Parallel()
+
+	r := getUsersContext()
+
+	cleanup := []uint{}
+	t.Run("Full auth flow", func(t *testing.T) {
+		password := "str0ng3stp4ssw0rd"
+		userReg := user.UserRegister{
+			Username:        "AGoodUser",
+			Email:           "cool@email.com",
+			Password:        password,
+			PasswordConfirm: password,
+		}
+		u := testRegister(t, r, userReg)
+		cleanup = append(cleanup, u.ID)
+
+		userLogin := user.UserLogin{
+			Email:    u.Email,
+			Password: password,
+		}
+		tokens := testLoginTokens(t, r, userLogin)
+
+		testMe(t, r, *u, tokens.Token)
+
+		refreshed := testRefreshToken(t, r, tokens)
+		testMe(t, r, *u, refreshed.Token)
+
+		// Replaying a refresh token ends the whole session.
+		_, err := testJsonPostRequest(r, "/refresh_token", user.RefreshRequest{RefreshToken: tokens.RefreshToken}, http.StatusUnauthorized)
+		if err != nil {
+			t.Fatalf("expected a reused refresh token to be rejected: %s", err)
+		}
+		_, err = testJsonPostRequest(r, "/refresh_token", user.RefreshRequest{RefreshToken: refreshed.RefreshToken}, http.StatusUnauthorized)
+		if err != nil {
+			t.Fatalf("expected the session's other refresh tokens to be revoked: %s", err)
+		}
+		if _, err := testAuthRequest(r, http.MethodGet, "/me", refreshed.Token, nil, http.StatusUnauthorized); err != nil {
+			t.Fatalf("expected the session's access tokens to be revoked: %s", err)
+		}
+	})
+	if err := cleanupUsers(cleanup); err != nil {
+		t.Fatalf("cleanup failed: %s", err)
+	}
+}
+
+func testRegister(
+	t *testing.T,
+	r *gin.Engine,
+	registerBody user.UserRegister,
+) *user.UserPersonal {
+	t.Helper()
+
+	responseBytes, err := testJsonPostRequest(r, "/register", registerBody, http.StatusCreated)
+	if err != nil {
+		// FIXME
+		t.Fatalf("it failed: %s", err)
+	}
+	var responseData user.UserIdentifierResponse
+	_, err = request.UnmarshalSuccessResponseData(responseBytes, &responseData)
+	if err != nil {
+		// FIXME
+		t.Fatal("bad response format")
+	}
+	identifier, err := user.Store.GetUserIdentifierByPublicId(responseData.User.PublicID)
+	if err != nil {
+		t.Fatalf("failed to register user: %s", err)
+	}
+	user, err := user.Store.GetUserPersonalById(identifier.ID)
+	if err != nil {
+		t.Fatalf("failed to register user: %s", err)
+	}
+
+	return user
+}
+
+func testLogin(
+	t *testing.T,
+	r *gin.Engine,
+	loginBody user.UserLogin,
+) string {
+	t.Helper()
+
+	return testLoginTokens(t, r, loginBody).Token
+}
+
+func testLoginTokens(
+	t *testing.T,
+	r *gin.Engine,
+	loginBody user.UserLogin,
+) *user.TokenResponse {
+	t.Helper()
+
+	responseBytes, err := testJsonPostRequest(r, "/login", loginBody, http.StatusOK)
+	if err != nil {
+		// FIXME
+		t.Fatal("login failed")
+	}
+	var response user.TokenResponse
+	_, err = request.UnmarshalSuccessResponseData(responseBytes, &response)
+	if err != nil {
+		// FIXME
+		t.Fatal("login failed response bad")
+	}
+	if response.Token == "" || response.RefreshToken == "" {
+		t.Fatal("expected an access token and a refresh token")
+	}
+
+	return &response
+}
+
+func testMe(
+	t *testing.T,
+	r *gin.Engine,
+	u user.UserPersonal,
+	token string,
+) {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodGet, "/me", nil)
+	req.Header.Add("Authorization", "Bearer "+token)
+	responseBytes, err := testGetRequest(r, "/me", http.StatusOK, req)
+	if err != nil {
+		// FIXME
+		t.Fatalf("me failed: %s", err)
+	}
+	var responseData user.UserPersonalResponse
+	_, err = request.UnmarshalSuccessResponseData(responseBytes, &responseData)
+	if err != nil {
+		// FIXME
+		t.Fatal("me failed response bad")
+	}
+
+	if u.PublicID != responseData.User.PublicID {
+		// FIXME
+		t.Fatalf("me failed: %s", err)
+	}
+}
+
+func testRefreshToken(
+	t *testing.T,
+	r *gin.Engine,
+	tokens *user.TokenResponse,
+) *user.TokenResponse {
+	t.Helper()
+
+	responseBytes, err := testJsonPostRequest(r, "/refresh_token", user.RefreshRequest{RefreshToken: tokens.RefreshToken}, http.StatusOK)
+	if err != nil {
+		t.Fatalf("refresh_token failed: %s", err)
+	}
+	var response user.TokenResponse
+	_, err = request.UnmarshalSuccessResponseData(responseBytes, &response)
+	if err != nil {
+		t.Fatal("refresh_token failed response bad")
+	}
+	if response.Token == "" || response.Token == tokens.Token || response.RefreshToken == tokens.RefreshToken {
+		t.Fatal("expected new tokens")
+	}
+	return &response
+}
+
+func TestCookieLogin(t *testing.T) {
+	t.Parallel()
+
+	r := getUsersContext()
+	password := "beepboopbop"
+	u := testRegister(t, r, user.UserRegister{
+		Username:        "CookieMonster",
+		Email:           "cookies@email.com",
+		Password:        password,
+		PasswordConfirm: password,
+	})
+	defer func() {
+		if err := cleanupUsers([]uint{u.ID}); err != nil {
+			t.Fatalf("failed cleanup: %s", err)
+		}
+	}()
+
+	// send makes a request with the cookies that have been set so far,
+	// and keeps any cookies set by the response.
+	cookies := map[string]*http.Cookie{}
+	send := func(method string, target string, body interface{}, expected int) *httptest.ResponseRecorder {
+		t.Helper()
+
+		var reqBody bytes.Buffer
+		if body != nil {
+			if err := json.NewEncoder(&reqBody).Encode(body); err != nil {
+				t.Fatal(err)
+			}
+		}
+		req := httptest.NewRequest(method, target, &reqBody)
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != expected {
+			t.Fatalf("%s %s: expected status code %d, got %d", method, target, expected, w.Code)
+		}
+		for _, cookie := range w.Result().Cookies() {
+			if !cookie.HttpOnly {
+				t.Fatalf("expected the %s cookie to be HttpOnly", cookie.Name)
+			}
+			if cookie.MaxAge < 0 {
+				delete(cookies, cookie.Name)
+			} else {
+				cookies[cookie.Name] = cookie
+			}
+		}
+		return w
+	}
+
+	w := send(http.MethodPost, "/login", user.UserLogin{Email: u.Email, Password: password, Cookie: true}, http.StatusOK)
+	var response user.TokenResponse
+	if _, err := request.UnmarshalSuccessResponseData(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if response.Token != "" || response.RefreshToken != "" {
+		t.Fatal("expected the tokens to only be sent as cookies")
+	}
+	if cookies["jwt"] == nil || cookies["refresh_token"] == nil {
+		t.Fatalf("expected token cookies, got %v", cookies)
+	}
+
+	send(http.MethodGet, "/me", nil, http.StatusOK)
+	oldRefresh := cookies["refresh_token"].Value
+	send(http.MethodPost, "/refresh_token", nil, http.StatusOK)
+	if cookies["refresh_token"].Value == oldRefresh {
+		t.Fatal("expected the refresh token cookie to be rotated")
+	}
+	send(http.MethodGet, "/me", nil, http.StatusOK)
+
+	send(http.MethodPost, "/logout", nil, http.StatusOK)
+	if len(cookies) != 0 {
+		t.Fatalf("expected logging out to clear the cookies, got %v", cookies)
+	}
+}
+
+func TestEmailVerification(t *testing.T) {
+	t.Parallel()
+
+	r := getUsersContext()
+	password := "beepboopbop"
+	u := testRegister(t, r, user.UserRegister{
+		Username:        "NewRunner",
+		Email:           "verify@email.com",
+		Password:        password,
+		PasswordConfirm: password,
+	})
+	defer func() {
+		if err := cleanupUsers([]uint{u.ID}); err != nil {
+			t.Fatalf("failed cleanup: %s", err)
+		}
+	}()
+	if u.EmailVerifiedAt != nil {
+		t.Fatal("expected a new user to be unverified")
+	}
+
+	token := testLogin(t, r, user.UserLogin{
+		Email:    u.Email,
+		Password: password,
+	})
+
+	// The registration email was only just sent.
+	req := httptest.NewRequest(http.MethodPost, "/verify-email/resend", nil)
+	req.Header.Add("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("expected a throttled resend, got %d", w.Code)
+	}
+
+	_, err := testJsonPostRequest(r, "/verify-email", user.VerifyEmail{Token: "not.a.token"}, http.StatusBadRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	verifyToken := outbox.lastToken(t, u.Email)
+	tampered := "1" + verifyToken
+	_, err = testJsonPostRequest(r, "/verify-email", user.VerifyEmail{Token: tampered}, http.StatusBadRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	responseBytes, err := testJsonPostRequest(r, "/verify-email", user.VerifyEmail{Token: verifyToken}, http.StatusOK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var responseData user.UserPersonalResponse
+	if _, err := request.UnmarshalSuccessResponseData(responseBytes, &responseData); err != nil {
+		t.Fatal(err)
+	}
+	if responseData.User.EmailVerifiedAt == nil {
+		t.Fatal("expected the user to be verified")
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/verify-email/resend", nil)
+	req.Header.Add("Authorization", "Bearer "+token)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusConflict {
+		t.Fatalf("expected a conflict once verified, got %d", w.Code)
+	}
+}
+
+func TestPasswordReset(t *testing.T) {
+	t.Parallel()
+
+	r := getUsersContext()
+	oldPassword := "beepboopbop"
+	newPassword := "a much better password"
+	u := testRegister(t, r, user.UserRegister{
+		Username:        "ForgetfulRunner",
+		Email:           "forgetful@email.com",
+		Password:        oldPassword,
+		PasswordConfirm: oldPassword,
+	})
+	defer func() {
+		if err := cleanupUsers([]uint{u.ID}); err != nil {
+			t.Fatalf("failed cleanup: %s", err)
+		}
+	}()
+	oldToken := testLogin(t, r, user.UserLogin{
+		Email:    u.Email,
+		Password: oldPassword,
+	})
+
+	for _, email := range []string{"nobody@email.com", u.Email} {
+		_, err := testJsonPostRequest(r, "/password/forgot", user.PasswordForgot{Email: email}, http.StatusAccepted)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// One for verification, and one for the reset.
+	outbox.waitFor(t, u.Email, 2)
+	resetToken := outbox.lastToken(t, u.Email)
+
+	reset := user.PasswordResetRequest{
+		Token:           "not a token",
+		Password:        newPassword,
+		PasswordConfirm: newPassword,
+	}
+	if _, err := testJsonPostRequest(r, "/password/reset", reset, http.StatusBadRequest); err != nil {
+		t.Fatal(err)
+	}
+	reset.Token = resetToken
+	if _, err := testJsonPostRequest(r, "/password/reset", reset, http.StatusNoContent); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := testJsonPostRequest(r, "/password/reset", reset, http.StatusBadRequest); err != nil {
+		t.Fatalf("expected the token to only work once: %s", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/me", nil)
+	req.Header.Add("Authorization", "Bearer "+oldToken)
+	if _, err := testGetRequest(r, "/me", http.StatusUnauthorized, req); err != nil {
+		t.Fatalf("expected the old session to be revoked: %s", err)
+	}
+
+	_, err := testJsonPostRequest(r, "/login", user.UserLogin{Email: u.Email, Password: oldPassword}, http.StatusUnauthorized)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newToken := testLogin(t, r, user.UserLogin{
+		Email:    u.Email,
+		Password: newPassword,
+	})
+	testMe(t, r, *u, newToken)
+}
+
+func TestAccountSettings(t *testing.T) {
+	t.Parallel()
+
+	r := getUsersContext()
+	password := "beepboopbop"
+	u := testRegister(t, r, user.UserRegister{
+		Username:        "IndecisiveRunner",
+		Email:           "indecisive@email.com",
+		Password:        password,
+		PasswordConfirm: password,
+	})
+	other := testRegister(t, r, user.UserRegister{
+		Username:        "SettledRunner",
+		Email:           "settled@email.com",
+		Password:        password,
+		PasswordConfirm: password,
+	})
+	defer func() {
+		if err := cleanupUsers([]uint{u.ID, other.ID}); err != nil {
+			t.Fatalf("failed cleanup: %s", err)
+		}
+	}()
+	token := testLogin(t, r, user.UserLogin{
+		Email:    u.Email,
+		Password: password,
+	})
+
+	str := func(s string) *string { return &s }
+	testCases := []struct {
+		name     string
+		body     user.UserSettings
+		expected int
+	}{
+		{
+			name:     "Taken username",
+			body:     user.UserSettings{Username: str(other.Username)},
+			expected: http.StatusConflict,
+		},
+		{
+			name:     "Taken username in another case",
+			body:     user.UserSettings{Username: str("settledrunner")},
+			expected: http.StatusConflict,
+		},
+		{
+			name:     "Invalid username",
+			body:     user.UserSettings{Username: str("Indecisive Runner!")},
+			expected: http.StatusBadRequest,
+		},
+		{
+			name:     "Reserved username",
+			body:     user.UserSettings{Username: str("Support")},
+			expected: http.StatusBadRequest,
+		},
+		{
+			name:     "New username",
+			body:     user.UserSettings{Username: str("DecisiveRunner")},
+			expected: http.StatusOK,
+		},
+		{
+			name:     "Username changed too recently",
+			body:     user.UserSettings{Username: str("IndecisiveRunner")},
+			expected: http.StatusTooManyRequests,
+		},
+		{
+			name:     "Email without the current password",
+			body:     user.UserSettings{Email: str("decisive@email.com")},
+			expected: http.StatusForbidden,
+		},
+		{
+			name:     "Taken email",
+			body:     user.UserSettings{Email: str(other.Email), CurrentPassword: password},
+			expected: http.StatusConflict,
+		},
+		{
+			name:     "New email",
+			body:     user.UserSettings{Email: str("decisive@email.com"), CurrentPassword: password},
+			expected: http.StatusOK,
+		},
+	}
+	for _, testCase := range testCases {
+		_, err := testAuthRequest(r, http.MethodPatch, "/me", token, testCase.body, testCase.expected)
+		if err != nil {
+			t.Fatalf("%s: %s", testCase.name, err)
+		}
+	}
+
+	updated, err := user.Store.GetUserById(u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.Username != "DecisiveRunner" || updated.Email != "decisive@email.com" {
+		t.Fatalf("expected the account to be updated, got %s <%s>", updated.Username, updated.Email)
+	}
+	if updated.IsVerified() {
+		t.Fatal("expected the new email to need verifying")
+	}
+	outbox.waitFor(t, "decisive@email.com", 1)
+
+	newPassword := "an even better password"
+	change := user.PasswordChange{
+		CurrentPassword: "not my password",
+		Password:        newPassword,
+		PasswordConfirm: newPassword,
+	}
+	if _, err := testAuthRequest(r, http.MethodPost, "/me/password", token, change, http.StatusForbidden); err != nil {
+		t.Fatal(err)
+	}
+	change.CurrentPassword = password
+	if _, err := testAuthRequest(r, http.MethodPost, "/me/password", token, change, http.StatusNoContent); err != nil {
+		t.Fatal(err)
+	}
+	testLogin(t, r, user.UserLogin{
+		Email:    updated.Email,
+		Password: newPassword,
+	})
+}
+
+func TestSessions(t *testing.T) {
+	t.Parallel()
+
+	r := getUsersContext()
+	password := "beepboopbop"
+	u := testRegister(t, r, user.UserRegister{
+		Username:        "WellTravelledRunner",
+		Email:           "travelled@email.com",
+		Password:        password,
+		PasswordConfirm: password,
+	})
+	defer func() {
+		if err := cleanupUsers([]uint{u.ID}); err != nil {
+			t.Fatalf("failed cleanup: %s", err)
+		}
+	}()
+	login := user.UserLogin{
+		Email:    u.Email,
+		Password: password,
+	}
+	laptop := testLogin(t, r, login)
+	phone := testLogin(t, r, login)
+
+	responseBytes, err := testAuthRequest(r, http.MethodGet, "/me/sessions", laptop, nil, http.StatusOK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var response user.SessionsResponse
+	if _, err := request.UnmarshalSuccessResponseData(responseBytes, &response); err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Sessions) != 2 {
+		t.Fatalf("expected 2 sessions, got %d", len(response.Sessions))
+	}
+	var phoneSession string
+	for _, session := range response.Sessions {
+		if !session.Current {
+			phoneSession = session.PublicID
+		}
+	}
+	if !database.IsPublicID(phoneSession) {
+		t.Fatal("expected only one session to be current")
+	}
+
+	if _, err := testAuthRequest(r, http.MethodDelete, "/me/sessions/1", laptop, nil, http.StatusBadRequest); err != nil {
+		t.Fatal(err)
+	}
+	target := "/me/sessions/" + phoneSession
+	if _, err := testAuthRequest(r, http.MethodDelete, target, laptop, nil, http.StatusNoContent); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := testAuthRequest(r, http.MethodGet, "/me", phone, nil, http.StatusUnauthorized); err != nil {
+		t.Fatalf("expected the revoked session to be logged out: %s", err)
+	}
+	if _, err := testAuthRequest(r, http.MethodGet, "/me", laptop, nil, http.StatusOK); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := testAuthRequest(r, http.MethodPost, "/logout", laptop, nil, http.StatusOK); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := testAuthRequest(r, http.MethodGet, "/me", laptop, nil, http.StatusUnauthorized); err != nil {
+		t.Fatalf("expected logging out to end the session: %s", err)
+	}
+
+	laptop = testLogin(t, r, login)
+	phone = testLogin(t, r, login)
+	if _, err := testAuthRequest(r, http.MethodDelete, "/me/sessions", phone, nil, http.StatusNoContent); err != nil {
+		t.Fatal(err)
+	}
+	for _, token := range []string{laptop, phone} {
+		if _, err := testAuthRequest(r, http.MethodGet, "/me", token, nil, http.StatusUnauthorized); err != nil {
+			t.Fatalf("expected every session to be logged out: %s", err)
+		}
+	}
+
+	// Banning a user logs them out everywhere.
+	tokens := testLoginTokens(t, r, login)
+	if err := user.Store.BanUser(u.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := testAuthRequest(r, http.MethodGet, "/me", tokens.Token, nil, http.StatusUnauthorized); err != nil {
+		t.Fatalf("expected the banned user's session to end: %s", err)
+	}
+	if _, err := testJsonPostRequest(r, "/refresh_token", user.RefreshRequest{RefreshToken: tokens.RefreshToken}, http.StatusUnauthorized); err != nil {
+		t.Fatalf("expected the banned user's refresh token to stop working: %s", err)
+	}
+}
+
+func TestSigningKeyRotation(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	_, oldKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldKeyFile := writeTestKey(t, dir, "old.pem", oldKey)
+	oldPublicKeyFile := writeTestKey(t, dir, "old.pub.pem", oldKey.Public())
+	newKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newKeyFile := writeTestKey(t, dir, "new.pem", newKey)
+
+	auth := config.Default().Auth
+	auth.SigningKeyFile = oldKeyFile
+	before := getSigningKeyContext(t, auth)
+	auth.SigningKeyFile = newKeyFile
+	auth.VerificationKeyFiles = []string{oldPublicKeyFile}
+	during := getSigningKeyContext(t, auth)
+	auth.VerificationKeyFiles = nil
+	after := getSigningKeyContext(t, auth)
+
+	password := "beepboopbop"
+	u := testRegister(t, before, user.UserRegister{
+		Username:        "KeyRotator",
+		Email:           "rotator@email.com",
+		Password:        password,
+		PasswordConfirm: password,
+	})
+	defer func() {
+		if err := cleanupUsers([]uint{u.ID}); err != nil {
+			t.Fatalf("failed cleanup: %s", err)
+		}
+	}()
+	login := user.UserLogin{
+		Email:    u.Email,
+		Password: password,
+	}
+
+	oldToken := testLogin(t, before, login)
+	oldJWKS := testJWKS(t, before)
+	if len(oldJWKS.Keys) != 1 {
+		t.Fatalf("expected 1 published key, got %d", len(oldJWKS.Keys))
+	}
+	testTokenKey(t, oldToken, "EdDSA", oldJWKS.Keys[0].KeyID)
+
+	newToken := testLogin(t, during, login)
+	newJWKS := testJWKS(t, during)
+	if len(newJWKS.Keys) != 2 || newJWKS.Keys[1].KeyID != oldJWKS.Keys[0].KeyID {
+		t.Fatalf("expected the new key and the old key to be published, got %+v", newJWKS.Keys)
+	}
+	testTokenKey(t, newToken, "RS256", newJWKS.Keys[0].KeyID)
+	if _, err := testAuthRequest(during, http.MethodGet, "/me", oldToken, nil, http.StatusOK); err != nil {
+		t.Fatalf("expected tokens from the old key to be accepted while rotating: %s", err)
+	}
+
+	// Other services only need the published key to check a token.
+	published := newJWKS.Keys[0]
+	n, err := base64.RawURLEncoding.DecodeString(published.N)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := base64.RawURLEncoding.DecodeString(published.E)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey := &rsa.PublicKey{
+		N: new(big.Int).SetBytes(n),
+		E: int(new(big.Int).SetBytes(e).Int64()),
+	}
+	_, err = jwtgo.Parse(newToken, func(*jwtgo.Token) (interface{}, error) {
+		return publicKey, nil
+	})
+	if err != nil {
+		t.Fatalf("expected the token to check out against the published key: %s", err)
+	}
+
+	if _, err := testAuthRequest(after, http.MethodGet, "/me", oldToken, nil, http.StatusUnauthorized); err != nil {
+		t.Fatalf("expected tokens from a retired key to be rejected: %s", err)
+	}
+	if _, err := testAuthRequest(after, http.MethodGet, "/me", newToken, nil, http.StatusOK); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := testAuthRequest(after, http.MethodGet, "/me", testLogin(t, getUsersContext(), login), nil, http.StatusUnauthorized); err != nil {
+		t.Fatalf("expected tokens signed with a secret the server doesn't have to be rejected: %s", err)
+	}
+}
+
+func getSigningKeyContext(t *testing.T, auth config.AuthConfig) *gin.Engine {
+	t.Helper()
+
+	authMiddleware, err := user.NewAuthMiddleware(auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return getUsersContextWith(authMiddleware)
+}
+
+func writeTestKey(t *testing.T, dir string, name string, key interface{}) string {
+	t.Helper()
+
+	var block pem.Block
+	var err error
+	if _, ok := key.(crypto.Signer); ok {
+		block.Type = "PRIVATE KEY"
+		block.Bytes, err = x509.MarshalPKCS8PrivateKey(key)
+	} else {
+		block.Type = "PUBLIC KEY"
+		block.Bytes, err = x509.MarshalPKIXPublicKey(key)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(&block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func testJWKS(t *testing.T, r *gin.Engine) user.JWKS {
+	t.Helper()
+
+	responseBytes, err := testGetRequest(r, "/.well-known/jwks.json", http.StatusOK, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var jwks user.JWKS
+	if err := json.Unmarshal(responseBytes, &jwks); err != nil {
+		t.Fatal(err)
+	}
+	return jwks
+}
+
+// testTokenKey checks the algorithm and key ID in the header of token.
+func testTokenKey(t *testing.T, token string, alg string, kid string) {
+	t.Helper()
+
+	segment, err := jwtgo.DecodeSegment(strings.Split(token, ".")[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var header map[string]string
+	if err := json.Unmarshal(segment, &header); err != nil {
+		t.Fatal(err)
+	}
+	if header["alg"] != alg || header["kid"] != kid {
+		t.Fatalf("expected a %s token from key %s, got %v", alg, kid, header)
+	}
+}
+
+func TestOAuthLogin(t *testing.T) {
+	t.Parallel()
+
+	r := getUsersContext()
+	discordUser := map[string]interface{}{
+		"id":       "80351110224678912",
+		"username": "discordrunner",
+		"email":    "discordrunner@email.com",
+		"verified": true,
+	}
+	start := func(token string) string {
+		t.Helper()
+		var responseBytes []byte
+		var err error
+		if token == "" {
+			responseBytes, err = testJsonPostRequest(r, "/oauth/discord/login", nil, http.StatusOK)
+		} else {
+			responseBytes, err = testAuthRequest(r, http.MethodPost, "/me/identities/discord", token, nil, http.StatusOK)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		var response user.OAuthRedirectResponse
+		if _, err := request.UnmarshalSuccessResponseData(responseBytes, &response); err != nil {
+			t.Fatal(err)
+		}
+		return response.URL
+	}
+	login := func(profile map[string]interface{}, expected int) *user.TokenResponse {
+		t.Helper()
+		code, state := provider.authorize(t, start(""), profile)
+		responseBytes, err := testJsonPostRequest(r, "/oauth/discord/callback", user.OAuthCallback{
+			Code:  code,
+			State: state,
+		}, expected)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var response user.TokenResponse
+		if expected == http.StatusOK {
+			if _, err := request.UnmarshalSuccessResponseData(responseBytes, &response); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return &response
+	}
+	me := func(token string) *user.UserPersonal {
+		t.Helper()
+		responseBytes, err := testAuthRequest(r, http.MethodGet, "/me", token, nil, http.StatusOK)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var response user.UserPersonalResponse
+		if _, err := request.UnmarshalSuccessResponseData(responseBytes, &response); err != nil {
+			t.Fatal(err)
+		}
+		identifier, err := user.Store.GetUserIdentifierByPublicId(response.User.PublicID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.User.ID = identifier.ID
+		return response.User
+	}
+
+	// Logging in for the first time signs up, using the provider's
+	// verified email address.
+	tokens := login(discordUser, http.StatusOK)
+	signedUp := me(tokens.Token)
+	defer func() {
+		if err := cleanupUsers([]uint{signedUp.ID}); err != nil {
+			t.Fatalf("failed cleanup: %s", err)
+		}
+	}()
+	if signedUp.Username != "discordrunner" || signedUp.Email != "discordrunner@email.com" || signedUp.EmailVerifiedAt == nil {
+		t.Fatalf("expected an account from the Discord profile, got %+v", signedUp)
+	}
+	if tokens.RefreshToken == "" {
+		t.Fatal("expected a refresh token")
+	}
+	if again := me(login(discordUser, http.StatusOK).Token); again.ID != signedUp.ID {
+		t.Fatalf("expected to log in to user %d again, got %d", signedUp.ID, again.ID)
+	}
+
+	// States are single use, and only work for the flow that made them.
+	code, state := provider.authorize(t, start(""), discordUser)
+	callback := user.OAuthCallback{Code: code, State: state}
+	if _, err := testJsonPostRequest(r, "/oauth/discord/callback", callback, http.StatusOK); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := testJsonPostRequest(r, "/oauth/discord/callback", callback, http.StatusBadRequest); err != nil {
+		t.Fatalf("expected a used state to be rejected: %s", err)
+	}
+	code, state = provider.authorize(t, start(tokens.Token), discordUser)
+	callback = user.OAuthCallback{Code: code, State: state}
+	if _, err := testJsonPostRequest(r, "/oauth/discord/callback", callback, http.StatusBadRequest); err != nil {
+		t.Fatalf("expected a linking state to be rejected when logging in: %s", err)
+	}
+	if _, err := testJsonPostRequest(r, "/oauth/twitch/login", nil, http.StatusNotFound); err != nil {
+		t.Fatalf("expected a provider that isn't set up to be rejected: %s", err)
+	}
+
+	// An existing account is only linked by someone logged in to it.
+	password := "beepboopbop"
+	u := testRegister(t, r, user.UserRegister{
+		Username:        "LinkingRunner",
+		Email:           "linking@email.com",
+		Password:        password,
+		PasswordConfirm: password,
+	})
+	defer func() {
+		if err := cleanupUsers([]uint{u.ID}); err != nil {
+			t.Fatalf("failed cleanup: %s", err)
+		}
+	}()
+	linkedUser := map[string]interface{}{
+		"id":       "80351110224678913",
+		"username": "linkingrunner",
+		"email":    u.Email,
+		"verified": true,
+	}
+	login(linkedUser, http.StatusConflict)
+
+	token := testLogin(t, r, user.UserLogin{
+		Email:    u.Email,
+		Password: password,
+	})
+	code, state = provider.authorize(t, start(token), linkedUser)
+	responseBytes, err := testAuthRequest(r, http.MethodPost, "/me/identities/discord/callback", token, user.OAuthCallback{
+		Code:  code,
+		State: state,
+	}, http.StatusOK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var identities user.ExternalIdentitiesResponse
+	if _, err := request.UnmarshalSuccessResponseData(responseBytes, &identities); err != nil {
+		t.Fatal(err)
+	}
+	if len(identities.Identities) != 1 || identities.Identities[0].Username != "linkingrunner" {
+		t.Fatalf("expected the Discord account to be linked, got %+v", identities.Identities)
+	}
+	if linked := me(login(linkedUser, http.StatusOK).Token); linked.ID != u.ID {
+		t.Fatalf("expected to log in to user %d, got %d", u.ID, linked.ID)
+	}
+
+	code, state = provider.authorize(t, start(token), discordUser)
+	_, err = testAuthRequest(r, http.MethodPost, "/me/identities/discord/callback", token, user.OAuthCallback{
+		Code:  code,
+		State: state,
+	}, http.StatusConflict)
+	if err != nil {
+		t.Fatalf("expected linking another user's account to be rejected: %s", err)
+	}
+
+	// Users without a password have to keep a way to log in.
+	if _, err := testAuthRequest(r, http.MethodDelete, "/me/identities/discord", tokens.Token, nil, http.StatusConflict); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := testAuthRequest(r, http.MethodDelete, "/me/identities/discord", token, nil, http.StatusNoContent); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := testAuthRequest(r, http.MethodDelete, "/me/identities/discord", token, nil, http.StatusNotFound); err != nil {
+		t.Fatal(err)
+	}
+
+	// Soon after logging in, they can change their email and set a
+	// password, which then lets them unlink the provider.
+	email := "discordrunner@example.com"
+	settings := user.UserSettings{Email: &email}
+	if _, err := testAuthRequest(r, http.MethodPatch, "/me", tokens.Token, settings, http.StatusOK); err != nil {
+		t.Fatal(err)
+	}
+	change := user.PasswordChange{
+		Password:        password,
+		PasswordConfirm: password,
+	}
+	if _, err := testAuthRequest(r, http.MethodPost, "/me/password", tokens.Token, change, http.StatusNoContent); err != nil {
+		t.Fatal(err)
+	}
+	testLogin(t, r, user.UserLogin{
+		Email:    email,
+		Password: password,
+	})
+	if _, err := testAuthRequest(r, http.MethodDelete, "/me/identities/discord", tokens.Token, nil, http.StatusNoContent); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPasswordRehash(t *testing.T) {
+	t.Parallel()
+
+	r := getUsersContext()
+	password := "beepboopbop"
+	legacy := config.Default().Auth.Password
+	legacy.Algorithm = config.PasswordBcrypt
+	legacy.BcryptCost = config.MinBcryptCost
+	hash, err := user.NewPasswordHasher(legacy).Hash([]byte(password))
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := &user.User{
+		Username: "RehashRunner",
+		Email:    "rehash@email.com",
+		Password: hash,
+	}
+	if err := user.Store.CreateUser(u); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := cleanupUsers([]uint{u.ID}); err != nil {
+			t.Fatalf("failed cleanup: %s", err)
+		}
+	}()
+	if !user.NeedsRehash(hash) {
+		t.Fatal("expected a bcrypt hash to need rehashing")
+	}
+
+	// Logging in upgrades the hash to the configured algorithm, and the
+	// password keeps working.
+	loginBody := user.UserLogin{
+		Email:    u.Email,
+		Password: password,
+	}
+	testLogin(t, r, loginBody)
+	upgraded, err := user.Store.GetUserById(u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(upgraded.Password), "$argon2id$") || user.NeedsRehash(upgraded.Password) {
+		t.Fatalf("expected an up to date argon2id hash, got %s", upgraded.Password)
+	}
+	testLogin(t, r, loginBody)
+	if _, err := testJsonPostRequest(r, "/login", user.UserLogin{
+		Email:    u.Email,
+		Password: "wrongpassword",
+	}, http.StatusUnauthorized); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoginThrottle(t *testing.T) {
+	t.Parallel()
+
+	r := getUsersContext()
+	password := "beepboopbop"
+	u := testRegister(t, r, user.UserRegister{
+		Username:        "ThrottledRunner",
+		Email:           "throttled@email.com",
+		Password:        password,
+		PasswordConfirm: password,
+	})
+	defer func() {
+		if err := cleanupUsers([]uint{u.ID}); err != nil {
+			t.Fatalf("failed cleanup: %s", err)
+		}
+	}()
+	wrong := user.UserLogin{
+		Email:    u.Email,
+		Password: "wrongpassword",
+	}
+	right := user.UserLogin{
+		Email:    u.Email,
+		Password: password,
+	}
+
+	// Logging in forgets earlier failures.
+	for i := 0; i < 4; i++ {
+		if _, err := testJsonPostRequest(r, "/login", wrong, http.StatusUnauthorized); err != nil {
+			t.Fatal(err)
+		}
+	}
+	testLogin(t, r, right)
+
+	// After 5 failures, even the right password is turned away.
+	for i := 0; i < 5; i++ {
+		if _, err := testJsonPostRequest(r, "/login", wrong, http.StatusUnauthorized); err != nil {
+			t.Fatal(err)
+		}
+	}
+	body, err := json.Marshal(right)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/login", bytes.NewBuffer(body))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected status code %d, got %d", http.StatusTooManyRequests, w.Code)
+	}
+	if retryAfter := w.Header().Get("Retry-After"); retryAfter != "60" && retryAfter != "59" {
+		t.Fatalf("expected to retry after a minute, got %q", retryAfter)
+	}
+
+	// The owner is told, after their verification email.
+	outbox.waitFor(t, u.Email, 2)
+	outbox.Lock()
+	notice := outbox.messages[u.Email][1]
+	outbox.Unlock()
+	if notice.Subject != "Logging in to your account was paused" {
+		t.Fatalf("expected a lockout notice, got %q", notice.Subject)
+	}
+
+	// The store counts failures for servers that share them.
+	key := fmt.Sprintf("test:%d", u.ID)
+	now := time.Now()
+	since := now.Add(-time.Hour)
+	for i := 1; i <= 2; i++ {
+		failures, err := user.Store.AddLoginFailure(key, now, since)
+		if err != nil || failures != i {
+			t.Fatalf("expected %d failures, got %d (%v)", i, failures, err)
+		}
+	}
+	if failures, last, err := user.Store.GetLoginFailures(key, since); err != nil || failures != 2 || last.IsZero() {
+		t.Fatalf("expected 2 failures at %s, got %d at %s (%v)", now, failures, last, err)
+	}
+	if failures, err := user.Store.AddLoginFailure(key, now.Add(2*time.Hour), now.Add(time.Hour)); err != nil || failures != 1 {
+		t.Fatalf("expected old failures to be forgotten, got %d (%v)", failures, err)
+	}
+	if err := user.Store.ResetLoginFailures(key); err != nil {
+		t.Fatal(err)
+	}
+	if failures, _, err := user.Store.GetLoginFailures(key, since); err != nil || failures != 0 {
+		t.Fatalf("expected no failures after a reset, got %d (%v)", failures, err)
+	}
+}
+
+func TestTwoFactor(t *testing.T) {
+	t.Parallel()
+
+	r := getUsersContext()
+	password := "beepboopbop"
+	u := testRegister(t, r, user.UserRegister{
+		Username:        "TwoFactorRunner",
+		Email:           "twofactor@email.com",
+		Password:        password,
+		PasswordConfirm: password,
+	})
+	defer func() {
+		if err := cleanupUsers([]uint{u.ID}); err != nil {
+			t.Fatalf("failed cleanup: %s", err)
+		}
+	}()
+	loginBody := user.UserLogin{
+		Email:    u.Email,
+		Password: password,
+	}
+	token := testLogin(t, r, loginBody)
+	status := func() user.TwoFactorStatus {
+		t.Helper()
+		responseBytes, err := testAuthRequest(r, http.MethodGet, "/me/2fa", token, nil, http.StatusOK)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var response user.TwoFactorStatus
+		if _, err := request.UnmarshalSuccessResponseData(responseBytes, &response); err != nil {
+			t.Fatal(err)
+		}
+		return response
+	}
+	if status().Enabled {
+		t.Fatal("expected two-factor authentication to start off")
+	}
+
+	// Turning it on takes a code from the new secret.
+	responseBytes, err := testAuthRequest(r, http.MethodPost, "/me/2fa/totp", token, nil, http.StatusOK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var enrollment user.TOTPEnrollment
+	if _, err := request.UnmarshalSuccessResponseData(responseBytes, &enrollment); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(enrollment.URI, "otpauth://totp/") || !strings.Contains(enrollment.URI, "secret="+enrollment.Secret) {
+		t.Fatalf("expected an otpauth URI with the secret, got %s", enrollment.URI)
+	}
+	now := time.Now()
+	wrong := user.TwoFactorCode{Code: testTOTPCode(t, enrollment.Secret, now.Add(time.Hour))}
+	if _, err := testAuthRequest(r, http.MethodPost, "/me/2fa/totp/confirm", token, wrong, http.StatusForbidden); err != nil {
+		t.Fatalf("expected a wrong code to be rejected: %s", err)
+	}
+	confirm := user.TwoFactorCode{Code: testTOTPCode(t, enrollment.Secret, now)}
+	responseBytes, err = testAuthRequest(r, http.MethodPost, "/me/2fa/totp/confirm", token, confirm, http.StatusOK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var recovery user.RecoveryCodesResponse
+	if _, err := request.UnmarshalSuccessResponseData(responseBytes, &recovery); err != nil {
+		t.Fatal(err)
+	}
+	if len(recovery.RecoveryCodes) != 10 {
+		t.Fatalf("expected 10 recovery codes, got %d", len(recovery.RecoveryCodes))
+	}
+	if s := status(); !s.Enabled || s.RecoveryCodesLeft != 10 {
+		t.Fatalf("expected two-factor authentication on with 10 recovery codes, got %+v", s)
+	}
+	if _, err := testAuthRequest(r, http.MethodPost, "/me/2fa/totp", token, nil, http.StatusConflict); err != nil {
+		t.Fatalf("expected enrolling again to be refused: %s", err)
+	}
+
+	// Logging in now only gives a challenge, which takes a code.
+	challenge := func() string {
+		t.Helper()
+		responseBytes, err := testJsonPostRequest(r, "/login", loginBody, http.StatusOK)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var response user.LoginChallengeResponse
+		if _, err := request.UnmarshalSuccessResponseData(responseBytes, &response); err != nil {
+			t.Fatal(err)
+		}
+		if !response.TwoFactorRequired || response.ChallengeToken == "" {
+			t.Fatalf("expected a login challenge, got %+v", response)
+		}
+		return response.ChallengeToken
+	}
+	finish := func(challengeToken string, code string, expected int) {
+		t.Helper()
+		_, err := testJsonPostRequest(r, "/login/2fa", user.TwoFactorLogin{
+			ChallengeToken: challengeToken,
+			Code:           code,
+		}, expected)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Codes can't be used twice.
+	challengeToken := challenge()
+	finish(challengeToken, confirm.Code, http.StatusUnauthorized)
+	finish(challengeToken, testTOTPCode(t, enrollment.Secret, now.Add(30*time.Second)), http.StatusOK)
+	finish(challengeToken, recovery.RecoveryCodes[0], http.StatusUnauthorized)
+
+	challengeToken = challenge()
+	finish(challengeToken, strings.ToUpper(recovery.RecoveryCodes[0]), http.StatusOK)
+	challengeToken = challenge()
+	finish(challengeToken, recovery.RecoveryCodes[0], http.StatusUnauthorized)
+	if left := status().RecoveryCodesLeft; left != 9 {
+		t.Fatalf("expected 9 recovery codes left, got %d", left)
+	}
+	twoFactorSessions := func() int {
+		t.Helper()
+		sessions, err := user.Store.GetActiveSessions(u.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		count := 0
+		for _, session := range sessions {
+			if session.TwoFactor {
+				count++
+			}
+		}
+		return count
+	}
+	if count := twoFactorSessions(); count != 2 {
+		t.Fatalf("expected the 2 logins with a code to be marked, got %d", count)
+	}
+
+	pending := challenge()
+
+	// Wrong codes count as failed logins, even across challenges, so the
+	// account is soon locked out. With the reused recovery code, that's
+	// five.
+	for i := 0; i < 2; i++ {
+		challengeToken = challenge()
+		finish(challengeToken, "000000", http.StatusUnauthorized)
+		finish(challengeToken, "000000", http.StatusUnauthorized)
+	}
+	finish(challengeToken, recovery.RecoveryCodes[1], http.StatusTooManyRequests)
+	if _, err := testJsonPostRequest(r, "/login", loginBody, http.StatusTooManyRequests); err != nil {
+		t.Fatal(err)
+	}
+
+	// Turning it off takes the password and a code.
+	if _, err := testAuthRequest(r, http.MethodDelete, "/me/2fa", token, user.TwoFactorDisable{
+		CurrentPassword: "wrongpassword",
+		Code:            recovery.RecoveryCodes[1],
+	}, http.StatusForbidden); err != nil {
+		t.Fatalf("expected a wrong password to be refused: %s", err)
+	}
+	if _, err := testAuthRequest(r, http.MethodDelete, "/me/2fa", token, user.TwoFactorDisable{
+		CurrentPassword: password,
+		Code:            recovery.RecoveryCodes[1],
+	}, http.StatusNoContent); err != nil {
+		t.Fatal(err)
+	}
+	if status().Enabled {
+		t.Fatal("expected two-factor authentication to be off")
+	}
+
+	// Logins that were waiting for a code can't be finished any more.
+	finish(pending, recovery.RecoveryCodes[2], http.StatusUnauthorized)
+	if count := twoFactorSessions(); count != 0 {
+		t.Fatalf("expected no sessions to count as logged in with a code, got %d", count)
+	}
+}
+
+// testTOTPCode works out the code an authenticator app would show for
+// secret at now (RFC 6238).
+func testTOTPCode(t *testing.T, secret string, now time.Time) string {
+	t.Helper()
+
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	if err != nil {
+		t.Fatalf("bad TOTP secret %q: %s", secret, err)
+	}
+	counter := make([]byte, 8)
+	binary.BigEndian.PutUint64(counter, uint64(now.Unix()/30))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	return fmt.Sprintf("%06d", value%1000000)
+}
+
+func TestPersonalAccessTokens(t *testing.T) {
+	t.Parallel()
+
+	r := getUsersContext()
+	password := "beepboopbop"
+	u := testRegister(t, r, user.UserRegister{
+		Username:        "ScriptedRunner",
+		Email:           "scripted@email.com",
+		Password:        password,
+		PasswordConfirm: password,
+	})
+	defer func() {
+		if err := cleanupUsers([]uint{u.ID}); err != nil {
+			t.Fatalf("failed cleanup: %s", err)
+		}
+	}()
+	accessToken := testLogin(t, r, user.UserLogin{
+		Email:    u.Email,
+		Password: password,
+	})
+
+	past := time.Now().Add(-time.Hour)
+	for _, body := range []user.PersonalTokenCreate{
+		{Name: "bot", Scopes: []user.Scope{"runs:delete"}},
+		{Name: "bot", Scopes: []user.Scope{}},
+		{Name: "bot", Scopes: []user.Scope{user.ScopeProfileRead}, ExpiresAt: &past},
+	} {
+		if _, err := testAuthRequest(r, http.MethodPost, "/me/tokens", accessToken, body, http.StatusBadRequest); err != nil {
+			t.Fatalf("expected %v to be refused: %s", body, err)
+		}
+	}
+
+	responseBytes, err := testAuthRequest(r, http.MethodPost, "/me/tokens", accessToken, user.PersonalTokenCreate{
+		Name:   "bot",
+		Scopes: []user.Scope{user.ScopeProfileRead, user.ScopeProfileRead},
+	}, http.StatusCreated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var created user.CreatedPersonalTokenResponse
+	if _, err := request.UnmarshalSuccessResponseData(responseBytes, &created); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(created.Token, created.Info.Prefix) {
+		t.Fatalf("expected the token to start with %q", created.Info.Prefix)
+	}
+	if len(created.Info.Scopes) != 1 {
+		t.Fatalf("expected duplicate scopes to be dropped, got %v", created.Info.Scopes)
+	}
+
+	if _, err := testAuthRequest(r, http.MethodGet, "/me", created.Token, nil, http.StatusOK); err != nil {
+		t.Fatal(err)
+	}
+	for _, target := range []string{"/me/sessions", "/me/tokens"} {
+		if _, err := testAuthRequest(r, http.MethodGet, target, created.Token, nil, http.StatusForbidden); err != nil {
+			t.Fatalf("expected the token to be refused by %s: %s", target, err)
+		}
+	}
+	if _, err := testAuthRequest(r, http.MethodGet, "/me", created.Token+"x", nil, http.StatusUnauthorized); err != nil {
+		t.Fatal(err)
+	}
+
+	responseBytes, err = testAuthRequest(r, http.MethodGet, "/me/tokens", accessToken, nil, http.StatusOK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tokens user.PersonalTokensResponse
+	if _, err := request.UnmarshalSuccessResponseData(responseBytes, &tokens); err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens.Tokens) != 1 || tokens.Tokens[0].LastUsedAt == nil {
+		t.Fatalf("expected one used token, got %+v", tokens.Tokens)
+	}
+
+	target := "/me/tokens/" + created.Info.PublicID
+	if _, err := testAuthRequest(r, http.MethodDelete, target, accessToken, nil, http.StatusNoContent); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := testAuthRequest(r, http.MethodDelete, target, accessToken, nil, http.StatusNotFound); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := testAuthRequest(r, http.MethodGet, "/me", created.Token, nil, http.StatusUnauthorized); err != nil {
+		t.Fatalf("expected the deleted token to stop working: %s", err)
+	}
+}
+
+func TestOAuthApps(t *testing.T) {
+	t.Parallel()
+
+	r := getUsersContext()
+	password := "beepboopbop"
+	u := testRegister(t, r, user.UserRegister{
+		Username:        "OverlayDeveloper",
+		Email:           "overlay@email.com",
+		Password:        password,
+		PasswordConfirm: password,
+	})
+	defer func() {
+		if err := cleanupUsers([]uint{u.ID}); err != nil {
+			t.Fatalf("failed cleanup: %s", err)
+		}
+	}()
+	if _, err := testJsonPostRequest(r, "/verify-email", user.VerifyEmail{Token: outbox.lastToken(t, u.Email)}, http.StatusOK); err != nil {
+		t.Fatal(err)
+	}
+	accessToken := testLogin(t, r, user.UserLogin{
+		Email:    u.Email,
+		Password: password,
+	})
+
+	redirectURI := "http://127.0.0.1:8123/callback"
+	if _, err := testAuthRequest(r, http.MethodPost, "/me/apps", accessToken, user.OAuthAppCreate{
+		Name:         "Overlay",
+		RedirectURIs: []string{"http://overlay.example.com/callback"},
+	}, http.StatusBadRequest); err != nil {
+		t.Fatalf("expected a plain http redirect URI to be refused: %s", err)
+	}
+	responseBytes, err := testAuthRequest(r, http.MethodPost, "/me/apps", accessToken, user.OAuthAppCreate{
+		Name:         "Overlay",
+		RedirectURIs: []string{redirectURI},
+	}, http.StatusCreated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var created user.CreatedOAuthAppResponse
+	if _, err := request.UnmarshalSuccessResponseData(responseBytes, &created); err != nil {
+		t.Fatal(err)
+	}
+	if created.ClientSecret != "" {
+		t.Fatal("expected a public app to have no secret")
+	}
+	clientId := created.App.ClientID
+
+	verifier := "a-code-verifier-that-is-long-enough-for-pkce-to-accept"
+	hash := sha256.Sum256([]byte(verifier))
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {clientId},
+		"scope":                 {"profile:read"},
+		"state":                 {"xyz"},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(hash[:])},
+		"code_challenge_method": {"S256"},
+	}
+	responseBytes, err = testAuthRequest(r, http.MethodGet, "/oauth/authorize?"+query.Encode(), accessToken, nil, http.StatusOK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var consent user.AuthorizationConsent
+	if _, err := request.UnmarshalSuccessResponseData(responseBytes, &consent); err != nil {
+		t.Fatal(err)
+	}
+	if consent.App.Owner != u.Username || consent.RedirectURI != redirectURI || len(consent.Scopes) != 1 {
+		t.Fatalf("unexpected consent screen %+v", consent)
+	}
+
+	authorize := func(approve bool) url.Values {
+		decision := user.AuthorizationDecision{
+			AuthorizationRequest: user.AuthorizationRequest{
+				ResponseType:        query.Get("response_type"),
+				ClientID:            clientId,
+				Scope:               query.Get("scope"),
+				State:               query.Get("state"),
+				CodeChallenge:       query.Get("code_challenge"),
+				CodeChallengeMethod: query.Get("code_challenge_method"),
+			},
+			Approve: approve,
+		}
+		responseBytes, err := testAuthRequest(r, http.MethodPost, "/oauth/authorize", accessToken, decision, http.StatusOK)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var redirect user.AuthorizationRedirect
+		if _, err := request.UnmarshalSuccessResponseData(responseBytes, &redirect); err != nil {
+			t.Fatal(err)
+		}
+		to, err := url.Parse(redirect.RedirectTo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if to.Query().Get("state") != "xyz" {
+			t.Fatalf("expected the state to be passed back, got %s", redirect.RedirectTo)
+		}
+		return to.Query()
+	}
+	if denied := authorize(false); denied.Get("error") != "access_denied" {
+		t.Fatalf("expected access to be denied, got %v", denied)
+	}
+
+	code := authorize(true).Get("code")
+	exchange := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"client_id":     {clientId},
+		"code_verifier": {verifier + "x"},
+	}
+	if _, err := testFormPost(r, "/oauth/token", exchange, http.StatusBadRequest); err != nil {
+		t.Fatalf("expected a wrong code verifier to be refused: %s", err)
+	}
+	code = authorize(true).Get("code")
+	exchange.Set("code", code)
+	exchange.Set("code_verifier", verifier)
+	responseBytes, err = testFormPost(r, "/oauth/token", exchange, http.StatusOK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tokens user.OAuthTokenResponse
+	if err := json.Unmarshal(responseBytes, &tokens); err != nil {
+		t.Fatal(err)
+	}
+	if tokens.Scope != "profile:read" {
+		t.Fatalf("expected the granted scope, got %q", tokens.Scope)
+	}
+	if _, err := testFormPost(r, "/oauth/token", exchange, http.StatusBadRequest); err != nil {
+		t.Fatalf("expected the code to only work once: %s", err)
+	}
+
+	if _, err := testAuthRequest(r, http.MethodGet, "/me", tokens.AccessToken, nil, http.StatusOK); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := testAuthRequest(r, http.MethodGet, "/me/sessions", tokens.AccessToken, nil, http.StatusForbidden); err != nil {
+		t.Fatalf("expected the app to be kept to its scopes: %s", err)
+	}
+
+	responseBytes, err = testFormPost(r, "/oauth/token", url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {tokens.RefreshToken},
+		"client_id":     {clientId},
+	}, http.StatusOK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(responseBytes, &tokens); err != nil {
+		t.Fatal(err)
+	}
 
-	if err := user.InitGormStore(nil); err != nil {
-		log.Fatalf("Gorm store failed to initialise.")
+	responseBytes, err = testAuthRequest(r, http.MethodGet, "/me/sessions", accessToken, nil, http.StatusOK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sessions user.SessionsResponse
+	if _, err := request.UnmarshalSuccessResponseData(responseBytes, &sessions); err != nil {
+		t.Fatal(err)
+	}
+	appSessions := 0
+	for _, session := range sessions.Sessions {
+		if session.AppPublicID == created.App.PublicID {
+			appSessions++
+		}
+	}
+	if appSessions != 1 {
+		t.Fatalf("expected one session started by the app, got %+v", sessions.Sessions)
+	}
+
+	introspect := func() user.IntrospectionResponse {
+		responseBytes, err := testFormPost(r, "/oauth/introspect", url.Values{
+			"token":     {tokens.AccessToken},
+			"client_id": {clientId},
+		}, http.StatusOK)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var introspection user.IntrospectionResponse
+		if err := json.Unmarshal(responseBytes, &introspection); err != nil {
+			t.Fatal(err)
+		}
+		return introspection
+	}
+	if introspection := introspect(); !introspection.Active || introspection.Username != u.Username {
+		t.Fatalf("expected the token to be active, got %+v", introspection)
+	}
+
+	if _, err := testFormPost(r, "/oauth/revoke", url.Values{
+		"token":     {tokens.RefreshToken},
+		"client_id": {clientId},
+	}, http.StatusOK); err != nil {
+		t.Fatal(err)
+	}
+	if introspect().Active {
+		t.Fatal("expected revoking the refresh token to end the session")
+	}
+	if _, err := testAuthRequest(r, http.MethodGet, "/me", tokens.AccessToken, nil, http.StatusUnauthorized); err != nil {
+		t.Fatal(err)
+	}
+
+	target := "/me/apps/" + created.App.PublicID
+	if _, err := testAuthRequest(r, http.MethodDelete, target, accessToken, nil, http.StatusNoContent); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := testAuthRequest(r, http.MethodDelete, target, accessToken, nil, http.StatusNotFound); err != nil {
+		t.Fatal(err)
 	}
 }
 
-func TestAuthFlow(t *testing.T) {
+func TestProfile(t *testing.T) {
 	t.Parallel()
 
 	r := getUsersContext()
-
-	cleanup := []uint{}
-	t.Run("Full auth flow", func(t *testing.T) {
-		password := "str0ng3stp4ssw0rd"
-		userReg := user.UserRegister{
-			Username:        "AGoodUser",
-			Email:           "cool@email.com",
-			Password:        password,
-			PasswordConfirm: password,
+	password := "beepboopbop"
+	u := testRegister(t, r, user.UserRegister{
+		Username:        "ProfiledRunner",
+		Email:           "profiled@email.com",
+		Password:        password,
+		PasswordConfirm: password,
+	})
+	defer func() {
+		if err := cleanupUsers([]uint{u.ID}); err != nil {
+			t.Fatalf("failed cleanup: %s", err)
 		}
-		u := testRegister(t, r, userReg)
-		cleanup = append(cleanup, u.ID)
+	}()
+	token := testLogin(t, r, user.UserLogin{
+		Email:    u.Email,
+		Password: password,
+	})
 
-		userLogin := user.UserLogin{
-			Email:    u.Email,
-			Password: password,
+	country := "XX"
+	timezone := "Nowhere/Special"
+	for _, update := range []user.ProfileUpdate{
+		{Country: &country},
+		{Timezone: &timezone},
+		{Links: &user.ProfileLinks{Twitch: "https://twitch.tv.example.com/runner"}},
+		{Links: &user.ProfileLinks{Twitter: "https://twitter.com/runner?ref=1"}},
+	} {
+		if _, err := testAuthRequest(r, http.MethodPatch, "/me/profile", token, update, http.StatusBadRequest); err != nil {
+			t.Fatalf("expected %+v to be refused: %s", update, err)
 		}
-		token := testLogin(t, r, userLogin)
-
-		testMe(t, r, *u, token)
-
-		testRefreshToken(t, r, token)
-	})
-	if err := cleanupUsers(cleanup); err != nil {
-		t.Fatalf("cleanup failed: %s", err)
 	}
-}
-
-func testRegister(
-	t *testing.T,
-	r *gin.Engine,
-	registerBody user.UserRegister,
-) *user.UserPersonal {
-	t.Helper()
 
-	responseBytes, err := testJsonPostRequest(r, "/register", registerBody, http.StatusCreated)
-	if err != nil {
-		// FIXME
-		t.Fatalf("it failed: %s", err)
+	displayName := " Profiled Runner "
+	country = "nz"
+	timezone = "Pacific/Auckland"
+	if _, err := testAuthRequest(r, http.MethodPatch, "/me/profile", token, user.ProfileUpdate{
+		DisplayName: &displayName,
+		Country:     &country,
+		Timezone:    &timezone,
+		Links: &user.ProfileLinks{
+			Twitch:  "twitch.tv/ProfiledRunner",
+			YouTube: "https://youtube.com/@ProfiledRunner",
+		},
+	}, http.StatusBadRequest); err != nil {
+		t.Fatalf("expected a link without a scheme to be refused: %s", err)
 	}
-	var responseData user.UserIdentifierResponse
-	_, err = request.UnmarshalSuccessResponseData(responseBytes, &responseData)
+	responseBytes, err := testAuthRequest(r, http.MethodPatch, "/me/profile", token, user.ProfileUpdate{
+		DisplayName: &displayName,
+		Country:     &country,
+		Timezone:    &timezone,
+		Links: &user.ProfileLinks{
+			Twitch:  "https://twitch.tv/ProfiledRunner/",
+			YouTube: "https://youtube.com/@ProfiledRunner",
+		},
+	}, http.StatusOK)
 	if err != nil {
-		// FIXME
-		t.Fatal("bad response format")
+		t.Fatal(err)
 	}
-	user, err := user.Store.GetUserPersonalById(responseData.User.ID)
-	if err != nil {
-		t.Fatalf("failed to register user: %s", err)
+	var response user.ProfileResponse
+	if _, err := request.UnmarshalSuccessResponseData(responseBytes, &response); err != nil {
+		t.Fatal(err)
+	}
+	expected := user.ProfileInfo{
+		DisplayName: "Profiled Runner",
+		Country:     "NZ",
+		Timezone:    "Pacific/Auckland",
+		Links: user.ProfileLinks{
+			Twitch:  "https://www.twitch.tv/ProfiledRunner",
+			YouTube: "https://www.youtube.com/@ProfiledRunner",
+		},
+	}
+	if *response.Profile != expected {
+		t.Fatalf("expected %+v, got %+v", expected, *response.Profile)
 	}
 
-	return user
-}
-
-func testLogin(
-	t *testing.T,
-	r *gin.Engine,
-	loginBody user.UserLogin,
-) string {
-	t.Helper()
+	// Fields that aren't given are kept.
+	bio := "Any% runner."
+	if _, err := testAuthRequest(r, http.MethodPatch, "/me/profile", token, user.ProfileUpdate{Bio: &bio}, http.StatusOK); err != nil {
+		t.Fatal(err)
+	}
+	expected.Bio = bio
 
-	responseBytes, err := testJsonPostRequest(r, "/login", loginBody, http.StatusOK)
-	if err != nil {
-		// FIXME
-		t.Fatal("login failed")
+	req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/users/%s", u.PublicID), nil)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code %d, got %d", http.StatusOK, w.Code)
 	}
-	var response user.TokenResponse
-	_, err = request.UnmarshalSuccessResponseData(responseBytes, &response)
-	if err != nil {
-		// FIXME
-		t.Fatal("login failed response bad")
+	var page user.UserProfileResponse
+	if _, err := request.UnmarshalSuccessResponseData(w.Body.Bytes(), &page); err != nil {
+		t.Fatal(err)
+	}
+	if page.User.Username != u.Username || *page.Profile != expected {
+		t.Fatalf("unexpected public page %+v", page)
 	}
-
-	return response.Token
 }
 
-func testMe(
-	t *testing.T,
-	r *gin.Engine,
-	u user.UserPersonal,
-	token string,
-) {
-	t.Helper()
+func TestUserLookup(t *testing.T) {
+	t.Parallel()
 
-	req := httptest.NewRequest(http.MethodGet, "/me", nil)
-	req.Header.Add("Authorization", "Bearer "+token)
-	responseBytes, err := testGetRequest(r, "/me", http.StatusOK, req)
+	r := getUsersContext()
+	password := "beepboopbop"
+	body, err := json.Marshal(user.UserRegister{
+		Username:        "NamedRunner",
+		Email:           "named@email.com",
+		Password:        password,
+		PasswordConfirm: password,
+	})
 	if err != nil {
-		// FIXME
-		t.Fatalf("me failed: %s", err)
+		t.Fatal(err)
 	}
-	var responseData user.UserPersonalResponse
-	_, err = request.UnmarshalSuccessResponseData(responseBytes, &responseData)
+	req := httptest.NewRequest(http.MethodPost, "/register", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected status code %d, got %d", http.StatusCreated, w.Code)
+	}
+	var registered user.UserIdentifierResponse
+	if _, err := request.UnmarshalSuccessResponseData(w.Body.Bytes(), &registered); err != nil {
+		t.Fatal(err)
+	}
+	u, err := user.Store.GetUserIdentifierByPublicId(registered.User.PublicID)
 	if err != nil {
-		// FIXME
-		t.Fatal("me failed response bad")
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := cleanupUsers([]uint{u.ID}); err != nil {
+			t.Fatalf("failed cleanup: %s", err)
+		}
+	}()
+	location := "/api/v1/users/" + u.PublicID
+	if w.Header().Get("Location") != location {
+		t.Fatalf("expected the user at %s, got %s", location, w.Header().Get("Location"))
 	}
 
-	if u.ID != responseData.User.ID {
-		// FIXME
-		t.Fatalf("me failed: %s", err)
+	get := func(target string, expected int) *httptest.ResponseRecorder {
+		t.Helper()
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+		if w.Code != expected {
+			t.Fatalf("%s: expected status code %d, got %d", target, expected, w.Code)
+		}
+		return w
 	}
-}
+	get("/users/1", http.StatusBadRequest)
+	get("/users/0000000000000", http.StatusNotFound)
+	get("/users/by-name/NoSuchRunner", http.StatusNotFound)
 
-func testRefreshToken(
-	t *testing.T,
-	r *gin.Engine,
-	token string,
-) {
-	t.Helper()
+	var page user.UserProfileResponse
+	for _, target := range []string{"/users/" + u.PublicID, "/users/by-name/namedrunner"} {
+		w := get(target, http.StatusOK)
+		if _, err := request.UnmarshalSuccessResponseData(w.Body.Bytes(), &page); err != nil {
+			t.Fatal(err)
+		}
+		if page.User.PublicID != u.PublicID || page.User.Username != "NamedRunner" {
+			t.Fatalf("%s: expected NamedRunner, got %+v", target, page.User)
+		}
+	}
 
-	req := httptest.NewRequest(http.MethodGet, "/refresh_token", nil)
-	req.Header.Add("Authorization", "Bearer "+token)
-	responseBytes, err := testGetRequest(r, "/refresh_token", http.StatusOK, req)
-	if err != nil {
-		// FIXME
-		t.Fatalf("refresh_token failed: %s", err)
+	// Emails are matched in any case.
+	token := testLogin(t, r, user.UserLogin{
+		Email:    "Named@Email.com",
+		Password: password,
+	})
+	newName := "RenamedRunner"
+	if _, err := testAuthRequest(r, http.MethodPatch, "/me", token, user.UserSettings{Username: &newName}, http.StatusOK); err != nil {
+		t.Fatal(err)
 	}
-	var response struct {
-		Token string `json:"token"`
+	// Old names are matched by their canonical form, like current ones.
+	for _, target := range []string{"/users/by-name/NAMEDRUNNER", "/users/by-name/NarnedRunner"} {
+		w = get(target, http.StatusMovedPermanently)
+		if w.Header().Get("Location") != location {
+			t.Fatalf("%s: expected a redirect to %s, got %s", target, location, w.Header().Get("Location"))
+		}
 	}
-	_, err = request.UnmarshalSuccessResponseData(responseBytes, &response)
-	if err != nil {
-		// FIXME
-		t.Fatal("refresh_token failed response bad")
+	w = get("/users/by-name/renamedrunner", http.StatusOK)
+	if _, err := request.UnmarshalSuccessResponseData(w.Body.Bytes(), &page); err != nil {
+		t.Fatal(err)
 	}
-	if token == response.Token {
-		// FIXME
-		t.Fatal("what the fuck")
+	if page.User.Username != newName {
+		t.Fatalf("expected %s, got %+v", newName, page.User)
 	}
 }
 
@@ -206,6 +1975,51 @@ func TestPOSTRegister400(t *testing.T) {
 				PasswordConfirm: "beepboopbo",
 			},
 		},
+		{
+			name: "Too short username",
+			body: user.UserRegister{
+				Username:        "R",
+				Email:           "x@y.com",
+				Password:        "beepboopbo",
+				PasswordConfirm: "beepboopbo",
+			},
+		},
+		{
+			name: "Username with a space",
+			body: user.UserRegister{
+				Username:        "Rage Cage",
+				Email:           "x@y.com",
+				Password:        "beepboopbo",
+				PasswordConfirm: "beepboopbo",
+			},
+		},
+		{
+			name: "Username with lookalike letters",
+			body: user.UserRegister{
+				Username:        "RageCаge",
+				Email:           "x@y.com",
+				Password:        "beepboopbo",
+				PasswordConfirm: "beepboopbo",
+			},
+		},
+		{
+			name: "Reserved username",
+			body: user.UserRegister{
+				Username:        "Admin",
+				Email:           "x@y.com",
+				Password:        "beepboopbo",
+				PasswordConfirm: "beepboopbo",
+			},
+		},
+		{
+			name: "Lookalike of a reserved username",
+			body: user.UserRegister{
+				Username:        "M0DERATOR",
+				Email:           "x@y.com",
+				Password:        "beepboopbo",
+				PasswordConfirm: "beepboopbo",
+			},
+		},
 	}
 
 	for _, testCase := range testCases {
@@ -258,6 +2072,66 @@ func TestPOSTRegister409(t *testing.T) {
 				PasswordConfirm: "beepboopbop",
 			},
 		},
+		{
+			name: "Email address in another case",
+			setupUser: user.UserRegister{
+				Username:        "CaseyRunner",
+				Email:           "casey@email.com",
+				Password:        "beepboopbop",
+				PasswordConfirm: "beepboopbop",
+			},
+			user: user.UserRegister{
+				Username:        "CaseyRunner2",
+				Email:           "Casey@Email.com",
+				Password:        "beepboopbop",
+				PasswordConfirm: "beepboopbop",
+			},
+		},
+		{
+			name: "Username in another case",
+			setupUser: user.UserRegister{
+				Username:        "LowKeyRunner",
+				Email:           "lowkey@email.com",
+				Password:        "beepboopbop",
+				PasswordConfirm: "beepboopbop",
+			},
+			user: user.UserRegister{
+				Username:        "lowkeyrunner",
+				Email:           "lowkey2@email.com",
+				Password:        "beepboopbop",
+				PasswordConfirm: "beepboopbop",
+			},
+		},
+		{
+			name: "Full-width username",
+			setupUser: user.UserRegister{
+				Username:        "WideRunner",
+				Email:           "wide@email.com",
+				Password:        "beepboopbop",
+				PasswordConfirm: "beepboopbop",
+			},
+			user: user.UserRegister{
+				Username:        "ＷｉｄｅＲｕｎｎｅｒ",
+				Email:           "wide2@email.com",
+				Password:        "beepboopbop",
+				PasswordConfirm: "beepboopbop",
+			},
+		},
+		{
+			name: "Username with lookalike digits",
+			setupUser: user.UserRegister{
+				Username:        "GoldRunner",
+				Email:           "gold@email.com",
+				Password:        "beepboopbop",
+				PasswordConfirm: "beepboopbop",
+			},
+			user: user.UserRegister{
+				Username:        "G0ldRunner",
+				Email:           "gold2@email.com",
+				Password:        "beepboopbop",
+				PasswordConfirm: "beepboopbop",
+			},
+		},
 	}
 
 	cleanup := []uint{}
@@ -349,10 +2223,20 @@ func TestLogin401(t *testing.T) {
 }
 
 func getUsersContext() *gin.Engine {
+	auth := config.Default().Auth
+	auth.JWTSecret = "a test secret that is long enough"
+	authMiddleware, err := user.NewAuthMiddleware(auth)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return getUsersContextWith(authMiddleware)
+}
+
+func getUsersContextWith(authMiddleware *user.AuthMiddleware) *gin.Engine {
 	w := httptest.NewRecorder()
 	_, r := gin.CreateTestContext(w)
+	r.GET("/.well-known/jwks.json", authMiddleware.JWKSHandler)
 	api := r.Group("/")
-	authMiddleware := user.GetAuthMiddlewareHandler()
 	user.PublicRoutes(api, authMiddleware)
 	api.Use(authMiddleware.MiddlewareFunc())
 	{
@@ -389,6 +2273,52 @@ func testJsonPostRequest(
 	return w.Body.Bytes(), nil
 }
 
+func testAuthRequest(
+	r *gin.Engine,
+	method string,
+	target string,
+	token string,
+	content interface{},
+	expectedStatusCode int,
+) ([]byte, error) {
+	reqBodyBytes, err := json.Marshal(content)
+	if err != nil {
+		return nil, err
+	}
+	req := httptest.NewRequest(method, target, bytes.NewBuffer(reqBodyBytes))
+	req.Header.Add("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != expectedStatusCode {
+		return nil, fmt.Errorf(
+			"expected status code %d, got %d",
+			expectedStatusCode,
+			w.Code,
+		)
+	}
+	return w.Body.Bytes(), nil
+}
+
+func testFormPost(
+	r *gin.Engine,
+	target string,
+	form url.Values,
+	expectedStatusCode int,
+) ([]byte, error) {
+	req := httptest.NewRequest(http.MethodPost, target, strings.NewReader(form.Encode()))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != expectedStatusCode {
+		return nil, fmt.Errorf(
+			"expected status code %d, got %d",
+			expectedStatusCode,
+			w.Code,
+		)
+	}
+	return w.Body.Bytes(), nil
+}
+
 func testGetRequest(
 	r *gin.Engine,
 	target string,
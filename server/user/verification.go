@@ -0,0 +1,205 @@
+package user
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/speedrun-website/leaderboard-backend/mail"
+	"github.com/speedrun-website/leaderboard-backend/server/request"
+)
+
+var ErrInvalidEmailToken = errors.New("this link is invalid or has expired")
+
+// Purposes for emailed tokens, so a token can't be used for something
+// it wasn't sent for.
+const verifyEmailPurpose = "verify-email"
+
+type VerifyEmail struct {
+	Token string `json:"token" binding:"required"`
+}
+
+// VerifyEmailHandler marks an email address as verified using the token
+// from a verification email. Verifying twice is not an error.
+func VerifyEmailHandler(c *gin.Context) {
+	var body VerifyEmail
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, request.ErrorResponse{
+			Errors: []error{
+				err,
+			},
+		})
+		return
+	}
+
+	user, err := checkEmailToken(verifyEmailPurpose, body.Token)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, request.ErrorResponse{
+			Errors: []error{
+				err,
+			},
+		})
+		return
+	}
+
+	if !user.IsVerified() {
+		err := Store.VerifyEmail(user.ID, user.Email)
+		if err != nil && !errors.Is(err, ErrUserNotFound) {
+			log.Println(err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	userInfo, err := Store.GetUserPersonalById(user.ID)
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	c.JSON(http.StatusOK, request.SuccessResponse{
+		Data: UserPersonalResponse{
+			User: userInfo,
+		},
+	})
+}
+
+// ResendVerificationHandler sends the logged-in user another verification
+// email, at most once per resend interval.
+func ResendVerificationHandler(c *gin.Context) {
+	user, ok := currentUser(c)
+	if !ok {
+		return
+	}
+
+	if user.IsVerified() {
+		c.AbortWithStatusJSON(http.StatusConflict, request.ErrorResponse{
+			Errors: []error{
+				ErrEmailAlreadyVerified,
+			},
+		})
+		return
+	}
+
+	now := time.Now()
+	err := Store.MarkVerificationSent(user.ID, now.Add(-settings.verificationResendInterval))
+	if errors.Is(err, ErrVerificationThrottled) {
+		retryAfter := settings.verificationResendInterval
+		if user.VerificationSentAt != nil {
+			retryAfter = user.VerificationSentAt.Add(settings.verificationResendInterval).Sub(now)
+		}
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		c.AbortWithStatusJSON(http.StatusTooManyRequests, request.ErrorResponse{
+			Errors: []error{
+				err,
+			},
+		})
+		return
+	} else if err != nil {
+		log.Println(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	if err := sendVerificationEmail(user); err != nil {
+		log.Printf("Could not send a verification email to user %d: %s", user.ID, err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	c.Status(http.StatusAccepted)
+}
+
+// RequireVerifiedEmail returns a middleware that aborts with a 403 unless
+// the logged-in user has verified their email address.
+func RequireVerifiedEmail() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, ok := currentUser(c)
+		if !ok {
+			return
+		}
+		if !user.IsVerified() {
+			c.AbortWithStatusJSON(http.StatusForbidden, request.ErrorResponse{
+				Errors: []error{
+					ErrEmailNotVerified,
+				},
+			})
+			return
+		}
+
+		c.Next()
+	}
+}
+
+func sendVerificationEmail(user *User) error {
+	token := signEmailToken(verifyEmailPurpose, user, time.Now().Add(settings.verificationTimeout))
+	link := fmt.Sprintf("%s/verify-email?token=%s", settings.frontendURL, url.QueryEscape(token))
+
+	return settings.sender.Send(mail.Message{
+		To:      user.Email,
+		Subject: "Verify your email address",
+		Body: fmt.Sprintf(
+			"Hi %s,\n\nOpen this link to verify your email address:\n\n%s\n\nThe link expires in %s. If you didn't sign up, you can ignore this email.\n",
+			user.Username,
+			link,
+			settings.verificationTimeout,
+		),
+	})
+}
+
+// signEmailToken returns a token for user that expires at expires.
+// The token is signed over the user's current email, so it stops
+// working if the email changes.
+func signEmailToken(purpose string, user *User, expires time.Time) string {
+	payload := strconv.FormatUint(uint64(user.ID), 36) + "." + strconv.FormatInt(expires.Unix(), 36)
+	signature := emailTokenSignature(purpose, payload, user.Email)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// checkEmailToken returns the user that token was signed for,
+// or ErrInvalidEmailToken if it isn't valid.
+func checkEmailToken(purpose string, token string) (*User, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidEmailToken
+	}
+	userId, err := strconv.ParseUint(parts[0], 36, 0)
+	if err != nil {
+		return nil, ErrInvalidEmailToken
+	}
+	expires, err := strconv.ParseInt(parts[1], 36, 64)
+	if err != nil {
+		return nil, ErrInvalidEmailToken
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidEmailToken
+	}
+
+	user, err := Store.GetUserById(uint(userId))
+	if err != nil {
+		return nil, ErrInvalidEmailToken
+	}
+	expected := emailTokenSignature(purpose, parts[0]+"."+parts[1], user.Email)
+	if !hmac.Equal(signature, expected) {
+		return nil, ErrInvalidEmailToken
+	}
+	if time.Now().Unix() > expires {
+		return nil, ErrInvalidEmailToken
+	}
+	return user, nil
+}
+
+func emailTokenSignature(purpose string, payload string, email string) []byte {
+	mac := hmac.New(sha256.New, settings.tokenSecret)
+	mac.Write([]byte(purpose + "\x00" + payload + "\x00" + email))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/mail"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/speedrun-website/leaderboard-backend/server"
+	"github.com/speedrun-website/leaderboard-backend/server/game"
+	"github.com/speedrun-website/leaderboard-backend/server/role"
+	"github.com/speedrun-website/leaderboard-backend/server/user"
+)
+
+const userUsage = `user create -username <name> -email <email> [-password <password>] [-role admin|staff]
+       user promote [-role <role>] [-game <slug>] <user>
+       user ban <user>
+       user unban <user>
+       user delete <user>
+
+<user> is a user ID or email address. Without -password, the password is
+read from the first line of stdin. Banning a user logs them out everywhere.`
+
+var userCommands = map[string]func(a *app, args []string) error{
+	"create":  runUserCreate,
+	"promote": runUserPromote,
+	"ban":     runUserBan,
+	"unban":   runUserUnban,
+	"delete":  runUserDelete,
+}
+
+func runUser(a *app, args []string) error {
+	if len(args) == 0 {
+		return usageError(userUsage)
+	}
+	sub, ok := userCommands[args[0]]
+	if !ok {
+		return usageError(userUsage)
+	}
+	if err := server.InitStores(a.db); err != nil {
+		return err
+	}
+	user.ConfigurePasswords(a.config.Auth.Password)
+	return sub(a, args[1:])
+}
+
+func runUserCreate(a *app, args []string) error {
+	flags := flag.NewFlagSet("user create", flag.ContinueOnError)
+	username := flags.String("username", "", "the new user's username")
+	email := flags.String("email", "", "the new user's email address")
+	password := flags.String("password", "", "the new user's password, read from stdin if not given")
+	siteRole := flags.String("role", "", "a site role to grant the new user")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *username == "" || *email == "" || flags.NArg() > 0 {
+		return usageError(userUsage)
+	}
+	// Administrators can give out reserved names, but not ones that
+	// break the rules for usernames.
+	normalized, err := user.NormalizeUsername(*username)
+	if err != nil {
+		return fmt.Errorf("%w: %s", errUsage, err)
+	}
+	*username = normalized
+	if _, err := mail.ParseAddress(*email); err != nil {
+		return fmt.Errorf("%w: invalid email address %q", errUsage, *email)
+	}
+	if *siteRole != "" && !role.IsSiteRole(*siteRole) {
+		return fmt.Errorf("%w: %s", role.ErrUnknownRole, *siteRole)
+	}
+
+	if *password == "" {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return fmt.Errorf("reading password from stdin failed: %w", err)
+		}
+		*password = strings.TrimRight(line, "\r\n")
+	}
+	// Match the rules that registration enforces.
+	if len(*password) < 8 {
+		return fmt.Errorf("%w: passwords must be at least 8 characters", errUsage)
+	}
+
+	hash, err := user.HashAndSaltPassword([]byte(*password))
+	if err != nil {
+		return err
+	}
+	// Accounts created by an administrator don't need to verify their email.
+	verifiedAt := time.Now()
+	u := &user.User{
+		Username:        *username,
+		Email:           *email,
+		Password:        hash,
+		EmailVerifiedAt: &verifiedAt,
+	}
+	if err := user.Store.CreateUser(u); err != nil {
+		return err
+	}
+	log.Printf("Created user %d (%s)", u.ID, u.Username)
+
+	if *siteRole != "" {
+		if err := role.Store.GrantSiteRole(u.ID, role.SiteRole(*siteRole)); err != nil {
+			return err
+		}
+		log.Printf("Granted %s to %s", *siteRole, u.Username)
+	}
+	return nil
+}
+
+func runUserPromote(a *app, args []string) error {
+	flags := flag.NewFlagSet("user promote", flag.ContinueOnError)
+	roleName := flags.String("role", "", "the role to grant: admin or staff, or moderator or verifier with -game (default admin, or moderator with -game)")
+	gameSlug := flags.String("game", "", "grant a role in this game instead of a site role")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return usageError(userUsage)
+	}
+	u, err := userFromArg(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	if *gameSlug == "" {
+		if *roleName == "" {
+			*roleName = string(role.Admin)
+		}
+		if !role.IsSiteRole(*roleName) {
+			return fmt.Errorf("%w: %s is not a site role", role.ErrUnknownRole, *roleName)
+		}
+		if err := role.Store.GrantSiteRole(u.ID, role.SiteRole(*roleName)); err != nil {
+			return err
+		}
+		log.Printf("Granted %s to %s", *roleName, u.Username)
+		return nil
+	}
+
+	if *roleName == "" {
+		*roleName = string(role.Moderator)
+	}
+	if !role.IsGameRole(*roleName) {
+		return fmt.Errorf("%w: %s is not a game role", role.ErrUnknownRole, *roleName)
+	}
+	g, err := game.Store.GetGameBySlug(*gameSlug)
+	if err != nil {
+		return err
+	}
+	if err := role.Store.GrantGameRole(g.ID, u.ID, role.GameRole(*roleName)); err != nil {
+		return err
+	}
+	log.Printf("Granted %s of %s to %s", *roleName, g.Slug, u.Username)
+	return nil
+}
+
+func runUserBan(a *app, args []string) error {
+	return changeUser(args, "Banned", user.Store.BanUser)
+}
+
+func runUserUnban(a *app, args []string) error {
+	return changeUser(args, "Unbanned", user.Store.UnbanUser)
+}
+
+func runUserDelete(a *app, args []string) error {
+	return changeUser(args, "Deleted", user.Store.DeleteUser)
+}
+
+// changeUser applies change to the single user named in args.
+func changeUser(args []string, done string, change func(uint) error) error {
+	if len(args) != 1 {
+		return usageError(userUsage)
+	}
+	u, err := userFromArg(args[0])
+	if err != nil {
+		return err
+	}
+	if err := change(u.ID); err != nil {
+		return err
+	}
+	log.Printf("%s user %d (%s)", done, u.ID, u.Username)
+	return nil
+}
+
+// userFromArg looks up a user by ID, or by email address if arg
+// isn't a number.
+func userFromArg(arg string) (*user.UserPersonal, error) {
+	if id, err := strconv.ParseUint(arg, 10, 0); err == nil {
+		return user.Store.GetUserPersonalById(uint(id))
+	}
+	u, err := user.Store.GetUserByEmail(arg)
+	if err != nil {
+		if errors.Is(err, user.ErrUserNotFound) {
+			return nil, fmt.Errorf("%w: %s", err, arg)
+		}
+		return nil, err
+	}
+	return u.AsPersonal(), nil
+}